@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"testing"
+)
+
+// Allocations per operation with logging disabled. Debug logs on these paths
+// must not build attributes, e.g. converting payload to string, which would
+// add allocations on every frame
+func TestDisabledLoggingAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("race detector allocates")
+	}
+
+	// masked frames received by server
+	ping := fuzzFrame(true, 0x9, true, []byte("ping"))
+	text := fuzzFrame(true, 0x1, true, []byte("text"))
+
+	tests := []struct {
+		name string
+		// runs n operations on new connection
+		run func(t *testing.T, n int)
+		max float64
+	}{
+		{"read ping", func(t *testing.T, n int) {
+			in := append(bytesRepeat(ping, n), text...)
+			c := newFuzzWsConn(t, newFuzzConn(in), true)
+			if _, _, err := c.NextMessage(); err != nil {
+				t.Fatalf("failed to read message: %v", err)
+			}
+		}, 3.5},
+		{"read message", func(t *testing.T, n int) {
+			c := newFuzzWsConn(t, newFuzzConn(bytesRepeat(text, n)), true)
+			for range n {
+				if _, _, err := c.NextMessage(); err != nil {
+					t.Fatalf("failed to read message: %v", err)
+				}
+			}
+		}, 10.5},
+		{"write message", func(t *testing.T, n int) {
+			c := newFuzzWsConn(t, newFuzzConn(nil), false)
+			for range n {
+				if err := c.WriteMessage(TextMessage, []byte("text")); err != nil {
+					t.Fatalf("failed to write message: %v", err)
+				}
+			}
+		}, 8.5},
+	}
+
+	const ops = 10
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// connection setup is excluded by subtracting run without operations
+			base := testing.AllocsPerRun(50, func() { tt.run(t, 0) })
+			total := testing.AllocsPerRun(50, func() { tt.run(t, ops) })
+
+			if perOp := (total - base) / ops; perOp > tt.max {
+				t.Errorf("%.1f allocations per operation, want at most %.1f", perOp, tt.max)
+			}
+		})
+	}
+}
+
+func bytesRepeat(b []byte, n int) []byte {
+	var out []byte
+	for range n {
+		out = append(out, b...)
+	}
+	return out
+}
@@ -0,0 +1,63 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+var (
+	// Returned from Upgrader.Authenticate when request has no valid credentials, results in 401
+	ErrUnauthorized = errors.New("unauthorized")
+	// Returned from Upgrader.Authenticate when credentials are valid, but access is denied, results in 403
+	ErrForbidden = errors.New("forbidden")
+)
+
+const (
+	defaultAuthChallenge = "Bearer"
+)
+
+type principalKey struct{}
+
+// Result of Authenticate hook
+type authenticated struct {
+	principal any
+}
+
+// Returns principal returned by Upgrader.Authenticate, use with Conn.Context()
+func PrincipalFromContext(ctx context.Context) (any, bool) {
+	p := ctx.Value(principalKey{})
+	return p, p != nil
+}
+
+// Runs Authenticate hook, failure response is written before returning error
+func (u *Upgrader) authenticate(w http.ResponseWriter, req *http.Request, l *slog.Logger) (*authenticated, error) {
+	principal, err := u.Authenticate(req)
+	if err == nil {
+		return &authenticated{principal}, nil
+	}
+
+	l.Debug("Failed to open websocket connection: authentication failed", "err", err)
+
+	if errors.Is(err, ErrForbidden) {
+		return nil, u.fail(w, req, http.StatusForbidden, FailureReasonForbidden,
+			fmt.Errorf("%w: [%w]", ErrHandshakeFailure, err))
+	}
+
+	if !errors.Is(err, ErrUnauthorized) {
+		// credentials could not be checked, e.g. token store is unavailable
+		return nil, u.fail(w, req, http.StatusInternalServerError, FailureReasonAuthError,
+			fmt.Errorf("%w: [%w]", ErrHandshakeFailure, err))
+	}
+
+	challenge := u.AuthChallenge
+	if challenge == "" {
+		challenge = defaultAuthChallenge
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+
+	return nil, u.fail(w, req, http.StatusUnauthorized, FailureReasonUnauthorized,
+		fmt.Errorf("%w: [%w]", ErrHandshakeFailure, err))
+}
@@ -0,0 +1,86 @@
+package websocket_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+func TestAuthenticate(t *testing.T) {
+	principals := make(chan any, 1)
+
+	u := &websocket.Upgrader{
+		Authenticate: func(req *http.Request) (any, error) {
+			token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("missing token: [%w]", websocket.ErrUnauthorized)
+			case token == "error":
+				return nil, errors.New("token store is unavailable")
+			case token == "banned":
+				return nil, fmt.Errorf("user is banned: [%w]", websocket.ErrForbidden)
+			default:
+				return "user:" + token, nil
+			}
+		},
+	}
+	srv := wstest.NewServer(u, func(c *websocket.Conn) {
+		defer c.Close()
+		p, _ := websocket.PrincipalFromContext(c.Context())
+		principals <- p
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"missing token", "", http.StatusUnauthorized},
+		{"forbidden", "Bearer banned", http.StatusForbidden},
+		{"auth error", "Bearer error", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.HTTP.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.status)
+			}
+			challenge := res.Header.Get("WWW-Authenticate")
+			if tt.status == http.StatusUnauthorized && challenge != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want %q", challenge, "Bearer")
+			}
+		})
+	}
+
+	t.Run("authenticated", func(t *testing.T) {
+		d := websocket.Dialer{}
+		c, err := d.Dial(srv.URL, map[string]string{"Authorization": "Bearer alice"})
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer c.Close()
+
+		if p := <-principals; p != "user:alice" {
+			t.Errorf("principal = %v, want %q", p, "user:alice")
+		}
+	})
+}
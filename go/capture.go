@@ -0,0 +1,81 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/wmdanor/websocket/go/internal"
+)
+
+type Direction uint8
+
+const (
+	DirectionInbound Direction = iota
+	DirectionOutbound
+)
+
+func (d Direction) String() string {
+	if d == DirectionOutbound {
+		return "out"
+	}
+	return "in"
+}
+
+// Frame recorded by FrameCapturer
+type CapturedFrame struct {
+	Time      time.Time
+	Direction Direction
+
+	IsFinal bool
+	RSV1    bool
+	RSV2    bool
+	RSV3    bool
+	// ContinuationFrame for all frames of fragmented message except first one
+	Type MessageType
+
+	IsMasked   bool
+	MaskingKey [4]byte
+
+	// Unmasked payload, valid only until CaptureFrame returns
+	Payload []byte
+}
+
+// FrameCapturer records every frame read from or written to connection,
+// it is called from both reading and writing goroutines
+type FrameCapturer interface {
+	CaptureFrame(f *CapturedFrame)
+}
+
+// Sets capturer of connection frames, must be set before connection is used.
+// Passing nil disables capture
+func (c *Conn) SetCapture(fc FrameCapturer) {
+	c.capturer = fc
+}
+
+// Returns nil if capture is disabled
+func (c *Conn) newCapturedFrame(f *internal.FrameHeader, d Direction) *CapturedFrame {
+	if c.capturer == nil {
+		return nil
+	}
+
+	return &CapturedFrame{
+		Time:       time.Now(),
+		Direction:  d,
+		IsFinal:    f.IsFinalFrame,
+		RSV1:       f.RSV1 != 0,
+		RSV2:       f.RSV2 != 0,
+		RSV3:       f.RSV3 != 0,
+		Type:       MessageType(f.Opcode),
+		IsMasked:   f.IsMasked,
+		MaskingKey: f.MaskingKey,
+	}
+}
+
+func (c *Conn) captureFrame(f *internal.FrameHeader, d Direction, payload []byte) {
+	cf := c.newCapturedFrame(f, d)
+	if cf == nil {
+		return
+	}
+
+	cf.Payload = payload
+	c.capturer.CaptureFrame(cf)
+}
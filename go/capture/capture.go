@@ -0,0 +1,200 @@
+// Package capture writes and reads websocket frame captures.
+//
+// Capture file starts with 8 byte header: magic "WSCAP" followed by
+// zero byte and big endian uint16 format version (currently 1).
+// Header is followed by frame records until the end of file,
+// all integers are big endian:
+//
+//	int64    timestamp, unix nanoseconds
+//	uint8    direction, 0 - inbound, 1 - outbound
+//	uint8    flags, 0x80 - FIN, 0x40 - RSV1, 0x20 - RSV2, 0x10 - RSV3, 0x01 - MASK
+//	uint8    opcode
+//	[4]byte  masking key, zeroes if frame is not masked
+//	uint64   payload length
+//	[]byte   unmasked payload
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+)
+
+const (
+	Version = 1
+
+	magic = "WSCAP\x00"
+
+	recordHeaderSize = 8 + 1 + 1 + 1 + 4 + 8
+
+	flagFin  = 0x80
+	flagRSV1 = 0x40
+	flagRSV2 = 0x20
+	flagRSV3 = 0x10
+	flagMask = 0x01
+
+	// limits allocation for corrupted files
+	maxPayloadLength = 1 << 30
+)
+
+var (
+	ErrBadFormat = errors.New("not a websocket capture")
+)
+
+// Writer is websocket.FrameCapturer which writes frames in capture format.
+// It is safe for concurrent use
+type Writer struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	err error
+}
+
+var _ websocket.FrameCapturer = (*Writer)(nil)
+
+// Creates writer and writes capture header
+func NewWriter(w io.Writer) (*Writer, error) {
+	bw := bufio.NewWriter(w)
+
+	header := [8]byte{}
+	copy(header[:], magic)
+	binary.BigEndian.PutUint16(header[6:], Version)
+
+	_, err := bw.Write(header[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to write capture header: [%w]", err)
+	}
+
+	return &Writer{w: bw}, nil
+}
+
+// Writes frame record, write errors are reported by Err and Flush
+func (w *Writer) CaptureFrame(f *websocket.CapturedFrame) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return
+	}
+
+	h := [recordHeaderSize]byte{}
+	binary.BigEndian.PutUint64(h[0:], uint64(f.Time.UnixNano()))
+	h[8] = byte(f.Direction)
+	h[9] = encodeFlags(f)
+	h[10] = byte(f.Type)
+	copy(h[11:15], f.MaskingKey[:])
+	binary.BigEndian.PutUint64(h[15:], uint64(len(f.Payload)))
+
+	_, err := w.w.Write(h[:])
+	if err == nil {
+		_, err = w.w.Write(f.Payload)
+	}
+	if err != nil {
+		w.err = fmt.Errorf("failed to write frame record: [%w]", err)
+	}
+}
+
+// First error which occurred while writing records
+func (w *Writer) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Writes buffered records to underlying writer
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	return w.w.Flush()
+}
+
+type Reader struct {
+	r *bufio.Reader
+}
+
+// Creates reader and validates capture header
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	header := [8]byte{}
+	_, err := io.ReadFull(br, header[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read header: [%w]", ErrBadFormat, err)
+	}
+	if !bytes.Equal(header[:len(magic)], []byte(magic)) {
+		return nil, fmt.Errorf("%w: invalid magic", ErrBadFormat)
+	}
+	if v := binary.BigEndian.Uint16(header[6:]); v != Version {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadFormat, v)
+	}
+
+	return &Reader{r: br}, nil
+}
+
+// Reads next frame record, returns io.EOF when there are no more records
+func (r *Reader) Next() (*websocket.CapturedFrame, error) {
+	h := [recordHeaderSize]byte{}
+	_, err := io.ReadFull(r.r, h[:])
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read frame record header: [%w]", err)
+	}
+
+	length := binary.BigEndian.Uint64(h[15:])
+	if length > maxPayloadLength {
+		return nil, fmt.Errorf("%w: frame payload length %d is too big", ErrBadFormat, length)
+	}
+
+	f := &websocket.CapturedFrame{
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(h[0:]))),
+		Direction: websocket.Direction(h[8]),
+		IsFinal:   h[9]&flagFin != 0,
+		RSV1:      h[9]&flagRSV1 != 0,
+		RSV2:      h[9]&flagRSV2 != 0,
+		RSV3:      h[9]&flagRSV3 != 0,
+		IsMasked:  h[9]&flagMask != 0,
+		Type:      websocket.MessageType(h[10]),
+		Payload:   make([]byte, length),
+	}
+	copy(f.MaskingKey[:], h[11:15])
+
+	_, err = io.ReadFull(r.r, f.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read frame payload: [%w]", err)
+	}
+
+	return f, nil
+}
+
+func encodeFlags(f *websocket.CapturedFrame) byte {
+	var flags byte
+	if f.IsFinal {
+		flags |= flagFin
+	}
+	if f.RSV1 {
+		flags |= flagRSV1
+	}
+	if f.RSV2 {
+		flags |= flagRSV2
+	}
+	if f.RSV3 {
+		flags |= flagRSV3
+	}
+	if f.IsMasked {
+		flags |= flagMask
+	}
+	return flags
+}
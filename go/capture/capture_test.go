@@ -0,0 +1,259 @@
+package capture_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/capture"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// Frames of short client session, payload lengths give packets
+// with every padding size
+func clientFrames() []*websocket.CapturedFrame {
+	ts := time.Unix(1700000000, 123456000)
+	key := [4]byte{1, 2, 3, 4}
+	return []*websocket.CapturedFrame{
+		{Time: ts, Direction: websocket.DirectionOutbound, IsFinal: true, Type: websocket.TextMessage,
+			IsMasked: true, MaskingKey: key, Payload: []byte("hi")},
+		{Time: ts.Add(time.Millisecond), Direction: websocket.DirectionInbound, IsFinal: true, Type: websocket.TextMessage,
+			Payload: []byte("hello")},
+		{Time: ts.Add(2 * time.Millisecond), Direction: websocket.DirectionInbound, IsFinal: true, Type: websocket.BinaryMessage,
+			Payload: []byte{1, 2, 3, 4}},
+		{Time: ts.Add(2 * time.Millisecond), Direction: websocket.DirectionInbound, IsFinal: true, Type: websocket.BinaryMessage,
+			Payload: []byte{1, 2, 3}},
+		{Time: ts.Add(3 * time.Millisecond), Direction: websocket.DirectionOutbound, IsFinal: true, Type: websocket.CloseMessage,
+			IsMasked: true, MaskingKey: key, Payload: []byte{0x03, 0xE8, 'b', 'y', 'e'}},
+	}
+}
+
+func TestPcapngGolden(t *testing.T) {
+	got := &bytes.Buffer{}
+	w, err := capture.NewPcapngWriter(got,
+		netip.MustParseAddrPort("10.0.0.1:50000"), netip.MustParseAddrPort("10.0.0.2:80"))
+	if err != nil {
+		t.Fatalf("failed to create pcapng writer: %v", err)
+	}
+	frames := clientFrames()
+	for _, f := range frames {
+		w.CaptureFrame(f)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	checkPcapngLayout(t, got.Bytes(), frames)
+
+	path := filepath.Join("testdata", "client.pcapng.golden")
+	if *update {
+		if err := os.WriteFile(path, got.Bytes(), 0o644); err != nil {
+			t.Fatalf("failed to update golden file: %v", err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("pcapng output differs from %s, regenerate it with -update if change is intended", path)
+	}
+}
+
+// Checks block structure, so golden file is not accepted blindly on update
+func checkPcapngLayout(t *testing.T, data []byte, frames []*websocket.CapturedFrame) {
+	t.Helper()
+
+	type block struct {
+		typ  uint32
+		body []byte
+	}
+	var blocks []block
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("%d trailing bytes after last block", len(data))
+		}
+		typ := binary.LittleEndian.Uint32(data[0:])
+		total := binary.LittleEndian.Uint32(data[4:])
+		if total%4 != 0 || total < 12 || int(total) > len(data) {
+			t.Fatalf("block %#x has invalid total length %d", typ, total)
+		}
+		if trailing := binary.LittleEndian.Uint32(data[total-4:]); trailing != total {
+			t.Fatalf("block %#x trailing length %d, want %d", typ, trailing, total)
+		}
+		blocks = append(blocks, block{typ, data[8 : total-4]})
+		data = data[total:]
+	}
+
+	// section header, interface description, TCP handshake and one packet per frame
+	if len(blocks) != 2+3+len(frames) {
+		t.Fatalf("got %d blocks, want %d", len(blocks), 2+3+len(frames))
+	}
+
+	shb := blocks[0]
+	if shb.typ != 0x0A0D0D0A || len(shb.body) != 16 {
+		t.Fatalf("first block is %#x with %d bytes body, want section header", shb.typ, len(shb.body))
+	}
+	if magic := binary.LittleEndian.Uint32(shb.body[0:]); magic != 0x1A2B3C4D {
+		t.Errorf("byte order magic %#x", magic)
+	}
+	if major, minor := binary.LittleEndian.Uint16(shb.body[4:]), binary.LittleEndian.Uint16(shb.body[6:]); major != 1 || minor != 0 {
+		t.Errorf("version %d.%d, want 1.0", major, minor)
+	}
+	if length := binary.LittleEndian.Uint64(shb.body[8:]); length != ^uint64(0) {
+		t.Errorf("section length %d, want unspecified", length)
+	}
+
+	idb := blocks[1]
+	if idb.typ != 1 || len(idb.body) != 8 {
+		t.Fatalf("second block is %#x with %d bytes body, want interface description", idb.typ, len(idb.body))
+	}
+	if linkType := binary.LittleEndian.Uint16(idb.body[0:]); linkType != 101 {
+		t.Errorf("link type %d, want raw IP", linkType)
+	}
+
+	paddings := map[int]bool{}
+	for i, b := range blocks[2:] {
+		if b.typ != 6 {
+			t.Fatalf("block %d is %#x, want enhanced packet", i+2, b.typ)
+		}
+		captured := int(binary.LittleEndian.Uint32(b.body[12:]))
+		original := int(binary.LittleEndian.Uint32(b.body[16:]))
+		if captured != original {
+			t.Errorf("block %d captured length %d, original %d", i+2, captured, original)
+		}
+
+		padding := len(b.body) - 20 - captured
+		if padding < 0 || padding > 3 || (captured+padding)%4 != 0 {
+			t.Fatalf("block %d packet of %d bytes padded with %d bytes", i+2, captured, padding)
+		}
+		if pad := b.body[20+captured:]; !bytes.Equal(pad, make([]byte, padding)) {
+			t.Errorf("block %d padding %v is not zeroed", i+2, pad)
+		}
+		paddings[padding] = true
+
+		// packets with frames follow handshake
+		if i < 3 {
+			continue
+		}
+		f := frames[i-3]
+		if ts := uint64(binary.LittleEndian.Uint32(b.body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(b.body[8:])); ts != uint64(f.Time.UnixMicro()) {
+			t.Errorf("block %d timestamp %d, want %d", i+2, ts, f.Time.UnixMicro())
+		}
+		// IPv4 and TCP headers without options
+		if payload := b.body[20+40 : 20+captured]; len(payload) < len(f.Payload) || payload[0]&0x0F != byte(f.Type) {
+			t.Errorf("block %d has frame % x, want %s frame", i+2, payload, f.Type)
+		}
+	}
+	if len(paddings) != 4 {
+		t.Errorf("packets use paddings %v, want every padding size", paddings)
+	}
+}
+
+func TestPcapngWriterIPv6(t *testing.T) {
+	_, err := capture.NewPcapngWriter(io.Discard,
+		netip.MustParseAddrPort("[::1]:50000"), netip.MustParseAddrPort("10.0.0.2:80"))
+	if err == nil {
+		t.Fatal("writer created with IPv6 address")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	ts := time.Unix(1700000000, 1)
+	frames := append(clientFrames(),
+		// flags and payload length encodings
+		&websocket.CapturedFrame{Time: ts, Direction: websocket.DirectionInbound, RSV1: true, RSV2: true, RSV3: true,
+			Type: websocket.BinaryMessage, Payload: bytes.Repeat([]byte{'a'}, 126)},
+		&websocket.CapturedFrame{Time: ts, Direction: websocket.DirectionOutbound, IsFinal: true,
+			Type: websocket.ContinuationFrame, Payload: bytes.Repeat([]byte{'b'}, 65536)},
+		&websocket.CapturedFrame{Time: ts, Direction: websocket.DirectionInbound, IsFinal: true,
+			Type: websocket.PingMessage, Payload: []byte{}},
+	)
+
+	buf := &bytes.Buffer{}
+	w, err := capture.NewWriter(buf)
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	for _, f := range frames {
+		w.CaptureFrame(f)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	r, err := capture.NewReader(buf)
+	if err != nil {
+		t.Fatalf("failed to create reader: %v", err)
+	}
+	for i, want := range frames {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("failed to read frame %d: %v", i, err)
+		}
+		if !got.Time.Equal(want.Time) {
+			t.Errorf("frame %d time %v, want %v", i, got.Time, want.Time)
+		}
+		got.Time = want.Time
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("frame %d = %+v, want %+v", i, got, want)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("read after last frame returned %v, want EOF", err)
+	}
+}
+
+func TestReaderBadFormat(t *testing.T) {
+	valid := &bytes.Buffer{}
+	w, err := capture.NewWriter(valid)
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	w.CaptureFrame(clientFrames()[0])
+	if err := w.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	file := valid.Bytes()
+
+	tests := []struct {
+		name string
+		data []byte
+		// error is returned by Next instead of NewReader
+		next bool
+	}{
+		{"empty", nil, false},
+		{"bad magic", append([]byte("PCAP"), file[4:]...), false},
+		{"unsupported version", append(append([]byte{}, file[:6]...), append([]byte{0, 2}, file[8:]...)...), false},
+		{"truncated record", file[:len(file)-1], true},
+		{"too big payload", append(append([]byte{}, file[:8+15]...), 0xFF, 0, 0, 0, 0, 0, 0, 0), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := capture.NewReader(bytes.NewReader(tt.data))
+			if err == nil {
+				if !tt.next {
+					t.Fatal("reader created")
+				}
+				_, err = r.Next()
+			}
+			if err == nil || err == io.EOF {
+				t.Fatalf("got error %v", err)
+			}
+			if !tt.next && !errors.Is(err, capture.ErrBadFormat) {
+				t.Fatalf("got error %v, want %v", err, capture.ErrBadFormat)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"sync"
+
+	websocket "github.com/wmdanor/websocket/go"
+)
+
+const (
+	pcapngBlockSHB = 0x0A0D0D0A
+	pcapngBlockIDB = 0x00000001
+	pcapngBlockEPB = 0x00000006
+
+	pcapngByteOrderMagic = 0x1A2B3C4D
+	// raw IP packets without link layer header
+	linkTypeRaw = 101
+
+	ipv4HeaderSize = 20
+	tcpHeaderSize  = 20
+
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+
+	initialSeq = 1000
+)
+
+// PcapngWriter is websocket.FrameCapturer which writes frames as pcapng file
+// with synthetic IPv4/TCP packets, one packet per frame, preceded by TCP
+// handshake. Use "Decode As... WebSocket" in Wireshark for the TCP port.
+// It is safe for concurrent use
+type PcapngWriter struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	err error
+
+	local, remote       netip.AddrPort
+	localSeq, remoteSeq uint32
+	handshakeWritten    bool
+	// local side of connection is the one which masks frames
+	isClient bool
+}
+
+var _ websocket.FrameCapturer = (*PcapngWriter)(nil)
+
+// Creates writer and writes pcapng section and interface headers.
+// Outbound frames are sent from local to remote address, only IPv4 is supported
+func NewPcapngWriter(w io.Writer, local, remote netip.AddrPort) (*PcapngWriter, error) {
+	if !local.Addr().Unmap().Is4() || !remote.Addr().Unmap().Is4() {
+		return nil, fmt.Errorf("only IPv4 addresses are supported")
+	}
+
+	pw := &PcapngWriter{
+		w:         bufio.NewWriter(w),
+		local:     netip.AddrPortFrom(local.Addr().Unmap(), local.Port()),
+		remote:    netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port()),
+		localSeq:  initialSeq,
+		remoteSeq: initialSeq,
+	}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1) // major version
+	binary.LittleEndian.PutUint16(shb[6:], 0) // minor version
+	binary.LittleEndian.PutUint64(shb[8:], math.MaxUint64)
+	pw.writeBlock(pcapngBlockSHB, shb)
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:], 0) // no snap length limit
+	pw.writeBlock(pcapngBlockIDB, idb)
+
+	if pw.err != nil {
+		return nil, pw.err
+	}
+
+	return pw, nil
+}
+
+func (pw *PcapngWriter) CaptureFrame(f *websocket.CapturedFrame) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if pw.err != nil {
+		return
+	}
+
+	if !pw.handshakeWritten {
+		pw.handshakeWritten = true
+		pw.isClient = (f.Direction == websocket.DirectionOutbound) == f.IsMasked
+		pw.writeHandshake(f)
+	}
+
+	data := encodeFrame(f)
+
+	ts := uint64(f.Time.UnixMicro())
+	if f.Direction == websocket.DirectionOutbound {
+		pw.writePacket(ts, pw.local, pw.remote, pw.localSeq, pw.remoteSeq, tcpFlagPSH|tcpFlagACK, data)
+		pw.localSeq += uint32(len(data))
+	} else {
+		pw.writePacket(ts, pw.remote, pw.local, pw.remoteSeq, pw.localSeq, tcpFlagPSH|tcpFlagACK, data)
+		pw.remoteSeq += uint32(len(data))
+	}
+}
+
+func (pw *PcapngWriter) Err() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
+
+func (pw *PcapngWriter) Flush() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if pw.err != nil {
+		return pw.err
+	}
+
+	return pw.w.Flush()
+}
+
+// Writes TCP three-way handshake, so analyzers can follow the stream
+func (pw *PcapngWriter) writeHandshake(first *websocket.CapturedFrame) {
+	ts := uint64(first.Time.UnixMicro())
+
+	client, server := pw.local, pw.remote
+	clientSeq, serverSeq := &pw.localSeq, &pw.remoteSeq
+	if !pw.isClient {
+		client, server = server, client
+		clientSeq, serverSeq = serverSeq, clientSeq
+	}
+
+	pw.writePacket(ts, client, server, *clientSeq-1, 0, tcpFlagSYN, nil)
+	pw.writePacket(ts, server, client, *serverSeq-1, *clientSeq, tcpFlagSYN|tcpFlagACK, nil)
+	pw.writePacket(ts, client, server, *clientSeq, *serverSeq, tcpFlagACK, nil)
+}
+
+func (pw *PcapngWriter) writePacket(ts uint64, src, dst netip.AddrPort, seq, ack uint32, flags byte, payload []byte) {
+	packet := make([]byte, ipv4HeaderSize+tcpHeaderSize+len(payload))
+
+	ip := packet[:ipv4HeaderSize]
+	ip[0] = 0x45 // version 4, header length 5 words
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(packet)))
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+	ip[8] = 64                                 // TTL
+	ip[9] = 6                                  // TCP
+	srcIP, dstIP := src.Addr().As4(), dst.Addr().As4()
+	copy(ip[12:16], srcIP[:])
+	copy(ip[16:20], dstIP[:])
+	binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+
+	tcp := packet[ipv4HeaderSize:]
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4 // header length 5 words
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], math.MaxUint16) // window
+	copy(tcp[tcpHeaderSize:], payload)
+
+	pseudo := make([]byte, 12)
+	copy(pseudo[0:4], srcIP[:])
+	copy(pseudo[4:8], dstIP[:])
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(sum(0, pseudo), tcp))
+
+	padding := (4 - len(packet)%4) % 4
+	epb := make([]byte, 20+len(packet)+padding)
+	binary.LittleEndian.PutUint32(epb[0:], 0) // interface id
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(len(packet)))
+	copy(epb[20:], packet)
+
+	pw.writeBlock(pcapngBlockEPB, epb)
+}
+
+// Writes block with body padded to 32 bits
+func (pw *PcapngWriter) writeBlock(blockType uint32, body []byte) {
+	if pw.err != nil {
+		return
+	}
+
+	total := uint32(12 + len(body))
+
+	b := make([]byte, total)
+	binary.LittleEndian.PutUint32(b[0:], blockType)
+	binary.LittleEndian.PutUint32(b[4:], total)
+	copy(b[8:], body)
+	binary.LittleEndian.PutUint32(b[total-4:], total)
+
+	_, err := pw.w.Write(b)
+	if err != nil {
+		pw.err = fmt.Errorf("failed to write pcapng block: [%w]", err)
+	}
+}
+
+// Encodes frame as it was sent on the wire, masking payload if needed
+func encodeFrame(f *websocket.CapturedFrame) []byte {
+	header := make([]byte, 0, 14)
+
+	b0 := encodeFlags(f) & 0xF0
+	b0 |= byte(f.Type) & 0x0F
+	header = append(header, b0)
+
+	var b1 byte
+	if f.IsMasked {
+		b1 = 0x80
+	}
+	length := len(f.Payload)
+	switch {
+	case length <= 125:
+		header = append(header, b1|byte(length))
+	case length <= math.MaxUint16:
+		header = append(header, b1|126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, b1|127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	if f.IsMasked {
+		header = append(header, f.MaskingKey[:]...)
+	}
+
+	data := append(header, f.Payload...)
+	if f.IsMasked {
+		payload := data[len(header):]
+		for i := range payload {
+			payload[i] ^= f.MaskingKey[i%4]
+		}
+	}
+
+	return data
+}
+
+func sum(acc uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		acc += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		acc += uint32(b[len(b)-1]) << 8
+	}
+	return acc
+}
+
+// Internet checksum of b added to partial sum acc
+func checksum(acc uint32, b []byte) uint16 {
+	acc = sum(acc, b)
+	for acc>>16 != 0 {
+		acc = acc&0xFFFF + acc>>16
+	}
+	return ^uint16(acc)
+}
@@ -0,0 +1,132 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	Type MessageType
+	Data []byte
+}
+
+// ChannelConn is channel based wrapper around Conn.
+// It owns reading from connection, so Conn read methods must not be used after
+// wrapping. Messages can be sent from any goroutine using Send
+type ChannelConn struct {
+	c *Conn
+
+	messages chan Message
+
+	// closed by Close to let read loop discard messages nobody is going to receive
+	closing   chan struct{}
+	closeOnce sync.Once
+	// closed when read loop exited and net.Conn was closed
+	done chan struct{}
+
+	// serializes messages, frames of different messages must not interleave
+	sendMu sync.Mutex
+
+	err error
+}
+
+// Wraps connection and starts goroutine reading messages from it.
+// bufSize is capacity of messages channel
+func NewChannelConn(c *Conn, bufSize int) *ChannelConn {
+	cc := &ChannelConn{
+		c:        c,
+		messages: make(chan Message, bufSize),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go cc.readLoop()
+
+	return cc
+}
+
+// Channel with received messages, it is closed when connection is closed.
+// After that Err reports why
+func (cc *ChannelConn) Messages() <-chan Message {
+	return cc.messages
+}
+
+func (cc *ChannelConn) Send(m Message) error {
+	cc.sendMu.Lock()
+	defer cc.sendMu.Unlock()
+
+	select {
+	case <-cc.closing:
+		return ErrConnClosed
+	default:
+	}
+
+	return cc.c.WriteMessage(m.Type, m.Data)
+}
+
+// Error which terminated connection, nil if it was closed by close handshake.
+// Must be called only after Messages channel is closed
+func (cc *ChannelConn) Err() error {
+	return cc.err
+}
+
+// Wrapped connection
+func (cc *ChannelConn) Conn() *Conn {
+	return cc.c
+}
+
+// Starts close handshake and waits for read loop to receive peer close frame.
+// If peer does not respond in time, connection is closed forcefully
+func (cc *ChannelConn) Close() error {
+	var err error
+
+	cc.closeOnce.Do(func() {
+		close(cc.closing)
+
+		cc.sendMu.Lock()
+		err = cc.c.WriteClose(CloseNormalClosure, "")
+		cc.sendMu.Unlock()
+
+		timer := time.NewTimer(closeTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-cc.done:
+		case <-timer.C:
+			cc.c.l.Debug("channel conn: close frame was not received in time, closing connection")
+			cc.c.closeNetConn()
+			<-cc.done
+		}
+	})
+
+	if err != nil && !errors.Is(err, ErrConnClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (cc *ChannelConn) readLoop() {
+	defer close(cc.done)
+	defer close(cc.messages)
+	defer cc.c.closeNetConn()
+
+	for {
+		mt, data, err := cc.c.NextMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, ErrConnClosed) {
+				cc.c.l.Debug("channel conn: read loop failed", "err", err)
+				cc.err = err
+			}
+			return
+		}
+
+		select {
+		case cc.messages <- Message{Type: mt, Data: data}:
+		case <-cc.closing:
+			cc.c.l.Debug("channel conn: closing, discarding message")
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package websocket_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+// Receives from channel or fails test if nothing arrives in time
+func recvMessage(t *testing.T, messages <-chan websocket.Message) (websocket.Message, bool) {
+	t.Helper()
+
+	select {
+	case m, ok := <-messages:
+		return m, ok
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for messages channel")
+		return websocket.Message{}, false
+	}
+}
+
+func TestChannelConn(t *testing.T) {
+	client, server := wstest.NewPipe()
+	cc := websocket.NewChannelConn(server, 1)
+
+	sent := []websocket.Message{
+		{Type: websocket.TextMessage, Data: []byte("first")},
+		{Type: websocket.BinaryMessage, Data: []byte{1, 2, 3}},
+		{Type: websocket.TextMessage, Data: []byte("third")},
+	}
+	go func() {
+		for _, m := range sent {
+			if err := client.WriteMessage(m.Type, m.Data); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, want := range sent {
+		m, ok := recvMessage(t, cc.Messages())
+		if !ok || m.Type != want.Type || string(m.Data) != string(want.Data) {
+			t.Fatalf("got %d %q %v, want %d %q", m.Type, m.Data, ok, want.Type, want.Data)
+		}
+	}
+
+	go func() { _ = cc.Send(websocket.Message{Type: websocket.TextMessage, Data: []byte("reply")}) }()
+	if _, data, err := client.NextMessage(); err != nil || string(data) != "reply" {
+		t.Fatalf("got %q %v, want %q", data, err, "reply")
+	}
+
+	// peer close ends messages channel without error
+	if err := client.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if _, ok := recvMessage(t, cc.Messages()); ok {
+		t.Fatal("messages channel is not closed after close handshake")
+	}
+	if err := cc.Err(); err != nil {
+		t.Errorf("error = %v, want nil after close handshake", err)
+	}
+}
+
+func TestChannelConnClose(t *testing.T) {
+	client, server := wstest.NewPipe()
+	// unbuffered and never received, so read loop is blocked on delivery
+	cc := websocket.NewChannelConn(server, 0)
+
+	go func() {
+		for range 3 {
+			if err := client.WriteMessage(websocket.TextMessage, []byte("unread")); err != nil {
+				return
+			}
+		}
+	}()
+	clientErr := make(chan error, 1)
+	go func() {
+		// answers close frame
+		_, _, err := client.NextMessage()
+		clientErr <- err
+	}()
+
+	closed := make(chan error, 1)
+	go func() { closed <- cc.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("failed to close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close blocked on undelivered messages")
+	}
+
+	// read loop is done once Close returns, undelivered messages are discarded
+	for {
+		if _, ok := recvMessage(t, cc.Messages()); !ok {
+			break
+		}
+	}
+	if err := cc.Err(); err != nil {
+		t.Errorf("error = %v, want nil after close handshake", err)
+	}
+	if err := cc.Send(websocket.Message{Type: websocket.TextMessage, Data: []byte("late")}); !errors.Is(err, websocket.ErrConnClosed) {
+		t.Errorf("send after close error = %v, want %v", err, websocket.ErrConnClosed)
+	}
+	if err := <-clientErr; err == nil {
+		t.Error("client read succeeded after close")
+	}
+}
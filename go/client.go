@@ -3,34 +3,113 @@ package websocket
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"time"
+
+	"github.com/wmdanor/websocket/go/internal/http2"
 )
 
 // TODO: add deadlines everywhere
 
 type Dialer struct {
 	Subprotocols []string
+	// Extensions offered in handshake request, in order of preference
+	Extensions []Extension
+	// Decides which messages are compressed when compression extension
+	// is negotiated, every message is compressed if nil
+	CompressionPolicy *CompressionPolicy
+	// Max payload size of written data frames, see Conn.SetMaxFrameSize
+	MaxFrameSize int
+	// Max size of received message, see Conn.SetReadLimit.
+	// Should be set when compression extension is used
+	ReadLimit int64
+
+	// Dials underlying connection, net.Dialer is used if nil
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	// TLS configuration for wss urls, default one if nil.
+	// ServerName is set to url host if empty
+	TLSClientConfig *tls.Config
+	// Offers HTTP/2 in TLS handshake of wss urls and opens connection with
+	// extended CONNECT (RFC 8441) if server selects it, HTTP/1.1 is used otherwise
+	EnableHTTP2 bool
+
+	// Receives handshake and connection events, nil if not needed
+	Observer Observer
+	// Creates spans for handshake, messages and close handshake,
+	// trace context is propagated in handshake request headers. nil if not needed
+	Tracer Tracer
 
 	InternalLogger *slog.Logger
 }
 
 func (d *Dialer) Dial(urlStr string, headers map[string]string) (*Conn, error) {
+	return d.DialContext(context.Background(), urlStr, headers)
+}
+
+// Context is used for opening handshake only, cancelling it after
+// connection is returned does not affect the connection
+func (d *Dialer) DialContext(ctx context.Context, urlStr string, headers map[string]string) (*Conn, error) {
 	l := d.InternalLogger
 	if l == nil {
 		l = slog.New(slog.DiscardHandler)
 	}
 
+	tracer := d.Tracer
+	if tracer == nil {
+		tracer = NopTracer{}
+	}
+
+	start := time.Now()
+
+	hsCtx, span := tracer.Start(ctx, SpanHandshake,
+		Attribute{AttrSide, SideClient.String()}, Attribute{AttrURL, urlStr})
+
+	c, failureReason, err := d.dial(hsCtx, tracer, urlStr, headers, l)
+	if err != nil {
+		if d.Observer != nil {
+			d.Observer.HandshakeFailed(SideClient, failureReason)
+		}
+		endSpan(span, err)
+		return nil, err
+	}
+
+	reqHeader := http.Header{}
+	for hk, hv := range headers {
+		reqHeader.Set(hk, hv)
+	}
+	c.setContext(ctx, reqHeader)
+	if d.CompressionPolicy != nil {
+		c.SetCompressionPolicy(d.CompressionPolicy)
+	}
+	c.SetMaxFrameSize(d.MaxFrameSize)
+	c.SetReadLimit(d.ReadLimit)
+
+	c.observe(d.Observer)
+	if d.Observer != nil {
+		d.Observer.HandshakeSucceeded(SideClient, time.Since(start))
+	}
+	c.trace(context.WithoutCancel(ctx), d.Tracer)
+	span.SetAttributes(Attribute{AttrSubprotocol, c.Subprotocol()})
+	span.End()
+
+	return c, nil
+}
+
+func (d *Dialer) dial(ctx context.Context, tracer Tracer, urlStr string, headers map[string]string, l *slog.Logger) (*Conn, string, error) {
 	writeBuf := make([]byte, 4096)
 
 	u, err := url.Parse(urlStr)
 	if err != nil {
-		return nil, fmt.Errorf("%w: failed to parse url: [%w]", ErrHandshakeFailure, err)
+		return nil, FailureReasonBadURL, fmt.Errorf("%w: failed to parse url: [%w]", ErrHandshakeFailure, err)
 	}
 
 	switch u.Scheme {
@@ -39,16 +118,29 @@ func (d *Dialer) Dial(urlStr string, headers map[string]string) (*Conn, error) {
 	case "wss":
 		u.Scheme = "https"
 	default:
-		return nil, fmt.Errorf("url schema must be ws or wss, actual %q", u.Scheme)
+		return nil, FailureReasonBadURL, fmt.Errorf("url schema must be ws or wss, actual %q", u.Scheme)
 	}
 
 	dialAddr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		dialAddr = net.JoinHostPort(u.Hostname(), port)
+	}
 
 	l.Debug("dialing websocket server")
 
-	netConn, err := net.Dial("tcp", dialAddr)
+	netDial := d.NetDialContext
+	if netDial == nil {
+		netDialer := net.Dialer{}
+		netDial = netDialer.DialContext
+	}
+
+	netConn, err := netDial(ctx, "tcp", dialAddr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial remote address %q: [%w]", dialAddr, err)
+		return nil, FailureReasonDial, fmt.Errorf("failed to dial remote address %q: [%w]", dialAddr, err)
 	}
 	defer func() {
 		if netConn != nil {
@@ -56,6 +148,47 @@ func (d *Dialer) Dial(urlStr string, headers map[string]string) (*Conn, error) {
 		}
 	}()
 
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = netConn.SetDeadline(deadline)
+	}
+	stopInterrupt := context.AfterFunc(ctx, func() {
+		_ = netConn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stopInterrupt()
+
+	if u.Scheme == "https" {
+		tlsConn, err := d.handshakeTLS(ctx, netConn, u.Hostname())
+		if err != nil {
+			return nil, FailureReasonDial, fmt.Errorf("%w: [%w]", ErrHandshakeFailure, err)
+		}
+		netConn = tlsConn
+
+		if tlsConn.ConnectionState().NegotiatedProtocol == alpnHTTP2 {
+			t, subprotocol, exts, failureReason, err := d.dialHTTP2(ctx, tracer, tlsConn, u, headers, l)
+			if err != nil {
+				return nil, failureReason, err
+			}
+
+			if !stopInterrupt() {
+				_ = t.Close()
+				return nil, FailureReasonConnectionError, fmt.Errorf("%w: [%w]", ErrHandshakeFailure, ctx.Err())
+			}
+			_ = netConn.SetDeadline(time.Time{})
+
+			// connection is owned by transport from now on
+			netConn = nil
+
+			c, err := newConn(t, bufio.NewReaderSize(t, 4096), writeBuf, subprotocol, l)
+			if err != nil {
+				_ = t.Close()
+				return nil, FailureReasonConnectionError, fmt.Errorf("failed to create conn object: [%w]", err)
+			}
+			c.setExtensions(exts)
+
+			return c, "", nil
+		}
+	}
+
 	req := http.Request{
 		Method:     http.MethodGet,
 		URL:        u,
@@ -78,55 +211,209 @@ func (d *Dialer) Dial(urlStr string, headers map[string]string) (*Conn, error) {
 		secWsProto := strings.Join(d.Subprotocols, ", ")
 		req.Header[headerSecWsProto] = []string{secWsProto}
 	}
+	if len(d.Extensions) > 0 {
+		req.Header[headerSecWsExt] = []string{d.extensionOffers()}
+	}
 
 	secWsKey := newSecWsKey()
 	expectedSecWsAccept := newSecWebsocketAccept(secWsKey).String()
 
 	req.Header[headerSecWsKey] = []string{secWsKey}
 
+	tracer.Inject(ctx, req.Header)
+
 	err = req.Write(netConn)
 	if err != nil {
-		return nil, fmt.Errorf("%w: failed to write request: [%w]", ErrHandshakeFailure, err)
+		return nil, FailureReasonConnectionError, fmt.Errorf("%w: failed to write request: [%w]", ErrHandshakeFailure, err)
 	}
 
 	bufReader := bufio.NewReaderSize(netConn, 4096)
 
 	res, err := http.ReadResponse(bufReader, &req)
 	if err != nil {
-		return nil, fmt.Errorf("%w: failed to read response: [%w]", ErrHandshakeFailure, err)
+		return nil, FailureReasonConnectionError, fmt.Errorf("%w: failed to read response: [%w]", ErrHandshakeFailure, err)
 	}
 	res.Body = io.NopCloser(bytes.NewReader([]byte{}))
 
 	if res.StatusCode != 101 {
-		return nil, fmt.Errorf(`%w: status code must be %d , actual %d`,
+		return nil, FailureReasonBadResponse, fmt.Errorf(`%w: status code must be %d , actual %d`,
 			ErrHandshakeFailure, 101, res.StatusCode)
 	}
 
 	actual, ok := headerEquals(res.Header, headerUpgrade, headerUpgradeExpected)
 	if !ok {
-		return nil, fmt.Errorf(`%w: %q header must be %q , actual %q`,
+		return nil, FailureReasonBadResponse, fmt.Errorf(`%w: %q header must be %q , actual %q`,
 			ErrHandshakeFailure, headerUpgrade, headerUpgradeExpected, actual)
 	}
 
 	actual, ok = headerEquals(res.Header, headerConn, headerConnExpected)
 	if !ok {
-		return nil, fmt.Errorf(`%w: %q header must be %q , actual %q`,
+		return nil, FailureReasonBadResponse, fmt.Errorf(`%w: %q header must be %q , actual %q`,
 			ErrHandshakeFailure, headerConn, headerConnExpected, actual)
 	}
 
 	secWsAccept := res.Header.Get(headerSecWsAccept)
 	if len(secWsAccept) == 0 {
-		return nil, fmt.Errorf("%w: missing %q header", ErrHandshakeFailure, headerSecWsAccept)
+		return nil, FailureReasonBadResponse, fmt.Errorf("%w: missing %q header", ErrHandshakeFailure, headerSecWsAccept)
 	} else if secWsAccept != expectedSecWsAccept {
-		return nil, fmt.Errorf("%w: %q header does not equal expected value", ErrHandshakeFailure, headerSecWsAccept)
+		return nil, FailureReasonBadResponse, fmt.Errorf("%w: %q header does not equal expected value", ErrHandshakeFailure, headerSecWsAccept)
 	}
 
-	c, err := newConn(netConn, bufReader, writeBuf, l)
+	subprotocol := res.Header.Get(headerSecWsProto)
+	if subprotocol != "" && !slices.Contains(d.Subprotocols, subprotocol) {
+		return nil, FailureReasonBadResponse, fmt.Errorf("%w: server selected subprotocol %q which was not requested",
+			ErrHandshakeFailure, subprotocol)
+	}
+
+	exts, err := d.acceptExtensions(res.Header)
+	if err != nil {
+		return nil, FailureReasonBadResponse, err
+	}
+
+	// handshake is done, connection must not be affected by ctx anymore
+	if !stopInterrupt() {
+		return nil, FailureReasonConnectionError, fmt.Errorf("%w: [%w]", ErrHandshakeFailure, ctx.Err())
+	}
+	_ = netConn.SetDeadline(time.Time{})
+
+	c, err := newConn(netTransport{netConn}, bufReader, writeBuf, subprotocol, l)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create conn object: [%w]", err)
+		return nil, FailureReasonConnectionError, fmt.Errorf("failed to create conn object: [%w]", err)
 	}
+	c.setExtensions(exts)
 
 	netConn = nil
 
-	return c, nil
+	return c, "", nil
+}
+
+func (d *Dialer) handshakeTLS(ctx context.Context, netConn net.Conn, host string) (*tls.Conn, error) {
+	cfg := &tls.Config{}
+	if d.TLSClientConfig != nil {
+		cfg = d.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if d.EnableHTTP2 && len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{alpnHTTP2, alpnHTTP1}
+	}
+
+	tlsConn := tls.Client(netConn, cfg)
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed TLS handshake: [%w]", err)
+	}
+
+	return tlsConn, nil
+}
+
+const (
+	alpnHTTP2 = "h2"
+	alpnHTTP1 = "http/1.1"
+)
+
+// Opens extended CONNECT stream (RFC 8441) on connection for which server selected h2,
+// connection is closed together with returned transport
+func (d *Dialer) dialHTTP2(ctx context.Context, tracer Tracer, tlsConn *tls.Conn, u *url.URL, headers map[string]string, l *slog.Logger) (*streamTransport, string, []negotiatedExtension, string, error) {
+	l.Debug("server selected HTTP/2, opening extended CONNECT stream")
+
+	cc, err := http2.NewClientConn(tlsConn)
+	if err != nil {
+		return nil, "", nil, FailureReasonConnectionError, fmt.Errorf("%w: failed to start HTTP/2 connection: [%w]", ErrHandshakeFailure, err)
+	}
+
+	fail := func(failureReason string, err error) (*streamTransport, string, []negotiatedExtension, string, error) {
+		_ = cc.Close()
+		return nil, "", nil, failureReason, err
+	}
+
+	if !cc.ExtendedConnectAllowed() {
+		return fail(FailureReasonBadResponse, fmt.Errorf("%w: server does not support extended CONNECT", ErrHandshakeFailure))
+	}
+
+	reqHeader := make(http.Header)
+	for hk, hv := range headers {
+		reqHeader[hk] = []string{hv}
+	}
+	reqHeader[headerSecWsVersion] = []string{headerSecWsVersionExpected}
+	if len(d.Subprotocols) > 0 {
+		reqHeader[headerSecWsProto] = []string{strings.Join(d.Subprotocols, ", ")}
+	}
+	if len(d.Extensions) > 0 {
+		reqHeader[headerSecWsExt] = []string{d.extensionOffers()}
+	}
+	tracer.Inject(ctx, reqHeader)
+
+	fields := []http2.HeaderField{
+		{Name: ":method", Value: http.MethodConnect},
+		{Name: headerProtocol, Value: headerUpgradeExpected},
+		{Name: ":scheme", Value: u.Scheme},
+		{Name: ":path", Value: u.RequestURI()},
+		{Name: ":authority", Value: u.Host},
+	}
+	for hk, hv := range reqHeader {
+		for _, v := range hv {
+			fields = append(fields, http2.HeaderField{Name: strings.ToLower(hk), Value: v})
+		}
+	}
+
+	stream, err := cc.OpenStream(fields)
+	if err != nil {
+		return fail(FailureReasonConnectionError, fmt.Errorf("%w: failed to open stream: [%w]", ErrHandshakeFailure, err))
+	}
+
+	resFields, err := stream.Response()
+	if err != nil {
+		return fail(FailureReasonConnectionError, fmt.Errorf("%w: failed to read response: [%w]", ErrHandshakeFailure, err))
+	}
+
+	status := ""
+	resHeader := make(http.Header)
+	for _, f := range resFields {
+		if f.Name == ":status" {
+			status = f.Value
+		} else {
+			resHeader.Add(f.Name, f.Value)
+		}
+	}
+
+	if status != "200" {
+		return fail(FailureReasonBadResponse, fmt.Errorf(`%w: status code must be %d , actual %s`,
+			ErrHandshakeFailure, http.StatusOK, status))
+	}
+
+	subprotocol := resHeader.Get(headerSecWsProto)
+	if subprotocol != "" && !slices.Contains(d.Subprotocols, subprotocol) {
+		return fail(FailureReasonBadResponse, fmt.Errorf("%w: server selected subprotocol %q which was not requested",
+			ErrHandshakeFailure, subprotocol))
+	}
+
+	exts, err := d.acceptExtensions(resHeader)
+	if err != nil {
+		return fail(FailureReasonBadResponse, err)
+	}
+
+	return newClientStreamTransport(stream, tlsConn.LocalAddr(), tlsConn.RemoteAddr(), cc.Close), subprotocol, exts, "", nil
+}
+
+func (d *Dialer) extensionOffers() string {
+	offers := make([]ExtensionOffer, len(d.Extensions))
+	for i, e := range d.Extensions {
+		offers[i] = e.Offer()
+		if offers[i].Name == "" {
+			offers[i].Name = e.Name()
+		}
+	}
+	return extensionsHeader(offers)
+}
+
+// Validates extensions selected by server in response headers
+func (d *Dialer) acceptExtensions(h http.Header) ([]negotiatedExtension, error) {
+	responses, err := ParseExtensions(h)
+	if err != nil {
+		return nil, fmt.Errorf("%w: [%w]", ErrHandshakeFailure, err)
+	}
+
+	return acceptedExtensions(d.Extensions, responses)
 }
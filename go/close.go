@@ -4,8 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"slices"
 	"time"
+	"unicode/utf8"
 )
 
 type CloseCode uint16
@@ -28,6 +30,14 @@ const (
 	CloseTLSHandshake            CloseCode = 1015
 )
 
+const (
+	// how long to wait for peer close frame after sending ours
+	closeTimeout = 15 * time.Second
+
+	// close frame payload must fit into 125 bytes including close code
+	maxCloseReasonLength = 123
+)
+
 var (
 	validCloseCodes []CloseCode = []CloseCode{
 		CloseNormalClosure,
@@ -74,26 +84,46 @@ func (c *Conn) Close() error {
 // use to close conn and store last err
 func (c *Conn) fatal(code CloseCode, err error, message string) error {
 	c.l.Debug("connection fatal error, closing connection", "err", err)
-	c.err = err
+	c.setErr(err)
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		// deadline was hit in the middle of frame, close handshake is not possible
+		c.l.Debug("connection timed out, skipping close handshake")
+		return errors.Join(err, c.closeNetConn())
+	}
 
 	if message == "" {
-		message = err.Error()
+		message = truncateCloseReason(err.Error())
 	}
 
 	return errors.Join(err, c.close(code, message))
 }
 
+// Cuts reason to max length without splitting runes
+func truncateCloseReason(reason string) string {
+	if len(reason) <= maxCloseReasonLength {
+		return reason
+	}
+
+	i := maxCloseReasonLength
+	for i > 0 && !utf8.RuneStart(reason[i]) {
+		i--
+	}
+
+	return reason[:i]
+}
+
 func (c *Conn) close(code CloseCode, message string) error {
-	defer c.conn.Close()
+	defer c.closeNetConn()
 
-	if c.sentConnClose && c.recvConnClose {
+	if c.isClosed() {
 		c.l.Debug("Already sent and received close frames, connection is closed, skipping")
 		return nil
 	}
 
 	c.l.Debug("Closing websocket connection")
 
-	if !c.sentConnClose {
+	if !c.sentConnClose.Load() {
 		if err := c.WriteClose(code, message); err != nil {
 			c.l.Debug("Failed to send close frame", "err", err)
 			return err
@@ -102,7 +132,7 @@ func (c *Conn) close(code CloseCode, message string) error {
 		c.l.Debug("Already sent close frame, skipping")
 	}
 
-	if !c.recvConnClose {
+	if !c.recvConnClose.Load() {
 		if err := c.waitCloseFrame(); err != nil {
 			if !errors.Is(err, io.EOF) {
 				c.l.Debug("Failed to receive close frame", "err", err)
@@ -119,18 +149,17 @@ func (c *Conn) close(code CloseCode, message string) error {
 }
 
 func (c *Conn) waitCloseFrame() error {
-	if c.recvConnClose {
+	if c.recvConnClose.Load() {
 		c.l.Debug("Close frame already received, skipping")
 		return nil
 	}
 
-	timeout := 15 * time.Second
-	err := c.conn.SetReadDeadline(time.Now().Add((timeout)))
+	err := c.readDeadline.set(time.Now().Add(closeTimeout))
 	if err != nil {
 		return fmt.Errorf("failed to set timeout for socket read: [%w]", err)
 	}
 
-	deadline := time.Now().Add(time.Second * 15)
+	deadline := time.Now().Add(closeTimeout)
 	for {
 		if time.Now().Compare(deadline) == 1 {
 			return fmt.Errorf("reached wait for close frame deadline")
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+)
+
+const (
+	// send time in unix nanoseconds as hex is put at the start of every message,
+	// it is ASCII so text messages stay valid UTF-8
+	timestampSize = 16
+
+	// how long to wait for server close frame after sending ours
+	closeWait = 5 * time.Second
+)
+
+const (
+	errDial         = "dial"
+	errWrite        = "write"
+	errRead         = "read"
+	errClose        = "close"
+	errCloseTimeout = "close_timeout"
+	errBadEcho      = "bad_echo"
+)
+
+type errorStat struct {
+	count int64
+	// first error of this kind
+	example string
+}
+
+// Stats of single connection, merged into report at the end
+type connStats struct {
+	connected     bool
+	sent          int64
+	received      int64
+	sentBytes     int64
+	receivedBytes int64
+	latency       *histogram
+	errors        map[string]*errorStat
+	// close code received from server, 0 if there was none
+	closeCode websocket.CloseCode
+}
+
+type worker struct {
+	cfg config
+
+	mu    sync.Mutex
+	stats connStats
+
+	// signals sender that message was echoed, used when rate is 0
+	echoed chan struct{}
+}
+
+// Runs all connections and collects report
+func runBench(cfg config) *report {
+	start := time.Now()
+	stopAt := start.Add(cfg.ramp + cfg.duration)
+
+	ctx, cancel := context.WithDeadline(context.Background(), stopAt)
+	defer cancel()
+
+	workers := make([]*worker, cfg.conns)
+	wg := sync.WaitGroup{}
+	for i := range workers {
+		w := &worker{
+			cfg:    cfg,
+			stats:  connStats{latency: newHistogram(), errors: map[string]*errorStat{}},
+			echoed: make(chan struct{}, 1),
+		}
+		workers[i] = w
+
+		startAt := start.Add(cfg.ramp * time.Duration(i) / time.Duration(cfg.conns))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.run(ctx, startAt)
+		}()
+	}
+
+	wg.Wait()
+
+	return newReport(cfg, time.Since(start), workers)
+}
+
+func (w *worker) run(ctx context.Context, startAt time.Time) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Until(startAt)):
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, w.cfg.timeout)
+	c, err := (&websocket.Dialer{}).DialContext(dialCtx, w.cfg.url, nil)
+	cancel()
+	if err != nil {
+		w.recordError(errDial, err)
+		return
+	}
+	defer c.Close()
+
+	w.mu.Lock()
+	w.stats.connected = true
+	w.mu.Unlock()
+
+	c.SetCloseHandler(func(code websocket.CloseCode, reason string) error {
+		w.mu.Lock()
+		w.stats.closeCode = code
+		w.mu.Unlock()
+		return c.WriteClose(code, reason)
+	})
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		w.readLoop(c)
+	}()
+
+	w.sendLoop(ctx, c, readDone)
+
+	select {
+	case <-readDone:
+		// server closed connection
+		return
+	default:
+	}
+
+	err = c.WriteClose(websocket.CloseNormalClosure, "")
+	if err != nil {
+		w.recordError(errClose, err)
+		return
+	}
+
+	select {
+	case <-readDone:
+	case <-time.After(closeWait):
+		w.recordError(errCloseTimeout, fmt.Errorf("server did not reply to close frame in %s", closeWait))
+	}
+}
+
+func (w *worker) sendLoop(ctx context.Context, c *websocket.Conn, readDone <-chan struct{}) {
+	mt := websocket.BinaryMessage
+	if w.cfg.text {
+		mt = websocket.TextMessage
+	}
+
+	data := make([]byte, w.cfg.size)
+	for i := timestampSize; i < len(data); i++ {
+		data[i] = 'a' + byte(i%26)
+	}
+
+	var tick <-chan time.Time
+	if w.cfg.rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / w.cfg.rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		ts := strconv.FormatInt(time.Now().UnixNano(), 16)
+		copy(data, fmt.Sprintf("%0*s", timestampSize, ts))
+
+		err := c.WriteMessage(mt, data)
+		if err != nil {
+			w.recordError(errWrite, err)
+			return
+		}
+
+		w.mu.Lock()
+		w.stats.sent++
+		w.stats.sentBytes += int64(len(data))
+		w.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-readDone:
+			return
+		case <-tick:
+		case <-w.waitEcho(tick):
+		}
+	}
+}
+
+// Without rate next message is sent once previous one is echoed
+func (w *worker) waitEcho(tick <-chan time.Time) <-chan struct{} {
+	if tick != nil {
+		return nil
+	}
+	return w.echoed
+}
+
+func (w *worker) readLoop(c *websocket.Conn) {
+	for {
+		_, data, err := c.NextMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, websocket.ErrConnClosed) {
+				w.recordError(errRead, err)
+			}
+			return
+		}
+
+		now := time.Now()
+
+		w.mu.Lock()
+		w.stats.received++
+		w.stats.receivedBytes += int64(len(data))
+		w.mu.Unlock()
+
+		sentAt, err := parseTimestamp(data)
+		if err != nil {
+			w.recordError(errBadEcho, err)
+		} else {
+			w.mu.Lock()
+			w.stats.latency.record(now.Sub(sentAt))
+			w.mu.Unlock()
+		}
+
+		select {
+		case w.echoed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func parseTimestamp(data []byte) (time.Time, error) {
+	if len(data) < timestampSize {
+		return time.Time{}, fmt.Errorf("message is too short: %d bytes", len(data))
+	}
+
+	ns, err := strconv.ParseInt(string(data[:timestampSize]), 16, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse timestamp: [%w]", err)
+	}
+
+	return time.Unix(0, ns), nil
+}
+
+func (w *worker) recordError(kind string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s, ok := w.stats.errors[kind]
+	if !ok {
+		s = &errorStat{example: err.Error()}
+		w.stats.errors[kind] = s
+	}
+	s.count++
+}
+
+type report struct {
+	URL         string  `json:"url"`
+	Conns       int     `json:"conns"`
+	Connected   int     `json:"connected"`
+	MessageSize int     `json:"message_size"`
+	Rate        float64 `json:"rate"`
+	Elapsed     float64 `json:"elapsed_seconds"`
+
+	Sent          int64 `json:"sent"`
+	Received      int64 `json:"received"`
+	SentBytes     int64 `json:"sent_bytes"`
+	ReceivedBytes int64 `json:"received_bytes"`
+
+	SentPerSecond          float64 `json:"sent_per_second"`
+	ReceivedPerSecond      float64 `json:"received_per_second"`
+	SentBytesPerSecond     float64 `json:"sent_bytes_per_second"`
+	ReceivedBytesPerSecond float64 `json:"received_bytes_per_second"`
+
+	Latency    latencyReport          `json:"latency"`
+	Errors     map[string]errorReport `json:"errors"`
+	CloseCodes map[string]int64       `json:"close_codes"`
+}
+
+// All durations are in milliseconds
+type latencyReport struct {
+	Count     int64          `json:"count"`
+	Min       float64        `json:"min_ms"`
+	Mean      float64        `json:"mean_ms"`
+	P50       float64        `json:"p50_ms"`
+	P90       float64        `json:"p90_ms"`
+	P99       float64        `json:"p99_ms"`
+	P999      float64        `json:"p999_ms"`
+	Max       float64        `json:"max_ms"`
+	Histogram []bucketReport `json:"histogram"`
+}
+
+type bucketReport struct {
+	LE    float64 `json:"le_ms"`
+	Count int64   `json:"count"`
+}
+
+type errorReport struct {
+	Count   int64  `json:"count"`
+	Example string `json:"example"`
+}
+
+func newReport(cfg config, elapsed time.Duration, workers []*worker) *report {
+	r := &report{
+		URL:         cfg.url,
+		Conns:       cfg.conns,
+		MessageSize: cfg.size,
+		Rate:        cfg.rate,
+		Elapsed:     elapsed.Seconds(),
+		Errors:      map[string]errorReport{},
+		CloseCodes:  map[string]int64{},
+	}
+
+	latency := newHistogram()
+	for _, w := range workers {
+		w.mu.Lock()
+		s := w.stats
+		w.mu.Unlock()
+
+		if s.connected {
+			r.Connected++
+		}
+		r.Sent += s.sent
+		r.Received += s.received
+		r.SentBytes += s.sentBytes
+		r.ReceivedBytes += s.receivedBytes
+		latency.merge(s.latency)
+
+		for kind, e := range s.errors {
+			er, ok := r.Errors[kind]
+			if !ok {
+				er.Example = e.example
+			}
+			er.Count += e.count
+			r.Errors[kind] = er
+		}
+
+		if s.closeCode != 0 {
+			r.CloseCodes[strconv.Itoa(int(s.closeCode))]++
+		} else if s.connected {
+			r.CloseCodes["none"]++
+		}
+	}
+
+	seconds := elapsed.Seconds()
+	r.SentPerSecond = float64(r.Sent) / seconds
+	r.ReceivedPerSecond = float64(r.Received) / seconds
+	r.SentBytesPerSecond = float64(r.SentBytes) / seconds
+	r.ReceivedBytesPerSecond = float64(r.ReceivedBytes) / seconds
+
+	r.Latency = latencyReport{
+		Count:     latency.count,
+		Min:       ms(latency.min),
+		Mean:      ms(latency.mean()),
+		P50:       ms(latency.quantile(0.5)),
+		P90:       ms(latency.quantile(0.9)),
+		P99:       ms(latency.quantile(0.99)),
+		P999:      ms(latency.quantile(0.999)),
+		Max:       ms(latency.max),
+		Histogram: []bucketReport{},
+	}
+	for i, c := range latency.counts {
+		if c > 0 {
+			r.Latency.Histogram = append(r.Latency.Histogram, bucketReport{LE: ms(bucketLimit(i)), Count: c})
+		}
+	}
+
+	return r
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func printSummary(out io.Writer, r *report) {
+	fmt.Fprintf(out, "connections: %d/%d connected in %.1fs\n", r.Connected, r.Conns, r.Elapsed)
+	fmt.Fprintf(out, "messages:    sent %d (%.0f/s), received %d (%.0f/s)\n",
+		r.Sent, r.SentPerSecond, r.Received, r.ReceivedPerSecond)
+	fmt.Fprintf(out, "throughput:  out %.2f MB/s, in %.2f MB/s\n",
+		r.SentBytesPerSecond/1e6, r.ReceivedBytesPerSecond/1e6)
+
+	l := r.Latency
+	fmt.Fprintf(out, "latency ms:  min %.3f, mean %.3f, p50 %.3f, p90 %.3f, p99 %.3f, p999 %.3f, max %.3f\n",
+		l.Min, l.Mean, l.P50, l.P90, l.P99, l.P999, l.Max)
+
+	for _, code := range slices.Sorted(maps.Keys(r.CloseCodes)) {
+		fmt.Fprintf(out, "close code %s: %d\n", code, r.CloseCodes[code])
+	}
+	for _, kind := range slices.Sorted(maps.Keys(r.Errors)) {
+		e := r.Errors[kind]
+		fmt.Fprintf(out, "errors %s: %d, e.g. %s\n", kind, e.Count, e.Example)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func histogramOf(ds ...time.Duration) *histogram {
+	h := newHistogram()
+	for _, d := range ds {
+		h.record(d)
+	}
+	return h
+}
+
+// 1ms, 2ms, ..., n ms
+func uniform(n int) []time.Duration {
+	ds := make([]time.Duration, n)
+	for i := range ds {
+		ds[i] = time.Duration(i+1) * time.Millisecond
+	}
+	return ds
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		q       float64
+		// quantile is at most 2% higher than actual value
+		want time.Duration
+	}{
+		{"empty", nil, 0.5, 0},
+		{"empty q=0", nil, 0, 0},
+		{"empty q=1", nil, 1, 0},
+		{"single", []time.Duration{5 * time.Millisecond}, 0.5, 5 * time.Millisecond},
+		{"single q=0", []time.Duration{5 * time.Millisecond}, 0, 5 * time.Millisecond},
+		{"single q=1", []time.Duration{5 * time.Millisecond}, 1, 5 * time.Millisecond},
+		{"uniform q=0", uniform(1000), 0, time.Millisecond},
+		{"uniform median", uniform(1000), 0.5, 500 * time.Millisecond},
+		{"uniform p99", uniform(1000), 0.99, 990 * time.Millisecond},
+		{"uniform q=1", uniform(1000), 1, 1000 * time.Millisecond},
+		{"bimodal median", []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond, time.Second}, 0.5, time.Millisecond},
+		{"bimodal p90", []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond, time.Second}, 0.9, time.Second},
+		{"below first bucket", []time.Duration{0, 500 * time.Nanosecond}, 1, 500 * time.Nanosecond},
+		{"beyond last bucket", []time.Duration{time.Second, 100 * time.Hour}, 1, 100 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := histogramOf(tt.samples...).quantile(tt.q)
+			if got < tt.want || float64(got) > float64(tt.want)*histogramGrowth {
+				t.Fatalf("quantile(%v) = %v, want %v within %v", tt.q, got, tt.want, histogramGrowth)
+			}
+		})
+	}
+}
+
+func TestHistogramMean(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		want    time.Duration
+	}{
+		{"empty", nil, 0},
+		{"single", []time.Duration{5 * time.Millisecond}, 5 * time.Millisecond},
+		{"uniform", uniform(1000), 500500 * time.Microsecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := histogramOf(tt.samples...).mean(); got != tt.want {
+				t.Fatalf("mean = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a := []time.Duration{3 * time.Millisecond, time.Second}
+	b := []time.Duration{time.Microsecond, 20 * time.Millisecond, 20 * time.Millisecond}
+
+	tests := []struct {
+		name string
+		a, b []time.Duration
+	}{
+		{"both", a, b},
+		{"into empty", nil, b},
+		{"empty", a, nil},
+		{"both empty", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := histogramOf(tt.a...)
+			got.merge(histogramOf(tt.b...))
+
+			// same as recording all samples into one histogram
+			want := histogramOf(append(append([]time.Duration{}, tt.a...), tt.b...)...)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("merged histogram count %d min %v max %v sum %v, want count %d min %v max %v sum %v",
+					got.count, got.min, got.max, got.sum, want.count, want.min, want.max, want.sum)
+			}
+		})
+	}
+}
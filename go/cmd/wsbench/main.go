@@ -0,0 +1,96 @@
+// Command wsbench load tests websocket servers.
+//
+// In client mode it opens connections with ramp-up, sends messages of given
+// size and rate on every connection and measures round-trip latency of echoed
+// messages, then writes JSON report. Target server must echo messages back.
+// In server mode it runs echo server which can be used as target:
+//
+//	wsbench -mode server -addr :9001
+//	wsbench -url ws://localhost:9001 -conns 500 -ramp 10s -duration 30s -size 256 -rate 20 -out report.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+type config struct {
+	url      string
+	conns    int
+	ramp     time.Duration
+	duration time.Duration
+	size     int
+	rate     float64
+	text     bool
+	timeout  time.Duration
+	out      string
+}
+
+func main() {
+	mode := flag.String("mode", "client", "client or server")
+	addr := flag.String("addr", ":9001", "listen address, server mode only")
+
+	cfg := config{}
+	flag.StringVar(&cfg.url, "url", "", "server url, client mode only")
+	flag.IntVar(&cfg.conns, "conns", 10, "number of concurrent connections")
+	flag.DurationVar(&cfg.ramp, "ramp", 0, "time over which connections are opened evenly")
+	flag.DurationVar(&cfg.duration, "duration", 10*time.Second, "time to send messages after all connections are opened")
+	flag.IntVar(&cfg.size, "size", 64, fmt.Sprintf("message size in bytes, at least %d", timestampSize))
+	flag.Float64Var(&cfg.rate, "rate", 0, "messages per second per connection, 0 - send next message once previous one is echoed")
+	flag.BoolVar(&cfg.text, "text", false, "send text messages instead of binary")
+	flag.DurationVar(&cfg.timeout, "timeout", 10*time.Second, "opening handshake timeout")
+	flag.StringVar(&cfg.out, "out", "", "file to write JSON report to, stdout if empty")
+	flag.Parse()
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	var err error
+	switch *mode {
+	case "client":
+		err = runClient(cfg)
+	case "server":
+		err = runServer(*addr)
+	default:
+		err = fmt.Errorf("unknown mode %q", *mode)
+	}
+	if err != nil {
+		slog.Error("wsbench failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+func runClient(cfg config) error {
+	if cfg.url == "" {
+		return fmt.Errorf("-url is required in client mode")
+	}
+	if cfg.conns <= 0 {
+		return fmt.Errorf("-conns must be positive")
+	}
+	cfg.size = max(cfg.size, timestampSize)
+
+	slog.Info("Starting benchmark", "url", cfg.url, "conns", cfg.conns, "ramp", cfg.ramp,
+		"duration", cfg.duration, "size", cfg.size, "rate", cfg.rate)
+
+	r := runBench(cfg)
+
+	printSummary(os.Stderr, r)
+
+	var w io.Writer = os.Stdout
+	if cfg.out != "" {
+		f, err := os.Create(cfg.out)
+		if err != nil {
+			return fmt.Errorf("failed to create report file: [%w]", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/metrics"
+)
+
+// Echoes every message back, used as benchmark target
+type echoHandler struct{}
+
+func (echoHandler) OnMessage(c *websocket.Conn, mt websocket.MessageType, data []byte) {
+	err := c.WriteMessage(mt, data)
+	if err != nil {
+		slog.Debug("Failed to echo message", "conn", c.ID(), "err", err)
+	}
+}
+
+func (echoHandler) OnPing(c *websocket.Conn, appData []byte) {}
+
+func (echoHandler) OnClose(c *websocket.Conn, code websocket.CloseCode, reason string) {}
+
+func (echoHandler) OnError(c *websocket.Conn, err error) {
+	slog.Debug("Connection failed", "conn", c.ID(), "err", err)
+}
+
+func runServer(addr string) error {
+	collector := metrics.NewCollector("wsbench")
+	upgrader := &websocket.Upgrader{Observer: collector}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", collector)
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		c, err := upgrader.Upgrade(w, req)
+		if err != nil {
+			slog.Debug("Opening connection failed", "err", err)
+			return
+		}
+
+		// Serve closes connection once it returns
+		_ = websocket.Serve(c, echoHandler{})
+	})
+
+	// benchmark target has nothing to finish, so it is stopped
+	// by interrupt without graceful shutdown
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	slog.Info("Starting echo server", "addr", addr)
+
+	err := server.ListenAndServe()
+	if err != nil {
+		return fmt.Errorf("failed to serve: [%w]", err)
+	}
+
+	return nil
+}
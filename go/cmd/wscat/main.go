@@ -0,0 +1,422 @@
+// Command wscat connects to websocket server, sends messages
+// from stdin and prints received ones.
+//
+// Every stdin line is sent as text message, lines starting with "/" are commands:
+//
+//	/ping [data]             sends ping
+//	/close [code [reason]]   sends close frame and exits once server replies
+//	/file path               sends file content as binary message
+//	//text                   sends "/text" as text message
+//
+// For scripting, messages can be passed with --send and --send-file instead of stdin:
+//
+//	wscat --send '{"op":"sub"}' --exit-after 3 --wait 10s ws://localhost:9001/feed
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+)
+
+const (
+	// how long to wait for server close frame after sending ours
+	closeWait = 5 * time.Second
+
+	timestampFormat = "15:04:05.000"
+)
+
+// Message to send, in order given on command line
+type outbound struct {
+	mt   websocket.MessageType
+	data string
+	// data is path to file
+	isFile bool
+}
+
+type headersFlag map[string]string
+
+func (h headersFlag) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headersFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, ":")
+	if !ok {
+		return fmt.Errorf("header must be in \"Name: value\" format")
+	}
+	h[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	return nil
+}
+
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// Appends outbound messages to shared list, so --send and --send-file keep their order
+type outboundFlag struct {
+	list   *[]outbound
+	mt     websocket.MessageType
+	isFile bool
+}
+
+func (o outboundFlag) String() string {
+	return ""
+}
+
+func (o outboundFlag) Set(v string) error {
+	*o.list = append(*o.list, outbound{mt: o.mt, data: v, isFile: o.isFile})
+	return nil
+}
+
+type options struct {
+	url          string
+	headers      headersFlag
+	subprotocols stringsFlag
+	send         []outbound
+	wait         time.Duration
+	exitAfter    int
+	timeout      time.Duration
+	insecure     bool
+	noTimestamps bool
+	verbose      bool
+}
+
+func main() {
+	opts := options{headers: headersFlag{}}
+
+	flag.Var(opts.headers, "H", `request header in "Name: value" format, can be repeated`)
+	flag.Var(&opts.subprotocols, "s", "subprotocol to request, can be repeated")
+	flag.Var(outboundFlag{&opts.send, websocket.TextMessage, false}, "send", "text message to send instead of reading stdin, can be repeated")
+	flag.Var(outboundFlag{&opts.send, websocket.BinaryMessage, true}, "send-file", "file to send as binary message instead of reading stdin, can be repeated")
+	flag.DurationVar(&opts.wait, "wait", 0, "time to wait for messages after everything is sent, unlimited with --exit-after if 0")
+	flag.IntVar(&opts.exitAfter, "exit-after", 0, "exit after receiving this many messages")
+	flag.DurationVar(&opts.timeout, "timeout", 10*time.Second, "opening handshake timeout")
+	flag.BoolVar(&opts.insecure, "insecure", false, "skip TLS certificate verification")
+	flag.BoolVar(&opts.noTimestamps, "no-timestamps", false, "don't prefix output with timestamps")
+	flag.BoolVar(&opts.verbose, "v", false, "log library internals to stderr")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] url\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	opts.url = flag.Arg(0)
+
+	err := run(opts, os.Stdin, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "wscat: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+type session struct {
+	c    *websocket.Conn
+	opts options
+
+	// lines read in interactive mode
+	in io.Reader
+
+	outMu sync.Mutex
+	out   io.Writer
+
+	received atomic.Int64
+	// closed when enough messages are received
+	enough     chan struct{}
+	enoughOnce sync.Once
+	// closed when connection reading stops
+	done    chan struct{}
+	readErr error
+
+	// underlying connection, closed if server doesn't reply to close frame
+	netConn net.Conn
+}
+
+func run(opts options, in io.Reader, out io.Writer) error {
+	d := websocket.Dialer{Subprotocols: opts.subprotocols}
+	if opts.insecure {
+		d.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if opts.verbose {
+		d.InternalLogger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+
+	var netConn net.Conn
+	d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var err error
+		netConn, err = (&net.Dialer{}).DialContext(ctx, network, addr)
+		return netConn, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+
+	c, err := d.DialContext(ctx, opts.url, opts.headers)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+
+	s := &session{
+		c:       c,
+		opts:    opts,
+		in:      in,
+		out:     out,
+		enough:  make(chan struct{}),
+		done:    make(chan struct{}),
+		netConn: netConn,
+	}
+
+	s.printf("connected to %s", opts.url)
+	if c.Subprotocol() != "" {
+		s.printf("subprotocol: %s", c.Subprotocol())
+	}
+
+	c.SetPongHandler(func(appData []byte) error {
+		s.printf("< pong: %s", appData)
+		return nil
+	})
+	c.SetCloseHandler(func(code websocket.CloseCode, reason string) error {
+		s.printf("< close %d: %s", code, reason)
+		return c.WriteClose(code, reason)
+	})
+
+	go s.readLoop()
+
+	if len(opts.send) > 0 {
+		err = s.runScript()
+	} else {
+		err = s.runInteractive()
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.close(websocket.CloseNormalClosure, "")
+}
+
+// Sends messages from flags and waits for responses
+func (s *session) runScript() error {
+	for _, o := range s.opts.send {
+		data := []byte(o.data)
+		if o.isFile {
+			var err error
+			data, err = os.ReadFile(o.data)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := s.send(o.mt, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.waitMessages()
+}
+
+// Sends stdin lines and handles commands until stdin is closed
+func (s *session) runInteractive() error {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(s.in)
+		scanner.Buffer(nil, 16*1024*1024)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	for {
+		select {
+		case <-s.done:
+			return s.readErr
+		case <-s.enough:
+			return nil
+		case line, ok := <-lines:
+			if !ok {
+				return s.waitMessages()
+			}
+
+			quit, err := s.handleLine(line)
+			if err != nil {
+				return err
+			}
+			if quit {
+				return nil
+			}
+		}
+	}
+}
+
+// Waits for --exit-after messages or --wait timeout
+func (s *session) waitMessages() error {
+	if s.opts.wait == 0 && s.opts.exitAfter == 0 {
+		return nil
+	}
+
+	var timeout <-chan time.Time
+	if s.opts.wait > 0 {
+		timer := time.NewTimer(s.opts.wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-s.enough:
+		return nil
+	case <-s.done:
+		if s.opts.exitAfter > 0 {
+			return fmt.Errorf("connection closed after %d of %d messages", s.received.Load(), s.opts.exitAfter)
+		}
+		return nil
+	case <-timeout:
+		if s.opts.exitAfter > 0 {
+			return fmt.Errorf("timed out after receiving %d of %d messages", s.received.Load(), s.opts.exitAfter)
+		}
+		return nil
+	}
+}
+
+func (s *session) handleLine(line string) (quit bool, err error) {
+	if !strings.HasPrefix(line, "/") || strings.HasPrefix(line, "//") {
+		return false, s.send(websocket.TextMessage, []byte(strings.TrimPrefix(line, "/")))
+	}
+
+	cmd, arg, _ := strings.Cut(line[1:], " ")
+	switch cmd {
+	case "ping":
+		err = s.c.WriteControl(websocket.PingMessage, []byte(arg))
+		if err == nil {
+			s.printf("> ping: %s", arg)
+		}
+		return false, err
+	case "close":
+		code := websocket.CloseNormalClosure
+		codeStr, reason, _ := strings.Cut(arg, " ")
+		if codeStr != "" {
+			n, err := strconv.ParseUint(codeStr, 10, 16)
+			var ok bool
+			if err == nil {
+				code, ok = websocket.NewCloseCode(uint16(n))
+			}
+			if !ok {
+				s.printf("invalid close code %q, must be one of defined codes or 3000-4999", codeStr)
+				return false, nil
+			}
+		}
+		return true, s.close(code, reason)
+	case "file":
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			s.printf("failed to read file: %v", err)
+			return false, nil
+		}
+		return false, s.send(websocket.BinaryMessage, data)
+	default:
+		s.printf("unknown command /%s, available: /ping [data], /close [code [reason]], /file path", cmd)
+		return false, nil
+	}
+}
+
+func (s *session) send(mt websocket.MessageType, data []byte) error {
+	err := s.c.WriteMessage(mt, data)
+	if err != nil {
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	s.printf("> %s", formatMessage(mt, data))
+	return nil
+}
+
+// Sends close frame and waits for server to close connection
+func (s *session) close(code websocket.CloseCode, reason string) error {
+	select {
+	case <-s.done:
+		// connection is already closed by server or failed
+		_ = s.c.Close()
+		return nil
+	default:
+	}
+
+	err := s.c.WriteClose(code, reason)
+	if err != nil {
+		return fmt.Errorf("failed to send close frame: %w", err)
+	}
+	s.printf("> close %d: %s", code, reason)
+
+	select {
+	case <-s.done:
+		// close frames were exchanged, only net.Conn is left to close
+		return s.c.Close()
+	case <-time.After(closeWait):
+		// close handshake can't finish, so connection is dropped
+		_ = s.netConn.Close()
+		return fmt.Errorf("server did not reply to close frame in %s", closeWait)
+	}
+}
+
+func (s *session) readLoop() {
+	defer close(s.done)
+
+	for {
+		mt, data, err := s.c.NextMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.readErr = err
+				s.printf("connection error: %v", err)
+			}
+			return
+		}
+
+		s.printf("< %s", formatMessage(mt, data))
+
+		received := s.received.Add(1)
+		if s.opts.exitAfter > 0 && received >= int64(s.opts.exitAfter) {
+			s.enoughOnce.Do(func() { close(s.enough) })
+		}
+	}
+}
+
+func (s *session) printf(format string, args ...any) {
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+
+	if !s.opts.noTimestamps {
+		fmt.Fprint(s.out, time.Now().Format(timestampFormat), " ")
+	}
+	fmt.Fprintf(s.out, format+"\n", args...)
+}
+
+func formatMessage(mt websocket.MessageType, data []byte) string {
+	if mt == websocket.TextMessage {
+		return fmt.Sprintf("text: %s", data)
+	}
+	return fmt.Sprintf("binary (%d bytes): %s", len(data), hex.EncodeToString(data))
+}
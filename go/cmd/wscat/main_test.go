@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+// Output buffer written by session and read by test
+type output struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.Write(p)
+}
+
+func (o *output) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.buf.String()
+}
+
+// Records everything server receives until connection is closed
+type recorder struct {
+	mu     sync.Mutex
+	events []string
+	done   chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{done: make(chan struct{})}
+}
+
+func (r *recorder) add(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) handle(c *websocket.Conn) {
+	defer close(r.done)
+	defer c.Close()
+
+	c.SetPingHandler(func(appData []byte) error {
+		r.add("ping %s", appData)
+		return nil
+	})
+	c.SetCloseHandler(func(code websocket.CloseCode, reason string) error {
+		r.add("close %d %s", code, reason)
+		return c.WriteClose(code, reason)
+	})
+	for {
+		mt, data, err := c.NextMessage()
+		if err != nil {
+			return
+		}
+		r.add("%s %s", mt, data)
+	}
+}
+
+// Events recorded once connection is closed
+func (r *recorder) wait(t *testing.T) []string {
+	t.Helper()
+
+	select {
+	case <-r.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server connection was not closed")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.events
+}
+
+func testOptions(srv *wstest.Server) options {
+	return options{
+		url:          srv.URL,
+		headers:      headersFlag{},
+		timeout:      5 * time.Second,
+		noTimestamps: true,
+	}
+}
+
+func TestHandleLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		// received by server, connection is closed normally at the end of input
+		want []string
+		// printed by wscat
+		output string
+	}{
+		{"text", []string{"hello"}, []string{"text hello", "close 1000 "}, "> text: hello"},
+		{"escaped slash", []string{"//text"}, []string{"text /text", "close 1000 "}, "> text: /text"},
+		{"ping", []string{"/ping p"}, []string{"ping p", "close 1000 "}, "> ping: p"},
+		{"close", []string{"/close", "unsent"}, []string{"close 1000 "}, "> close 1000: "},
+		{"close code and reason", []string{"/close 4000 going away"}, []string{"close 4000 going away"}, "> close 4000: going away"},
+		{"reserved close code", []string{"/close 1005", "after"}, []string{"text after", "close 1000 "}, `invalid close code "1005"`},
+		{"out of range close code", []string{"/close 70000"}, []string{"close 1000 "}, `invalid close code "70000"`},
+		{"not a close code", []string{"/close abc"}, []string{"close 1000 "}, `invalid close code "abc"`},
+		{"unknown command", []string{"/unknown"}, []string{"close 1000 "}, "unknown command /unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRecorder()
+			srv := wstest.NewServer(nil, r.handle)
+			defer srv.Close()
+
+			out := &output{}
+			in := strings.NewReader(strings.Join(tt.lines, "\n") + "\n")
+			if err := run(testOptions(srv), in, out); err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+
+			if got := r.wait(t); !slices.Equal(got, tt.want) {
+				t.Errorf("server received %q, want %q", got, tt.want)
+			}
+			if !strings.Contains(out.String(), tt.output) {
+				t.Errorf("output %q does not contain %q", out.String(), tt.output)
+			}
+		})
+	}
+}
+
+func TestScript(t *testing.T) {
+	// replies to every message with two messages
+	twice := func(c *websocket.Conn) {
+		defer c.Close()
+		for {
+			mt, data, err := c.NextMessage()
+			if err != nil {
+				return
+			}
+			for range 2 {
+				if err := c.WriteMessage(mt, data); err != nil {
+					return
+				}
+			}
+		}
+	}
+	silent := func(c *websocket.Conn) {
+		defer c.Close()
+		for {
+			if _, _, err := c.NextMessage(); err != nil {
+				return
+			}
+		}
+	}
+	closing := func(c *websocket.Conn) {
+		_, _, _ = c.NextMessage()
+		_ = c.WriteClose(websocket.CloseGoingAway, "")
+		_, _, _ = c.NextMessage()
+		_ = c.Close()
+	}
+
+	file := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(file, []byte{1, 2, 3}, 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		handler   func(c *websocket.Conn)
+		send      []outbound
+		exitAfter int
+		wait      time.Duration
+		// empty if run succeeds
+		err    string
+		output []string
+	}{
+		{
+			name:      "exit after",
+			handler:   twice,
+			send:      []outbound{{mt: websocket.TextMessage, data: "a"}, {mt: websocket.BinaryMessage, data: file, isFile: true}},
+			exitAfter: 4,
+			output:    []string{"> text: a", "> binary (3 bytes): 010203", "< text: a", "< binary (3 bytes): 010203"},
+		},
+		{
+			name:      "exit after within wait",
+			handler:   twice,
+			send:      []outbound{{mt: websocket.TextMessage, data: "a"}},
+			exitAfter: 2,
+			wait:      5 * time.Second,
+			output:    []string{"< text: a"},
+		},
+		{
+			name:      "exit after timed out",
+			handler:   silent,
+			send:      []outbound{{mt: websocket.TextMessage, data: "a"}},
+			exitAfter: 1,
+			wait:      100 * time.Millisecond,
+			err:       "timed out after receiving 0 of 1 messages",
+		},
+		{
+			name:      "exit after closed by server",
+			handler:   closing,
+			send:      []outbound{{mt: websocket.TextMessage, data: "a"}},
+			exitAfter: 1,
+			err:       "connection closed after 0 of 1 messages",
+		},
+		{
+			name:    "wait",
+			handler: twice,
+			send:    []outbound{{mt: websocket.TextMessage, data: "a"}},
+			wait:    100 * time.Millisecond,
+			output:  []string{"< text: a\n< text: a"},
+		},
+		{
+			name:    "missing file",
+			handler: silent,
+			send:    []outbound{{mt: websocket.BinaryMessage, data: filepath.Join(t.TempDir(), "missing"), isFile: true}},
+			err:     "no such file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := wstest.NewServer(nil, tt.handler)
+			defer srv.Close()
+
+			opts := testOptions(srv)
+			opts.send = tt.send
+			opts.exitAfter = tt.exitAfter
+			opts.wait = tt.wait
+
+			out := &output{}
+			start := time.Now()
+			err := run(opts, strings.NewReader(""), out)
+			if tt.err == "" && err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("run error %v, want %q", err, tt.err)
+			}
+			// waiting stops once enough messages are received
+			if tt.exitAfter > 0 && tt.err == "" && time.Since(start) > time.Second {
+				t.Errorf("run took %s", time.Since(start))
+			}
+
+			for _, line := range tt.output {
+				if !strings.Contains(out.String(), line+"\n") {
+					t.Errorf("output %q does not contain %q", out.String(), line)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+// Command wsreplay plays websocket frame capture back.
+//
+// In client mode it connects to server and replays client side capture:
+// outbound frames are sent, inbound frames are read and compared with recorded ones.
+// In server mode it accepts single connection and replays server side capture
+// the same way, acting as fake server.
+//
+//	wsreplay -capture client.wscap -mode client -url ws://localhost:9001
+//	wsreplay -capture server.wscap -mode server -addr :9001
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/capture"
+)
+
+var (
+	capturePath = flag.String("capture", "", "path to capture file")
+	mode        = flag.String("mode", "client", "client or server")
+	urlStr      = flag.String("url", "", "server url, client mode only")
+	addr        = flag.String("addr", ":9001", "listen address, server mode only")
+	timing      = flag.Bool("timing", false, "preserve recorded delays between outbound frames")
+	verbose     = flag.Bool("v", false, "log library internals")
+)
+
+func main() {
+	flag.Parse()
+
+	l := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	slog.SetDefault(l)
+
+	var internal *slog.Logger
+	if *verbose {
+		internal = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+
+	if *capturePath == "" {
+		fmt.Fprintln(os.Stderr, "-capture is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	frames, err := readCapture(*capturePath)
+	if err != nil {
+		slog.Error("Failed to read capture", "err", err)
+		os.Exit(1)
+	}
+
+	switch *mode {
+	case "client":
+		err = runClient(frames, internal)
+	case "server":
+		err = runServer(frames, internal)
+	default:
+		err = fmt.Errorf("unknown mode %q", *mode)
+	}
+	if err != nil {
+		slog.Error("Replay failed", "err", err)
+		os.Exit(1)
+	}
+
+	slog.Info("Replay finished")
+}
+
+func readCapture(path string) ([]*websocket.CapturedFrame, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := capture.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var frames []*websocket.CapturedFrame
+	for {
+		frame, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+func runClient(frames []*websocket.CapturedFrame, l *slog.Logger) error {
+	if *urlStr == "" {
+		return fmt.Errorf("-url is required in client mode")
+	}
+
+	d := websocket.Dialer{InternalLogger: l}
+	c, err := d.Dial(*urlStr, nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect: [%w]", err)
+	}
+
+	return replay(c, frames, *timing)
+}
+
+func runServer(frames []*websocket.CapturedFrame, l *slog.Logger) error {
+	u := websocket.Upgrader{InternalLogger: l}
+
+	result := make(chan error, 1)
+	server := &http.Server{
+		Addr: *addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			c, err := u.Upgrade(w, req)
+			if err != nil {
+				slog.Error("Opening connection failed", "err", err)
+				return
+			}
+			result <- replay(c, frames, *timing)
+		}),
+	}
+
+	go func() {
+		slog.Info("Waiting for connection", "addr", *addr)
+		err := server.ListenAndServe()
+		if !errors.Is(err, http.ErrServerClosed) {
+			result <- err
+		}
+	}()
+
+	err := <-result
+	_ = server.Close()
+	return err
+}
+
+// Sends outbound frames and compares inbound ones with recorded frames,
+// automatic pong and close replies are disabled as they are part of capture.
+// Received close frame ends replay, recorded reply to it is sent if there is one
+func replay(c *websocket.Conn, frames []*websocket.CapturedFrame, timing bool) error {
+	c.SetPingHandler(func([]byte) error { return nil })
+	c.SetCloseHandler(func(websocket.CloseCode, string) error { return nil })
+
+	defer c.Close()
+
+	differ := 0
+	sentClose := false
+	var prev time.Time
+	for i, f := range frames {
+		if f.Direction == websocket.DirectionOutbound {
+			if timing && !prev.IsZero() {
+				time.Sleep(f.Time.Sub(prev))
+			}
+			prev = f.Time
+
+			err := sendFrame(c, i, f)
+			if err != nil {
+				return err
+			}
+			sentClose = sentClose || f.Type == websocket.CloseMessage
+			continue
+		}
+
+		got, err := c.ReadFrame()
+		if err != nil {
+			return fmt.Errorf("failed to read frame %d: [%w]", i, err)
+		}
+
+		if got.Type != f.Type || got.IsFinal != f.IsFinal || !bytes.Equal(got.Payload, f.Payload) {
+			slog.Warn("Received frame differs from capture", "n", i,
+				"type", got.Type, "expectedType", f.Type,
+				"fin", got.IsFinal, "expectedFin", f.IsFinal,
+				"len", len(got.Payload), "expectedLen", len(f.Payload))
+			differ++
+		} else {
+			slog.Info("Received expected frame", "n", i, "type", got.Type, "fin", got.IsFinal, "len", len(got.Payload))
+		}
+
+		if got.Type == websocket.CloseMessage {
+			if f.Type != websocket.CloseMessage {
+				slog.Warn("Connection was closed before end of capture", "n", i)
+			}
+			if !sentClose {
+				err := replyClose(c, frames, i+1, got)
+				if err != nil {
+					return err
+				}
+			}
+			break
+		}
+	}
+
+	if differ > 0 {
+		return fmt.Errorf("%d received frames differ from capture", differ)
+	}
+	return nil
+}
+
+func sendFrame(c *websocket.Conn, i int, f *websocket.CapturedFrame) error {
+	slog.Info("Sending frame", "n", i, "type", f.Type, "fin", f.IsFinal, "len", len(f.Payload))
+	var err error
+	if f.Type == websocket.CloseMessage {
+		// frame API is closed once close frame is received
+		err = c.WriteControl(f.Type, f.Payload)
+	} else {
+		err = c.WriteFrame(f.IsFinal, f.Type, f.Payload)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send frame %d: [%w]", i, err)
+	}
+	return nil
+}
+
+// Sends recorded close frame which follows received one, received close is
+// echoed if capture has none, e.g. because connection was closed earlier
+func replyClose(c *websocket.Conn, frames []*websocket.CapturedFrame, from int, received *websocket.Frame) error {
+	for i := from; i < len(frames); i++ {
+		f := frames[i]
+		if f.Direction == websocket.DirectionOutbound && f.Type == websocket.CloseMessage {
+			return sendFrame(c, i, f)
+		}
+	}
+
+	err := c.WriteControl(websocket.CloseMessage, received.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to reply to close frame: [%w]", err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/capture"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+// Echoes messages, connection is closed by server once "bye" is received
+func echoUntilBye(c *websocket.Conn) {
+	defer c.Close()
+	for {
+		mt, data, err := c.NextMessage()
+		if err != nil {
+			return
+		}
+		if string(data) == "bye" {
+			return
+		}
+		if err := c.WriteMessage(mt, data); err != nil {
+			return
+		}
+	}
+}
+
+func TestReplayCapture(t *testing.T) {
+	tests := []struct {
+		name string
+		// session recorded by client
+		session func(c *websocket.Conn)
+	}{
+		{"closed by client", func(c *websocket.Conn) {
+			_ = c.WriteMessage(websocket.TextMessage, []byte("hello"))
+			_, _, _ = c.NextMessage()
+			_ = c.WriteMessage(websocket.BinaryMessage, []byte{1, 2, 3})
+			_, _, _ = c.NextMessage()
+			_ = c.Close()
+		}},
+		{"closed by server", func(c *websocket.Conn) {
+			_ = c.WriteMessage(websocket.TextMessage, []byte("hello"))
+			_, _, _ = c.NextMessage()
+			_ = c.WriteMessage(websocket.TextMessage, []byte("bye"))
+			// close frame is echoed while reading
+			_, _, _ = c.NextMessage()
+		}},
+	}
+
+	srv := wstest.NewServer(nil, echoUntilBye)
+	defer srv.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := srv.Dial("/")
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+
+			buf := &bytes.Buffer{}
+			w, err := capture.NewWriter(buf)
+			if err != nil {
+				t.Fatalf("failed to create capture writer: %v", err)
+			}
+			c.SetCapture(w)
+			tt.session(c)
+			if err := w.Flush(); err != nil {
+				t.Fatalf("failed to flush capture: %v", err)
+			}
+
+			path := filepath.Join(t.TempDir(), "session.wscap")
+			if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+				t.Fatalf("failed to write capture: %v", err)
+			}
+			frames, err := readCapture(path)
+			if err != nil {
+				t.Fatalf("failed to read capture: %v", err)
+			}
+			if last := frames[len(frames)-1]; last.Type != websocket.CloseMessage {
+				t.Fatalf("last captured frame is %s, want close", last.Type)
+			}
+
+			c, err = srv.Dial("/")
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			if err := replay(c, frames, false); err != nil {
+				t.Fatalf("replay failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestReplayDiffers(t *testing.T) {
+	srv := wstest.NewServer(nil, echoUntilBye)
+	defer srv.Close()
+
+	frames := []*websocket.CapturedFrame{
+		{Direction: websocket.DirectionOutbound, IsFinal: true, Type: websocket.TextMessage, Payload: []byte("hello")},
+		{Direction: websocket.DirectionInbound, IsFinal: true, Type: websocket.TextMessage, Payload: []byte("other")},
+		{Direction: websocket.DirectionOutbound, IsFinal: true, Type: websocket.CloseMessage},
+		{Direction: websocket.DirectionInbound, IsFinal: true, Type: websocket.CloseMessage},
+	}
+
+	c, err := srv.Dial("/")
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	if err := replay(c, frames, false); err == nil {
+		t.Fatal("replay of differing session succeeded")
+	}
+}
@@ -0,0 +1,239 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"sync"
+)
+
+const (
+	defaultCompressionWindow = 16
+)
+
+// Decides which written messages are compressed by negotiated compression
+// extension, e.g. PerMessageDeflate. Extensions implementing CompressionExtension
+// are not applied to messages left uncompressed, other extensions are always
+// applied. Zero value compresses every message
+type CompressionPolicy struct {
+	// Messages shorter than that are sent uncompressed. Up to MinSize bytes are
+	// buffered before decision is made, so message flushed before that is sent uncompressed
+	MinSize int
+	// Message types which are never compressed, e.g. BinaryMessage with already compressed data
+	SkipTypes []MessageType
+	// Compression is paused for Window messages once compressed messages of
+	// last Window took more than MaxRatio of their size, e.g. 0.9.
+	// 0 disables pausing
+	MaxRatio float64
+	// Amount of messages ratio is measured over and compression is paused for, 16 if 0
+	Window int
+}
+
+// Written messages stats of compression extension
+type CompressionStats struct {
+	Compressed int
+	// Messages left uncompressed by policy
+	Uncompressed int
+	// Messages left uncompressed because compression was paused due to poor ratio
+	Paused int
+	// Size of compressed messages before and after compression
+	BytesIn, BytesOut int64
+}
+
+// Bytes not sent thanks to compression, negative if compression made messages larger
+func (s CompressionStats) Saved() int64 {
+	return s.BytesIn - s.BytesOut
+}
+
+type compression struct {
+	mu     sync.Mutex
+	policy *CompressionPolicy
+	stats  CompressionStats
+
+	// compressed messages of current window
+	windowIn, windowOut int64
+	windowMessages      int
+	// messages left to send uncompressed
+	paused int
+}
+
+// Sets policy of message compression, nil compresses every message.
+// Has no effect if no compression extension was negotiated.
+// Applies to writers created after the call
+func (c *Conn) SetCompressionPolicy(p *CompressionPolicy) {
+	c.compression.mu.Lock()
+	defer c.compression.mu.Unlock()
+
+	c.compression.policy = p
+	c.compression.windowIn, c.compression.windowOut, c.compression.windowMessages = 0, 0, 0
+	c.compression.paused = 0
+}
+
+func (c *Conn) CompressionStats() CompressionStats {
+	c.compression.mu.Lock()
+	defer c.compression.mu.Unlock()
+	return c.compression.stats
+}
+
+// Returns if message can be compressed and min size it must have for that
+func (cp *compression) allow(mt MessageType) (bool, int) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	p := cp.policy
+	if p == nil {
+		return true, 0
+	}
+
+	if slices.Contains(p.SkipTypes, mt) {
+		cp.stats.Uncompressed++
+		return false, 0
+	}
+	if cp.paused > 0 {
+		cp.paused--
+		cp.stats.Paused++
+		return false, 0
+	}
+
+	return true, p.MinSize
+}
+
+// Records written message, in is its size, out is size after compression
+func (cp *compression) record(compressed bool, in, out int) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if !compressed {
+		cp.stats.Uncompressed++
+		return
+	}
+
+	cp.stats.Compressed++
+	cp.stats.BytesIn += int64(in)
+	cp.stats.BytesOut += int64(out)
+
+	p := cp.policy
+	if p == nil || p.MaxRatio == 0 {
+		return
+	}
+
+	window := p.Window
+	if window == 0 {
+		window = defaultCompressionWindow
+	}
+
+	cp.windowIn += int64(in)
+	cp.windowOut += int64(out)
+	cp.windowMessages++
+	if cp.windowMessages < window {
+		return
+	}
+
+	if cp.windowIn > 0 && float64(cp.windowOut)/float64(cp.windowIn) > p.MaxRatio {
+		cp.paused = window
+	}
+	cp.windowIn, cp.windowOut, cp.windowMessages = 0, 0, 0
+}
+
+// Outermost writer of message when compression extension is negotiated,
+// buffers data until it is known if message should be compressed
+type compressionWriter struct {
+	w  *messageWriter
+	mt MessageType
+
+	minSize int
+	buf     []byte
+
+	// extensions chain, nil until decision is made
+	out        io.WriteCloser
+	compressed bool
+	// message skipped by type or pause is counted in advance
+	counted bool
+
+	// bytes written before compression
+	n int
+}
+
+func (c *Conn) newCompressionWriter(w *messageWriter) io.WriteCloser {
+	cw := &compressionWriter{w: w, mt: w.messageType}
+
+	allowed, minSize := c.compression.allow(w.messageType)
+	if !allowed {
+		cw.counted = true
+		_ = cw.decide(false)
+		return cw
+	}
+	if minSize == 0 {
+		_ = cw.decide(true)
+		return cw
+	}
+
+	cw.minSize = minSize
+	return cw
+}
+
+func (w *compressionWriter) decide(compress bool) error {
+	w.compressed = compress
+	w.out = w.w.c.wrapWriter(w.mt, &w.w.rsv, w.w, !compress)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) > 0 {
+		_, err := w.out.Write(buf)
+		return err
+	}
+	return nil
+}
+
+func (w *compressionWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+
+	if w.out != nil {
+		return w.out.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minSize {
+		err := w.decide(true)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *compressionWriter) Flush() error {
+	if w.out == nil {
+		err := w.decide(false)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, ok := w.out.(Flusher)
+	if !ok {
+		return errors.New("message writer can't be flushed")
+	}
+	return f.Flush()
+}
+
+func (w *compressionWriter) Close() error {
+	if w.out == nil {
+		err := w.decide(false)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := w.out.Close()
+	if err != nil {
+		return err
+	}
+
+	if !w.counted {
+		w.w.c.compression.record(w.compressed, w.n, w.w.bytes)
+	}
+
+	return nil
+}
@@ -0,0 +1,335 @@
+package websocket_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+func deflatePipe(t *testing.T, d, u websocket.PerMessageDeflate, policy *websocket.CompressionPolicy) (client, server *websocket.Conn) {
+	t.Helper()
+
+	client, server, err := wstest.NewPipeWith(
+		&websocket.Dialer{Extensions: []websocket.Extension{d}, CompressionPolicy: policy},
+		&websocket.Upgrader{Extensions: []websocket.Extension{u}},
+	)
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	go wstest.Echo(server)
+
+	return client, server
+}
+
+func roundTrip(t *testing.T, c *websocket.Conn, mt websocket.MessageType, data []byte) {
+	t.Helper()
+
+	if err := c.WriteMessage(mt, data); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	gotType, got, err := c.NextMessage()
+	if err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if gotType != mt || !bytes.Equal(got, data) {
+		t.Fatalf("echo = %s of %d bytes, want %s of %d bytes", gotType, len(got), mt, len(data))
+	}
+}
+
+func TestPerMessageDeflate(t *testing.T) {
+	tests := []struct {
+		name   string
+		client websocket.PerMessageDeflate
+		server websocket.PerMessageDeflate
+		header string
+	}{
+		{"context takeover", websocket.PerMessageDeflate{}, websocket.PerMessageDeflate{}, "permessage-deflate"},
+		{
+			"client no context takeover",
+			websocket.PerMessageDeflate{NoContextTakeover: true, Level: flate.BestSpeed},
+			websocket.PerMessageDeflate{},
+			"permessage-deflate; client_no_context_takeover",
+		},
+		{
+			"server no context takeover",
+			websocket.PerMessageDeflate{},
+			websocket.PerMessageDeflate{NoContextTakeover: true},
+			"permessage-deflate; server_no_context_takeover",
+		},
+		{
+			"both requested by client",
+			websocket.PerMessageDeflate{NoContextTakeover: true, PeerNoContextTakeover: true},
+			websocket.PerMessageDeflate{},
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+		},
+	}
+
+	large := make([]byte, 200_000)
+	rand.New(rand.NewSource(1)).Read(large)
+	text := []byte(strings.Repeat("hello, compressed world! ", 400))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := deflatePipe(t, tt.client, tt.server, nil)
+
+			exts := client.Extensions()
+			if len(exts) != 1 || exts[0].String() != tt.header {
+				t.Fatalf("extensions = %v, want %q", exts, tt.header)
+			}
+
+			rec := &frameRecorder{}
+			client.SetCapture(rec)
+
+			for range 3 {
+				roundTrip(t, client, websocket.TextMessage, text)
+			}
+			roundTrip(t, client, websocket.BinaryMessage, []byte{})
+			roundTrip(t, client, websocket.BinaryMessage, large)
+			roundTrip(t, client, websocket.TextMessage, text)
+
+			// fragmented message
+			w, err := client.NextWriter(websocket.TextMessage)
+			if err != nil {
+				t.Fatalf("failed to get writer: %v", err)
+			}
+			_, _ = w.Write(text[:100])
+			if err := w.(websocket.Flusher).Flush(); err != nil {
+				t.Fatalf("failed to flush: %v", err)
+			}
+			_, _ = w.Write(text[100:])
+			if err := w.Close(); err != nil {
+				t.Fatalf("failed to close writer: %v", err)
+			}
+			_, got, err := client.NextMessage()
+			if err != nil || !bytes.Equal(got, text) {
+				t.Fatalf("fragmented echo = %d bytes %v, want %d bytes", len(got), err, len(text))
+			}
+
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+
+			first := rec.frames[0]
+			if !first.RSV1 || len(first.Payload) >= len(text)/10 {
+				t.Fatalf("first frame RSV1 = %v, payload of %d bytes, want compressed", first.RSV1, len(first.Payload))
+			}
+			// first message has no history, so plain flate can read it
+			fr := flate.NewReader(io.MultiReader(bytes.NewReader(first.Payload),
+				bytes.NewReader([]byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff})))
+			decompressed, err := io.ReadAll(fr)
+			if err != nil || !bytes.Equal(decompressed, text) {
+				t.Fatalf("first frame decompressed to %d bytes %v, want %d bytes", len(decompressed), err, len(text))
+			}
+
+			stats := client.CompressionStats()
+			if stats.Compressed != 7 || stats.Saved() <= 0 {
+				t.Errorf("stats = %+v, want 7 compressed messages with saved bytes", stats)
+			}
+		})
+	}
+}
+
+func TestPerMessageDeflateDeclined(t *testing.T) {
+	u := &websocket.Upgrader{Extensions: []websocket.Extension{websocket.PerMessageDeflate{}}}
+	d := &websocket.Dialer{Extensions: []websocket.Extension{limitedWindowDeflate{}}}
+
+	client, server, err := wstest.NewPipeWith(d, u)
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	defer client.Close()
+	go wstest.Echo(server)
+
+	if exts := client.Extensions(); len(exts) != 0 {
+		t.Fatalf("extensions = %v, want none", exts)
+	}
+	roundTrip(t, client, websocket.TextMessage, []byte("plain"))
+}
+
+// Asks server to use smaller window which compress/flate doesn't support
+type limitedWindowDeflate struct {
+	websocket.PerMessageDeflate
+}
+
+func (limitedWindowDeflate) Offer() websocket.ExtensionOffer {
+	return websocket.ExtensionOffer{
+		Name:   "permessage-deflate",
+		Params: []websocket.ExtensionParam{{Name: "server_max_window_bits", Value: "10"}},
+	}
+}
+
+func TestCompressionPolicy(t *testing.T) {
+	text := []byte(strings.Repeat("compressible ", 100))
+	rnd := rand.New(rand.NewSource(1))
+
+	t.Run("min size and types", func(t *testing.T) {
+		client, _ := deflatePipe(t, websocket.PerMessageDeflate{}, websocket.PerMessageDeflate{},
+			&websocket.CompressionPolicy{MinSize: 64, SkipTypes: []websocket.MessageType{websocket.BinaryMessage}})
+
+		rec := &frameRecorder{}
+		client.SetCapture(rec)
+
+		roundTrip(t, client, websocket.TextMessage, []byte("short"))
+		roundTrip(t, client, websocket.TextMessage, text)
+		roundTrip(t, client, websocket.BinaryMessage, text)
+		// written in parts smaller than threshold
+		w, err := client.NextWriter(websocket.TextMessage)
+		if err != nil {
+			t.Fatalf("failed to get writer: %v", err)
+		}
+		for i := 0; i < len(text); i += 10 {
+			_, _ = w.Write(text[i:min(i+10, len(text))])
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("failed to close writer: %v", err)
+		}
+		if _, _, err := client.NextMessage(); err != nil {
+			t.Fatalf("failed to read echo: %v", err)
+		}
+
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		want := []bool{false, true, false, true}
+		for i, f := range rec.frames {
+			if f.RSV1 != want[i] {
+				t.Errorf("message %d RSV1 = %v, want %v", i, f.RSV1, want[i])
+			}
+		}
+
+		stats := client.CompressionStats()
+		if stats.Compressed != 2 || stats.Uncompressed != 2 {
+			t.Errorf("stats = %+v, want 2 compressed and 2 uncompressed", stats)
+		}
+		if stats.BytesIn != int64(2*len(text)) || stats.Saved() <= 0 {
+			t.Errorf("stats = %+v, want %d bytes in with saved bytes", stats, 2*len(text))
+		}
+	})
+
+	t.Run("adaptive", func(t *testing.T) {
+		client, _ := deflatePipe(t, websocket.PerMessageDeflate{}, websocket.PerMessageDeflate{},
+			&websocket.CompressionPolicy{MaxRatio: 0.9, Window: 4})
+
+		rec := &frameRecorder{}
+		client.SetCapture(rec)
+
+		// random data is not compressible, compression is paused for next 4 messages.
+		// Every message is different, otherwise it would match previous ones
+		for range 4 {
+			random := make([]byte, 1000)
+			rnd.Read(random)
+			roundTrip(t, client, websocket.BinaryMessage, random)
+		}
+		for range 4 {
+			roundTrip(t, client, websocket.TextMessage, text)
+		}
+		// retried after pause
+		roundTrip(t, client, websocket.TextMessage, text)
+
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		for i, f := range rec.frames {
+			want := i < 4 || i == 8
+			if f.RSV1 != want {
+				t.Errorf("message %d RSV1 = %v, want %v", i, f.RSV1, want)
+			}
+		}
+
+		stats := client.CompressionStats()
+		if stats.Compressed != 5 || stats.Paused != 4 {
+			t.Errorf("stats = %+v, want 5 compressed and 4 paused", stats)
+		}
+	})
+}
+
+func TestCompressionPolicyKeepsOtherExtensions(t *testing.T) {
+	policy := &websocket.CompressionPolicy{MinSize: 1000, SkipTypes: []websocket.MessageType{websocket.BinaryMessage}}
+	d := &websocket.Dialer{Extensions: []websocket.Extension{xorExtension{0x5a}}, CompressionPolicy: policy}
+	u := &websocket.Upgrader{Extensions: []websocket.Extension{xorExtension{}}}
+
+	client, server, err := wstest.NewPipeWith(d, u)
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	defer client.Close()
+	go wstest.Echo(server)
+
+	rec := &frameRecorder{}
+	client.SetCapture(rec)
+
+	roundTrip(t, client, websocket.BinaryMessage, []byte{1, 2, 3})
+	roundTrip(t, client, websocket.TextMessage, []byte("short"))
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	want := [][]byte{xor([]byte{1, 2, 3}, 0x5a), xor([]byte("short"), 0x5a)}
+	for i, f := range rec.frames {
+		if !f.RSV1 || !bytes.Equal(f.Payload, want[i]) {
+			t.Errorf("frame %d RSV1 = %v, payload %v, want extension applied", i, f.RSV1, f.Payload)
+		}
+	}
+}
+
+func TestReadLimitDecompressed(t *testing.T) {
+	deflate := []websocket.Extension{websocket.PerMessageDeflate{}}
+	u := &websocket.Upgrader{Extensions: deflate, ReadLimit: 1 << 20}
+
+	serverErr := make(chan error, 1)
+	srv := wstest.NewServer(u, func(c *websocket.Conn) {
+		_, _, err := c.NextMessage()
+		serverErr <- err
+	})
+	defer srv.Close()
+
+	client, err := (&websocket.Dialer{Extensions: deflate}).Dial(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	// 10MB of zeros are compressed to few KB, server may close
+	// connection before whole message is written
+	_ = client.WriteMessage(websocket.BinaryMessage, make([]byte, 10<<20))
+
+	if err := <-serverErr; !errors.Is(err, websocket.ErrReadLimitExceeded) {
+		t.Errorf("server error = %v, want %v", err, websocket.ErrReadLimitExceeded)
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	server, raw, err := wstest.NewRawClient(&websocket.Upgrader{ReadLimit: 10})
+	if err != nil {
+		t.Fatalf("failed to create raw client: %v", err)
+	}
+	defer raw.Close()
+
+	writeFrames(t, raw,
+		raw.Frame(websocket.TextMessage, true, []byte("0123456789")),
+		raw.Frame(websocket.TextMessage, false, []byte("01234")),
+		raw.Frame(websocket.ContinuationFrame, true, []byte("567890")),
+	)
+
+	if _, data, err := server.NextMessage(); err != nil || string(data) != "0123456789" {
+		t.Fatalf("got %q %v, want message of limit size", data, err)
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := server.NextMessage()
+		readErr <- err
+	}()
+
+	code, _, err := raw.ReadClose()
+	if err != nil || code != websocket.CloseMessageTooBig {
+		t.Fatalf("close code = %d %v, want %d", code, err, websocket.CloseMessageTooBig)
+	}
+	if err := <-readErr; !errors.Is(err, websocket.ErrReadLimitExceeded) {
+		t.Errorf("read error = %v, want %v", err, websocket.ErrReadLimitExceeded)
+	}
+}
@@ -0,0 +1,685 @@
+package websocket_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+// RFC 6455 conformance tests covering behaviours checked by Autobahn test suite.
+// Every case is run against server and client Conn, raw peer sends frames
+// and Conn echoes received messages back until it closes the connection
+
+const conformanceTimeout = 10 * time.Second
+
+type conformanceSide struct {
+	name    string
+	connect func() (*websocket.Conn, *wstest.RawConn, error)
+}
+
+var conformanceSides = []conformanceSide{
+	{"server", func() (*websocket.Conn, *wstest.RawConn, error) { return wstest.NewRawClient(nil) }},
+	{"client", func() (*websocket.Conn, *wstest.RawConn, error) { return wstest.NewRawServer(nil) }},
+}
+
+// Builds frame for raw peer, so it is masked according to peer side
+type frameFn func(r *wstest.RawConn) *wstest.RawFrame
+
+// Message or control frame received by raw peer
+type received struct {
+	Type    websocket.MessageType
+	Payload []byte
+}
+
+type conformanceCase struct {
+	name   string
+	frames []frameFn
+	// messages and control frames Conn must send before close frame
+	want []received
+	// code of close frame Conn must send
+	code websocket.CloseCode
+}
+
+func frame(mt websocket.MessageType, isFinal bool, payload string) frameFn {
+	return func(r *wstest.RawConn) *wstest.RawFrame {
+		return r.Frame(mt, isFinal, []byte(payload))
+	}
+}
+
+func text(payload string) frameFn {
+	return frame(websocket.TextMessage, true, payload)
+}
+
+func binaryFrame(payload []byte) frameFn {
+	return frame(websocket.BinaryMessage, true, string(payload))
+}
+
+func closeFrame(code websocket.CloseCode, reason string) frameFn {
+	return frame(websocket.CloseMessage, true, string(wstest.ClosePayload(code, reason)))
+}
+
+var normalClose = closeFrame(websocket.CloseNormalClosure, "")
+
+// Changes frame built by f
+func with(f frameFn, change func(f *wstest.RawFrame)) frameFn {
+	return func(r *wstest.RawConn) *wstest.RawFrame {
+		frame := f(r)
+		change(frame)
+		return frame
+	}
+}
+
+func frames(fs ...frameFn) []frameFn {
+	return fs
+}
+
+func msg(mt websocket.MessageType, payload string) received {
+	return received{mt, []byte(payload)}
+}
+
+// Splits payload into fragments of given size
+func fragments(mt websocket.MessageType, payload string, size int) []frameFn {
+	var fs []frameFn
+	for first := true; first || len(payload) > 0; first = false {
+		n := min(size, len(payload))
+		opcode := websocket.ContinuationFrame
+		if first {
+			opcode = mt
+		}
+		fs = append(fs, frame(opcode, n == len(payload), payload[:n]))
+		payload = payload[n:]
+	}
+	return fs
+}
+
+func runConformance(t *testing.T, cases []conformanceCase) {
+	t.Helper()
+
+	for _, side := range conformanceSides {
+		t.Run(side.name, func(t *testing.T) {
+			for _, tc := range cases {
+				t.Run(tc.name, func(t *testing.T) {
+					t.Parallel()
+					runConformanceCase(t, side, tc)
+				})
+			}
+		})
+	}
+}
+
+func runConformanceCase(t *testing.T, side conformanceSide, tc conformanceCase) {
+	conn, raw, err := side.connect()
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer raw.Close()
+
+	_ = raw.SetDeadline(time.Now().Add(conformanceTimeout))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wstest.Echo(conn)
+	}()
+
+	go func() {
+		for _, f := range tc.frames {
+			err := raw.WriteFrame(f(raw))
+			if err != nil {
+				// connection was closed by Conn
+				return
+			}
+		}
+	}()
+
+	got, code, err := readUntilClose(raw)
+	if err != nil {
+		t.Fatalf("failed to read close frame, received %s before: %v", describe(got), err)
+	}
+
+	if !equalReceived(got, tc.want) {
+		t.Errorf("received %s, expected %s", describe(got), describe(tc.want))
+	}
+	if code != tc.code {
+		t.Errorf("received close code %d, expected %d", code, tc.code)
+	}
+
+	err = raw.ExpectEOF()
+	if err != nil {
+		t.Errorf("connection must be closed after close frame: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(conformanceTimeout):
+		t.Errorf("Conn did not return from reading")
+	}
+}
+
+// Reads messages and control frames until close frame, returns its code
+func readUntilClose(raw *wstest.RawConn) ([]received, websocket.CloseCode, error) {
+	var got []received
+	var cur *received
+
+	for {
+		f, err := raw.ReadFrame()
+		if err != nil {
+			return got, 0, err
+		}
+		if f.RSV1 || f.RSV2 || f.RSV3 {
+			return got, 0, fmt.Errorf("received frame with RSV bits set")
+		}
+
+		switch f.Opcode {
+		case websocket.CloseMessage:
+			if len(f.Payload) < 2 {
+				return got, websocket.CloseNoStatusReceived, nil
+			}
+			return got, websocket.CloseCode(binary.BigEndian.Uint16(f.Payload)), nil
+		case websocket.PingMessage, websocket.PongMessage:
+			got = append(got, received{f.Opcode, f.Payload})
+			continue
+		case websocket.ContinuationFrame:
+			if cur == nil {
+				return got, 0, fmt.Errorf("received continuation frame without message to continue")
+			}
+			cur.Payload = append(cur.Payload, f.Payload...)
+		default:
+			if cur != nil {
+				return got, 0, fmt.Errorf("received new message before previous one was finished")
+			}
+			cur = &received{f.Opcode, f.Payload}
+		}
+
+		if f.IsFinal {
+			got = append(got, *cur)
+			cur = nil
+		}
+	}
+}
+
+func equalReceived(a, b []received) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type != b[i].Type || !bytes.Equal(a[i].Payload, b[i].Payload) {
+			return false
+		}
+	}
+	return true
+}
+
+func describe(rs []received) string {
+	parts := make([]string, 0, len(rs))
+	for _, r := range rs {
+		if len(r.Payload) > 32 {
+			parts = append(parts, fmt.Sprintf("%s(%d bytes)", r.Type, len(r.Payload)))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s(%q)", r.Type, r.Payload))
+		}
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+func TestConformanceFraming(t *testing.T) {
+	large := bytes.Repeat([]byte{0xAB}, 1<<20)
+
+	runConformance(t, []conformanceCase{
+		{
+			name:   "empty text",
+			frames: frames(text(""), normalClose),
+			want:   []received{msg(websocket.TextMessage, "")},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "text 125 bytes",
+			frames: frames(text(strings.Repeat("*", 125)), normalClose),
+			want:   []received{msg(websocket.TextMessage, strings.Repeat("*", 125))},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "text 126 bytes",
+			frames: frames(text(strings.Repeat("*", 126)), normalClose),
+			want:   []received{msg(websocket.TextMessage, strings.Repeat("*", 126))},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "text 65535 bytes",
+			frames: frames(text(strings.Repeat("*", 65535)), normalClose),
+			want:   []received{msg(websocket.TextMessage, strings.Repeat("*", 65535))},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "text 65536 bytes",
+			frames: frames(text(strings.Repeat("*", 65536)), normalClose),
+			want:   []received{msg(websocket.TextMessage, strings.Repeat("*", 65536))},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "empty binary",
+			frames: frames(binaryFrame(nil), normalClose),
+			want:   []received{msg(websocket.BinaryMessage, "")},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "binary 1MiB",
+			frames: frames(binaryFrame(large), normalClose),
+			want:   []received{{websocket.BinaryMessage, large}},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name: "several messages",
+			frames: frames(text("one"), binaryFrame([]byte{1, 2, 3}), text("three"),
+				normalClose),
+			want: []received{
+				msg(websocket.TextMessage, "one"),
+				{websocket.BinaryMessage, []byte{1, 2, 3}},
+				msg(websocket.TextMessage, "three"),
+			},
+			code: websocket.CloseNormalClosure,
+		},
+	})
+}
+
+func TestConformanceFragmentation(t *testing.T) {
+	large := strings.Repeat("fragment", 1<<19)
+
+	runConformance(t, []conformanceCase{
+		{
+			name: "text in 3 fragments",
+			frames: frames(
+				frame(websocket.TextMessage, false, "frag1"),
+				frame(websocket.ContinuationFrame, false, "frag2"),
+				frame(websocket.ContinuationFrame, true, "frag3"),
+				normalClose),
+			want: []received{msg(websocket.TextMessage, "frag1frag2frag3")},
+			code: websocket.CloseNormalClosure,
+		},
+		{
+			name: "binary of empty fragments",
+			frames: frames(
+				frame(websocket.BinaryMessage, false, ""),
+				frame(websocket.ContinuationFrame, false, ""),
+				frame(websocket.ContinuationFrame, true, ""),
+				normalClose),
+			want: []received{msg(websocket.BinaryMessage, "")},
+			code: websocket.CloseNormalClosure,
+		},
+		{
+			name:   "binary 4MiB in 64KiB fragments",
+			frames: append(fragments(websocket.BinaryMessage, large, 1<<16), normalClose),
+			want:   []received{msg(websocket.BinaryMessage, large)},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "text in 1 byte fragments",
+			frames: append(fragments(websocket.TextMessage, "Hello, World!", 1), normalClose),
+			want:   []received{msg(websocket.TextMessage, "Hello, World!")},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name: "two fragmented messages",
+			frames: frames(
+				frame(websocket.TextMessage, false, "a"),
+				frame(websocket.ContinuationFrame, true, "b"),
+				frame(websocket.BinaryMessage, false, "c"),
+				frame(websocket.ContinuationFrame, true, "d"),
+				normalClose),
+			want: []received{
+				msg(websocket.TextMessage, "ab"),
+				msg(websocket.BinaryMessage, "cd"),
+			},
+			code: websocket.CloseNormalClosure,
+		},
+		{
+			name:   "continuation without message",
+			frames: frames(frame(websocket.ContinuationFrame, true, "cont"), normalClose),
+			code:   websocket.CloseProtocolError,
+		},
+		{
+			name: "continuation after final frame",
+			frames: frames(
+				text("final"),
+				frame(websocket.ContinuationFrame, true, "cont"),
+				normalClose),
+			want: []received{msg(websocket.TextMessage, "final")},
+			code: websocket.CloseProtocolError,
+		},
+		{
+			name: "new message in the middle of fragmented one",
+			frames: frames(
+				frame(websocket.TextMessage, false, "first"),
+				frame(websocket.TextMessage, true, "second"),
+				normalClose),
+			code: websocket.CloseProtocolError,
+		},
+		{
+			name: "close in the middle of fragmented message",
+			frames: frames(
+				frame(websocket.TextMessage, false, "first"),
+				normalClose),
+			code: websocket.CloseNormalClosure,
+		},
+	})
+}
+
+func TestConformanceControlFrames(t *testing.T) {
+	pings := make([]frameFn, 0, 11)
+	pongs := make([]received, 0, 10)
+	for i := range 10 {
+		payload := fmt.Sprintf("ping %d", i)
+		pings = append(pings, frame(websocket.PingMessage, true, payload))
+		pongs = append(pongs, msg(websocket.PongMessage, payload))
+	}
+	pings = append(pings, normalClose)
+
+	runConformance(t, []conformanceCase{
+		{
+			name:   "empty ping",
+			frames: frames(frame(websocket.PingMessage, true, ""), normalClose),
+			want:   []received{msg(websocket.PongMessage, "")},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "ping 125 bytes",
+			frames: frames(frame(websocket.PingMessage, true, strings.Repeat("p", 125)), normalClose),
+			want:   []received{msg(websocket.PongMessage, strings.Repeat("p", 125))},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "ping 126 bytes",
+			frames: frames(frame(websocket.PingMessage, true, strings.Repeat("p", 126)), normalClose),
+			code:   websocket.CloseProtocolError,
+		},
+		{
+			name:   "fragmented ping",
+			frames: frames(frame(websocket.PingMessage, false, "ping"), normalClose),
+			code:   websocket.CloseProtocolError,
+		},
+		{
+			name:   "10 pings",
+			frames: pings,
+			want:   pongs,
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "unsolicited pong",
+			frames: frames(frame(websocket.PongMessage, true, "pong"), text("text"), normalClose),
+			want:   []received{msg(websocket.TextMessage, "text")},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name: "ping between fragments",
+			frames: frames(
+				frame(websocket.TextMessage, false, "Hello, "),
+				frame(websocket.PingMessage, true, "ping"),
+				frame(websocket.ContinuationFrame, true, "World!"),
+				normalClose),
+			want: []received{
+				msg(websocket.PongMessage, "ping"),
+				msg(websocket.TextMessage, "Hello, World!"),
+			},
+			code: websocket.CloseNormalClosure,
+		},
+		{
+			name: "pong between fragments",
+			frames: frames(
+				frame(websocket.BinaryMessage, false, "frag1"),
+				frame(websocket.PongMessage, true, "pong"),
+				frame(websocket.ContinuationFrame, false, "frag2"),
+				frame(websocket.PongMessage, true, "pong"),
+				frame(websocket.ContinuationFrame, true, "frag3"),
+				normalClose),
+			want: []received{msg(websocket.BinaryMessage, "frag1frag2frag3")},
+			code: websocket.CloseNormalClosure,
+		},
+	})
+}
+
+func TestConformanceReserved(t *testing.T) {
+	cases := []conformanceCase{
+		{
+			name:   "RSV1",
+			frames: frames(with(text("rsv"), func(f *wstest.RawFrame) { f.RSV1 = true }), normalClose),
+			code:   websocket.CloseProtocolError,
+		},
+		{
+			name:   "RSV2",
+			frames: frames(with(text("rsv"), func(f *wstest.RawFrame) { f.RSV2 = true }), normalClose),
+			code:   websocket.CloseProtocolError,
+		},
+		{
+			name: "RSV3 on ping",
+			frames: frames(
+				with(frame(websocket.PingMessage, true, "rsv"), func(f *wstest.RawFrame) { f.RSV3 = true }),
+				normalClose),
+			code: websocket.CloseProtocolError,
+		},
+		{
+			name: "RSV after valid message",
+			frames: frames(
+				text("valid"),
+				with(text("rsv"), func(f *wstest.RawFrame) { f.RSV1, f.RSV2, f.RSV3 = true, true, true }),
+				normalClose),
+			want: []received{msg(websocket.TextMessage, "valid")},
+			code: websocket.CloseProtocolError,
+		},
+		{
+			name: "wrong masking",
+			frames: frames(
+				// server must receive masked frames only, client unmasked ones
+				with(text("mask"), func(f *wstest.RawFrame) { f.IsMasked = !f.IsMasked }),
+				normalClose),
+			code: websocket.CloseProtocolError,
+		},
+	}
+
+	for _, opcode := range []websocket.MessageType{3, 4, 5, 6, 7, 11, 12, 13, 14, 15} {
+		cases = append(cases, conformanceCase{
+			name:   fmt.Sprintf("opcode %d", opcode),
+			frames: frames(text("valid"), frame(opcode, true, "reserved"), normalClose),
+			want:   []received{msg(websocket.TextMessage, "valid")},
+			code:   websocket.CloseProtocolError,
+		})
+	}
+
+	runConformance(t, cases)
+}
+
+func TestConformanceUTF8(t *testing.T) {
+	const kosme = "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5"
+	const mixed = "Hello-\xc2\xb5@\xc3\x9f\xc3\xb6\xc3\xa4\xc3\xbc\xc3\xa0\xc3\xa1-UTF-8!!\xf0\x9f\x98\x80"
+
+	cases := []conformanceCase{
+		{
+			name:   "valid",
+			frames: frames(text(mixed), normalClose),
+			want:   []received{msg(websocket.TextMessage, mixed)},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "valid in 1 byte fragments",
+			frames: append(fragments(websocket.TextMessage, mixed, 1), normalClose),
+			want:   []received{msg(websocket.TextMessage, mixed)},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "valid large",
+			frames: frames(text(strings.Repeat(kosme, 10000)), normalClose),
+			want:   []received{msg(websocket.TextMessage, strings.Repeat(kosme, 10000))},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "replacement character",
+			frames: frames(text("\xef\xbf\xbd"), normalClose),
+			want:   []received{msg(websocket.TextMessage, "\xef\xbf\xbd")},
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name: "invalid in last fragment",
+			frames: frames(
+				frame(websocket.TextMessage, false, kosme),
+				frame(websocket.ContinuationFrame, true, "\xed\xa0\x80edited"),
+				normalClose),
+			code: websocket.CloseInvalidFramePayloadData,
+		},
+		{
+			name: "invalid rune split between fragments",
+			frames: frames(
+				frame(websocket.TextMessage, false, kosme+"\xf4"),
+				frame(websocket.ContinuationFrame, true, "\x90\x80\x80"),
+				normalClose),
+			code: websocket.CloseInvalidFramePayloadData,
+		},
+		{
+			name: "message ends in the middle of rune",
+			frames: frames(
+				frame(websocket.TextMessage, false, kosme),
+				frame(websocket.ContinuationFrame, true, "\xe2\x82"),
+				normalClose),
+			code: websocket.CloseInvalidFramePayloadData,
+		},
+	}
+
+	for i := 1; i < len(kosme); i++ {
+		cases = append(cases, conformanceCase{
+			name: fmt.Sprintf("valid split at %d", i),
+			frames: frames(
+				frame(websocket.TextMessage, false, kosme[:i]),
+				frame(websocket.ContinuationFrame, true, kosme[i:]),
+				normalClose),
+			want: []received{msg(websocket.TextMessage, kosme)},
+			code: websocket.CloseNormalClosure,
+		})
+	}
+
+	invalid := []string{
+		"\xff",
+		"\xfe\xff",
+		"\xc0\xaf",         // overlong
+		"\xe0\x80\xaf",     // overlong
+		"\xed\xa0\x80",     // surrogate
+		"\xf4\x90\x80\x80", // above U+10FFFF
+		"\x80",             // lone continuation byte
+		kosme + "\xe2\x82", // truncated
+		"\xce\xba\xe1\xbd\xb9" + "\xed\xa0\x80" + "edited",
+	}
+	for i, s := range invalid {
+		cases = append(cases, conformanceCase{
+			name:   fmt.Sprintf("invalid %d", i),
+			frames: frames(text(s), normalClose),
+			code:   websocket.CloseInvalidFramePayloadData,
+		})
+	}
+
+	runConformance(t, cases)
+}
+
+func TestConformanceClose(t *testing.T) {
+	cases := []conformanceCase{
+		{
+			name:   "empty close",
+			frames: frames(frame(websocket.CloseMessage, true, "")),
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "close with 1 byte payload",
+			frames: frames(frame(websocket.CloseMessage, true, "\x03")),
+			code:   websocket.CloseProtocolError,
+		},
+		{
+			name:   "close with reason",
+			frames: frames(closeFrame(websocket.CloseNormalClosure, "bye")),
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "close with 123 bytes reason",
+			frames: frames(closeFrame(websocket.CloseNormalClosure, strings.Repeat("r", 123))),
+			code:   websocket.CloseNormalClosure,
+		},
+		{
+			name:   "close with 124 bytes reason",
+			frames: frames(closeFrame(websocket.CloseNormalClosure, strings.Repeat("r", 124))),
+			code:   websocket.CloseProtocolError,
+		},
+		{
+			name:   "close with invalid UTF-8 reason",
+			frames: frames(closeFrame(websocket.CloseNormalClosure, "\xce\xba\xe1\xbd\xb9\xed\xa0\x80")),
+			code:   websocket.CloseInvalidFramePayloadData,
+		},
+		{
+			name:   "messages after close are ignored",
+			frames: frames(normalClose, text("ignored"), frame(websocket.PingMessage, true, "ignored")),
+			code:   websocket.CloseNormalClosure,
+		},
+	}
+
+	valid := []websocket.CloseCode{1000, 1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011, 3000, 3999, 4000, 4999}
+	for _, code := range valid {
+		cases = append(cases, conformanceCase{
+			name:   fmt.Sprintf("valid code %d", code),
+			frames: frames(closeFrame(code, "")),
+			code:   code,
+		})
+	}
+
+	invalid := []websocket.CloseCode{0, 999, 1004, 1005, 1006, 1015, 1016, 1100, 2000, 2999, 5000, 65535}
+	for _, code := range invalid {
+		cases = append(cases, conformanceCase{
+			name:   fmt.Sprintf("invalid code %d", code),
+			frames: frames(closeFrame(code, "")),
+			code:   websocket.CloseProtocolError,
+		})
+	}
+
+	runConformance(t, cases)
+}
+
+// Client and server Conn talking to each other over TCP
+func TestConformanceConnPair(t *testing.T) {
+	srv := wstest.NewServer(nil, wstest.Echo)
+	defer srv.Close()
+
+	c, err := srv.Dial("/")
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	for _, size := range []int{0, 1, 125, 126, 4095, 4096, 4097, 65535, 65536, 1 << 20} {
+		data := bytes.Repeat([]byte("x"), size)
+		for _, mt := range []websocket.MessageType{websocket.TextMessage, websocket.BinaryMessage} {
+			err := c.WriteMessage(mt, data)
+			if err != nil {
+				t.Fatalf("failed to write %s message of %d bytes: %v", mt, size, err)
+			}
+
+			gotType, got, err := c.NextMessage()
+			if err != nil {
+				t.Fatalf("failed to read %s message of %d bytes: %v", mt, size, err)
+			}
+			if gotType != mt || !bytes.Equal(got, data) {
+				t.Errorf("received %s message of %d bytes, expected %s message of %d bytes",
+					gotType, len(got), mt, size)
+			}
+		}
+	}
+
+	err = c.Close()
+	if err != nil {
+		t.Errorf("close handshake failed: %v", err)
+	}
+
+	_, _, err = c.NextMessage()
+	if !errors.Is(err, websocket.ErrConnClosed) && !errors.Is(err, io.EOF) {
+		t.Errorf("reading closed connection must fail with closed error, received %v", err)
+	}
+}
@@ -3,51 +3,153 @@ package websocket
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"log/slog"
 	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Conn struct {
 	l *slog.Logger
+	// debug logging is enabled, checked before logging on hot paths,
+	// so attributes are not constructed
+	debug bool
 
-	conn net.Conn
+	id          string
+	subprotocol string
+	// sequence number of last message read or written
+	seq atomic.Uint64
+
+	conn transport
+	// deadlines of conn, context moves them temporarily
+	readDeadline, writeDeadline connDeadline
 
 	r    *bufio.Reader
 	wBuf *bytes.Buffer
+	// max payload of written data frames, 0 if unlimited
+	maxFrameSize int
+	// max size of received message, 0 if unlimited
+	readLimit int64
+	// lazily allocated buffers of client masking of caller data and ReadFrom
+	maskBuf  []byte
+	frameBuf []byte
+
+	// serializes frames written to conn, control frames may be written
+	// from reading goroutine while another one writes message
+	wMu sync.Mutex
 
-	sentConnClose bool
-	recvConnClose bool
+	sentConnClose atomic.Bool
+	recvConnClose atomic.Bool
 
 	curReader *messageReader
 	curWriter *messageWriter
 
+	// negotiated extensions in order of server response
+	extensions []negotiatedExtension
+	// RSV bits of all extensions and of extensions which transform frames
+	extRSV, frameRSV RSV
+	frameExts        bool
+	// compression extension was negotiated
+	compressExts bool
+	compression  compression
+
+	// inbound rate limits, nil if unlimited
+	limiter *rateLimiter
+
+	// fragmented message state of low level frame API
+	rFragmented bool
+	wFragmented bool
+
 	isServer bool
 
 	handleClose func(code CloseCode, appData string) error
 	handlePing  func(appData []byte) error
 	handlePong  func(appData []byte) error
 
-	err error
+	errMu sync.Mutex
+	err   error
+
+	obs Observer
+
+	// derived from upgrade request or dial context, cancelled once net.Conn is closed
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	reqHeader http.Header
+
+	tracer   Tracer
+	traceCtx context.Context
+
+	// time and span of close handshake, started by first close frame sent or received
+	closeMu    sync.Mutex
+	closeStart time.Time
+	closeSpan  Span
+
+	// stats of message read or written with low level frame API
+	rType, wType    MessageType
+	rFrames, rBytes int
+	wFrames, wBytes int
+	rSpan, wSpan    Span
+
+	capturer FrameCapturer
+
+	// called once net.Conn is closed
+	onClose   []func()
+	closeOnce sync.Once
 }
 
+var (
+	ErrConnClosed = errors.New("connection closed")
+)
+
 const (
 	// min size to be able to store control messages data
 	minWriteBufSize = 4096
+
+	maskBufSize     = 32 * 1024
+	readFromBufSize = 64 * 1024
 )
 
-func newConn(netConn net.Conn, reader *bufio.Reader, writeBuf []byte, l *slog.Logger) (*Conn, error) {
+func newConn(t transport, reader *bufio.Reader, writeBuf []byte, subprotocol string, l *slog.Logger) (*Conn, error) {
 	if len(writeBuf) < minWriteBufSize {
 		writeBuf = make([]byte, minWriteBufSize)
 	}
 
+	id := newConnID()
+	debug := l.Enabled(context.Background(), slog.LevelDebug)
+	if debug {
+		l = l.With(slog.Group("conn",
+			"id", id,
+			"remote", t.RemoteAddr().String(),
+			"local", t.LocalAddr().String(),
+			"subprotocol", subprotocol,
+		))
+	}
+
 	conn := &Conn{
-		conn: netConn,
-		r:    reader,
-		wBuf: bytes.NewBuffer(writeBuf),
-		l:    l,
+		id:          id,
+		subprotocol: subprotocol,
+		conn:        t,
+		r:           reader,
+		wBuf:        bytes.NewBuffer(writeBuf),
+		l:           l,
+		debug:       debug,
+		obs:         NopObserver{},
+
+		tracer:   NopTracer{},
+		traceCtx: context.Background(),
 	}
 
+	conn.readDeadline.apply = t.SetReadDeadline
+	conn.writeDeadline.apply = t.SetWriteDeadline
+	conn.setContext(context.Background(), http.Header{})
+
 	conn.SetCloseHandler(nil)
 	conn.SetPingHandler(nil)
 	conn.SetPongHandler(nil)
@@ -55,11 +157,101 @@ func newConn(netConn net.Conn, reader *bufio.Reader, writeBuf []byte, l *slog.Lo
 	return conn, nil
 }
 
+func newConnID() string {
+	b := [8]byte{}
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// Random connection id, stays the same for connection lifetime
+// and is attached to its internal logger
+func (c *Conn) ID() string {
+	return c.id
+}
+
+// Subprotocol selected during opening handshake, empty if none
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Context of connection, derived from upgrade request on server and from dial
+// context on client without their cancellation and deadline. Carries principal
+// of authenticated request. Cancelled once connection is closed for any reason,
+// context.Cause returns error which closed it or ErrConnClosed
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+// Headers of opening handshake request, received ones on server
+// and ones passed to Dial on client
+func (c *Conn) RequestHeader() http.Header {
+	return c.reqHeader
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Must be called before connection is returned to user
+func (c *Conn) setContext(parent context.Context, header http.Header) {
+	c.ctx, c.cancel = context.WithCancelCause(context.WithoutCancel(parent))
+	c.reqHeader = header
+}
+
+// Returns logger tagged with next message sequence number,
+// attributes are not constructed if debug logging is disabled
+func (c *Conn) messageLogger() (*slog.Logger, uint64) {
+	seq := c.seq.Add(1)
+	if !c.debug {
+		return c.l, seq
+	}
+	return c.l.With("seq", seq), seq
+}
+
+func (c *Conn) setErr(err error) {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	c.err = err
+}
+
+func (c *Conn) getErr() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// Closes underlying transport without close handshake
+func (c *Conn) closeNetConn() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+		for _, f := range c.onClose {
+			f()
+		}
+
+		cause := c.getErr()
+		if cause == nil {
+			cause = ErrConnClosed
+		}
+		c.cancel(cause)
+	})
+	return err
+}
+
+func (c *Conn) isClosed() bool {
+	return c.sentConnClose.Load() && c.recvConnClose.Load()
+}
+
 func CloseMessageData(code CloseCode, message string) []byte {
 	msgB := []byte(message)
 	b := make([]byte, 2+len(msgB))
 
 	binary.BigEndian.PutUint16(b, code.U())
+	copy(b[2:], msgB)
 
 	return b
 }
@@ -0,0 +1,134 @@
+package websocket_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+// Buffer safe for concurrent log writes
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Decoded JSON log records
+func (b *logBuffer) records(t *testing.T) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var records []map[string]any
+	dec := json.NewDecoder(&b.buf)
+	for dec.More() {
+		var r map[string]any
+		if err := dec.Decode(&r); err != nil {
+			t.Fatalf("failed to decode log record: %v", err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// Closes pipe with server answering close
+func closePipe(client, server *websocket.Conn) {
+	go func() { _, _, _ = server.NextMessage() }()
+	_ = client.Close()
+}
+
+// Writes message from one pipe end and reads it on other
+func sendMessage(t *testing.T, from, to *websocket.Conn, data string) {
+	t.Helper()
+
+	written := make(chan error, 1)
+	go func() { written <- from.WriteMessage(websocket.TextMessage, []byte(data)) }()
+	if _, _, err := to.NextMessage(); err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+}
+
+func TestConnID(t *testing.T) {
+	var logs logBuffer
+	l := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	u := &websocket.Upgrader{InternalLogger: l}
+
+	ids := map[string]bool{}
+	for range 3 {
+		client, server, err := wstest.NewPipeWith(&websocket.Dialer{}, u)
+		if err != nil {
+			t.Fatalf("failed to create pipe: %v", err)
+		}
+
+		id := server.ID()
+		if id == "" || ids[id] || id == client.ID() {
+			t.Fatalf("id %q is empty or not unique", id)
+		}
+		ids[id] = true
+
+		sendMessage(t, client, server, "hello")
+		if server.ID() != id {
+			t.Fatalf("id changed from %q to %q", id, server.ID())
+		}
+
+		closePipe(client, server)
+	}
+
+	// every connection record is tagged with one of connection ids
+	for _, r := range logs.records(t) {
+		conn, ok := r["conn"].(map[string]any)
+		if !ok {
+			continue
+		}
+		if id, _ := conn["id"].(string); !ids[id] {
+			t.Fatalf("record %v has unknown conn id", r)
+		}
+	}
+}
+
+func TestConnMessageSeq(t *testing.T) {
+	var logs logBuffer
+	l := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	client, server, err := wstest.NewPipeWith(&websocket.Dialer{}, &websocket.Upgrader{InternalLogger: l})
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	defer closePipe(client, server)
+
+	// reads and writes share sequence
+	for _, data := range []string{"a", "b", "c"} {
+		sendMessage(t, client, server, data)
+		sendMessage(t, server, client, data)
+	}
+
+	var seqs []float64
+	for _, r := range logs.records(t) {
+		seq, ok := r["seq"].(float64)
+		if !ok {
+			continue
+		}
+		if n := len(seqs); n == 0 || seqs[n-1] != seq {
+			seqs = append(seqs, seq)
+		}
+	}
+	if len(seqs) != 6 {
+		t.Fatalf("got sequence numbers %v, want 1 to 6", seqs)
+	}
+	for i, seq := range seqs {
+		if seq != float64(i+1) {
+			t.Fatalf("got sequence numbers %v, want 1 to 6", seqs)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package websocket
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Sets deadline of reads from underlying connection, zero value means no deadline.
+// Read which timed out while waiting for the next message can be retried,
+// timeout in the middle of the message closes connection
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.readDeadline.set(t)
+}
+
+// Sets deadline of writes to underlying connection, zero value means no deadline.
+// Message which was partially written can't be finished after timeout
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.writeDeadline.set(t)
+}
+
+// Deadline of underlying connection, remembered so it can be restored
+// once context stops interrupting operation
+type connDeadline struct {
+	mu sync.Mutex
+	t  time.Time
+	// moved to the past by context, new deadline is applied once restored
+	interrupted bool
+	apply       func(time.Time) error
+	// closed once deadline in effect changes
+	changed chan struct{}
+}
+
+// Returns deadline in effect and channel which is closed once it changes
+func (d *connDeadline) current() (time.Time, <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	if d.interrupted {
+		return time.Unix(1, 0), d.changed
+	}
+	return d.t, d.changed
+}
+
+func (d *connDeadline) notify() {
+	if d.changed != nil {
+		close(d.changed)
+		d.changed = nil
+	}
+}
+
+func (d *connDeadline) set(t time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.t = t
+	if d.interrupted {
+		return nil
+	}
+	d.notify()
+	return d.apply(t)
+}
+
+func (d *connDeadline) interrupt() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.interrupted = true
+	d.notify()
+	_ = d.apply(time.Unix(1, 0))
+}
+
+func (d *connDeadline) restore() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.interrupted = false
+	d.notify()
+	_ = d.apply(d.t)
+}
+
+// Same as NextMessage, but unblocks when context is done and returns ctx.Err().
+// Connection stays usable if context was done while waiting for the next frame,
+// if it happened in the middle of the message connection is closed.
+// Deadline set with SetReadDeadline is kept once it returns
+func (c *Conn) NextMessageContext(ctx context.Context) (MessageType, []byte, error) {
+	if err := ctx.Err(); err != nil {
+		return MessageType(0), nil, err
+	}
+
+	interrupted := c.watchContext(ctx, &c.readDeadline)
+	mt, data, err := c.NextMessage()
+	if interrupted() && err != nil {
+		return MessageType(0), nil, ctx.Err()
+	}
+
+	return mt, data, err
+}
+
+// Same as NextReader, but unblocks when context is done and returns ctx.Err().
+// Context is only used to wait for the message, not for reading returned reader
+func (c *Conn) NextReaderContext(ctx context.Context) (MessageType, io.Reader, error) {
+	if err := ctx.Err(); err != nil {
+		return MessageType(0), nil, err
+	}
+
+	interrupted := c.watchContext(ctx, &c.readDeadline)
+	mt, r, err := c.NextReader()
+	if interrupted() && err != nil {
+		return MessageType(0), nil, ctx.Err()
+	}
+
+	return mt, r, err
+}
+
+// Same as WriteMessage, but unblocks when context is done and returns ctx.Err().
+// Message which was partially written can't be finished, so connection is closed
+func (c *Conn) WriteMessageContext(ctx context.Context, messageType MessageType, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	interrupted := c.watchContext(ctx, &c.writeDeadline)
+	err := c.WriteMessage(messageType, data)
+	if interrupted() && err != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// Moves deadline to the past when context is done, so blocked operation returns.
+// Returned func must be called after the operation, it restores deadline
+// and reports if operation was interrupted by context
+func (c *Conn) watchContext(ctx context.Context, d *connDeadline) func() bool {
+	if ctx.Done() == nil {
+		return func() bool { return false }
+	}
+
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(fired)
+		c.l.Debug("context is done, interrupting blocked operation")
+		d.interrupt()
+	})
+
+	return func() bool {
+		if stop() {
+			return false
+		}
+
+		<-fired
+		d.restore()
+		return true
+	}
+}
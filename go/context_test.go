@@ -0,0 +1,145 @@
+package websocket_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+type ctxKey struct{}
+
+func TestConnContext(t *testing.T) {
+	d := &websocket.Dialer{
+		Subprotocols: []string{"chat"},
+		Extensions:   []websocket.Extension{xorExtension{0x5a}},
+	}
+	u := &websocket.Upgrader{
+		Subprotocols: []string{"chat"},
+		Extensions:   []websocket.Extension{xorExtension{}},
+	}
+	conns := make(chan *websocket.Conn, 1)
+	srv := wstest.NewServer(u, func(c *websocket.Conn) {
+		conns <- c
+		_, _, _ = c.NextMessage()
+	})
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "value"))
+	client, err := d.DialContext(ctx, srv.URL, map[string]string{"x-token": "abc"})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	server := <-conns
+
+	// dial context is not propagated as cancellation
+	cancel()
+	if err := client.Context().Err(); err != nil {
+		t.Fatalf("client context is done after dial context was cancelled: %v", err)
+	}
+	if v := client.Context().Value(ctxKey{}); v != "value" {
+		t.Errorf("client context value = %v, want %q", v, "value")
+	}
+	if v := client.RequestHeader().Get("X-Token"); v != "abc" {
+		t.Errorf("client request header = %q, want %q", v, "abc")
+	}
+
+	if v := server.RequestHeader().Get("X-Token"); v != "abc" {
+		t.Errorf("server request header = %q, want %q", v, "abc")
+	}
+	if server.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Errorf("server remote address = %s, want %s", server.RemoteAddr(), client.LocalAddr())
+	}
+	for _, c := range []*websocket.Conn{client, server} {
+		if c.Subprotocol() != "chat" {
+			t.Errorf("subprotocol = %q, want %q", c.Subprotocol(), "chat")
+		}
+		exts := c.Extensions()
+		if len(exts) != 1 || exts[0].String() != "x-xor; key=90" {
+			t.Errorf("extensions = %v, want [x-xor; key=90]", exts)
+		}
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	for name, c := range map[string]*websocket.Conn{"client": client, "server": server} {
+		select {
+		case <-c.Context().Done():
+		case <-time.After(time.Second):
+			t.Fatalf("%s context is not cancelled after close", name)
+		}
+		if cause := context.Cause(c.Context()); cause == nil || errors.Is(cause, context.Canceled) {
+			t.Errorf("%s context cause = %v, want connection error", name, cause)
+		}
+	}
+}
+
+func TestNextMessageContext(t *testing.T) {
+	client, server := wstest.NewPipe()
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := client.NextMessageContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("read error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// deadline set before context read is restored after it
+	if err := client.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := client.NextMessageContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("read error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, _, err := client.NextMessage(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	// nothing was read, so connection is still usable
+	_ = client.SetReadDeadline(time.Time{})
+	go func() {
+		_ = server.WriteMessage(websocket.TextMessage, []byte("hello"))
+		// answers close
+		_, _, _ = server.NextMessage()
+	}()
+	_, data, err := client.NextMessageContext(context.Background())
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("got %q %v, want %q", data, err, "hello")
+	}
+}
+
+func TestReadTimeoutMidMessage(t *testing.T) {
+	server, raw, err := wstest.NewRawClient(nil)
+	if err != nil {
+		t.Fatalf("failed to create raw client: %v", err)
+	}
+	defer raw.Close()
+
+	writeFrames(t, raw, raw.Frame(websocket.TextMessage, false, []byte("first frame")))
+
+	_, r, err := server.NextReader()
+	if err != nil {
+		t.Fatalf("failed to get reader: %v", err)
+	}
+	_ = server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	// continuation frame never arrives
+	if _, err := io.ReadAll(r); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	// message can't be continued, so connection is closed
+	_ = server.SetReadDeadline(time.Time{})
+	if _, _, err := server.NextMessage(); err == nil {
+		t.Fatal("read succeeded after timeout in the middle of message")
+	}
+}
@@ -0,0 +1,356 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	deflateExtensionName = "permessage-deflate"
+
+	paramServerNoContextTakeover = "server_no_context_takeover"
+	paramClientNoContextTakeover = "client_no_context_takeover"
+	paramServerMaxWindowBits     = "server_max_window_bits"
+	paramClientMaxWindowBits     = "client_max_window_bits"
+
+	// compress/flate always uses max window
+	deflateMaxWindowBits = 15
+	deflateWindowSize    = 1 << deflateMaxWindowBits
+)
+
+// Empty stored block which ends every compressed message, it is
+// removed by sender. Final empty block is appended by reader, so
+// flate reader returns io.EOF at the end of message
+var (
+	deflateTail      = []byte{0x00, 0x00, 0xff, 0xff}
+	deflateFinalTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+)
+
+// permessage-deflate extension (RFC 7692), compresses text and binary messages
+// and marks them with RSV1. Which messages are compressed is decided by
+// Conn compression policy. Window size can't be limited, so offers which
+// require it are declined. Small compressed message may inflate to huge one,
+// so read limit of connection should be set
+type PerMessageDeflate struct {
+	// compress/flate level, flate.DefaultCompression if 0
+	Level int
+	// Compress every message with empty window, saves memory between
+	// messages at the cost of compression ratio
+	NoContextTakeover bool
+	// Ask peer to compress every message with empty window
+	PeerNoContextTakeover bool
+}
+
+func (e PerMessageDeflate) Name() string { return deflateExtensionName }
+func (e PerMessageDeflate) RSV() RSV     { return RSV1 }
+
+func (e PerMessageDeflate) Compression() bool { return true }
+
+func (e PerMessageDeflate) Offer() ExtensionOffer {
+	offer := ExtensionOffer{Name: deflateExtensionName}
+	if e.NoContextTakeover {
+		offer.Params = append(offer.Params, ExtensionParam{Name: paramClientNoContextTakeover})
+	}
+	if e.PeerNoContextTakeover {
+		offer.Params = append(offer.Params, ExtensionParam{Name: paramServerNoContextTakeover})
+	}
+	return offer
+}
+
+// Client side
+func (e PerMessageDeflate) Accepted(response ExtensionOffer) (ExtensionConn, error) {
+	params, err := parseDeflateParams(response)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := params[paramClientMaxWindowBits]; ok {
+		return nil, fmt.Errorf("%s was not offered", paramClientMaxWindowBits)
+	}
+	_, peerNoTakeover := params[paramServerNoContextTakeover]
+	if e.PeerNoContextTakeover && !peerNoTakeover {
+		return nil, fmt.Errorf("%s was requested, but not accepted", paramServerNoContextTakeover)
+	}
+	_, noTakeover := params[paramClientNoContextTakeover]
+
+	return e.newConn(noTakeover || e.NoContextTakeover, peerNoTakeover), nil
+}
+
+// Server side, offers which ask to limit server window are declined
+func (e PerMessageDeflate) Accept(offer ExtensionOffer) (ExtensionOffer, ExtensionConn, error) {
+	params, err := parseDeflateParams(offer)
+	if err != nil {
+		return ExtensionOffer{}, nil, nil
+	}
+
+	if bits, ok := params[paramServerMaxWindowBits]; ok && bits != deflateMaxWindowBits {
+		return ExtensionOffer{}, nil, nil
+	}
+
+	response := ExtensionOffer{Name: deflateExtensionName}
+
+	_, noTakeover := params[paramServerNoContextTakeover]
+	noTakeover = noTakeover || e.NoContextTakeover
+	if noTakeover {
+		response.Params = append(response.Params, ExtensionParam{Name: paramServerNoContextTakeover})
+	}
+
+	_, peerNoTakeover := params[paramClientNoContextTakeover]
+	peerNoTakeover = peerNoTakeover || e.PeerNoContextTakeover
+	if peerNoTakeover {
+		response.Params = append(response.Params, ExtensionParam{Name: paramClientNoContextTakeover})
+	}
+
+	return response, e.newConn(noTakeover, peerNoTakeover), nil
+}
+
+// Returns parameters with window bits values, -1 if window bits has no value.
+// Unknown, duplicate and invalid parameters are not allowed
+func parseDeflateParams(offer ExtensionOffer) (map[string]int, error) {
+	params := make(map[string]int, len(offer.Params))
+
+	for _, p := range offer.Params {
+		if _, ok := params[p.Name]; ok {
+			return nil, fmt.Errorf("duplicate parameter %q", p.Name)
+		}
+
+		switch p.Name {
+		case paramServerNoContextTakeover, paramClientNoContextTakeover:
+			if p.Value != "" {
+				return nil, fmt.Errorf("parameter %q must not have value", p.Name)
+			}
+			params[p.Name] = 0
+		case paramServerMaxWindowBits, paramClientMaxWindowBits:
+			if p.Value == "" && p.Name == paramClientMaxWindowBits {
+				params[p.Name] = -1
+				continue
+			}
+			bits, err := strconv.Atoi(p.Value)
+			if err != nil || bits < 8 || bits > deflateMaxWindowBits || p.Value[0] == '0' {
+				return nil, fmt.Errorf("invalid value of %q: %q", p.Name, p.Value)
+			}
+			params[p.Name] = bits
+		default:
+			return nil, fmt.Errorf("unknown parameter %q", p.Name)
+		}
+	}
+
+	return params, nil
+}
+
+func (e PerMessageDeflate) newConn(noTakeover, peerNoTakeover bool) *deflateConn {
+	level := e.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	return &deflateConn{level: level, noTakeover: noTakeover, peerNoTakeover: peerNoTakeover}
+}
+
+// Compression state of one connection, writer and reader keep their
+// windows between messages unless context takeover is disabled
+type deflateConn struct {
+	level          int
+	noTakeover     bool
+	peerNoTakeover bool
+
+	// writes to message writer of current message, flate.Writer.Reset
+	// would drop its window, so destination is switched here instead
+	dst destWriter
+	fw  *flate.Writer
+
+	fr io.ReadCloser
+	// last uncompressed bytes read, dictionary of next message
+	window []byte
+}
+
+type destWriter struct {
+	w io.Writer
+}
+
+func (d *destWriter) Write(p []byte) (int, error) {
+	return d.w.Write(p)
+}
+
+func (c *deflateConn) WrapWriter(mt MessageType, rsv *RSV, w io.WriteCloser) io.WriteCloser {
+	*rsv |= RSV1
+
+	tw := &truncWriter{w: w}
+	c.dst.w = tw
+	if c.fw == nil {
+		fw, err := flate.NewWriter(&c.dst, c.level)
+		if err != nil {
+			// invalid level
+			fw, _ = flate.NewWriter(&c.dst, flate.DefaultCompression)
+		}
+		c.fw = fw
+	}
+
+	return &deflateWriter{conn: c, tw: tw}
+}
+
+func (c *deflateConn) WrapReader(mt MessageType, rsv RSV, r io.Reader) io.Reader {
+	if rsv&RSV1 == 0 {
+		return r
+	}
+
+	var dict []byte
+	if !c.peerNoTakeover {
+		dict = c.window
+	}
+
+	src := io.MultiReader(r, bytes.NewReader(deflateFinalTail))
+	if c.fr == nil {
+		c.fr = flate.NewReaderDict(src, dict)
+	} else {
+		_ = c.fr.(flate.Resetter).Reset(src, dict)
+	}
+
+	return &deflateReader{conn: c, src: r}
+}
+
+type deflateWriter struct {
+	conn *deflateConn
+	tw   *truncWriter
+	err  error
+}
+
+func (w *deflateWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.conn.fw.Write(p)
+	if err != nil {
+		w.err = fmt.Errorf("failed to compress message: [%w]", err)
+		return n, w.err
+	}
+	return n, nil
+}
+
+// Writes compressed data written so far as non-final frame
+func (w *deflateWriter) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	err := w.conn.fw.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to compress message: [%w]", err)
+	}
+	return w.tw.flush()
+}
+
+func (w *deflateWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	err := w.conn.fw.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to compress message: [%w]", err)
+	}
+	if !bytes.Equal(w.tw.tail[:w.tw.n], deflateTail) {
+		return errors.New("compressed message does not end with empty block")
+	}
+
+	if w.conn.noTakeover {
+		w.conn.fw.Reset(&w.conn.dst)
+	}
+
+	return w.tw.w.Close()
+}
+
+// Holds back last 4 bytes written, so empty block which ends
+// compressed message is not sent
+type truncWriter struct {
+	w    io.WriteCloser
+	tail [4]byte
+	n    int
+}
+
+func (w *truncWriter) Write(p []byte) (int, error) {
+	written := len(p)
+
+	if w.n < len(w.tail) {
+		n := copy(w.tail[w.n:], p)
+		w.n += n
+		p = p[n:]
+		if len(p) == 0 {
+			return written, nil
+		}
+	}
+
+	// m oldest held back bytes are written, m last bytes of p are held back instead
+	m := min(len(p), len(w.tail))
+	_, err := w.w.Write(w.tail[:m])
+	if err != nil {
+		return 0, err
+	}
+	copy(w.tail[:], w.tail[m:])
+	copy(w.tail[len(w.tail)-m:], p[len(p)-m:])
+
+	_, err = w.w.Write(p[:len(p)-m])
+	if err != nil {
+		return 0, err
+	}
+
+	return written, nil
+}
+
+// Writes everything including held back bytes as non-final frame
+func (w *truncWriter) flush() error {
+	if w.n > 0 {
+		_, err := w.w.Write(w.tail[:w.n])
+		if err != nil {
+			return err
+		}
+		w.n = 0
+	}
+
+	f, ok := w.w.(Flusher)
+	if !ok {
+		return errors.New("message writer can't be flushed")
+	}
+	return f.Flush()
+}
+
+type deflateReader struct {
+	conn *deflateConn
+	src  io.Reader
+}
+
+func (r *deflateReader) Read(p []byte) (int, error) {
+	n, err := r.conn.fr.Read(p)
+	if n > 0 && !r.conn.peerNoTakeover {
+		r.conn.appendWindow(p[:n])
+	}
+
+	if err == io.EOF {
+		// anything after final block is not part of stream, message must be
+		// read to the end for next one to start
+		_, derr := io.Copy(io.Discard, r.src)
+		if derr != nil {
+			return n, derr
+		}
+		return n, io.EOF
+	}
+	if err != nil {
+		return n, fmt.Errorf("failed to decompress message: [%w]", err)
+	}
+
+	return n, nil
+}
+
+// Keeps last window size bytes of uncompressed data
+func (c *deflateConn) appendWindow(p []byte) {
+	if len(p) >= deflateWindowSize {
+		c.window = append(c.window[:0], p[len(p)-deflateWindowSize:]...)
+		return
+	}
+	if drop := len(c.window) + len(p) - deflateWindowSize; drop > 0 {
+		c.window = append(c.window[:0], c.window[drop:]...)
+	}
+	c.window = append(c.window, p...)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -21,12 +20,6 @@ func handler(w http.ResponseWriter, req *http.Request) {
 	c, err := upgrader.Upgrade(w, req)
 	if err != nil {
 		slog.Error("Opening connection failed", "err", err)
-		if errors.Is(err, websocket.ErrHandshakeFailure) {
-			w.WriteHeader(400)
-		} else {
-			w.WriteHeader(500)
-		}
-		w.Write([]byte(err.Error()))
 		return
 	}
 
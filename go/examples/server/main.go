@@ -1,13 +1,16 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"time"
 
 	websocket "github.com/wmdanor/websocket/go"
 )
@@ -20,12 +23,6 @@ func handler(w http.ResponseWriter, req *http.Request) {
 	c, err := upgrader.Upgrade(w, req)
 	if err != nil {
 		slog.Error("Opening connection failed", "err", err)
-		if errors.Is(err, websocket.ErrHandshakeFailure) {
-			w.WriteHeader(400)
-		} else {
-			w.WriteHeader(500)
-		}
-		w.Write([]byte(err.Error()))
 		return
 	}
 
@@ -63,7 +60,36 @@ func main() {
 	slog.Info("Starting server", "addr", addr)
 
 	http.HandleFunc("/", handler)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	server := &http.Server{Addr: addr}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		<-sig
+
+		slog.Info("Shutting down server")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err := server.Shutdown(ctx)
+		if err != nil {
+			slog.Error("Failed to shutdown server", "err", err)
+		}
+		// hijacked connections are not tracked by http.Server
+		err = upgrader.Shutdown(ctx)
+		if err != nil {
+			slog.Error("Failed to shutdown websocket connections", "err", err)
+		}
+	}()
+
+	err = server.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdownDone
 }
 
 func setupLogger() {
@@ -0,0 +1,487 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/wmdanor/websocket/go/internal"
+)
+
+// RSV bits of frame header, only bits claimed by negotiated extensions may be set
+type RSV uint8
+
+const (
+	RSV1 RSV = 0b100
+	RSV2 RSV = 0b010
+	RSV3 RSV = 0b001
+)
+
+// Extension negotiated with Sec-WebSocket-Extensions header (RFC 6455 section 9).
+// Same value is used for all connections of Upgrader or Dialer,
+// state of single connection is kept in ExtensionConn
+type Extension interface {
+	// Extension token used in Sec-WebSocket-Extensions header
+	Name() string
+	// RSV bits used by extension, extensions of one connection must not share them
+	RSV() RSV
+
+	// Client side, offer sent in handshake request
+	Offer() ExtensionOffer
+	// Client side, called with parameters of server response to offer,
+	// error fails handshake
+	Accepted(response ExtensionOffer) (ExtensionConn, error)
+
+	// Server side, called with client offers of this extension until one is accepted.
+	// Returns response parameters or nil ExtensionConn to decline offer,
+	// error fails handshake
+	Accept(offer ExtensionOffer) (ExtensionOffer, ExtensionConn, error)
+}
+
+// Negotiated extension of single connection, transforms payload of data messages.
+// Outgoing data passes extensions in order they were listed in server response,
+// incoming data in reverse order
+type ExtensionConn interface {
+	// Wraps payload writer of outgoing message, closing returned writer must close w.
+	// RSV bits set before first write to w are sent in first frame of message
+	WrapWriter(mt MessageType, rsv *RSV, w io.WriteCloser) io.WriteCloser
+	// Wraps payload reader of incoming message, rsv are bits of its first frame
+	WrapReader(mt MessageType, rsv RSV, r io.Reader) io.Reader
+}
+
+// Optionally implemented by ExtensionConn to transform every data frame.
+// Frames are read fully into memory before being passed to it.
+// Bits of such extension may be set on any data frame, bits of other
+// extensions on first frame of message only
+type FrameTransformer interface {
+	// Called for outgoing data frame after message transforms, payload may be replaced
+	TransformOutgoing(f *Frame) error
+	// Called for incoming data frame before message transforms, payload may be replaced
+	// and extension bits should be cleared
+	TransformIncoming(f *Frame) error
+}
+
+// Optionally implemented by Extension which compresses messages, such as
+// PerMessageDeflate. It is skipped for messages CompressionPolicy leaves
+// uncompressed, other extensions are applied to every message
+type CompressionExtension interface {
+	Extension
+	// Reports if extension compresses messages
+	Compression() bool
+}
+
+var (
+	ErrInvalidExtensionHeader = errors.New("invalid extension header")
+)
+
+// Single element of Sec-WebSocket-Extensions header, same format
+// is used for client offers and server responses
+type ExtensionOffer struct {
+	Name   string
+	Params []ExtensionParam
+}
+
+// Value is empty if parameter has no value
+type ExtensionParam struct {
+	Name  string
+	Value string
+}
+
+// Returns value of first parameter with given name
+func (o ExtensionOffer) Param(name string) (string, bool) {
+	for _, p := range o.Params {
+		if strings.EqualFold(p.Name, name) {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// Formats offer as header element, values which are not tokens are quoted
+func (o ExtensionOffer) String() string {
+	var sb strings.Builder
+	sb.WriteString(o.Name)
+	for _, p := range o.Params {
+		sb.WriteString("; ")
+		sb.WriteString(p.Name)
+		if p.Value == "" {
+			continue
+		}
+		sb.WriteByte('=')
+		if isToken(p.Value) {
+			sb.WriteString(p.Value)
+		} else {
+			sb.WriteString(quoteString(p.Value))
+		}
+	}
+	return sb.String()
+}
+
+// Parses all Sec-WebSocket-Extensions header values, grammar of RFC 6455 section 9.1:
+//
+//	extension-list  = 1#extension
+//	extension       = extension-token *( ";" extension-param )
+//	extension-param = token [ "=" (token | quoted-string) ]
+func ParseExtensions(h http.Header) ([]ExtensionOffer, error) {
+	var offers []ExtensionOffer
+	for _, v := range h.Values(headerSecWsExt) {
+		parsed, err := parseExtensionList(v)
+		if err != nil {
+			return nil, err
+		}
+		offers = append(offers, parsed...)
+	}
+	return offers, nil
+}
+
+func parseExtensionList(s string) ([]ExtensionOffer, error) {
+	var offers []ExtensionOffer
+	p := extParser{s: s}
+
+	for {
+		p.skipSpace()
+		if p.eof() {
+			break
+		}
+		// empty list elements are allowed by #rule
+		if p.consume(',') {
+			continue
+		}
+
+		name := p.token()
+		if name == "" {
+			return nil, p.errorf("expected extension token")
+		}
+		offer := ExtensionOffer{Name: name}
+
+		for {
+			p.skipSpace()
+			if !p.consume(';') {
+				break
+			}
+			p.skipSpace()
+
+			param := ExtensionParam{Name: p.token()}
+			if param.Name == "" {
+				return nil, p.errorf("expected parameter name")
+			}
+
+			p.skipSpace()
+			if p.consume('=') {
+				p.skipSpace()
+				value, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				param.Value = value
+			}
+
+			offer.Params = append(offer.Params, param)
+		}
+
+		offers = append(offers, offer)
+
+		p.skipSpace()
+		if !p.eof() && !p.consume(',') {
+			return nil, p.errorf("expected ',' or ';'")
+		}
+	}
+
+	return offers, nil
+}
+
+type extParser struct {
+	s   string
+	pos int
+}
+
+func (p *extParser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *extParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s at position %d of %q", ErrInvalidExtensionHeader, fmt.Sprintf(format, args...), p.pos, p.s)
+}
+
+func (p *extParser) skipSpace() {
+	for !p.eof() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *extParser) consume(c byte) bool {
+	if !p.eof() && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *extParser) token() string {
+	start := p.pos
+	for !p.eof() && isTokenChar(p.s[p.pos]) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// Token or quoted string, unquoted value of quoted string must be token as well
+func (p *extParser) value() (string, error) {
+	if !p.consume('"') {
+		v := p.token()
+		if v == "" {
+			return "", p.errorf("expected parameter value")
+		}
+		return v, nil
+	}
+
+	var sb strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf("unterminated quoted string")
+		}
+		c := p.s[p.pos]
+		p.pos++
+
+		switch c {
+		case '"':
+			v := sb.String()
+			if !isToken(v) {
+				return "", p.errorf("quoted parameter value %q must be token", v)
+			}
+			return v, nil
+		case '\\':
+			if p.eof() {
+				return "", p.errorf("unterminated quoted string")
+			}
+			sb.WriteByte(p.s[p.pos])
+			p.pos++
+		default:
+			sb.WriteByte(c)
+		}
+	}
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// tchar of RFC 9110
+func isTokenChar(c byte) bool {
+	if c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func quoteString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(s[i])
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func headerRSV(f *internal.FrameHeader) RSV {
+	return RSV(f.RSV1<<2 | f.RSV2<<1 | f.RSV3)
+}
+
+// Extension negotiated for connection
+type negotiatedExtension struct {
+	name string
+	rsv  RSV
+	conn ExtensionConn
+	// nil if extension transforms messages only
+	frames FrameTransformer
+	// extension implements CompressionExtension
+	compress bool
+	// parameters of server response
+	params ExtensionOffer
+}
+
+func newNegotiatedExtension(ext Extension, params ExtensionOffer, conn ExtensionConn) negotiatedExtension {
+	frames, _ := conn.(FrameTransformer)
+	ce, ok := ext.(CompressionExtension)
+	return negotiatedExtension{
+		name:     ext.Name(),
+		rsv:      ext.RSV(),
+		conn:     conn,
+		frames:   frames,
+		compress: ok && ce.Compression(),
+		params:   params,
+	}
+}
+
+// Server side, accepts first acceptable offer of every supported extension.
+// Extensions are ordered as client listed them, rsv conflicts are resolved
+// in favor of extension offered first
+func negotiateExtensions(supported []Extension, offers []ExtensionOffer) ([]negotiatedExtension, error) {
+	var negotiated []negotiatedExtension
+	var used RSV
+
+	for _, offer := range offers {
+		for _, ext := range supported {
+			if !strings.EqualFold(ext.Name(), offer.Name) || used&ext.RSV() != 0 ||
+				containsExtension(negotiated, ext.Name()) {
+				continue
+			}
+
+			response, conn, err := ext.Accept(offer)
+			if err != nil {
+				return nil, fmt.Errorf("%w: extension %q rejected offer: [%w]", ErrHandshakeFailure, ext.Name(), err)
+			}
+			if conn == nil {
+				continue
+			}
+
+			if response.Name == "" {
+				response.Name = ext.Name()
+			}
+			negotiated = append(negotiated, newNegotiatedExtension(ext, response, conn))
+			used |= ext.RSV()
+		}
+	}
+
+	return negotiated, nil
+}
+
+// Client side, validates extensions selected by server
+func acceptedExtensions(offered []Extension, responses []ExtensionOffer) ([]negotiatedExtension, error) {
+	var negotiated []negotiatedExtension
+	var used RSV
+
+	for _, response := range responses {
+		var ext Extension
+		for _, e := range offered {
+			if strings.EqualFold(e.Name(), response.Name) {
+				ext = e
+				break
+			}
+		}
+
+		if ext == nil {
+			return nil, fmt.Errorf("%w: server selected extension %q which was not offered", ErrHandshakeFailure, response.Name)
+		}
+		if containsExtension(negotiated, ext.Name()) {
+			return nil, fmt.Errorf("%w: server selected extension %q more than once", ErrHandshakeFailure, response.Name)
+		}
+		if used&ext.RSV() != 0 {
+			return nil, fmt.Errorf("%w: extension %q uses RSV bits of another extension", ErrHandshakeFailure, response.Name)
+		}
+
+		conn, err := ext.Accepted(response)
+		if err != nil {
+			return nil, fmt.Errorf("%w: extension %q rejected response: [%w]", ErrHandshakeFailure, ext.Name(), err)
+		}
+
+		negotiated = append(negotiated, newNegotiatedExtension(ext, response, conn))
+		used |= ext.RSV()
+	}
+
+	return negotiated, nil
+}
+
+func containsExtension(exts []negotiatedExtension, name string) bool {
+	for _, e := range exts {
+		if strings.EqualFold(e.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Value of Sec-WebSocket-Extensions header, empty if there are no extensions
+func extensionsHeader(offers []ExtensionOffer) string {
+	elems := make([]string, len(offers))
+	for i, o := range offers {
+		elems[i] = o.String()
+	}
+	return strings.Join(elems, ", ")
+}
+
+// Extensions negotiated during opening handshake with parameters
+// of handshake response, in order they are applied to written messages
+func (c *Conn) Extensions() []ExtensionOffer {
+	offers := make([]ExtensionOffer, len(c.extensions))
+	for i, e := range c.extensions {
+		offers[i] = e.params
+	}
+	return offers
+}
+
+func (c *Conn) setExtensions(exts []negotiatedExtension) {
+	c.extensions = exts
+	c.extRSV, c.frameRSV = 0, 0
+	for _, e := range exts {
+		c.extRSV |= e.rsv
+		if e.compress {
+			c.compressExts = true
+		}
+		if e.frames != nil {
+			c.frameRSV |= e.rsv
+			c.frameExts = true
+		}
+	}
+}
+
+// Wraps message writer with extensions, first negotiated extension is outermost.
+// Compression extensions are skipped for messages left uncompressed
+func (c *Conn) wrapWriter(mt MessageType, rsv *RSV, w io.WriteCloser, skipCompression bool) io.WriteCloser {
+	for i := len(c.extensions) - 1; i >= 0; i-- {
+		if skipCompression && c.extensions[i].compress {
+			continue
+		}
+		w = c.extensions[i].conn.WrapWriter(mt, rsv, w)
+	}
+	return w
+}
+
+// Wraps message reader with extensions, last negotiated extension is innermost
+func (c *Conn) wrapReader(mt MessageType, rsv RSV, r io.Reader) io.Reader {
+	for i := len(c.extensions) - 1; i >= 0; i-- {
+		r = c.extensions[i].conn.WrapReader(mt, rsv, r)
+	}
+	return r
+}
+
+func (c *Conn) transformOutgoing(f *Frame) error {
+	for _, e := range c.extensions {
+		if e.frames == nil {
+			continue
+		}
+		err := e.frames.TransformOutgoing(f)
+		if err != nil {
+			return fmt.Errorf("extension %q failed to transform frame: [%w]", e.name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Conn) transformIncoming(f *Frame) error {
+	for i := len(c.extensions) - 1; i >= 0; i-- {
+		e := c.extensions[i]
+		if e.frames == nil {
+			continue
+		}
+		err := e.frames.TransformIncoming(f)
+		if err != nil {
+			return fmt.Errorf("extension %q failed to transform frame: [%w]", e.name, err)
+		}
+	}
+	return nil
+}
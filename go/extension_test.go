@@ -0,0 +1,318 @@
+package websocket_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+// XORs message payload with key negotiated in "key" parameter,
+// first frame of message is marked with RSV1
+type xorExtension struct {
+	key byte
+}
+
+func (e xorExtension) Name() string       { return "x-xor" }
+func (e xorExtension) RSV() websocket.RSV { return websocket.RSV1 }
+
+func (e xorExtension) Offer() websocket.ExtensionOffer {
+	return websocket.ExtensionOffer{
+		Name:   e.Name(),
+		Params: []websocket.ExtensionParam{{Name: "key", Value: strconv.Itoa(int(e.key))}},
+	}
+}
+
+func (e xorExtension) Accepted(response websocket.ExtensionOffer) (websocket.ExtensionConn, error) {
+	key, err := xorKey(response)
+	if err != nil {
+		return nil, err
+	}
+	return xorConn{key}, nil
+}
+
+func (e xorExtension) Accept(offer websocket.ExtensionOffer) (websocket.ExtensionOffer, websocket.ExtensionConn, error) {
+	key, err := xorKey(offer)
+	if err != nil {
+		return websocket.ExtensionOffer{}, nil, err
+	}
+	return offer, xorConn{key}, nil
+}
+
+func xorKey(params websocket.ExtensionOffer) (byte, error) {
+	v, _ := params.Param("key")
+	key, err := strconv.ParseUint(v, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid key %q", v)
+	}
+	return byte(key), nil
+}
+
+type xorConn struct {
+	key byte
+}
+
+func (c xorConn) WrapWriter(_ websocket.MessageType, rsv *websocket.RSV, w io.WriteCloser) io.WriteCloser {
+	*rsv |= websocket.RSV1
+	return &xorWriter{w, c.key}
+}
+
+func (c xorConn) WrapReader(_ websocket.MessageType, rsv websocket.RSV, r io.Reader) io.Reader {
+	if rsv&websocket.RSV1 == 0 {
+		return r
+	}
+	return &xorReader{r, c.key}
+}
+
+type xorWriter struct {
+	w   io.WriteCloser
+	key byte
+}
+
+func (w *xorWriter) Write(p []byte) (int, error) {
+	return w.w.Write(xor(bytes.Clone(p), w.key))
+}
+
+func (w *xorWriter) Flush() error {
+	return w.w.(websocket.Flusher).Flush()
+}
+
+func (w *xorWriter) Close() error {
+	return w.w.Close()
+}
+
+type xorReader struct {
+	r   io.Reader
+	key byte
+}
+
+func (r *xorReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	xor(p[:n], r.key)
+	return n, err
+}
+
+func xor(b []byte, key byte) []byte {
+	for i := range b {
+		b[i] ^= key
+	}
+	return b
+}
+
+// Prefixes every data frame with its sequence number, frames are marked with RSV2
+type seqExtension struct{}
+
+func (seqExtension) Name() string                    { return "x-seq" }
+func (seqExtension) RSV() websocket.RSV              { return websocket.RSV2 }
+func (seqExtension) Offer() websocket.ExtensionOffer { return websocket.ExtensionOffer{Name: "x-seq"} }
+
+func (seqExtension) Accepted(websocket.ExtensionOffer) (websocket.ExtensionConn, error) {
+	return &seqConn{}, nil
+}
+
+func (seqExtension) Accept(offer websocket.ExtensionOffer) (websocket.ExtensionOffer, websocket.ExtensionConn, error) {
+	return offer, &seqConn{}, nil
+}
+
+type seqConn struct {
+	out, in byte
+}
+
+func (c *seqConn) WrapWriter(_ websocket.MessageType, _ *websocket.RSV, w io.WriteCloser) io.WriteCloser {
+	return w
+}
+
+func (c *seqConn) WrapReader(_ websocket.MessageType, _ websocket.RSV, r io.Reader) io.Reader {
+	return r
+}
+
+func (c *seqConn) TransformOutgoing(f *websocket.Frame) error {
+	f.Payload = append([]byte{c.out}, f.Payload...)
+	f.RSV |= websocket.RSV2
+	c.out++
+	return nil
+}
+
+func (c *seqConn) TransformIncoming(f *websocket.Frame) error {
+	if f.RSV&websocket.RSV2 == 0 || len(f.Payload) == 0 {
+		return errors.New("frame has no sequence number")
+	}
+	if f.Payload[0] != c.in {
+		return fmt.Errorf("frame sequence number is %d, expected %d", f.Payload[0], c.in)
+	}
+	f.Payload = f.Payload[1:]
+	f.RSV &^= websocket.RSV2
+	c.in++
+	return nil
+}
+
+type frameRecorder struct {
+	mu     sync.Mutex
+	frames []websocket.CapturedFrame
+}
+
+func (r *frameRecorder) CaptureFrame(f *websocket.CapturedFrame) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f.Direction == websocket.DirectionOutbound {
+		cf := *f
+		cf.Payload = bytes.Clone(f.Payload)
+		r.frames = append(r.frames, cf)
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	d := &websocket.Dialer{Extensions: []websocket.Extension{xorExtension{0x5a}, seqExtension{}}}
+	u := &websocket.Upgrader{Extensions: []websocket.Extension{seqExtension{}, xorExtension{}}}
+
+	client, server, err := wstest.NewPipeWith(d, u)
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	defer client.Close()
+
+	go wstest.Echo(server)
+
+	rec := &frameRecorder{}
+	client.SetCapture(rec)
+
+	w, err := client.NextWriter(websocket.TextMessage)
+	if err != nil {
+		t.Fatalf("failed to get writer: %v", err)
+	}
+	if _, err := io.WriteString(w, "hello, "); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := w.(websocket.Flusher).Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if _, err := io.WriteString(w, "world"); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+
+	mt, data, err := client.NextMessage()
+	if err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if mt != websocket.TextMessage || string(data) != "hello, world" {
+		t.Fatalf("echo = %s %q, want text %q", mt, data, "hello, world")
+	}
+
+	if err := client.WriteMessage(websocket.BinaryMessage, []byte{1, 2, 3}); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	mt, data, err = client.NextMessage()
+	if err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if mt != websocket.BinaryMessage || !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Fatalf("echo = %s %v, want binary %v", mt, data, []byte{1, 2, 3})
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	want := []struct {
+		rsv1, rsv2 bool
+		payload    []byte
+	}{
+		{true, true, append([]byte{0}, xor([]byte("hello, "), 0x5a)...)},
+		{false, true, append([]byte{1}, xor([]byte("world"), 0x5a)...)},
+		{true, true, append([]byte{2}, xor([]byte{1, 2, 3}, 0x5a)...)},
+	}
+	if len(rec.frames) != len(want) {
+		t.Fatalf("client wrote %d frames, want %d", len(rec.frames), len(want))
+	}
+	for i, w := range want {
+		f := rec.frames[i]
+		if f.RSV1 != w.rsv1 || f.RSV2 != w.rsv2 || f.RSV3 {
+			t.Errorf("frame %d has RSV bits %v %v %v, want %v %v false", i, f.RSV1, f.RSV2, f.RSV3, w.rsv1, w.rsv2)
+		}
+		if !bytes.Equal(f.Payload, w.payload) {
+			t.Errorf("frame %d payload = %v, want %v", i, f.Payload, w.payload)
+		}
+	}
+}
+
+func TestExtensionsNotSupportedByServer(t *testing.T) {
+	d := &websocket.Dialer{Extensions: []websocket.Extension{xorExtension{0x5a}}}
+
+	client, server, err := wstest.NewPipeWith(d, &websocket.Upgrader{})
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	defer client.Close()
+	go wstest.Echo(server)
+
+	rec := &frameRecorder{}
+	client.SetCapture(rec)
+
+	if err := client.WriteMessage(websocket.TextMessage, []byte("plain")); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	_, data, err := client.NextMessage()
+	if err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if string(data) != "plain" {
+		t.Fatalf("echo = %q, want %q", data, "plain")
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.frames) != 1 || rec.frames[0].RSV1 || string(rec.frames[0].Payload) != "plain" {
+		t.Fatalf("message must be sent as is without RSV bits")
+	}
+}
+
+func TestExtensionHeaderParsing(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		err    bool
+	}{
+		{"permessage-deflate; client_max_window_bits, x-ext", "permessage-deflate; client_max_window_bits, x-ext", false},
+		{`x; a="b"; c = d ,, y`, "x; a=b; c=d, y", false},
+		{`x; a="b,c"`, "", true},
+		{"x; a=", "", true},
+		{"x y", "", true},
+		{`x; a="b`, "", true},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+		h.Set("Sec-WebSocket-Extensions", tt.header)
+
+		offers, err := websocket.ParseExtensions(h)
+		if tt.err {
+			if !errors.Is(err, websocket.ErrInvalidExtensionHeader) {
+				t.Errorf("ParseExtensions(%q) error = %v, want ErrInvalidExtensionHeader", tt.header, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseExtensions(%q) failed: %v", tt.header, err)
+			continue
+		}
+
+		var got []string
+		for _, o := range offers {
+			got = append(got, o.String())
+		}
+		if strings.Join(got, ", ") != tt.want {
+			t.Errorf("ParseExtensions(%q) = %q, want %q", tt.header, strings.Join(got, ", "), tt.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/wmdanor/websocket/go/internal"
+)
+
+// Single websocket frame with unmasked payload
+type Frame struct {
+	IsFinal bool
+	// RSV bits left after extensions transformed frame
+	RSV RSV
+	// ContinuationFrame for all frames of fragmented message except first one
+	Type    MessageType
+	Payload []byte
+}
+
+// Implemented by writer returned from NextWriter, allows to send
+// buffered data as non-final frame without ending the message
+type Flusher interface {
+	Flush() error
+}
+
+// Reads next frame, control frames are returned as well after being handled
+// by close, ping and pong handlers. Calls after close frame was returned
+// fail with error wrapping io.EOF.
+// Text frames are not validated to be UTF-8 as single frame may end in the
+// middle of rune. Extensions transform frames only, message transforms are
+// not applied. Must not be mixed with NextReader in the middle of message
+func (c *Conn) ReadFrame() (*Frame, error) {
+	if err := c.getErr(); err != nil {
+		return nil, err
+	}
+
+	if c.isClosed() {
+		return nil, ErrConnClosed
+	}
+
+	if c.curReader != nil {
+		err := c.curReader.close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to close current reader: [%w]", err)
+		}
+		c.curReader = nil
+	}
+
+	f, err := c.readRawFrameHeader()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read frame: [%w]", err)
+	}
+
+	if f.Opcode.IsControl() {
+		payload, err := c.readControlFrame(f)
+		if err != nil && !errors.Is(err, errCloseReceived) {
+			return nil, err
+		}
+
+		return &Frame{IsFinal: true, Type: MessageType(f.Opcode), Payload: payload}, nil
+	}
+
+	if f.Opcode == internal.OpcodeContinuationFrame && !c.rFragmented {
+		return nil, c.fatal(CloseProtocolError,
+			fmt.Errorf("received continuation frame without message to continue"), "")
+	}
+	if f.Opcode != internal.OpcodeContinuationFrame && c.rFragmented {
+		return nil, c.fatal(CloseProtocolError,
+			fmt.Errorf("succeeding frames must be continuation frames received opcode: %X", f.Opcode), "")
+	}
+	c.rFragmented = !f.IsFinalFrame
+
+	if c.readLimit > 0 && f.PayloadLength > uint64(c.readLimit-int64(c.rBytes)) {
+		return nil, c.fatal(CloseMessageTooBig, ErrReadLimitExceeded, "")
+	}
+
+	payload, err := c.readPayload(f.PayloadLength)
+	if err != nil {
+		return nil, c.fatal(CloseInternalServerErr,
+			fmt.Errorf("failed to read frame data: [%w]", err), "")
+	}
+	if c.isServer {
+		internal.Mask(payload, f.MaskingKey)
+	}
+	c.captureFrame(f, DirectionInbound, payload)
+
+	c.l.Debug("read frame", "isFinal", f.IsFinalFrame, "opcode", f.Opcode, "payloadLength", f.PayloadLength)
+
+	if f.Opcode != internal.OpcodeContinuationFrame {
+		c.rType = MessageType(f.Opcode)
+		c.rSpan = c.startSpan(SpanRead,
+			Attribute{AttrMessageType, c.rType.String()}, Attribute{AttrMessageSeq, c.seq.Add(1)})
+	}
+	c.rFrames++
+	c.rBytes += len(payload)
+	if f.IsFinalFrame {
+		c.obs.MessageRead(c.side(), c.rType, c.rBytes, c.rFrames)
+		c.rSpan.SetAttributes(Attribute{AttrMessageSize, c.rBytes})
+		c.rSpan.End()
+		c.rFrames, c.rBytes, c.rSpan = 0, 0, nil
+	}
+
+	fr := &Frame{IsFinal: f.IsFinalFrame, Type: MessageType(f.Opcode), RSV: headerRSV(f), Payload: payload}
+	if c.frameExts && f.Opcode.IsData() {
+		err = c.transformIncoming(fr)
+		if err != nil {
+			return nil, c.fatal(CloseProtocolError, err, "")
+		}
+	}
+
+	return fr, nil
+}
+
+// Writes single frame. Data frames of one message must be started with text or
+// binary frame and continued with ContinuationFrame frames, last one being final.
+// Must not be used while writer returned from NextWriter is open
+func (c *Conn) WriteFrame(isFinal bool, mt MessageType, payload []byte) error {
+	if err := c.getErr(); err != nil {
+		return err
+	}
+
+	if c.curWriter != nil {
+		return fmt.Errorf("message writer is open, close it before writing frames")
+	}
+
+	opcode := internal.Opcode(mt)
+	if opcode.IsReserved() {
+		return fmt.Errorf("frame type must not be one of reserved values")
+	}
+
+	switch {
+	case opcode.IsControl() && !isFinal:
+		return fmt.Errorf("control frames must not be fragmented")
+	case opcode.IsControl():
+		// control frames are allowed in the middle of fragmented message
+	case opcode == internal.OpcodeContinuationFrame && !c.wFragmented:
+		return fmt.Errorf("continuation frame must follow non-final text or binary frame")
+	case opcode != internal.OpcodeContinuationFrame && c.wFragmented:
+		return fmt.Errorf("previous message is not finished, expected continuation frame")
+	}
+
+	if opcode.IsControl() {
+		return c.WriteControl(mt, payload)
+	}
+
+	if opcode != internal.OpcodeContinuationFrame {
+		c.wType = mt
+		c.wSpan = c.startSpan(SpanWrite,
+			Attribute{AttrMessageType, mt.String()}, Attribute{AttrMessageSeq, c.seq.Add(1)})
+	}
+	var rsv RSV
+	if c.frameExts && opcode.IsData() {
+		fr := &Frame{IsFinal: isFinal, Type: mt, Payload: payload}
+		err := c.transformOutgoing(fr)
+		if err != nil {
+			endSpan(c.wSpan, err)
+			return err
+		}
+		payload, rsv = fr.Payload, fr.RSV
+	}
+
+	// caller data must stay intact, so it is not masked in place
+	err := c.writeFrame(isFinal, rsv, opcode, payload, true)
+	if err != nil {
+		endSpan(c.wSpan, err)
+		return fmt.Errorf("failed to write frame: [%w]", err)
+	}
+	c.wFragmented = !isFinal
+
+	c.wFrames++
+	c.wBytes += len(payload)
+	if isFinal {
+		c.obs.MessageWritten(c.side(), c.wType, c.wBytes, c.wFrames)
+		c.wSpan.SetAttributes(Attribute{AttrMessageSize, c.wBytes})
+		c.wSpan.End()
+		c.wFrames, c.wBytes, c.wSpan = 0, 0, nil
+	}
+
+	return nil
+}
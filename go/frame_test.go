@@ -0,0 +1,161 @@
+package websocket_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+func TestReadFrameClose(t *testing.T) {
+	server, raw, err := wstest.NewRawClient(nil)
+	if err != nil {
+		t.Fatalf("failed to create raw client: %v", err)
+	}
+	defer raw.Close()
+
+	writeFrames(t, raw,
+		raw.Frame(websocket.TextMessage, true, []byte("last")),
+		raw.Frame(websocket.CloseMessage, true, wstest.ClosePayload(websocket.CloseGoingAway, "bye")),
+	)
+
+	// echoed close frame is read from raw client
+	go func() { _, _, _ = raw.ReadClose() }()
+
+	want := []websocket.Frame{
+		{IsFinal: true, Type: websocket.TextMessage, Payload: []byte("last")},
+		{IsFinal: true, Type: websocket.CloseMessage, Payload: wstest.ClosePayload(websocket.CloseGoingAway, "bye")},
+	}
+	for _, w := range want {
+		f, err := server.ReadFrame()
+		if err != nil {
+			t.Fatalf("failed to read frame: %v", err)
+		}
+		if f.IsFinal != w.IsFinal || f.Type != w.Type || string(f.Payload) != string(w.Payload) {
+			t.Errorf("frame = {%v %s %q}, want {%v %s %q}", f.IsFinal, f.Type, f.Payload, w.IsFinal, w.Type, w.Payload)
+		}
+	}
+
+	if _, err := server.ReadFrame(); !errors.Is(err, io.EOF) {
+		t.Errorf("read after close frame error = %v, want io.EOF", err)
+	}
+}
+
+func TestReadFrameLimit(t *testing.T) {
+	// masked binary frame header announcing 2^62 bytes, payload never follows
+	oversized := binary.BigEndian.AppendUint64([]byte{0x82, 0x80 | 127}, 1<<62)
+	oversized = append(oversized, 0, 0, 0, 0)
+
+	tests := []struct {
+		name  string
+		write func(raw *wstest.RawConn) error
+		// frames read before limit is exceeded
+		frames int
+	}{
+		{"oversized frame", func(raw *wstest.RawConn) error {
+			_, err := raw.Write(oversized)
+			return err
+		}, 0},
+		{"fragmented message", func(raw *wstest.RawConn) error {
+			err := raw.WriteFrame(raw.Frame(websocket.TextMessage, false, []byte("01234")))
+			if err != nil {
+				return err
+			}
+			return raw.WriteFrame(raw.Frame(websocket.ContinuationFrame, true, []byte("567890")))
+		}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, raw, err := wstest.NewRawClient(&websocket.Upgrader{ReadLimit: 10})
+			if err != nil {
+				t.Fatalf("failed to create raw client: %v", err)
+			}
+			defer raw.Close()
+
+			go func() { _ = tt.write(raw) }()
+
+			readErr := make(chan error, 1)
+			go func() {
+				for range tt.frames {
+					if _, err := server.ReadFrame(); err != nil {
+						readErr <- err
+						return
+					}
+				}
+				_, err := server.ReadFrame()
+				readErr <- err
+			}()
+
+			code, _, err := raw.ReadClose()
+			if err != nil || code != websocket.CloseMessageTooBig {
+				t.Fatalf("close code = %d %v, want %d", code, err, websocket.CloseMessageTooBig)
+			}
+			if err := <-readErr; !errors.Is(err, websocket.ErrReadLimitExceeded) {
+				t.Errorf("read error = %v, want %v", err, websocket.ErrReadLimitExceeded)
+			}
+		})
+	}
+}
+
+func TestNextWriterInFragmentedMessage(t *testing.T) {
+	client, server := wstest.NewPipe()
+	defer client.Close()
+	go wstest.Echo(server)
+
+	if err := client.WriteFrame(false, websocket.TextMessage, []byte("hello, ")); err != nil {
+		t.Fatalf("failed to write frame: %v", err)
+	}
+	if err := client.WriteMessage(websocket.TextMessage, []byte("interleaved")); err == nil {
+		t.Fatal("message was written in the middle of fragmented one")
+	}
+	if err := client.WriteFrame(true, websocket.ContinuationFrame, []byte("world")); err != nil {
+		t.Fatalf("failed to write frame: %v", err)
+	}
+
+	mt, data, err := client.NextMessage()
+	if err != nil || mt != websocket.TextMessage || string(data) != "hello, world" {
+		t.Fatalf("echo = %s %q %v, want text %q", mt, data, err, "hello, world")
+	}
+}
+
+func TestWriteFrameKeepsData(t *testing.T) {
+	client, raw, err := wstest.NewRawServer(nil)
+	if err != nil {
+		t.Fatalf("failed to create raw server: %v", err)
+	}
+	defer raw.Close()
+
+	frames := []struct {
+		isFinal bool
+		mt      websocket.MessageType
+	}{
+		{false, websocket.BinaryMessage},
+		{true, websocket.PingMessage},
+		{true, websocket.ContinuationFrame},
+	}
+	for _, f := range frames {
+		data := []byte("payload")
+
+		written := make(chan error, 1)
+		go func() { written <- client.WriteFrame(f.isFinal, f.mt, data) }()
+		got, err := raw.ReadFrame()
+		if err != nil {
+			t.Fatalf("failed to read frame: %v", err)
+		}
+		if err := <-written; err != nil {
+			t.Fatalf("failed to write frame: %v", err)
+		}
+
+		if !got.IsMasked || string(got.Payload) != "payload" {
+			t.Fatalf("got %s frame %q, masked %t, want masked %q", got.Opcode, got.Payload, got.IsMasked, "payload")
+		}
+		// client masks frames, caller data must not be masked in place
+		if string(data) != "payload" {
+			t.Fatalf("%s frame data changed to %q", f.mt, data)
+		}
+	}
+}
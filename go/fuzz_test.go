@@ -0,0 +1,594 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// Seed corpus is in testdata/fuzz, run with e.g.
+//
+//	go test -run '^$' -fuzz FuzzServerFrames
+
+// Max amount of messages read from single input, inputs are small,
+// so it is never reached unless reading loops without consuming input
+const fuzzMaxMessages = 1000
+
+// net.Conn which reads from fixed input and records written data
+type fuzzConn struct {
+	in  *bytes.Reader
+	out bytes.Buffer
+
+	// builds input from data written so far, called on first read
+	respond func(written []byte) []byte
+}
+
+func newFuzzConn(in []byte) *fuzzConn {
+	return &fuzzConn{in: bytes.NewReader(in)}
+}
+
+func (c *fuzzConn) Read(b []byte) (int, error) {
+	if c.in == nil {
+		c.in = bytes.NewReader(c.respond(c.out.Bytes()))
+	}
+	return c.in.Read(b)
+}
+
+func (c *fuzzConn) Write(b []byte) (int, error)      { return c.out.Write(b) }
+func (c *fuzzConn) Close() error                     { return nil }
+func (c *fuzzConn) LocalAddr() net.Addr              { return fuzzAddr{} }
+func (c *fuzzConn) RemoteAddr() net.Addr             { return fuzzAddr{} }
+func (c *fuzzConn) SetDeadline(time.Time) error      { return nil }
+func (c *fuzzConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *fuzzConn) SetWriteDeadline(time.Time) error { return nil }
+
+type fuzzAddr struct{}
+
+func (fuzzAddr) Network() string { return "fuzz" }
+func (fuzzAddr) String() string  { return "fuzz" }
+
+func newFuzzWsConn(t *testing.T, netConn net.Conn, isServer bool) *Conn {
+	c, err := newConn(netTransport{netConn}, bufio.NewReader(netConn), nil, "", slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatalf("failed to create conn: %v", err)
+	}
+	c.isServer = isServer
+	return c
+}
+
+// Encodes frame, payload is masked with fixed key if masked is true
+func fuzzFrame(isFinal bool, opcode byte, masked bool, payload []byte) []byte {
+	b0 := opcode & 0x0F
+	if isFinal {
+		b0 |= 0x80
+	}
+
+	var b1 byte
+	if masked {
+		b1 = 0x80
+	}
+
+	b := []byte{b0}
+	switch {
+	case len(payload) <= 125:
+		b = append(b, b1|byte(len(payload)))
+	case len(payload) <= math.MaxUint16:
+		b = append(b, b1|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b = append(b, b1|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+
+	if !masked {
+		return append(b, payload...)
+	}
+
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	b = append(b, key[:]...)
+	for i, p := range payload {
+		b = append(b, p^key[i%4])
+	}
+	return b
+}
+
+type writtenFrame struct {
+	isFinal bool
+	opcode  byte
+	payload []byte
+}
+
+// Parses frames written by conn, checks that they are well formed
+func parseWrittenFrames(b []byte, masked bool) ([]writtenFrame, error) {
+	var frames []writtenFrame
+
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("truncated frame header")
+		}
+		f := writtenFrame{isFinal: b[0]&0x80 != 0, opcode: b[0] & 0x0F}
+		if b[0]&0x70 != 0 {
+			return nil, fmt.Errorf("RSV bits are set")
+		}
+		if (b[1]&0x80 != 0) != masked {
+			return nil, fmt.Errorf("frame masking is %t, expected %t", b[1]&0x80 != 0, masked)
+		}
+
+		length := uint64(b[1] & 0x7F)
+		b = b[2:]
+		switch length {
+		case 126:
+			if len(b) < 2 {
+				return nil, fmt.Errorf("truncated frame length")
+			}
+			length = uint64(binary.BigEndian.Uint16(b))
+			b = b[2:]
+		case 127:
+			if len(b) < 8 {
+				return nil, fmt.Errorf("truncated frame length")
+			}
+			length = binary.BigEndian.Uint64(b)
+			b = b[8:]
+		}
+
+		var key [4]byte
+		if masked {
+			if len(b) < 4 {
+				return nil, fmt.Errorf("truncated masking key")
+			}
+			copy(key[:], b)
+			b = b[4:]
+		}
+
+		if uint64(len(b)) < length {
+			return nil, fmt.Errorf("truncated frame payload")
+		}
+		f.payload = slices.Clone(b[:length])
+		b = b[length:]
+		for i := range f.payload {
+			f.payload[i] ^= key[i%4]
+		}
+
+		frames = append(frames, f)
+	}
+
+	return frames, nil
+}
+
+// Checks invariants of frames written in response to arbitrary input
+func checkWrittenFrames(t *testing.T, out []byte, masked bool) []writtenFrame {
+	frames, err := parseWrittenFrames(out, masked)
+	if err != nil {
+		t.Fatalf("conn wrote malformed frame: %v", err)
+	}
+
+	for i, f := range frames {
+		if f.opcode >= 8 && (len(f.payload) > 125 || !f.isFinal) {
+			t.Fatalf("conn wrote invalid control frame: opcode %d, final %t, %d bytes",
+				f.opcode, f.isFinal, len(f.payload))
+		}
+		if f.opcode != byte(CloseMessage) {
+			continue
+		}
+
+		if i != len(frames)-1 {
+			t.Fatalf("conn wrote frames after close frame")
+		}
+		if len(f.payload) == 1 {
+			t.Fatalf("conn wrote close frame with 1 byte payload")
+		}
+		if len(f.payload) >= 2 {
+			code := CloseCode(binary.BigEndian.Uint16(f.payload))
+			if !code.IsValid() {
+				t.Fatalf("conn wrote close frame with invalid code %d", code)
+			}
+			if !utf8.Valid(f.payload[2:]) {
+				t.Fatalf("conn wrote close frame with invalid UTF-8 reason %q", f.payload[2:])
+			}
+		}
+	}
+
+	return frames
+}
+
+// Reads all messages from conn with message or frame API
+func readAll(t *testing.T, c *Conn, in []byte, frameAPI bool) {
+	for range fuzzMaxMessages {
+		if frameAPI {
+			f, err := c.ReadFrame()
+			if err != nil {
+				return
+			}
+			if len(f.Payload) > len(in) {
+				t.Fatalf("frame payload of %d bytes is bigger than input", len(f.Payload))
+			}
+			continue
+		}
+
+		mt, data, err := c.NextMessage()
+		if err != nil {
+			return
+		}
+		if len(data) > len(in) {
+			t.Fatalf("message of %d bytes is bigger than input", len(data))
+		}
+		if mt == TextMessage && !utf8.Valid(data) {
+			t.Fatalf("invalid UTF-8 text message returned without error: %q", data)
+		}
+	}
+
+	t.Fatalf("read more than %d messages from %d bytes of input", fuzzMaxMessages, len(in))
+}
+
+func addFrameSeeds(f *testing.F, masked bool) {
+	frame := func(isFinal bool, opcode byte, payload string) []byte {
+		return fuzzFrame(isFinal, opcode, masked, []byte(payload))
+	}
+	closeFrame := func(code CloseCode, reason string) []byte {
+		return frame(true, byte(CloseMessage), string(CloseMessageData(code, reason)))
+	}
+
+	seeds := [][]byte{
+		frame(true, byte(TextMessage), "hello"),
+		bytes.Join([][]byte{
+			frame(false, byte(TextMessage), "Hello, "),
+			frame(true, byte(PingMessage), "ping"),
+			frame(true, byte(ContinuationFrame), "World!"),
+			closeFrame(CloseNormalClosure, "bye"),
+		}, nil),
+		frame(true, byte(BinaryMessage), strings.Repeat("b", 300)),
+		frame(true, byte(TextMessage), "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5"),
+		bytes.Join([][]byte{
+			frame(false, byte(TextMessage), "\xce\xba\xe1"),
+			frame(true, byte(ContinuationFrame), "\xbd\xb9"),
+		}, nil),
+		frame(true, byte(TextMessage), "\xed\xa0\x80"),
+		frame(true, byte(ContinuationFrame), "cont"),
+		frame(true, 3, "reserved"),
+		frame(false, byte(PingMessage), "ping"),
+		frame(true, byte(PingMessage), strings.Repeat("p", 126)),
+		closeFrame(1005, ""),
+		frame(true, byte(CloseMessage), "\x03"),
+		// 64 bit length with most significant bit set
+		{0x82, 0xFF, 0x80, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4},
+		// huge length without payload
+		{0x82, 0xFF, 0x7F, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 1, 2, 3, 4},
+		// RSV bits
+		{0xF1, 0x80, 1, 2, 3, 4},
+	}
+
+	for _, seed := range seeds {
+		f.Add(seed, false)
+		f.Add(seed, true)
+	}
+}
+
+func fuzzFrameStream(f *testing.F, isServer bool) {
+	// server receives masked frames and writes unmasked ones
+	addFrameSeeds(f, isServer)
+
+	f.Fuzz(func(t *testing.T, in []byte, frameAPI bool) {
+		netConn := newFuzzConn(in)
+		c := newFuzzWsConn(t, netConn, isServer)
+
+		readAll(t, c, in, frameAPI)
+		_ = c.Close()
+
+		checkWrittenFrames(t, netConn.out.Bytes(), !isServer)
+	})
+}
+
+func FuzzServerFrames(f *testing.F) {
+	fuzzFrameStream(f, true)
+}
+
+func FuzzClientFrames(f *testing.F) {
+	fuzzFrameStream(f, false)
+}
+
+// Checks that close frame with arbitrary payload is answered with correct close code
+func FuzzClosePayload(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x03})
+	f.Add([]byte{0x03, 0xE8})
+	f.Add(append([]byte{0x03, 0xE8}, "normal"...))
+	f.Add([]byte{0x03, 0xED})
+	f.Add([]byte{0x0B, 0xB8})
+	f.Add([]byte{0x13, 0x87})
+	f.Add([]byte{0x13, 0x88})
+	f.Add(append([]byte{0x03, 0xE8}, "\xed\xa0\x80"...))
+	f.Add(append([]byte{0x03, 0xE8}, strings.Repeat("r", 123)...))
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		netConn := newFuzzConn(fuzzFrame(true, byte(CloseMessage), true, payload))
+		c := newFuzzWsConn(t, netConn, true)
+
+		_, _, err := c.NextMessage()
+		if err == nil {
+			t.Fatalf("reading close frame must fail")
+		}
+
+		frames := checkWrittenFrames(t, netConn.out.Bytes(), false)
+		if len(frames) != 1 || frames[0].opcode != byte(CloseMessage) {
+			t.Fatalf("conn must reply with single close frame, wrote %d frames", len(frames))
+		}
+
+		var code CloseCode
+		if len(frames[0].payload) >= 2 {
+			code = CloseCode(binary.BigEndian.Uint16(frames[0].payload))
+		}
+
+		var expected CloseCode
+		switch {
+		case len(payload) > 125 || len(payload) == 1:
+			expected = CloseProtocolError
+		case len(payload) == 0:
+			expected = CloseNormalClosure
+		case !utf8.Valid(payload[2:]):
+			expected = CloseInvalidFramePayloadData
+		case !CloseCode(binary.BigEndian.Uint16(payload)).IsValid():
+			expected = CloseProtocolError
+		default:
+			expected = CloseCode(binary.BigEndian.Uint16(payload))
+		}
+
+		if code != expected {
+			t.Fatalf("conn replied with close code %d, expected %d", code, expected)
+		}
+	})
+}
+
+func FuzzSubprotocolHeader(f *testing.F) {
+	f.Add("chat, superchat", "superchat,chat")
+	f.Add("chat", "")
+	f.Add(" , ,chat,,", "chat")
+	f.Add("a b, c\t", "a b")
+	f.Add("", "chat")
+
+	f.Fuzz(func(t *testing.T, header string, supported string) {
+		h := http.Header{}
+		h.Add(headerSecWsProto, header)
+
+		tokens := headerTokens(h, headerSecWsProto)
+		for _, token := range tokens {
+			if token == "" || strings.Contains(token, ",") || strings.TrimSpace(token) != token {
+				t.Fatalf("invalid token %q parsed from %q", token, header)
+			}
+		}
+
+		supportedList := strings.Split(supported, ",")
+		selected := selectSubprotocol(supportedList, tokens)
+		if selected == "" {
+			return
+		}
+		if !slices.Contains(tokens, selected) || !slices.Contains(supportedList, selected) {
+			t.Fatalf("selected %q which is not both requested %q and supported %q",
+				selected, tokens, supportedList)
+		}
+	})
+}
+
+// Runs server side opening handshake with arbitrary request headers
+func FuzzOpenHandshake(f *testing.F) {
+	f.Add("GET", "websocket", "Upgrade", "13", "dGhlIHNhbXBsZSBub25jZQ==", "chat, superchat", "")
+	f.Add("GET", "WebSocket", "upgrade", "13", "dGhlIHNhbXBsZSBub25jZQ==", "", "permessage-deflate; client_max_window_bits")
+	f.Add("POST", "websocket", "Upgrade", "13", "dGhlIHNhbXBsZSBub25jZQ==", "", "")
+	f.Add("GET", "websocket", "keep-alive, Upgrade", "8", "short", "chat", "x-ext; a=\"b,c\", y")
+	f.Add("GET", "websocket", "Upgrade", "13", "!!!!", "", "")
+
+	f.Fuzz(func(t *testing.T, method, upgrade, connection, version, key, protocol, extensions string) {
+		req, err := http.NewRequest(http.MethodGet, "http://fuzz/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Method = method
+		req.Header[headerUpgrade] = []string{upgrade}
+		req.Header[headerConn] = []string{connection}
+		req.Header[headerSecWsVersion] = []string{version}
+		req.Header[headerSecWsKey] = []string{key}
+		req.Header[headerSecWsProto] = []string{protocol}
+		req.Header[headerSecWsExt] = []string{extensions}
+
+		u := Upgrader{
+			Subprotocols: []string{"chat", "superchat"},
+			Extensions:   []Extension{fuzzExtension{"x-ext", RSV1}, fuzzExtension{"permessage-deflate", RSV1}},
+		}
+		w := httptest.NewRecorder()
+
+		subprotocol, exts, err := u.handleOpenHandshake(w, req, u.Subprotocols, slog.New(slog.DiscardHandler))
+		if err != nil {
+			if !errors.Is(err, ErrHandshakeFailure) {
+				t.Fatalf("handshake error must wrap ErrHandshakeFailure: %v", err)
+			}
+			return
+		}
+
+		if accept := w.Header().Get(headerSecWsAccept); accept != newSecWebsocketAccept(key).String() {
+			t.Fatalf("invalid %s header %q", headerSecWsAccept, accept)
+		}
+		if subprotocol != "" && !slices.Contains(headerTokens(req.Header, headerSecWsProto), subprotocol) {
+			t.Fatalf("selected subprotocol %q was not requested", subprotocol)
+		}
+
+		responses, err := ParseExtensions(w.Header())
+		if err != nil {
+			t.Fatalf("sent invalid %s header: %v", headerSecWsExt, err)
+		}
+		if len(responses) != len(exts) {
+			t.Fatalf("negotiated %d extensions, but %d were sent", len(exts), len(responses))
+		}
+		// both extensions use RSV1, so only one of them may be accepted
+		if len(responses) > 1 {
+			t.Fatalf("accepted extensions with conflicting RSV bits: %s", w.Header().Get(headerSecWsExt))
+		}
+		offers, _ := ParseExtensions(req.Header)
+		for _, r := range responses {
+			if !slices.ContainsFunc(offers, func(o ExtensionOffer) bool { return strings.EqualFold(o.Name, r.Name) }) {
+				t.Fatalf("accepted extension %q which was not offered", r.Name)
+			}
+		}
+	})
+}
+
+// Accepts every offer, responds with offered parameters
+type fuzzExtension struct {
+	name string
+	rsv  RSV
+}
+
+func (e fuzzExtension) Name() string          { return e.name }
+func (e fuzzExtension) RSV() RSV              { return e.rsv }
+func (e fuzzExtension) Offer() ExtensionOffer { return ExtensionOffer{Name: e.name} }
+
+func (e fuzzExtension) Accepted(ExtensionOffer) (ExtensionConn, error) {
+	return fuzzExtensionConn{}, nil
+}
+
+func (e fuzzExtension) Accept(offer ExtensionOffer) (ExtensionOffer, ExtensionConn, error) {
+	return offer, fuzzExtensionConn{}, nil
+}
+
+type fuzzExtensionConn struct{}
+
+func (fuzzExtensionConn) WrapWriter(_ MessageType, _ *RSV, w io.WriteCloser) io.WriteCloser {
+	return w
+}
+
+func (fuzzExtensionConn) WrapReader(_ MessageType, _ RSV, r io.Reader) io.Reader {
+	return r
+}
+
+// Checks that parsed extensions are formatted back to equal header
+func FuzzExtensionHeader(f *testing.F) {
+	f.Add("permessage-deflate; client_max_window_bits, permessage-deflate")
+	f.Add("x-ext; a=\"b\", y;z=1")
+	f.Add(" , a ;b = c ,, d")
+	f.Add("a; b=\"c,d\"")
+	f.Add("a; b=\"\\c\"")
+	f.Add("a;")
+
+	f.Fuzz(func(t *testing.T, header string) {
+		h := http.Header{}
+		h.Add(headerSecWsExt, header)
+
+		offers, err := ParseExtensions(h)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidExtensionHeader) {
+				t.Fatalf("parse error must wrap ErrInvalidExtensionHeader: %v", err)
+			}
+			return
+		}
+
+		formatted := extensionsHeader(offers)
+		h.Set(headerSecWsExt, formatted)
+		reparsed, err := ParseExtensions(h)
+		if err != nil {
+			t.Fatalf("failed to parse formatted header %q: %v", formatted, err)
+		}
+		if !slices.EqualFunc(offers, reparsed, func(a, b ExtensionOffer) bool {
+			return a.Name == b.Name && slices.Equal(a.Params, b.Params)
+		}) {
+			t.Fatalf("header %q was formatted as %q which parses differently", header, formatted)
+		}
+	})
+}
+
+// Placeholder in fuzzed handshake response replaced with valid accept value
+const fuzzAcceptPlaceholder = "{accept}"
+
+// Runs client opening handshake against arbitrary response followed by frames
+func FuzzClientHandshake(f *testing.F) {
+	valid := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + fuzzAcceptPlaceholder + "\r\n"
+
+	f.Add([]byte(valid + "\r\n"))
+	f.Add([]byte(valid + "Sec-WebSocket-Protocol: chat\r\n\r\n" + string(fuzzFrame(true, 1, false, []byte("hi")))))
+	f.Add([]byte(valid + "Sec-WebSocket-Protocol: other\r\n\r\n"))
+	f.Add([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	f.Add([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: wrong\r\n\r\n"))
+	f.Add([]byte("HTTP/1.1 101\r\n"))
+
+	f.Fuzz(func(t *testing.T, response []byte) {
+		netConn := &fuzzConn{}
+		netConn.respond = func(written []byte) []byte {
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(written)))
+			if err != nil {
+				t.Fatalf("client wrote invalid request: %v", err)
+			}
+			accept := newSecWebsocketAccept(req.Header.Get(headerSecWsKey)).String()
+			return bytes.ReplaceAll(response, []byte(fuzzAcceptPlaceholder), []byte(accept))
+		}
+
+		d := Dialer{
+			Subprotocols: []string{"chat"},
+			NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return netConn, nil
+			},
+		}
+
+		c, err := d.Dial("ws://fuzz/", nil)
+		if err != nil {
+			return
+		}
+
+		if c.Subprotocol() != "" && c.Subprotocol() != "chat" {
+			t.Fatalf("accepted subprotocol %q which was not requested", c.Subprotocol())
+		}
+
+		written := netConn.out.Len()
+		readAll(t, c, response, false)
+		_ = c.Close()
+
+		checkWrittenFrames(t, netConn.out.Bytes()[written:], true)
+	})
+}
+
+// Checks that PROXY header parser doesn't panic or read past header
+func FuzzProxyHeader(f *testing.F) {
+	f.Add([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n"))
+	f.Add([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"))
+	f.Add([]byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"))
+	f.Add([]byte("PROXY TCP4 192.0.2.1\r\n"))
+	f.Add(append([]byte(proxyV2Signature), 0x21, 0x11, 0x00, 0x12,
+		192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb, 0x01, 0x00, 0x03, 'h', '2', 0x00))
+	f.Add(append([]byte(proxyV2Signature), 0x20, 0x00, 0x00, 0x00))
+	f.Add([]byte("GET / HTTP/1.1\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		br := bytes.NewReader(data)
+		r := bufio.NewReader(br)
+
+		h, err := readProxyHeader(r, ProxyProtocolRequired)
+		if err != nil {
+			return
+		}
+
+		if h.Version != 1 && h.Version != 2 {
+			t.Fatalf("parsed header has version %d", h.Version)
+		}
+		if (h.Source == nil) != (h.Destination == nil) {
+			t.Fatalf("only one of addresses is set: %v %v", h.Source, h.Destination)
+		}
+
+		consumed := len(data) - r.Buffered() - br.Len()
+		if h.Version == 1 && (consumed > proxyV1MaxLength || !bytes.HasSuffix(data[:consumed], []byte("\r\n"))) {
+			t.Fatalf("v1 header consumed %d bytes %q", consumed, data[:consumed])
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+)
+
+// Handler receives connection events from Serve.
+// All methods are called from the goroutine running Serve
+type Handler interface {
+	OnMessage(c *Conn, mt MessageType, data []byte)
+	OnPing(c *Conn, appData []byte)
+	OnClose(c *Conn, code CloseCode, reason string)
+	OnError(c *Conn, err error)
+}
+
+// Serve reads messages from connection and dispatches them to handler
+// until connection is closed. Pong and close replies are written automatically.
+// Returns nil if connection was closed by close handshake
+func Serve(c *Conn, h Handler) error {
+	c.SetPingHandler(func(appData []byte) error {
+		h.OnPing(c, appData)
+		return c.WriteControl(PongMessage, appData)
+	})
+	c.SetCloseHandler(func(code CloseCode, reason string) error {
+		h.OnClose(c, code, reason)
+		return c.WriteClose(code, reason)
+	})
+
+	defer c.closeNetConn()
+
+	for {
+		mt, data, err := c.NextMessage()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, ErrConnClosed) {
+				c.l.Debug("serve: connection closed")
+				return nil
+			}
+
+			c.l.Debug("serve: connection failed", "err", err)
+			h.OnError(c, err)
+			return err
+		}
+
+		h.OnMessage(c, mt, data)
+	}
+}
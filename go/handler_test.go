@@ -0,0 +1,115 @@
+package websocket_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+// Records handler events in order they were received
+type eventHandler struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *eventHandler) add(format string, args ...any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, fmt.Sprintf(format, args...))
+}
+
+func (h *eventHandler) OnMessage(c *websocket.Conn, mt websocket.MessageType, data []byte) {
+	h.add("message %d %s", mt, data)
+}
+
+func (h *eventHandler) OnPing(c *websocket.Conn, appData []byte) {
+	h.add("ping %s", appData)
+}
+
+func (h *eventHandler) OnClose(c *websocket.Conn, code websocket.CloseCode, reason string) {
+	h.add("close %d %s", code, reason)
+}
+
+func (h *eventHandler) OnError(c *websocket.Conn, err error) {
+	h.add("error")
+}
+
+func TestServe(t *testing.T) {
+	h := &eventHandler{}
+	served := make(chan error, 1)
+	srv := wstest.NewServer(&websocket.Upgrader{}, func(c *websocket.Conn) {
+		served <- websocket.Serve(c, h)
+	})
+	defer srv.Close()
+
+	client, err := srv.Dial("/")
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	pongs := make(chan string, 1)
+	client.SetPongHandler(func(appData []byte) error {
+		pongs <- string(appData)
+		return nil
+	})
+
+	_ = client.WriteMessage(websocket.TextMessage, []byte("hello"))
+	_ = client.WriteMessage(websocket.BinaryMessage, []byte("data"))
+	_ = client.WriteControl(websocket.PingMessage, []byte("p"))
+	_ = client.WriteClose(websocket.CloseGoingAway, "")
+
+	// reads pong and close reply
+	if _, _, err := client.NextMessage(); err == nil {
+		t.Fatal("read succeeded after close handshake")
+	}
+	if p := <-pongs; p != "p" {
+		t.Errorf("pong = %q, want %q", p, "p")
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("serve error = %v, want nil after close handshake", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after close handshake")
+	}
+
+	want := []string{"message 1 hello", "message 2 data", "ping p", "close 1001 "}
+	if fmt.Sprint(h.events) != fmt.Sprint(want) {
+		t.Errorf("events = %q, want %q", h.events, want)
+	}
+}
+
+func TestServeError(t *testing.T) {
+	client, server := wstest.NewPipe()
+
+	h := &eventHandler{}
+	served := make(chan error, 1)
+	go func() { served <- websocket.Serve(server, h) }()
+
+	codes := make(chan websocket.CloseCode, 1)
+	client.SetCloseHandler(func(code websocket.CloseCode, reason string) error {
+		codes <- code
+		return client.WriteClose(code, reason)
+	})
+
+	// writer doesn't validate text, so server receives invalid UTF-8
+	go func() { _ = client.WriteMessage(websocket.TextMessage, []byte{'a', 0xff}) }()
+	if _, _, err := client.NextMessage(); err == nil {
+		t.Fatal("read succeeded after close")
+	}
+	if code := <-codes; code != websocket.CloseInvalidFramePayloadData {
+		t.Errorf("close code = %d, want %d", code, websocket.CloseInvalidFramePayloadData)
+	}
+
+	if err := <-served; err == nil {
+		t.Fatal("serve returned nil after invalid message")
+	}
+	if want := []string{"error"}; fmt.Sprint(h.events) != fmt.Sprint(want) {
+		t.Errorf("events = %q, want %q", h.events, want)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"net/http"
+	"slices"
 	"strings"
 )
 
@@ -18,6 +19,8 @@ const (
 	headerSecWsExt     = "Sec-WebSocket-Extensions"
 	headerSecWsKey     = "Sec-WebSocket-Key"
 	headerSecWsAccept  = "Sec-WebSocket-Accept"
+	// HTTP/2 pseudo header of extended CONNECT, net/http passes it with request headers
+	headerProtocol = ":protocol"
 
 	headerUpgradeExpected      = "websocket"
 	headerConnExpected         = "Upgrade"
@@ -69,3 +72,27 @@ func headerEquals(h http.Header, header, expectedValue string) (string, bool) {
 		return actualValue, false
 	}
 }
+
+// Returns comma separated tokens from all values of header, empty tokens are skipped
+func headerTokens(h http.Header, header string) []string {
+	var tokens []string
+	for _, v := range h.Values(header) {
+		for t := range strings.SplitSeq(v, ",") {
+			t = strings.TrimSpace(t)
+			if t != "" {
+				tokens = append(tokens, t)
+			}
+		}
+	}
+	return tokens
+}
+
+// Selects first of server supported subprotocols requested by client
+func selectSubprotocol(supported, requested []string) string {
+	for _, s := range supported {
+		if slices.Contains(requested, s) {
+			return s
+		}
+	}
+	return ""
+}
@@ -0,0 +1,124 @@
+package websocket_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+// http.Server advertises extended CONNECT only if GODEBUG has http2xconnect=1
+// when net/http is initialized, so test is run in subprocess with it set
+const http2DebugSetting = "http2xconnect=1"
+
+func TestHTTP2ExtendedConnect(t *testing.T) {
+	if !strings.Contains(os.Getenv("GODEBUG"), http2DebugSetting) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHTTP2ExtendedConnect$", "-test.v")
+		cmd.Env = append(os.Environ(), "GODEBUG="+http2DebugSetting)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("test failed with %s:\n%s", http2DebugSetting, out)
+		}
+		return
+	}
+
+	for _, enableHTTP2 := range []bool{true, false} {
+		name := "http2"
+		if !enableHTTP2 {
+			name = "http1 fallback"
+		}
+		t.Run(name, func(t *testing.T) {
+			testHTTP2Echo(t, enableHTTP2)
+		})
+	}
+}
+
+func testHTTP2Echo(t *testing.T, enableHTTP2 bool) {
+	protos := make(chan string, 1)
+	closes := make(chan proxyClose, 1)
+
+	u := &websocket.Upgrader{Subprotocols: []string{"chat"}}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		protos <- req.Proto
+		c, err := u.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+
+		recvClose(c, closes)
+		wstest.Echo(c)
+	}))
+	srv.EnableHTTP2 = enableHTTP2
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	d := websocket.Dialer{
+		Subprotocols:    []string{"chat"},
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+		EnableHTTP2:     true,
+	}
+
+	c, err := d.Dial("wss"+strings.TrimPrefix(srv.URL, "https")+"/echo", nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+
+	wantProto := "HTTP/2.0"
+	if !enableHTTP2 {
+		wantProto = "HTTP/1.1"
+	}
+	if proto := <-protos; proto != wantProto {
+		t.Errorf("server received %s request, want %s", proto, wantProto)
+	}
+	if c.Subprotocol() != "chat" {
+		t.Errorf("subprotocol = %q, want %q", c.Subprotocol(), "chat")
+	}
+
+	messages := []struct {
+		mt   websocket.MessageType
+		data string
+	}{
+		{websocket.TextMessage, "hello"},
+		{websocket.BinaryMessage, "\x00\xff"},
+		{websocket.TextMessage, strings.Repeat("abcdefgh", 20000)},
+	}
+	for _, m := range messages {
+		if err := c.WriteMessage(m.mt, []byte(m.data)); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+		mt, data, err := c.NextMessage()
+		if err != nil {
+			t.Fatalf("failed to read message: %v", err)
+		}
+		if mt != m.mt || string(data) != m.data {
+			t.Errorf("echo = %s of %d bytes, want %s of %d bytes", mt, len(data), m.mt, len(m.data))
+		}
+	}
+
+	if err := c.WriteClose(4001, "bye"); err != nil {
+		t.Fatalf("failed to write close: %v", err)
+	}
+	if _, _, err := c.NextMessage(); err == nil {
+		t.Fatalf("expected connection to be closed")
+	}
+
+	select {
+	case got := <-closes:
+		if want := (proxyClose{4001, "bye"}); got != want {
+			t.Errorf("server received close %v, want %v", got, want)
+		}
+	case <-time.After(proxyTestTimeout):
+		t.Fatalf("server did not receive close frame")
+	}
+}
@@ -0,0 +1,657 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// receive window of every stream and of connection
+	recvWindowSize = 1 << 20
+	// limit of headers block split into CONTINUATION frames, so server can't
+	// grow it without bound
+	maxHeadersBlockSize = 1 << 20
+)
+
+var (
+	ErrConnClosed = errors.New("http2 connection closed")
+)
+
+type StreamError struct {
+	Code ErrCode
+}
+
+func (e StreamError) Error() string {
+	return fmt.Sprintf("stream was reset by peer with error code %d", e.Code)
+}
+
+// Client side HTTP/2 connection for long living bidirectional streams.
+// Server push, priorities and trailers are not supported
+type ClientConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	// serializes frame writes
+	wMu sync.Mutex
+
+	// used only by read loop
+	dec *Decoder
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	settingsReceived chan struct{}
+	extendedConnect  bool
+	peerMaxFrameSize uint32
+	peerWindowSize   int64
+	sendWindow       int64
+	// received data consumed by streams which wasn't acknowledged with WINDOW_UPDATE
+	recvUnacked int64
+
+	streams      map[uint32]*Stream
+	nextStreamID uint32
+	goAway       bool
+	err          error
+	// closed once err is set
+	done chan struct{}
+
+	closeOnce sync.Once
+}
+
+// Sends connection preface and waits for server settings,
+// use net.Conn deadline to limit the wait
+func NewClientConn(conn net.Conn) (*ClientConn, error) {
+	cc := &ClientConn{
+		conn:             conn,
+		br:               bufio.NewReader(conn),
+		dec:              NewDecoder(defaultHeaderTableSize),
+		settingsReceived: make(chan struct{}),
+		peerMaxFrameSize: defaultMaxFrameSize,
+		peerWindowSize:   defaultWindowSize,
+		sendWindow:       defaultWindowSize,
+		streams:          make(map[uint32]*Stream),
+		nextStreamID:     1,
+		done:             make(chan struct{}),
+	}
+	cc.cond = sync.NewCond(&cc.mu)
+
+	settings := settingsPayload(map[settingID]uint32{
+		settingEnablePush:        0,
+		settingInitialWindowSize: recvWindowSize,
+	})
+	windowUpdate := binary.BigEndian.AppendUint32(nil, recvWindowSize-defaultWindowSize)
+
+	_, err := io.WriteString(conn, ClientPreface)
+	if err == nil {
+		err = writeFrame(conn, frameSettings, 0, 0, settings)
+	}
+	if err == nil {
+		err = writeFrame(conn, frameWindowUpdate, 0, 0, windowUpdate)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write connection preface: [%w]", err)
+	}
+
+	go cc.readLoop()
+
+	select {
+	case <-cc.settingsReceived:
+		return cc, nil
+	case <-cc.done:
+		return nil, fmt.Errorf("failed to receive server settings: [%w]", cc.getErr())
+	}
+}
+
+func settingsPayload(settings map[settingID]uint32) []byte {
+	b := make([]byte, 0, len(settings)*6)
+	for id, v := range settings {
+		b = binary.BigEndian.AppendUint16(b, uint16(id))
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// Reports if server allows extended CONNECT (RFC 8441)
+func (cc *ClientConn) ExtendedConnectAllowed() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.extendedConnect
+}
+
+// Opens stream by sending request headers, request body is written to the stream
+func (cc *ClientConn) OpenStream(fields []HeaderField) (*Stream, error) {
+	var block []byte
+	for _, f := range fields {
+		block = appendHeaderField(block, f)
+	}
+
+	cc.mu.Lock()
+	if cc.err != nil {
+		cc.mu.Unlock()
+		return nil, cc.err
+	}
+	if cc.goAway {
+		cc.mu.Unlock()
+		return nil, fmt.Errorf("server sent GOAWAY: [%w]", ErrConnClosed)
+	}
+
+	s := &Stream{
+		cc:         cc,
+		id:         cc.nextStreamID,
+		sendWindow: cc.peerWindowSize,
+	}
+	cc.nextStreamID += 2
+	cc.streams[s.id] = s
+	maxFrameSize := int(cc.peerMaxFrameSize)
+	cc.mu.Unlock()
+
+	cc.wMu.Lock()
+	defer cc.wMu.Unlock()
+
+	typ := frameHeaders
+	for {
+		chunk := block[:min(len(block), maxFrameSize)]
+		block = block[len(chunk):]
+
+		var flags uint8
+		if len(block) == 0 {
+			flags = flagEndHeaders
+		}
+		err := writeFrame(cc.conn, typ, flags, s.id, chunk)
+		if err != nil {
+			cc.fail(err)
+			return nil, fmt.Errorf("failed to write headers: [%w]", err)
+		}
+
+		if len(block) == 0 {
+			return s, nil
+		}
+		typ = frameContinuation
+	}
+}
+
+// Sends GOAWAY and closes connection
+func (cc *ClientConn) Close() error {
+	var err error
+	cc.closeOnce.Do(func() {
+		cc.wMu.Lock()
+		payload := binary.BigEndian.AppendUint32(nil, 0)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(ErrCodeNo))
+		_ = writeFrame(cc.conn, frameGoAway, 0, 0, payload)
+		cc.wMu.Unlock()
+
+		cc.fail(ErrConnClosed)
+		err = cc.conn.Close()
+	})
+	return err
+}
+
+func (cc *ClientConn) getErr() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.err
+}
+
+// Fails connection and all streams, first error is kept
+func (cc *ClientConn) fail(err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.err == nil {
+		cc.err = err
+		close(cc.done)
+	}
+	for _, s := range cc.streams {
+		if s.err == nil {
+			s.err = err
+		}
+	}
+	cc.cond.Broadcast()
+}
+
+// Sends GOAWAY with error code and fails connection
+func (cc *ClientConn) connError(code ErrCode, err error) {
+	cc.wMu.Lock()
+	payload := binary.BigEndian.AppendUint32(nil, 0)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	_ = writeFrame(cc.conn, frameGoAway, 0, 0, payload)
+	cc.wMu.Unlock()
+
+	cc.fail(err)
+	_ = cc.conn.Close()
+}
+
+func (cc *ClientConn) writeFrame(typ frameType, flags uint8, streamID uint32, payload []byte) error {
+	cc.wMu.Lock()
+	defer cc.wMu.Unlock()
+	return writeFrame(cc.conn, typ, flags, streamID, payload)
+}
+
+func (cc *ClientConn) readLoop() {
+	// headers block split into CONTINUATION frames
+	var headersStream uint32
+	var headersBlock []byte
+	var headersEndStream bool
+
+	for {
+		f, err := readFrame(cc.br, defaultMaxFrameSize)
+		if err != nil {
+			if errors.Is(err, ErrFrameTooLarge) {
+				cc.connError(ErrCodeFrameSize, err)
+				return
+			}
+			cc.fail(fmt.Errorf("failed to read frame: [%w]", err))
+			return
+		}
+
+		if headersStream != 0 && (f.typ != frameContinuation || f.streamID != headersStream) {
+			cc.connError(ErrCodeProtocol, fmt.Errorf("expected CONTINUATION frame"))
+			return
+		}
+
+		switch f.typ {
+		case frameSettings:
+			err = cc.handleSettings(f)
+		case framePing:
+			if !f.has(flagAck) {
+				err = cc.writeFrame(framePing, flagAck, 0, f.payload)
+			}
+		case frameWindowUpdate:
+			err = cc.handleWindowUpdate(f)
+		case frameHeaders:
+			var block []byte
+			block, err = unpad(f)
+			if err == nil && f.has(flagPriority) {
+				if len(block) < 5 {
+					err = fmt.Errorf("invalid HEADERS frame")
+				} else {
+					block = block[5:]
+				}
+			}
+			if err != nil {
+				break
+			}
+			headersStream, headersBlock, headersEndStream = f.streamID, append([]byte(nil), block...), f.has(flagEndStream)
+			if f.has(flagEndHeaders) {
+				err = cc.handleHeaders(headersStream, headersBlock, headersEndStream)
+				headersStream, headersBlock = 0, nil
+			}
+		case frameContinuation:
+			if headersStream == 0 {
+				err = fmt.Errorf("unexpected CONTINUATION frame")
+				break
+			}
+			if len(headersBlock)+len(f.payload) > maxHeadersBlockSize {
+				cc.connError(ErrCodeEnhanceYourCalm, fmt.Errorf("headers block exceeds %d bytes", maxHeadersBlockSize))
+				return
+			}
+			headersBlock = append(headersBlock, f.payload...)
+			if f.has(flagEndHeaders) {
+				err = cc.handleHeaders(headersStream, headersBlock, headersEndStream)
+				headersStream, headersBlock = 0, nil
+			}
+		case frameData:
+			err = cc.handleData(f)
+		case frameRSTStream:
+			if len(f.payload) != 4 {
+				err = fmt.Errorf("invalid RST_STREAM frame")
+				break
+			}
+			cc.resetStream(f.streamID, StreamError{ErrCode(binary.BigEndian.Uint32(f.payload))})
+		case frameGoAway:
+			cc.mu.Lock()
+			cc.goAway = true
+			cc.mu.Unlock()
+		case framePushPromise:
+			err = fmt.Errorf("server push is disabled")
+		default:
+			// PRIORITY and unknown frames are ignored
+		}
+
+		if err != nil {
+			code := ErrCodeProtocol
+			if errors.Is(err, ErrHpack) {
+				code = ErrCodeCompression
+			}
+			cc.connError(code, err)
+			return
+		}
+	}
+}
+
+func (cc *ClientConn) handleSettings(f *frame) error {
+	if f.streamID != 0 {
+		return fmt.Errorf("SETTINGS frame on stream %d", f.streamID)
+	}
+	if f.has(flagAck) {
+		return nil
+	}
+	if len(f.payload)%6 != 0 {
+		return fmt.Errorf("invalid SETTINGS frame length %d", len(f.payload))
+	}
+
+	cc.mu.Lock()
+	for p := f.payload; len(p) > 0; p = p[6:] {
+		id, v := settingID(binary.BigEndian.Uint16(p)), binary.BigEndian.Uint32(p[2:])
+		switch id {
+		case settingInitialWindowSize:
+			if v > maxWindowSize {
+				cc.mu.Unlock()
+				return fmt.Errorf("initial window size %d is too large", v)
+			}
+			delta := int64(v) - cc.peerWindowSize
+			cc.peerWindowSize = int64(v)
+			for _, s := range cc.streams {
+				s.sendWindow += delta
+			}
+		case settingMaxFrameSize:
+			if v < defaultMaxFrameSize || v > maxFrameSizeLimit {
+				cc.mu.Unlock()
+				return fmt.Errorf("invalid max frame size %d", v)
+			}
+			cc.peerMaxFrameSize = v
+		case settingEnableConnectProtocol:
+			cc.extendedConnect = v == 1
+		}
+	}
+	cc.cond.Broadcast()
+
+	select {
+	case <-cc.settingsReceived:
+	default:
+		close(cc.settingsReceived)
+	}
+	cc.mu.Unlock()
+
+	return cc.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+func (cc *ClientConn) handleWindowUpdate(f *frame) error {
+	if len(f.payload) != 4 {
+		return fmt.Errorf("invalid WINDOW_UPDATE frame")
+	}
+	inc := int64(binary.BigEndian.Uint32(f.payload) & maxWindowSize)
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if f.streamID == 0 {
+		cc.sendWindow += inc
+		if cc.sendWindow > maxWindowSize {
+			return fmt.Errorf("connection window overflow")
+		}
+	} else if s, ok := cc.streams[f.streamID]; ok {
+		s.sendWindow += inc
+	}
+	cc.cond.Broadcast()
+
+	return nil
+}
+
+func (cc *ClientConn) handleHeaders(streamID uint32, block []byte, endStream bool) error {
+	// block must be decoded even for unknown stream to keep table in sync
+	fields, err := cc.dec.Decode(block)
+	if err != nil {
+		return err
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	s, ok := cc.streams[streamID]
+	if !ok {
+		return nil
+	}
+
+	if s.response == nil {
+		// informational responses are skipped
+		for _, f := range fields {
+			if f.Name == ":status" && len(f.Value) == 3 && f.Value[0] == '1' {
+				return nil
+			}
+		}
+		s.response = fields
+	}
+	// trailers are ignored
+	if endStream {
+		s.recvEOF = true
+	}
+	cc.cond.Broadcast()
+
+	return nil
+}
+
+func (cc *ClientConn) handleData(f *frame) error {
+	data, err := unpad(f)
+	if err != nil {
+		return err
+	}
+
+	// padding and data which is dropped are acknowledged right away
+	unused := len(f.payload)
+
+	cc.mu.Lock()
+	s, ok := cc.streams[f.streamID]
+	if ok && s.response != nil && !s.recvEOF {
+		s.recv.Write(data)
+		if f.has(flagEndStream) {
+			s.recvEOF = true
+		}
+		unused -= len(data)
+		cc.cond.Broadcast()
+	}
+	cc.mu.Unlock()
+
+	if unused > 0 {
+		return cc.writeFrame(frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, uint32(unused)))
+	}
+
+	return nil
+}
+
+func (cc *ClientConn) resetStream(streamID uint32, err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if s, ok := cc.streams[streamID]; ok {
+		if s.err == nil {
+			s.err = err
+		}
+		delete(cc.streams, streamID)
+		cc.cond.Broadcast()
+	}
+}
+
+// Single stream, Read returns response body and Write sends request body
+type Stream struct {
+	cc *ClientConn
+	id uint32
+
+	// all fields below are guarded by cc.mu
+	sendWindow int64
+	sentEOF    bool
+
+	response []HeaderField
+
+	recv        bytes.Buffer
+	recvEOF     bool
+	recvUnacked int64
+
+	// Write waiting for flow control window fails once deadline passes
+	writeDeadline time.Time
+	deadlineTimer *time.Timer
+
+	err error
+}
+
+// Waits for response headers
+func (s *Stream) Response() ([]HeaderField, error) {
+	s.cc.mu.Lock()
+	defer s.cc.mu.Unlock()
+
+	for s.response == nil && s.err == nil {
+		s.cc.cond.Wait()
+	}
+	if s.response == nil {
+		return nil, s.err
+	}
+
+	return s.response, nil
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	cc := s.cc
+
+	cc.mu.Lock()
+	for s.recv.Len() == 0 && !s.recvEOF && s.err == nil {
+		cc.cond.Wait()
+	}
+	if s.recv.Len() == 0 {
+		defer cc.mu.Unlock()
+		if s.err != nil {
+			return 0, s.err
+		}
+		return 0, io.EOF
+	}
+
+	n, _ := s.recv.Read(p)
+
+	// window is updated once half of it is consumed
+	var streamInc, connInc int64
+	s.recvUnacked += int64(n)
+	if s.recvUnacked >= recvWindowSize/2 {
+		streamInc, s.recvUnacked = s.recvUnacked, 0
+	}
+	cc.recvUnacked += int64(n)
+	if cc.recvUnacked >= recvWindowSize/2 {
+		connInc, cc.recvUnacked = cc.recvUnacked, 0
+	}
+	cc.mu.Unlock()
+
+	if streamInc > 0 && !s.recvEOF {
+		_ = cc.writeFrame(frameWindowUpdate, 0, s.id, binary.BigEndian.AppendUint32(nil, uint32(streamInc)))
+	}
+	if connInc > 0 {
+		_ = cc.writeFrame(frameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, uint32(connInc)))
+	}
+
+	return n, nil
+}
+
+// Sets deadline of Write waiting for flow control windows, zero value
+// disables it. Frames are written to connection shared by all streams,
+// so write which already started is not interrupted
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	cc := s.cc
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	s.writeDeadline = t
+	if s.deadlineTimer != nil {
+		s.deadlineTimer.Stop()
+		s.deadlineTimer = nil
+	}
+	if d := time.Until(t); !t.IsZero() && d > 0 {
+		s.deadlineTimer = time.AfterFunc(d, func() {
+			cc.mu.Lock()
+			cc.cond.Broadcast()
+			cc.mu.Unlock()
+		})
+	}
+	cc.cond.Broadcast()
+
+	return nil
+}
+
+// Guarded by cc.mu
+func (s *Stream) writeExpired() bool {
+	return !s.writeDeadline.IsZero() && !time.Now().Before(s.writeDeadline)
+}
+
+// Blocks until flow control windows allow to send data
+func (s *Stream) Write(p []byte) (int, error) {
+	cc := s.cc
+	written := 0
+
+	for len(p) > 0 {
+		cc.mu.Lock()
+		for s.err == nil && !s.sentEOF && !s.writeExpired() && (s.sendWindow <= 0 || cc.sendWindow <= 0) {
+			cc.cond.Wait()
+		}
+		if s.err != nil {
+			cc.mu.Unlock()
+			return written, s.err
+		}
+		if s.writeExpired() {
+			cc.mu.Unlock()
+			return written, os.ErrDeadlineExceeded
+		}
+		if s.sentEOF {
+			cc.mu.Unlock()
+			return written, fmt.Errorf("stream is closed for writing")
+		}
+
+		n := min(int64(len(p)), s.sendWindow, cc.sendWindow, int64(cc.peerMaxFrameSize))
+		s.sendWindow -= n
+		cc.sendWindow -= n
+		cc.mu.Unlock()
+
+		err := cc.writeFrame(frameData, 0, s.id, p[:n])
+		if err != nil {
+			cc.fail(err)
+			return written, fmt.Errorf("failed to write data: [%w]", err)
+		}
+
+		p = p[n:]
+		written += int(n)
+	}
+
+	return written, nil
+}
+
+// Ends request body, response body can still be read
+func (s *Stream) CloseWrite() error {
+	cc := s.cc
+
+	cc.mu.Lock()
+	if s.sentEOF || s.err != nil {
+		cc.mu.Unlock()
+		return nil
+	}
+	s.sentEOF = true
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+
+	return cc.writeFrame(frameData, flagEndStream, s.id, nil)
+}
+
+// Ends request body and resets stream if response is not finished yet
+func (s *Stream) Close() error {
+	err := s.CloseWrite()
+
+	cc := s.cc
+	cc.mu.Lock()
+	reset := !s.recvEOF && s.err == nil
+	if s.err == nil {
+		s.err = ErrConnClosed
+	}
+	delete(cc.streams, s.id)
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+
+	if reset {
+		err = errors.Join(err, cc.writeFrame(frameRSTStream, 0, s.id,
+			binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel))))
+	}
+
+	return err
+}
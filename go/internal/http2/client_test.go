@@ -0,0 +1,116 @@
+package http2
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Returns client connected to fake server which sends settings, returned
+// server conn can be used to send more frames and frames sent by client are
+// passed to channel until it is full
+func newFakeServer(t *testing.T, settings map[settingID]uint32) (*ClientConn, net.Conn, <-chan *frame) {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { _ = serverConn.Close() })
+
+	received := make(chan *frame, 100)
+	go func() {
+		defer close(received)
+
+		preface := make([]byte, len(ClientPreface))
+		if _, err := io.ReadFull(serverConn, preface); err != nil || string(preface) != ClientPreface {
+			return
+		}
+		go func() { _ = writeFrame(serverConn, frameSettings, 0, 0, settingsPayload(settings)) }()
+
+		for {
+			f, err := readFrame(serverConn, maxFrameSizeLimit)
+			if err != nil {
+				return
+			}
+			select {
+			case received <- f:
+			default:
+			}
+		}
+	}()
+
+	cc, err := NewClientConn(clientConn)
+	if err != nil {
+		t.Fatalf("failed to create client conn: %v", err)
+	}
+	t.Cleanup(func() { _ = cc.Close() })
+
+	return cc, serverConn, received
+}
+
+func TestStreamWriteDeadline(t *testing.T) {
+	// stream window is 0, so writes wait for WINDOW_UPDATE
+	cc, _, _ := newFakeServer(t, map[settingID]uint32{settingInitialWindowSize: 0})
+
+	s, err := cc.OpenStream([]HeaderField{{":method", "CONNECT"}})
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+
+	if err := s.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Write([]byte("blocked"))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("write error = %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write was not interrupted by deadline")
+	}
+
+	// deadline in the past fails writes right away
+	if _, err := s.Write([]byte("late")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write after deadline error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+}
+
+func TestHeadersBlockLimit(t *testing.T) {
+	cc, server, received := newFakeServer(t, nil)
+
+	go func() {
+		block := make([]byte, defaultMaxFrameSize)
+		if err := writeFrame(server, frameHeaders, 0, 1, block); err != nil {
+			return
+		}
+		// CONTINUATION frames without END_HEADERS until client gives up
+		for {
+			if err := writeFrame(server, frameContinuation, 0, 1, block); err != nil {
+				return
+			}
+		}
+	}()
+
+	for f := range received {
+		if f.typ != frameGoAway {
+			continue
+		}
+		if code := ErrCode(binary.BigEndian.Uint32(f.payload[4:])); code != ErrCodeEnhanceYourCalm {
+			t.Fatalf("GOAWAY code = %d, want %d", code, ErrCodeEnhanceYourCalm)
+		}
+		if _, err := cc.OpenStream(nil); err == nil {
+			t.Fatal("stream opened on failed connection")
+		}
+		return
+	}
+	t.Fatal("connection closed without GOAWAY")
+}
@@ -0,0 +1,139 @@
+// Package http2 implements client side of HTTP/2 (RFC 9113) needed to open
+// websocket streams with extended CONNECT (RFC 8441). net/http client does not
+// allow :protocol pseudo header, so it can't be used for that
+package http2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	frameHeaderLen = 9
+
+	defaultMaxFrameSize = 16384
+	maxFrameSizeLimit   = 1<<24 - 1
+	defaultWindowSize   = 65535
+	maxWindowSize       = 1<<31 - 1
+)
+
+type frameType uint8
+
+const (
+	frameData         frameType = 0x0
+	frameHeaders      frameType = 0x1
+	framePriority     frameType = 0x2
+	frameRSTStream    frameType = 0x3
+	frameSettings     frameType = 0x4
+	framePushPromise  frameType = 0x5
+	framePing         frameType = 0x6
+	frameGoAway       frameType = 0x7
+	frameWindowUpdate frameType = 0x8
+	frameContinuation frameType = 0x9
+)
+
+const (
+	flagEndStream  uint8 = 0x1
+	flagAck        uint8 = 0x1
+	flagEndHeaders uint8 = 0x4
+	flagPadded     uint8 = 0x8
+	flagPriority   uint8 = 0x20
+)
+
+type settingID uint16
+
+const (
+	settingHeaderTableSize       settingID = 0x1
+	settingEnablePush            settingID = 0x2
+	settingMaxConcurrentStreams  settingID = 0x3
+	settingInitialWindowSize     settingID = 0x4
+	settingMaxFrameSize          settingID = 0x5
+	settingMaxHeaderListSize     settingID = 0x6
+	settingEnableConnectProtocol settingID = 0x8
+)
+
+type ErrCode uint32
+
+const (
+	ErrCodeNo              ErrCode = 0x0
+	ErrCodeProtocol        ErrCode = 0x1
+	ErrCodeInternal        ErrCode = 0x2
+	ErrCodeFlowControl     ErrCode = 0x3
+	ErrCodeStreamClosed    ErrCode = 0x5
+	ErrCodeFrameSize       ErrCode = 0x6
+	ErrCodeCancel          ErrCode = 0x8
+	ErrCodeCompression     ErrCode = 0x9
+	ErrCodeEnhanceYourCalm ErrCode = 0xb
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame exceeds max frame size")
+)
+
+type frame struct {
+	typ      frameType
+	flags    uint8
+	streamID uint32
+	payload  []byte
+}
+
+func (f *frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+func readFrame(r io.Reader, maxSize uint32) (*frame, error) {
+	var h [frameHeaderLen]byte
+	_, err := io.ReadFull(r, h[:])
+	if err != nil {
+		return nil, err
+	}
+
+	length := uint32(h[0])<<16 | uint32(h[1])<<8 | uint32(h[2])
+	if length > maxSize {
+		return nil, fmt.Errorf("%w: %d > %d", ErrFrameTooLarge, length, maxSize)
+	}
+
+	f := &frame{
+		typ:      frameType(h[3]),
+		flags:    h[4],
+		streamID: binary.BigEndian.Uint32(h[5:]) & (1<<31 - 1),
+		payload:  make([]byte, length),
+	}
+	_, err = io.ReadFull(r, f.payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Frame is written with single Write call
+func writeFrame(w io.Writer, typ frameType, flags uint8, streamID uint32, payload []byte) error {
+	b := make([]byte, frameHeaderLen, frameHeaderLen+len(payload))
+	b[0], b[1], b[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	b[3] = byte(typ)
+	b[4] = flags
+	binary.BigEndian.PutUint32(b[5:], streamID)
+	b = append(b, payload...)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// Removes padding of DATA and HEADERS frames
+func unpad(f *frame) ([]byte, error) {
+	p := f.payload
+	if !f.has(flagPadded) {
+		return p, nil
+	}
+
+	if len(p) == 0 || int(p[0]) >= len(p) {
+		return nil, fmt.Errorf("invalid padding length")
+	}
+
+	return p[1 : len(p)-int(p[0])], nil
+}
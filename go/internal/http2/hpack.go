@@ -0,0 +1,377 @@
+package http2
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// HPACK (RFC 7541). Request headers are encoded as literals without indexing,
+// so encoder needs no state, response headers are fully decoded
+
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// Size of entry in dynamic table
+func (f HeaderField) size() int {
+	return len(f.Name) + len(f.Value) + 32
+}
+
+const (
+	defaultHeaderTableSize = 4096
+)
+
+var (
+	ErrHpack = errors.New("hpack decoding failed")
+)
+
+var staticTable = []HeaderField{
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+// Appends header field as literal without indexing with literal name
+func appendHeaderField(dst []byte, f HeaderField) []byte {
+	dst = appendInt(dst, 4, 0x00, 0)
+	dst = appendString(dst, f.Name)
+	return appendString(dst, f.Value)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = appendInt(dst, 7, 0x00, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// Integer with n bit prefix, flags are the rest of first byte
+func appendInt(dst []byte, n uint8, flags byte, v uint64) []byte {
+	limit := uint64(1)<<n - 1
+	if v < limit {
+		return append(dst, flags|byte(v))
+	}
+
+	dst = append(dst, flags|byte(limit))
+	v -= limit
+	for v >= 128 {
+		dst = append(dst, byte(v%128)|0x80)
+		v /= 128
+	}
+
+	return append(dst, byte(v))
+}
+
+func readInt(b []byte, n uint8) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, fmt.Errorf("%w: truncated integer", ErrHpack)
+	}
+
+	limit := uint64(1)<<n - 1
+	v := uint64(b[0]) & limit
+	b = b[1:]
+	if v < limit {
+		return v, b, nil
+	}
+
+	var m uint
+	for {
+		if len(b) == 0 {
+			return 0, nil, fmt.Errorf("%w: truncated integer", ErrHpack)
+		}
+		c := b[0]
+		b = b[1:]
+
+		v += uint64(c&0x7f) << m
+		m += 7
+		if c&0x80 == 0 {
+			return v, b, nil
+		}
+		if m > 56 {
+			return 0, nil, fmt.Errorf("%w: integer overflow", ErrHpack)
+		}
+	}
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) == 0 {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrHpack)
+	}
+	isHuffman := b[0]&0x80 != 0
+
+	length, b, err := readInt(b, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(b)) < length {
+		return "", nil, fmt.Errorf("%w: truncated string", ErrHpack)
+	}
+
+	s, b := b[:length], b[length:]
+	if !isHuffman {
+		return string(s), b, nil
+	}
+
+	decoded, err := huffmanDecode(s)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return decoded, b, nil
+}
+
+// Decodes header blocks, must be used for all blocks of connection in order
+type Decoder struct {
+	// oldest entry first
+	dynamic []HeaderField
+	size    int
+	maxSize int
+	// max size allowed by our settings, peer may only lower it
+	allowedMaxSize int
+}
+
+func NewDecoder(maxSize int) *Decoder {
+	return &Decoder{maxSize: maxSize, allowedMaxSize: maxSize}
+}
+
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+
+	for len(block) > 0 {
+		var err error
+		b := block[0]
+
+		switch {
+		case b&0x80 != 0:
+			// indexed header field
+			var idx uint64
+			idx, block, err = readInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			f, err := d.at(idx)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, f)
+		case b&0xc0 == 0x40:
+			// literal with incremental indexing
+			var f HeaderField
+			f, block, err = d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, f)
+			d.add(f)
+		case b&0xe0 == 0x20:
+			if len(fields) > 0 {
+				return nil, fmt.Errorf("%w: table size update after header field", ErrHpack)
+			}
+			var size uint64
+			size, block, err = readInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.allowedMaxSize) {
+				return nil, fmt.Errorf("%w: table size %d exceeds %d", ErrHpack, size, d.allowedMaxSize)
+			}
+			d.maxSize = int(size)
+			d.evict()
+		default:
+			// literal without indexing or never indexed
+			var f HeaderField
+			f, block, err = d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, f)
+		}
+	}
+
+	return fields, nil
+}
+
+func (d *Decoder) readLiteral(b []byte, n uint8) (HeaderField, []byte, error) {
+	idx, b, err := readInt(b, n)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+
+	var f HeaderField
+	if idx > 0 {
+		indexed, err := d.at(idx)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+		f.Name = indexed.Name
+	} else {
+		f.Name, b, err = readString(b)
+		if err != nil {
+			return HeaderField{}, nil, err
+		}
+	}
+
+	f.Value, b, err = readString(b)
+	if err != nil {
+		return HeaderField{}, nil, err
+	}
+
+	return f, b, nil
+}
+
+func (d *Decoder) at(idx uint64) (HeaderField, error) {
+	if idx == 0 {
+		return HeaderField{}, fmt.Errorf("%w: index 0", ErrHpack)
+	}
+	if idx <= uint64(len(staticTable)) {
+		return staticTable[idx-1], nil
+	}
+
+	idx -= uint64(len(staticTable))
+	if idx > uint64(len(d.dynamic)) {
+		return HeaderField{}, fmt.Errorf("%w: index %d is out of table", ErrHpack, idx+uint64(len(staticTable)))
+	}
+
+	return d.dynamic[len(d.dynamic)-int(idx)], nil
+}
+
+func (d *Decoder) add(f HeaderField) {
+	if f.size() > d.maxSize {
+		d.dynamic, d.size = nil, 0
+		return
+	}
+
+	d.dynamic = append(d.dynamic, f)
+	d.size += f.size()
+	d.evict()
+}
+
+func (d *Decoder) evict() {
+	for d.size > d.maxSize {
+		d.size -= d.dynamic[0].size()
+		d.dynamic = d.dynamic[1:]
+	}
+}
+
+type huffmanNode struct {
+	children [2]*huffmanNode
+	// decoded octet, EOS or -1 for internal node
+	sym int
+}
+
+var (
+	huffmanRootOnce sync.Once
+	huffmanRoot     *huffmanNode
+)
+
+const huffmanEOS = 256
+
+func buildHuffmanTree() {
+	huffmanRoot = &huffmanNode{sym: -1}
+	for sym, c := range huffmanCodes {
+		n := huffmanRoot
+		for i := int(c.len) - 1; i >= 0; i-- {
+			bit := (c.code >> i) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{sym: -1}
+			}
+			n = n.children[bit]
+		}
+		n.sym = sym
+	}
+}
+
+func huffmanDecode(b []byte) (string, error) {
+	huffmanRootOnce.Do(buildHuffmanTree)
+
+	out := make([]byte, 0, len(b)*8/5)
+	n := huffmanRoot
+	// bits after last decoded symbol must be EOS prefix shorter than 8 bits
+	padBits, padOnes := 0, true
+
+	for _, c := range b {
+		for i := 7; i >= 0; i-- {
+			bit := (c >> i) & 1
+			n = n.children[bit]
+			if n == nil {
+				return "", fmt.Errorf("%w: invalid huffman code", ErrHpack)
+			}
+
+			padBits++
+			padOnes = padOnes && bit == 1
+
+			if n.sym == huffmanEOS {
+				return "", fmt.Errorf("%w: EOS in huffman string", ErrHpack)
+			}
+			if n.sym >= 0 {
+				out = append(out, byte(n.sym))
+				n = huffmanRoot
+				padBits, padOnes = 0, true
+			}
+		}
+	}
+
+	if padBits > 7 || !padOnes {
+		return "", fmt.Errorf("%w: invalid huffman padding", ErrHpack)
+	}
+
+	return string(out), nil
+}
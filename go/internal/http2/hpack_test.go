@@ -0,0 +1,201 @@
+package http2
+
+import (
+	"encoding/hex"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type hpackBlock struct {
+	hex  string
+	want []HeaderField
+	// dynamic table size after block is decoded
+	size int
+}
+
+func mustHex(t testing.TB, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatalf("invalid hex %q: %v", s, err)
+	}
+	return b
+}
+
+// RFC 7541 Appendix C.3 and C.4, same requests with and without Huffman coding
+var (
+	requests = [][]HeaderField{
+		{
+			{":method", "GET"},
+			{":scheme", "http"},
+			{":path", "/"},
+			{":authority", "www.example.com"},
+		},
+		{
+			{":method", "GET"},
+			{":scheme", "http"},
+			{":path", "/"},
+			{":authority", "www.example.com"},
+			{"cache-control", "no-cache"},
+		},
+		{
+			{":method", "GET"},
+			{":scheme", "https"},
+			{":path", "/index.html"},
+			{":authority", "www.example.com"},
+			{"custom-key", "custom-value"},
+		},
+	}
+	requestSizes = []int{57, 110, 164}
+
+	requestsPlain = []string{
+		"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+		"8286 84be 5808 6e6f 2d63 6163 6865",
+		"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+	}
+	requestsHuffman = []string{
+		"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+		"8286 84be 5886 a8eb 1064 9cbf",
+		"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+	}
+)
+
+// RFC 7541 Appendix C.5 and C.6, same responses with and without Huffman
+// coding, decoded with table size of 256 so entries are evicted
+var (
+	responses = [][]HeaderField{
+		{
+			{":status", "302"},
+			{"cache-control", "private"},
+			{"date", "Mon, 21 Oct 2013 20:13:21 GMT"},
+			{"location", "https://www.example.com"},
+		},
+		{
+			{":status", "307"},
+			{"cache-control", "private"},
+			{"date", "Mon, 21 Oct 2013 20:13:21 GMT"},
+			{"location", "https://www.example.com"},
+		},
+		{
+			{":status", "200"},
+			{"cache-control", "private"},
+			{"date", "Mon, 21 Oct 2013 20:13:22 GMT"},
+			{"location", "https://www.example.com"},
+			{"content-encoding", "gzip"},
+			{"set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"},
+		},
+	}
+	responseSizes = []int{222, 222, 215}
+
+	responsesPlain = []string{
+		"4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 " +
+			"2032 303a 3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 " +
+			"6c65 2e63 6f6d",
+		"4803 3330 37c1 c0bf",
+		"88c1 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3220 474d " +
+			"54c0 5a04 677a 6970 7738 666f 6f3d 4153 444a 4b48 514b 425a 584f 5157 454f 5049 " +
+			"5541 5851 5745 4f49 553b 206d 6178 2d61 6765 3d33 3630 303b 2076 6572 7369 6f6e " +
+			"3d31",
+	}
+	responsesHuffman = []string{
+		"4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 " +
+			"2d1b ff6e 919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3",
+		"4883 640e ffc1 c0bf",
+		"88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab " +
+			"77ad 94e7 821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f " +
+			"9587 3160 65c0 03ed 4ee5 b106 3d50 07",
+	}
+)
+
+func blocks(hexes []string, want [][]HeaderField, sizes []int) []hpackBlock {
+	var b []hpackBlock
+	for i := range hexes {
+		b = append(b, hpackBlock{hexes[i], want[i], sizes[i]})
+	}
+	return b
+}
+
+func TestDecoderRFCExamples(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int
+		blocks  []hpackBlock
+	}{
+		{"requests", 4096, blocks(requestsPlain, requests, requestSizes)},
+		{"requests huffman", 4096, blocks(requestsHuffman, requests, requestSizes)},
+		{"responses", 256, blocks(responsesPlain, responses, responseSizes)},
+		{"responses huffman", 256, blocks(responsesHuffman, responses, responseSizes)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// blocks share dynamic table, so they are decoded in order
+			d := NewDecoder(tt.maxSize)
+			for i, b := range tt.blocks {
+				got, err := d.Decode(mustHex(t, b.hex))
+				if err != nil {
+					t.Fatalf("block %d: failed to decode: %v", i, err)
+				}
+				if !slices.Equal(got, b.want) {
+					t.Fatalf("block %d: got %v, want %v", i, got, b.want)
+				}
+				if d.size != b.size {
+					t.Fatalf("block %d: dynamic table size = %d, want %d", i, d.size, b.size)
+				}
+			}
+		})
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+	}{
+		{"index 0", "80"},
+		{"index out of table", "be"},
+		{"truncated integer", "ff"},
+		{"truncated string", "400a 6375"},
+		{"table size update after field", "82 3f e1 1f"},
+		{"table size above allowed", "3f e2 1f"},
+		{"huffman EOS padding", "0085 ffff ffff ff00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDecoder(4096).Decode(mustHex(t, tt.hex)); err == nil {
+				t.Fatal("invalid block decoded without error")
+			}
+		})
+	}
+}
+
+// Checks that arbitrary blocks don't panic and keep dynamic table within limit
+func FuzzDecode(f *testing.F) {
+	for _, hexes := range [][]string{requestsPlain, requestsHuffman, responsesPlain, responsesHuffman} {
+		var all []byte
+		for _, h := range hexes {
+			all = append(all, mustHex(f, h)...)
+		}
+		f.Add(all)
+	}
+
+	f.Fuzz(func(t *testing.T, block []byte) {
+		d := NewDecoder(256)
+		// same block twice to exercise entries added by first one
+		for range 2 {
+			if _, err := d.Decode(block); err != nil {
+				return
+			}
+
+			size := 0
+			for _, e := range d.dynamic {
+				size += e.size()
+			}
+			if size != d.size || d.size > d.maxSize || d.maxSize > d.allowedMaxSize {
+				t.Fatalf("dynamic table size %d (tracked %d), max %d, allowed %d",
+					size, d.size, d.maxSize, d.allowedMaxSize)
+			}
+		}
+	})
+}
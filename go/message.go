@@ -1,12 +1,17 @@
 package websocket
 
 import (
+	"fmt"
+
 	"github.com/wmdanor/websocket/go/internal"
 )
 
 type MessageType uint8
 
 const (
+	// Frame only, used by low level frame API
+	ContinuationFrame MessageType = MessageType(internal.OpcodeContinuationFrame)
+
 	// Non-control
 	TextMessage   MessageType = MessageType(internal.OpcodeTextFrame)
 	BinaryMessage MessageType = MessageType(internal.OpcodeBinaryFrame)
@@ -17,6 +22,25 @@ const (
 	PongMessage  MessageType = MessageType(internal.OpcodePong)
 )
 
+func (mt MessageType) String() string {
+	switch mt {
+	case ContinuationFrame:
+		return "continuation"
+	case TextMessage:
+		return "text"
+	case BinaryMessage:
+		return "binary"
+	case CloseMessage:
+		return "close"
+	case PingMessage:
+		return "ping"
+	case PongMessage:
+		return "pong"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(mt))
+	}
+}
+
 // func (c *Conn) nextFrame() error {
 // 	fixed := c.readNBytes(2)
 // 	if err != nil {
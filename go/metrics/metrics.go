@@ -0,0 +1,352 @@
+// Package metrics implements websocket.Observer which collects
+// connection metrics and exposes them in Prometheus text format
+// without depending on Prometheus client library
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+)
+
+const (
+	directionIn  = "in"
+	directionOut = "out"
+)
+
+var (
+	latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	framesBuckets  = []float64{1, 2, 4, 8, 16, 32, 64, 128}
+)
+
+// Collector is websocket.Observer, pass it to Upgrader and Dialer
+// and serve it on metrics endpoint
+type Collector struct {
+	namespace string
+
+	mu sync.Mutex
+
+	handshakes        *counterVec
+	handshakeFailures *counterVec
+	handshakeDuration *histogramVec
+
+	connsOpened *counterVec
+	connsOpen   *counterVec
+
+	messages      *counterVec
+	messageBytes  *counterVec
+	messageFrames *histogramVec
+
+	controlFrames *counterVec
+
+	closeCodes    *counterVec
+	closeDuration *histogramVec
+}
+
+var _ websocket.Observer = (*Collector)(nil)
+
+// Creates collector, all metric names are prefixed with namespace,
+// "websocket" is used if it is empty
+func NewCollector(namespace string) *Collector {
+	if namespace == "" {
+		namespace = "websocket"
+	}
+
+	return &Collector{
+		namespace: namespace,
+
+		handshakes: newCounterVec("handshakes_total", "counter",
+			"Completed opening handshakes.", "side"),
+		handshakeFailures: newCounterVec("handshake_failures_total", "counter",
+			"Failed opening handshakes by reason.", "side", "reason"),
+		handshakeDuration: newHistogramVec("handshake_duration_seconds",
+			"Opening handshake latency.", latencyBuckets, "side"),
+
+		connsOpened: newCounterVec("connections_opened_total", "counter",
+			"Opened connections.", "side"),
+		connsOpen: newCounterVec("connections_open", "gauge",
+			"Currently open connections.", "side"),
+
+		messages: newCounterVec("messages_total", "counter",
+			"Data messages by direction and type.", "side", "direction", "type"),
+		messageBytes: newCounterVec("message_bytes_total", "counter",
+			"Data message payload bytes by direction and type.", "side", "direction", "type"),
+		messageFrames: newHistogramVec("message_frames",
+			"Frames per data message.", framesBuckets, "side", "direction"),
+
+		controlFrames: newCounterVec("control_frames_total", "counter",
+			"Control frames by direction and type.", "side", "direction", "type"),
+
+		closeCodes: newCounterVec("close_codes_total", "counter",
+			"Close frames by direction and close code.", "side", "direction", "code"),
+		closeDuration: newHistogramVec("close_handshake_duration_seconds",
+			"Closing handshake latency.", latencyBuckets, "side"),
+	}
+}
+
+func (c *Collector) HandshakeSucceeded(side websocket.Side, latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handshakes.add(1, side.String())
+	c.handshakeDuration.observe(latency.Seconds(), side.String())
+}
+
+func (c *Collector) HandshakeFailed(side websocket.Side, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handshakeFailures.add(1, side.String(), reason)
+}
+
+func (c *Collector) ConnOpened(side websocket.Side) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connsOpened.add(1, side.String())
+	c.connsOpen.add(1, side.String())
+}
+
+func (c *Collector) ConnClosed(side websocket.Side) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connsOpen.add(-1, side.String())
+}
+
+func (c *Collector) MessageRead(side websocket.Side, mt websocket.MessageType, bytes int, frames int) {
+	c.message(side, directionIn, mt, bytes, frames)
+}
+
+func (c *Collector) MessageWritten(side websocket.Side, mt websocket.MessageType, bytes int, frames int) {
+	c.message(side, directionOut, mt, bytes, frames)
+}
+
+func (c *Collector) message(side websocket.Side, direction string, mt websocket.MessageType, bytes int, frames int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages.add(1, side.String(), direction, mt.String())
+	c.messageBytes.add(float64(bytes), side.String(), direction, mt.String())
+	c.messageFrames.observe(float64(frames), side.String(), direction)
+}
+
+func (c *Collector) ControlFrameRead(side websocket.Side, mt websocket.MessageType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.controlFrames.add(1, side.String(), directionIn, mt.String())
+}
+
+func (c *Collector) ControlFrameWritten(side websocket.Side, mt websocket.MessageType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.controlFrames.add(1, side.String(), directionOut, mt.String())
+}
+
+func (c *Collector) CloseSent(side websocket.Side, code websocket.CloseCode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeCodes.add(1, side.String(), directionOut, strconv.Itoa(int(code)))
+}
+
+func (c *Collector) CloseReceived(side websocket.Side, code websocket.CloseCode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeCodes.add(1, side.String(), directionIn, strconv.Itoa(int(code)))
+}
+
+func (c *Collector) CloseHandshakeCompleted(side websocket.Side, latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeDuration.observe(latency.Seconds(), side.String())
+}
+
+// Serves metrics in Prometheus text exposition format
+func (c *Collector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = c.WriteTo(w)
+}
+
+// Writes metrics in Prometheus text exposition format
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	c.handshakes.write(cw, c.namespace)
+	c.handshakeFailures.write(cw, c.namespace)
+	c.handshakeDuration.write(cw, c.namespace)
+	c.connsOpened.write(cw, c.namespace)
+	c.connsOpen.write(cw, c.namespace)
+	c.messages.write(cw, c.namespace)
+	c.messageBytes.write(cw, c.namespace)
+	c.messageFrames.write(cw, c.namespace)
+	c.controlFrames.write(cw, c.namespace)
+	c.closeCodes.write(cw, c.namespace)
+	c.closeDuration.write(cw, c.namespace)
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+
+	return cw.n, cw.w.Flush()
+}
+
+type counterVec struct {
+	name   string
+	kind   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func newCounterVec(name, kind, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		kind:   kind,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func (v *counterVec) add(delta float64, labelValues ...string) {
+	v.values[formatLabels(v.labels, labelValues)] += delta
+}
+
+func (v *counterVec) write(w *countingWriter, namespace string) {
+	name := namespace + "_" + v.name
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, v.help, name, v.kind)
+
+	for _, labels := range sortedKeys(v.values) {
+		w.printf("%s%s %s\n", name, labels, formatFloat(v.values[labels]))
+	}
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+	// label values, used to add "le" label
+	labelValues []string
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+func (v *histogramVec) observe(value float64, labelValues ...string) {
+	key := formatLabels(v.labels, labelValues)
+
+	h, ok := v.values[key]
+	if !ok {
+		h = &histogram{
+			counts:      make([]uint64, len(v.buckets)),
+			labelValues: labelValues,
+		}
+		v.values[key] = h
+	}
+
+	for i, le := range v.buckets {
+		if value <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (v *histogramVec) write(w *countingWriter, namespace string) {
+	name := namespace + "_" + v.name
+	w.printf("# HELP %s %s\n# TYPE %s histogram\n", name, v.help, name)
+
+	bucketLabels := append(slices.Clone(v.labels), "le")
+
+	for _, labels := range sortedKeys(v.values) {
+		h := v.values[labels]
+
+		for i, le := range v.buckets {
+			lv := append(slices.Clone(h.labelValues), formatFloat(le))
+			w.printf("%s_bucket%s %d\n", name, formatLabels(bucketLabels, lv), h.counts[i])
+		}
+		lv := append(slices.Clone(h.labelValues), "+Inf")
+		w.printf("%s_bucket%s %d\n", name, formatLabels(bucketLabels, lv), h.count)
+
+		w.printf("%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+		w.printf("%s_count%s %d\n", name, labels, h.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	b := strings.Builder{}
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) printf(format string, args ...any) {
+	if w.err != nil {
+		return
+	}
+
+	n, err := fmt.Fprintf(w.w, format, args...)
+	w.n += int64(n)
+	w.err = err
+}
@@ -0,0 +1,108 @@
+package metrics_test
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/metrics"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestCollectorGolden(t *testing.T) {
+	c := metrics.NewCollector("test")
+
+	c.HandshakeSucceeded(websocket.SideServer, 3*time.Millisecond)
+	c.HandshakeSucceeded(websocket.SideClient, 20*time.Millisecond)
+	c.HandshakeFailed(websocket.SideServer, websocket.FailureReasonBadRequest)
+	// label values are escaped
+	c.HandshakeFailed(websocket.SideClient, "quote \" backslash \\ newline \n")
+
+	c.ConnOpened(websocket.SideServer)
+	c.ConnOpened(websocket.SideServer)
+	c.ConnClosed(websocket.SideServer)
+
+	c.MessageRead(websocket.SideServer, websocket.TextMessage, 5, 1)
+	c.MessageRead(websocket.SideServer, websocket.BinaryMessage, 1000, 3)
+	c.MessageWritten(websocket.SideServer, websocket.TextMessage, 7, 1)
+
+	c.ControlFrameRead(websocket.SideServer, websocket.PingMessage)
+	c.ControlFrameWritten(websocket.SideServer, websocket.PongMessage)
+
+	c.CloseReceived(websocket.SideServer, websocket.CloseGoingAway)
+	c.CloseSent(websocket.SideServer, websocket.CloseGoingAway)
+	c.CloseHandshakeCompleted(websocket.SideServer, 500*time.Microsecond)
+
+	got := &bytes.Buffer{}
+	n, err := c.WriteTo(got)
+	if err != nil {
+		t.Fatalf("failed to write metrics: %v", err)
+	}
+	if n != int64(got.Len()) {
+		t.Errorf("reported %d bytes written, want %d", n, got.Len())
+	}
+
+	path := filepath.Join("testdata", "collector.golden")
+	if *update {
+		if err := os.WriteFile(path, got.Bytes(), 0o644); err != nil {
+			t.Fatalf("failed to update golden file: %v", err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("metrics differ from %s, run with -update to see diff:\n%s", path, got)
+	}
+}
+
+// Checks that connection reports its events to collector
+func TestCollectorObserver(t *testing.T) {
+	c := metrics.NewCollector("")
+	client, server, err := wstest.NewPipeWith(
+		&websocket.Dialer{Observer: c},
+		&websocket.Upgrader{Observer: c},
+	)
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+
+	go func() {
+		_ = client.WriteMessage(websocket.TextMessage, []byte("hello"))
+		_ = client.Close()
+	}()
+	if _, _, err := server.NextMessage(); err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	// answers close
+	if _, _, err := server.NextMessage(); err == nil {
+		t.Fatal("read succeeded after close")
+	}
+
+	out := &strings.Builder{}
+	_, _ = c.WriteTo(out)
+
+	for _, line := range []string{
+		`websocket_handshakes_total{side="client"} 1`,
+		`websocket_handshakes_total{side="server"} 1`,
+		`websocket_connections_opened_total{side="server"} 1`,
+		`websocket_messages_total{side="client",direction="out",type="text"} 1`,
+		`websocket_messages_total{side="server",direction="in",type="text"} 1`,
+		`websocket_message_bytes_total{side="server",direction="in",type="text"} 5`,
+		`websocket_close_codes_total{side="client",direction="out",code="1000"} 1`,
+		`websocket_close_codes_total{side="server",direction="in",code="1000"} 1`,
+		`websocket_close_codes_total{side="server",direction="out",code="1000"} 1`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("metrics do not contain %q", line)
+		}
+	}
+}
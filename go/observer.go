@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"time"
+)
+
+type Side uint8
+
+const (
+	SideClient Side = iota
+	SideServer
+)
+
+func (s Side) String() string {
+	if s == SideServer {
+		return "server"
+	}
+	return "client"
+}
+
+// Handshake failure reasons reported to Observer
+const (
+	FailureReasonBadURL          = "bad_url"
+	FailureReasonDial            = "dial"
+	FailureReasonBadRequest      = "bad_request"
+	FailureReasonBadResponse     = "bad_response"
+	FailureReasonHijack          = "hijack"
+	FailureReasonShutdown        = "shutdown"
+	FailureReasonTooManyConns    = "too_many_connections"
+	FailureReasonConnectionError = "connection_error"
+	FailureReasonBadGateway      = "bad_gateway"
+	FailureReasonUnauthorized    = "unauthorized"
+	FailureReasonForbidden       = "forbidden"
+	FailureReasonAuthError       = "auth_error"
+	FailureReasonRejected        = "rejected"
+	FailureReasonReservedHeader  = "reserved_header"
+)
+
+// Observer receives connection events, use it to collect metrics.
+// Methods are called synchronously from connection goroutines,
+// so they must be fast and safe for concurrent use.
+// Embed NopObserver to implement only needed methods
+type Observer interface {
+	HandshakeSucceeded(side Side, latency time.Duration)
+	HandshakeFailed(side Side, reason string)
+
+	ConnOpened(side Side)
+	ConnClosed(side Side)
+
+	MessageRead(side Side, mt MessageType, bytes int, frames int)
+	MessageWritten(side Side, mt MessageType, bytes int, frames int)
+
+	ControlFrameRead(side Side, mt MessageType)
+	ControlFrameWritten(side Side, mt MessageType)
+
+	CloseSent(side Side, code CloseCode)
+	CloseReceived(side Side, code CloseCode)
+	// Time between first close frame sent or received and close handshake completion
+	CloseHandshakeCompleted(side Side, latency time.Duration)
+}
+
+type NopObserver struct{}
+
+func (NopObserver) HandshakeSucceeded(side Side, latency time.Duration)             {}
+func (NopObserver) HandshakeFailed(side Side, reason string)                        {}
+func (NopObserver) ConnOpened(side Side)                                            {}
+func (NopObserver) ConnClosed(side Side)                                            {}
+func (NopObserver) MessageRead(side Side, mt MessageType, bytes int, frames int)    {}
+func (NopObserver) MessageWritten(side Side, mt MessageType, bytes int, frames int) {}
+func (NopObserver) ControlFrameRead(side Side, mt MessageType)                      {}
+func (NopObserver) ControlFrameWritten(side Side, mt MessageType)                   {}
+func (NopObserver) CloseSent(side Side, code CloseCode)                             {}
+func (NopObserver) CloseReceived(side Side, code CloseCode)                         {}
+func (NopObserver) CloseHandshakeCompleted(side Side, latency time.Duration)        {}
+
+func (c *Conn) side() Side {
+	if c.isServer {
+		return SideServer
+	}
+	return SideClient
+}
+
+// Sets observer and reports connection as opened
+func (c *Conn) observe(o Observer) {
+	if o == nil {
+		return
+	}
+
+	c.obs = o
+	c.obs.ConnOpened(c.side())
+	c.onClose = append(c.onClose, func() {
+		c.obs.ConnClosed(c.side())
+	})
+}
+
+// Called after close frame was sent or received,
+// second call completes close handshake
+func (c *Conn) observeCloseFrame(sent bool, code CloseCode) {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	if c.closeStart.IsZero() {
+		c.closeStart = time.Now()
+
+		initiator := "remote"
+		if sent {
+			initiator = "local"
+		}
+		c.closeSpan = c.startSpan(SpanClose, Attribute{AttrCloseInitiator, initiator})
+		c.closeSpan.SetAttributes(Attribute{AttrCloseCode, int(code)})
+		return
+	}
+
+	if c.isClosed() {
+		c.obs.CloseHandshakeCompleted(c.side(), time.Since(c.closeStart))
+		c.closeSpan.End()
+	}
+}
@@ -0,0 +1,266 @@
+package websocket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/wmdanor/websocket/go/internal"
+)
+
+const (
+	headerXForwardedFor   = "X-Forwarded-For"
+	headerXForwardedHost  = "X-Forwarded-Host"
+	headerXForwardedProto = "X-Forwarded-Proto"
+	headerCookie          = "Cookie"
+)
+
+// ReverseProxy is http.Handler which accepts websocket connections and relays
+// them to backend servers. Backend is dialed first, so client gets subprotocol
+// selected by backend, then messages are relayed in both directions until
+// either side closes connection, close code and reason are passed to other side.
+// Pings are answered by proxy on each side and are not relayed
+type ReverseProxy struct {
+	// Returns ws or wss url of backend to relay request to, required.
+	// Request is rejected with 502 if error is returned
+	Backend func(req *http.Request) (string, error)
+
+	// Accepts client connections, Upgrader.Subprotocols is ignored.
+	// Upgrader.Authenticate runs before backend is dialed.
+	// Default one is used if nil
+	Upgrader *Upgrader
+	// Dials backend connections, Dialer.Subprotocols is ignored.
+	// Default one is used if nil
+	Dialer *Dialer
+
+	// Request headers forwarded to backend in addition to cookies and
+	// X-Forwarded-* headers, e.g. Origin or Authorization
+	ForwardHeaders []string
+
+	// Relays every frame as is, otherwise messages are relayed as a stream
+	// and may be split into frames differently. Message transforms of extensions,
+	// e.g. compression, can't be applied to single frames, so messages are
+	// relayed as a stream when either connection has negotiated extensions
+	PreserveFragmentation bool
+
+	InternalLogger *slog.Logger
+}
+
+func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	l := p.InternalLogger
+	if l == nil {
+		l = slog.New(slog.DiscardHandler)
+	}
+
+	u := p.Upgrader
+	if u == nil {
+		u = &Upgrader{}
+	}
+
+	if !isUpgradeRequest(req) {
+		// backend is not dialed for requests which would be rejected anyway
+		_, _ = u.upgrade(w, req, nil, nil, nil)
+		return
+	}
+
+	// backend is not dialed for unauthenticated requests either
+	var auth *authenticated
+	if u.Authenticate != nil {
+		var err error
+		auth, err = u.authenticate(w, req, l)
+		if err != nil {
+			return
+		}
+	}
+
+	backendURL, err := p.Backend(req)
+	if err != nil {
+		l.Debug("proxy: failed to select backend", "err", err)
+		_ = u.fail(w, req, http.StatusBadGateway, FailureReasonBadGateway,
+			fmt.Errorf("failed to select backend: [%w]", err))
+		return
+	}
+
+	d := Dialer{}
+	if p.Dialer != nil {
+		d = *p.Dialer
+	}
+	d.Subprotocols = headerTokens(req.Header, headerSecWsProto)
+
+	backend, err := d.DialContext(req.Context(), backendURL, p.forwardedHeaders(req))
+	if err != nil {
+		l.Debug("proxy: failed to dial backend", "backend", backendURL, "err", err)
+		_ = u.fail(w, req, http.StatusBadGateway, FailureReasonBadGateway,
+			fmt.Errorf("failed to dial backend: [%w]", err))
+		return
+	}
+
+	var subprotocols []string
+	if backend.Subprotocol() != "" {
+		subprotocols = []string{backend.Subprotocol()}
+	}
+
+	client, err := u.upgrade(w, req, nil, subprotocols, auth)
+	if err != nil {
+		l.Debug("proxy: failed to upgrade client connection", "err", err)
+		_ = backend.WriteClose(CloseGoingAway, "client handshake failed")
+		_ = backend.closeNetConn()
+		return
+	}
+
+	l.Debug("proxy: relaying connection", "client", client.ID(), "backend", backend.ID(), "url", backendURL)
+
+	preserve := p.PreserveFragmentation && len(client.extensions) == 0 && len(backend.extensions) == 0
+	if p.PreserveFragmentation && !preserve {
+		l.Debug("proxy: extensions were negotiated, relaying messages instead of frames")
+	}
+	p.relay(client, backend, preserve, l)
+
+	l.Debug("proxy: connection closed", "client", client.ID(), "backend", backend.ID())
+}
+
+func isUpgradeRequest(req *http.Request) bool {
+	if isExtendedConnect(req) {
+		return true
+	}
+	_, ok := headerEquals(req.Header, headerUpgrade, headerUpgradeExpected)
+	return ok && req.Method == http.MethodGet
+}
+
+func (p *ReverseProxy) forwardedHeaders(req *http.Request) map[string]string {
+	headers := map[string]string{}
+
+	for _, name := range p.ForwardHeaders {
+		if v := req.Header.Values(name); len(v) > 0 {
+			headers[name] = strings.Join(v, ", ")
+		}
+	}
+
+	if v := req.Header.Values(headerCookie); len(v) > 0 {
+		headers[headerCookie] = strings.Join(v, "; ")
+	}
+
+	forwardedFor := remoteIP(req)
+	if prior := req.Header.Values(headerXForwardedFor); len(prior) > 0 {
+		forwardedFor = strings.Join(prior, ", ") + ", " + forwardedFor
+	}
+	headers[headerXForwardedFor] = forwardedFor
+
+	headers[headerXForwardedHost] = req.Host
+	if req.TLS != nil {
+		headers[headerXForwardedProto] = "https"
+	} else {
+		headers[headerXForwardedProto] = "http"
+	}
+
+	return headers
+}
+
+// Relays messages between connections until both are closed
+func (p *ReverseProxy) relay(client, backend *Conn, preserve bool, l *slog.Logger) {
+	forwardClose(client, backend)
+	forwardClose(backend, client)
+
+	errc := make(chan error, 2)
+	go func() {
+		errc <- pipe(client, backend, preserve)
+	}()
+	go func() {
+		errc <- pipe(backend, client, preserve)
+	}()
+
+	err := <-errc
+	if !isConnClosedErr(err) {
+		l.Debug("proxy: relay failed", "client", client.ID(), "backend", backend.ID(), "err", err)
+		// connection which is still alive must not wait for close
+		// frame from peer which failed, close frames are not sent twice
+		_ = client.WriteClose(CloseInternalServerErr, "backend connection failed")
+		_ = backend.WriteClose(CloseGoingAway, "client connection failed")
+	}
+
+	select {
+	case err = <-errc:
+	case <-time.After(closeTimeout):
+		err = fmt.Errorf("timed out waiting for close frame")
+	}
+	if !isConnClosedErr(err) {
+		l.Debug("proxy: relay failed", "client", client.ID(), "backend", backend.ID(), "err", err)
+	}
+
+	_ = client.closeNetConn()
+	_ = backend.closeNetConn()
+}
+
+// Close frame received on src is sent to dst with the same code and reason
+// before being echoed back
+func forwardClose(src, dst *Conn) {
+	src.SetCloseHandler(func(code CloseCode, reason string) error {
+		err := dst.WriteClose(code, reason)
+		if err != nil {
+			src.l.Debug("proxy: failed to forward close frame", "err", err)
+		}
+
+		return src.WriteClose(code, reason)
+	})
+}
+
+// Copies messages or frames from src to dst until src is closed
+func pipe(src, dst *Conn, preserve bool) error {
+	for {
+		var err error
+		if preserve {
+			err = pipeFrame(src, dst)
+		} else {
+			err = pipeMessage(src, dst)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func pipeFrame(src, dst *Conn) error {
+	f, err := src.ReadFrame()
+	if err != nil {
+		return err
+	}
+
+	if internal.Opcode(f.Type).IsControl() {
+		// already handled by src handlers
+		return nil
+	}
+
+	err = dst.WriteFrame(f.IsFinal, f.Type, f.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to write frame: [%w]", err)
+	}
+
+	return nil
+}
+
+func pipeMessage(src, dst *Conn) error {
+	mt, r, err := src.NextReader()
+	if err != nil {
+		return err
+	}
+
+	w, err := dst.NextWriter(mt)
+	if err != nil {
+		return fmt.Errorf("failed to get next writer: [%w]", err)
+	}
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		return fmt.Errorf("failed to copy message: [%w]", err)
+	}
+
+	return w.Close()
+}
+
+func isConnClosedErr(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, ErrConnClosed)
+}
@@ -0,0 +1,257 @@
+package websocket_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+const proxyTestTimeout = 5 * time.Second
+
+type proxyClose struct {
+	code   websocket.CloseCode
+	reason string
+}
+
+// Starts backend which runs handler for every upgraded connection and proxy in front of it
+func newProxyPair(t *testing.T, u *websocket.Upgrader, p *websocket.ReverseProxy, handler func(c *websocket.Conn, req *http.Request)) string {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c, err := u.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		handler(c, req)
+	}))
+	t.Cleanup(backend.Close)
+
+	if p.Backend == nil {
+		p.Backend = func(req *http.Request) (string, error) {
+			return "ws" + strings.TrimPrefix(backend.URL, "http") + req.URL.Path, nil
+		}
+	}
+
+	proxy := httptest.NewServer(p)
+	t.Cleanup(proxy.Close)
+
+	return "ws" + strings.TrimPrefix(proxy.URL, "http")
+}
+
+func recvClose(c *websocket.Conn, closes chan<- proxyClose) {
+	c.SetCloseHandler(func(code websocket.CloseCode, reason string) error {
+		closes <- proxyClose{code, reason}
+		return c.WriteClose(code, reason)
+	})
+}
+
+func TestReverseProxyRelay(t *testing.T) {
+	type backendReq struct {
+		forwardedFor string
+		cookie       string
+		origin       string
+	}
+	reqs := make(chan backendReq, 1)
+	backendCloses := make(chan proxyClose, 1)
+
+	u := &websocket.Upgrader{Subprotocols: []string{"chat.v2", "chat.v1"}}
+	url := newProxyPair(t, u, &websocket.ReverseProxy{ForwardHeaders: []string{"Origin"}}, func(c *websocket.Conn, req *http.Request) {
+		reqs <- backendReq{req.Header.Get("X-Forwarded-For"), req.Header.Get("Cookie"), req.Header.Get("Origin")}
+		recvClose(c, backendCloses)
+		wstest.Echo(c)
+	})
+
+	d := websocket.Dialer{Subprotocols: []string{"chat.v1", "chat.v2"}}
+	c, err := d.Dial(url+"/chat", map[string]string{
+		"Cookie":          "session=abc",
+		"Origin":          "https://example.com",
+		"X-Forwarded-For": "10.0.0.1",
+	})
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer c.Close()
+
+	if c.Subprotocol() != "chat.v2" {
+		t.Errorf("subprotocol = %q, want subprotocol selected by backend %q", c.Subprotocol(), "chat.v2")
+	}
+
+	req := <-reqs
+	if req.forwardedFor != "10.0.0.1, 127.0.0.1" {
+		t.Errorf("X-Forwarded-For = %q, want %q", req.forwardedFor, "10.0.0.1, 127.0.0.1")
+	}
+	if req.cookie != "session=abc" {
+		t.Errorf("Cookie = %q, want %q", req.cookie, "session=abc")
+	}
+	if req.origin != "https://example.com" {
+		t.Errorf("Origin = %q, want %q", req.origin, "https://example.com")
+	}
+
+	big := strings.Repeat("0123456789", 2000)
+	messages := []struct {
+		mt   websocket.MessageType
+		data string
+	}{
+		{websocket.TextMessage, "hello"},
+		{websocket.BinaryMessage, "\x00\x01\x02"},
+		{websocket.TextMessage, big},
+		{websocket.TextMessage, ""},
+	}
+	for _, m := range messages {
+		if err := c.WriteMessage(m.mt, []byte(m.data)); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+		mt, data, err := c.NextMessage()
+		if err != nil {
+			t.Fatalf("failed to read message: %v", err)
+		}
+		if mt != m.mt || string(data) != m.data {
+			t.Errorf("echo = %s of %d bytes, want %s of %d bytes", mt, len(data), m.mt, len(m.data))
+		}
+	}
+
+	clientCloses := make(chan proxyClose, 1)
+	recvClose(c, clientCloses)
+	if err := c.WriteClose(4001, "client done"); err != nil {
+		t.Fatalf("failed to write close: %v", err)
+	}
+	if _, _, err := c.NextMessage(); err == nil {
+		t.Fatalf("expected connection to be closed")
+	}
+
+	want := proxyClose{4001, "client done"}
+	select {
+	case got := <-backendCloses:
+		if got != want {
+			t.Errorf("backend received close %v, want %v", got, want)
+		}
+	case <-time.After(proxyTestTimeout):
+		t.Fatalf("backend did not receive close frame")
+	}
+	select {
+	case got := <-clientCloses:
+		if got != want {
+			t.Errorf("client received close reply %v, want %v", got, want)
+		}
+	case <-time.After(proxyTestTimeout):
+		t.Fatalf("client did not receive close reply")
+	}
+}
+
+func TestReverseProxyPreserveFragmentation(t *testing.T) {
+	url := newProxyPair(t, &websocket.Upgrader{}, &websocket.ReverseProxy{PreserveFragmentation: true}, func(c *websocket.Conn, req *http.Request) {
+		for {
+			f, err := c.ReadFrame()
+			if err != nil {
+				return
+			}
+			if f.Type == websocket.CloseMessage {
+				return
+			}
+			if err := c.WriteFrame(f.IsFinal, f.Type, f.Payload); err != nil {
+				return
+			}
+			if f.IsFinal {
+				_ = c.WriteClose(4002, "backend done")
+				_, _, _ = c.NextMessage()
+				return
+			}
+		}
+	})
+
+	c, err := (&websocket.Dialer{}).Dial(url, nil)
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer c.Close()
+
+	sent := []websocket.Frame{
+		{IsFinal: false, Type: websocket.BinaryMessage, Payload: []byte("one")},
+		{IsFinal: false, Type: websocket.ContinuationFrame, Payload: []byte("two")},
+		{IsFinal: true, Type: websocket.ContinuationFrame, Payload: []byte("three")},
+	}
+	for _, f := range sent {
+		if err := c.WriteFrame(f.IsFinal, f.Type, f.Payload); err != nil {
+			t.Fatalf("failed to write frame: %v", err)
+		}
+	}
+
+	for _, want := range sent {
+		f, err := c.ReadFrame()
+		if err != nil {
+			t.Fatalf("failed to read frame: %v", err)
+		}
+		if f.IsFinal != want.IsFinal || f.Type != want.Type || string(f.Payload) != string(want.Payload) {
+			t.Errorf("frame = {%v %s %q}, want {%v %s %q}",
+				f.IsFinal, f.Type, f.Payload, want.IsFinal, want.Type, want.Payload)
+		}
+	}
+
+	closes := make(chan proxyClose, 1)
+	recvClose(c, closes)
+	if _, _, err := c.NextMessage(); err == nil {
+		t.Fatalf("expected connection to be closed")
+	}
+
+	select {
+	case got := <-closes:
+		if want := (proxyClose{4002, "backend done"}); got != want {
+			t.Errorf("client received close %v, want %v", got, want)
+		}
+	case <-time.After(proxyTestTimeout):
+		t.Fatalf("client did not receive close frame")
+	}
+}
+
+func TestReverseProxyBadGateway(t *testing.T) {
+	p := &websocket.ReverseProxy{
+		Backend: func(req *http.Request) (string, error) {
+			return "", errors.New("no backend")
+		},
+	}
+	url := newProxyPair(t, &websocket.Upgrader{}, p, func(c *websocket.Conn, req *http.Request) {})
+
+	_, err := (&websocket.Dialer{}).Dial(url, nil)
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("dial error = %v, want 502 response", err)
+	}
+}
+
+func TestReverseProxyPreserveFragmentationCompressed(t *testing.T) {
+	deflate := []websocket.Extension{websocket.PerMessageDeflate{}}
+	p := &websocket.ReverseProxy{
+		PreserveFragmentation: true,
+		Upgrader:              &websocket.Upgrader{Extensions: deflate},
+		Dialer:                &websocket.Dialer{Extensions: deflate},
+	}
+	url := newProxyPair(t, &websocket.Upgrader{Extensions: deflate}, p, func(c *websocket.Conn, req *http.Request) {
+		wstest.Echo(c)
+	})
+
+	c, err := (&websocket.Dialer{Extensions: deflate}).Dial(url, nil)
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer c.Close()
+
+	if exts := c.Extensions(); len(exts) != 1 {
+		t.Fatalf("extensions = %v, want permessage-deflate", exts)
+	}
+
+	text := strings.Repeat("compressed through proxy ", 100)
+	for range 3 {
+		if err := c.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+		mt, data, err := c.NextMessage()
+		if err != nil || mt != websocket.TextMessage || string(data) != text {
+			t.Fatalf("echo = %s of %d bytes %v, want text of %d bytes", mt, len(data), err, len(text))
+		}
+	}
+}
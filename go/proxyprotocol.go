@@ -0,0 +1,322 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Whether connections accepted with UpgradeConn start with
+// PROXY protocol header (v1 or v2) sent by load balancer
+type ProxyProtocol int
+
+const (
+	// Header is not expected, default
+	ProxyProtocolOff ProxyProtocol = iota
+	// Header is parsed if present
+	ProxyProtocolOptional
+	// Connections without header are rejected
+	ProxyProtocolRequired
+)
+
+var (
+	ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+	ErrMissingProxyHeader = errors.New("missing PROXY protocol header")
+)
+
+// Types of v2 header TLV fields
+const (
+	ProxyTLVALPN      byte = 0x01
+	ProxyTLVAuthority byte = 0x02
+	ProxyTLVUniqueID  byte = 0x05
+	ProxyTLVSSL       byte = 0x20
+)
+
+const (
+	// v1 line including CRLF is at most 107 bytes
+	proxyV1MaxLength = 107
+	proxyV1Prefix    = "PROXY "
+	proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+	// 16 bytes fixed part and up to 64KB of addresses and TLVs
+	proxyV2MaxLength = 16 + 0xFFFF
+)
+
+// PROXY protocol header with original addresses of connection
+type ProxyHeader struct {
+	// 1 or 2
+	Version int
+	// Original client and server addresses, nil for LOCAL command or
+	// UNKNOWN/UNSPEC address family, addresses of connection are kept then
+	Source, Destination net.Addr
+	// Type-length-value fields of v2 header
+	TLVs []ProxyTLV
+}
+
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Value of first TLV field of given type
+func (h *ProxyHeader) TLV(typ byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+type proxyHeaderKey struct{}
+
+// Returns PROXY protocol header of connection accepted with UpgradeConn,
+// use with Conn.Context() or context of returned request. Header read with
+// ReadProxyHeader is found as well when its connection is passed to UpgradeConn
+func ProxyHeaderFromContext(ctx context.Context) (*ProxyHeader, bool) {
+	h, ok := ctx.Value(proxyHeaderKey{}).(*ProxyHeader)
+	return h, ok
+}
+
+// Reads PROXY protocol header from the start of connection accepted from
+// listener, so it can be done before TLS handshake. Returned connection reports
+// addresses from header and must be used instead of netConn, header is nil if
+// it is optional and missing. Caller should set deadline for reading header
+func ReadProxyHeader(netConn net.Conn, mode ProxyProtocol) (net.Conn, *ProxyHeader, error) {
+	if mode == ProxyProtocolOff {
+		return netConn, nil, nil
+	}
+
+	r := bufio.NewReader(netConn)
+	h, err := readProxyHeader(r, mode)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY header: [%w]", err)
+	}
+
+	return newProxiedConn(netConn, r, h), h, nil
+}
+
+// Returns header read with ReadProxyHeader, connection may be wrapped into TLS
+func proxyHeaderOf(netConn net.Conn) *ProxyHeader {
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		netConn = tlsConn.NetConn()
+	}
+	if pc, ok := netConn.(*proxiedConn); ok {
+		return pc.header
+	}
+	return nil
+}
+
+// Reads header from the start of connection, nil is returned
+// if there is no header and it is optional
+func readProxyHeader(r *bufio.Reader, mode ProxyProtocol) (*ProxyHeader, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		prefix, err := r.Peek(len(proxyV1Prefix))
+		if err == nil && string(prefix) == proxyV1Prefix {
+			return parseProxyHeaderV1(r)
+		}
+	case proxyV2Signature[0]:
+		sig, err := r.Peek(len(proxyV2Signature))
+		if err == nil && string(sig) == proxyV2Signature {
+			return parseProxyHeaderV2(r)
+		}
+	}
+
+	if mode == ProxyProtocolRequired {
+		return nil, ErrMissingProxyHeader
+	}
+	return nil, nil
+}
+
+// PROXY TCP4|TCP6 <src ip> <dst ip> <src port> <dst port>\r\n or PROXY UNKNOWN ...\r\n
+func parseProxyHeaderV1(r *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read v1 header: [%w]", err)
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header is longer than %d bytes", ErrInvalidProxyHeader, proxyV1MaxLength)
+	}
+
+	fields := strings.Split(string(line[len(proxyV1Prefix):len(line)-2]), " ")
+	h := &ProxyHeader{Version: 1}
+
+	switch fields[0] {
+	case "UNKNOWN":
+		// rest of line must be ignored
+		return h, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: unknown v1 protocol %q", ErrInvalidProxyHeader, fields[0])
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: v1 header has %d fields, expected 5", ErrInvalidProxyHeader, len(fields))
+	}
+
+	src, err := parseProxyAddrV1(fields[0], fields[1], fields[3])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyAddrV1(fields[0], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	h.Source, h.Destination = src, dst
+
+	return h, nil
+}
+
+func parseProxyAddrV1(proto, ipStr, portStr string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil || strings.Contains(ipStr, ":") != (proto == "TCP6") {
+		return nil, fmt.Errorf("%w: invalid %s address %q", ErrInvalidProxyHeader, proto, ipStr)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || (len(portStr) > 1 && portStr[0] == '0') {
+		return nil, fmt.Errorf("%w: invalid port %q", ErrInvalidProxyHeader, portStr)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// 12 bytes signature, version and command, family and protocol,
+// big endian length of addresses and TLVs which follow
+func parseProxyHeaderV2(r *bufio.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, len(proxyV2Signature)+4)
+	_, err := io.ReadFull(r, fixed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read v2 header: [%w]", err)
+	}
+
+	verCmd, famProto := fixed[12], fixed[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidProxyHeader, verCmd>>4)
+	}
+	cmd := verCmd & 0x0f
+	if cmd > 1 {
+		return nil, fmt.Errorf("%w: unknown command %d", ErrInvalidProxyHeader, cmd)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read v2 header: [%w]", err)
+	}
+
+	h := &ProxyHeader{Version: 2}
+
+	proto := famProto & 0x0f
+	if proto > 2 {
+		return nil, fmt.Errorf("%w: unknown transport protocol %d", ErrInvalidProxyHeader, proto)
+	}
+
+	var addrLen int
+	switch famProto >> 4 {
+	case 0x0: // UNSPEC
+	case 0x1: // INET
+		addrLen = 12
+	case 0x2: // INET6
+		addrLen = 36
+	case 0x3: // UNIX
+		addrLen = 216
+	default:
+		return nil, fmt.Errorf("%w: unknown address family %d", ErrInvalidProxyHeader, famProto>>4)
+	}
+	if len(payload) < addrLen {
+		return nil, fmt.Errorf("%w: addresses take %d bytes, header has %d", ErrInvalidProxyHeader, addrLen, len(payload))
+	}
+	addrs := payload[:addrLen]
+
+	// addresses of LOCAL command are ignored, it is sent by balancer
+	// itself, e.g. for health checks. Addresses of UNSPEC protocol are
+	// ignored as well, since it is not known what they are
+	if cmd == 1 && proto != 0x0 {
+		switch famProto >> 4 {
+		case 0x1:
+			h.Source = proxyAddrV2(proto, addrs[0:4], addrs[8:10])
+			h.Destination = proxyAddrV2(proto, addrs[4:8], addrs[10:12])
+		case 0x2:
+			h.Source = proxyAddrV2(proto, addrs[0:16], addrs[32:34])
+			h.Destination = proxyAddrV2(proto, addrs[16:32], addrs[34:36])
+		case 0x3:
+			network := "unix"
+			if proto == 0x2 {
+				network = "unixgram"
+			}
+			h.Source = &net.UnixAddr{Name: string(bytes.TrimRight(addrs[:108], "\x00")), Net: network}
+			h.Destination = &net.UnixAddr{Name: string(bytes.TrimRight(addrs[108:], "\x00")), Net: network}
+		}
+	}
+
+	tlvs := payload[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, fmt.Errorf("%w: truncated TLV", ErrInvalidProxyHeader)
+		}
+		n := int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+n {
+			return nil, fmt.Errorf("%w: TLV length %d exceeds header", ErrInvalidProxyHeader, n)
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+n]})
+		tlvs = tlvs[3+n:]
+	}
+
+	return h, nil
+}
+
+// TCP address for STREAM protocol and UDP address for DGRAM
+func proxyAddrV2(proto byte, ip, port []byte) net.Addr {
+	p := int(binary.BigEndian.Uint16(port))
+	if proto == 0x2 {
+		return &net.UDPAddr{IP: net.IP(ip), Port: p}
+	}
+	return &net.TCPAddr{IP: net.IP(ip), Port: p}
+}
+
+// Reports addresses from PROXY header instead of balancer ones
+type proxiedConn struct {
+	net.Conn
+	// data buffered while header was read comes first
+	r             io.Reader
+	remote, local net.Addr
+	header        *ProxyHeader
+}
+
+func newProxiedConn(netConn net.Conn, r io.Reader, h *ProxyHeader) *proxiedConn {
+	c := &proxiedConn{Conn: netConn, r: r, remote: netConn.RemoteAddr(), local: netConn.LocalAddr(), header: h}
+	if h != nil && h.Source != nil {
+		c.remote, c.local = h.Source, h.Destination
+	}
+	return c
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	return c.local
+}
@@ -0,0 +1,312 @@
+package websocket_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+)
+
+const handshakeRequest = "GET /path HTTP/1.1\r\n" +
+	"Host: example.com\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Version: 13\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+
+func TestProxyProtocol(t *testing.T) {
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	v2 = append(v2, 0x21, 0x11, 0x00, 0x12,
+		192, 0, 2, 1, // source
+		198, 51, 100, 1, // destination
+		0xdc, 0x04, 0x01, 0xbb, // ports 56324 and 443
+		0x01, 0x00, 0x03, 'h', '2', '1', // ALPN
+	)
+	v2Local := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20, 0x00, 0x00, 0x00)
+	// TLVs larger than default request header limit
+	v2Large := []byte("\r\n\r\n\x00\r\nQUIT\n")
+	v2Large = append(v2Large, 0x21, 0x11, 0xff, 0xff,
+		192, 0, 2, 1,
+		198, 51, 100, 1,
+		0xdc, 0x04, 0x01, 0xbb,
+		0xe0, 0xff, 0xf0, // custom TLV of 65520 bytes fills header length
+	)
+	v2Large = append(v2Large, make([]byte, 0xfff0)...)
+
+	tests := []struct {
+		name   string
+		mode   websocket.ProxyProtocol
+		header string
+		remote string
+		local  string
+		alpn   string
+		// request header limit, default if 0
+		maxHeaderBytes int
+		err            error
+	}{
+		{
+			name:   "v1",
+			mode:   websocket.ProxyProtocolRequired,
+			header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			remote: "192.0.2.1:56324",
+			local:  "198.51.100.1:443",
+		},
+		{
+			name:   "v1 ipv6",
+			mode:   websocket.ProxyProtocolOptional,
+			header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+			remote: "[2001:db8::1]:56324",
+			local:  "[2001:db8::2]:443",
+		},
+		{
+			name:   "v2 with TLV",
+			mode:   websocket.ProxyProtocolRequired,
+			header: string(v2),
+			remote: "192.0.2.1:56324",
+			local:  "198.51.100.1:443",
+			alpn:   "h21",
+		},
+		{
+			name:   "v2 larger than request limit",
+			mode:   websocket.ProxyProtocolRequired,
+			header: string(v2Large),
+			remote: "192.0.2.1:56324",
+			local:  "198.51.100.1:443",
+		},
+		{
+			name:           "request over limit after v2",
+			mode:           websocket.ProxyProtocolRequired,
+			header:         string(v2Large),
+			maxHeaderBytes: 100,
+			err:            websocket.ErrRequestHeaderTooLarge,
+		},
+		{
+			// request is read ahead with PROXY header
+			name:           "request over limit after v1",
+			mode:           websocket.ProxyProtocolRequired,
+			header:         "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			maxHeaderBytes: 100,
+			err:            websocket.ErrRequestHeaderTooLarge,
+		},
+		{
+			name:   "v2 local",
+			mode:   websocket.ProxyProtocolRequired,
+			header: string(v2Local),
+		},
+		{
+			name: "optional without header",
+			mode: websocket.ProxyProtocolOptional,
+		},
+		{
+			name: "required without header",
+			mode: websocket.ProxyProtocolRequired,
+			err:  websocket.ErrMissingProxyHeader,
+		},
+		{
+			name:   "invalid v1",
+			mode:   websocket.ProxyProtocolOptional,
+			header: "PROXY TCP4 2001:db8::1 192.0.2.1 1 2\r\n",
+			err:    websocket.ErrInvalidProxyHeader,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientNetConn, serverNetConn := net.Pipe()
+			defer clientNetConn.Close()
+
+			type result struct {
+				conn *websocket.Conn
+				err  error
+			}
+			results := make(chan result, 1)
+			go func() {
+				u := &websocket.Upgrader{}
+				c, _, err := u.UpgradeConn(serverNetConn, &websocket.UpgradeConnOptions{
+					ProxyProtocol:    tt.mode,
+					HandshakeTimeout: time.Second,
+					MaxHeaderBytes:   tt.maxHeaderBytes,
+				})
+				results <- result{c, err}
+			}()
+
+			go func() {
+				_, _ = clientNetConn.Write([]byte(tt.header + handshakeRequest))
+			}()
+
+			if tt.err != nil {
+				// error response is discarded
+				go func() { _, _ = io.Copy(io.Discard, clientNetConn) }()
+				res := <-results
+				if !errors.Is(res.err, tt.err) {
+					t.Fatalf("upgrade error = %v, want %v", res.err, tt.err)
+				}
+				return
+			}
+
+			res, err := http.ReadResponse(bufio.NewReader(clientNetConn), nil)
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			if res.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status = %d, want 101", res.StatusCode)
+			}
+
+			r := <-results
+			if r.err != nil {
+				t.Fatalf("failed to upgrade: %v", r.err)
+			}
+			c := r.conn
+
+			remote, local := tt.remote, tt.local
+			if remote == "" {
+				remote, local = serverNetConn.RemoteAddr().String(), serverNetConn.LocalAddr().String()
+			}
+			if c.RemoteAddr().String() != remote || c.LocalAddr().String() != local {
+				t.Errorf("addresses = %s %s, want %s %s", c.RemoteAddr(), c.LocalAddr(), remote, local)
+			}
+
+			h, ok := websocket.ProxyHeaderFromContext(c.Context())
+			if ok != (tt.header != "") {
+				t.Fatalf("PROXY header in context = %v, want %v", ok, tt.header != "")
+			}
+			if tt.alpn != "" {
+				alpn, _ := h.TLV(websocket.ProxyTLVALPN)
+				if string(alpn) != tt.alpn {
+					t.Errorf("ALPN TLV = %q, want %q", alpn, tt.alpn)
+				}
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	defer srv.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	type result struct {
+		conn *websocket.Conn
+		req  *http.Request
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		netConn, err := ln.Accept()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		// header precedes TLS handshake
+		netConn, _, err = websocket.ReadProxyHeader(netConn, websocket.ProxyProtocolRequired)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		tlsConn := tls.Server(netConn, &tls.Config{Certificates: srv.TLS.Certificates})
+		c, req, err := (&websocket.Upgrader{}).UpgradeConn(tlsConn, nil)
+		results <- result{c, req, err}
+		if err == nil {
+			_, _, _ = c.NextMessage()
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	d := &websocket.Dialer{
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			netConn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			_, err = netConn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"))
+			return netConn, err
+		},
+	}
+	client, err := d.Dial("wss://"+ln.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	r := <-results
+	if r.err != nil {
+		t.Fatalf("failed to upgrade: %v", r.err)
+	}
+	if r.req.TLS == nil {
+		t.Error("request has no TLS state")
+	}
+	if got := r.conn.RemoteAddr().String(); got != "192.0.2.1:56324" || r.req.RemoteAddr != got {
+		t.Errorf("remote address = %s, request %s, want %s", got, r.req.RemoteAddr, "192.0.2.1:56324")
+	}
+	if _, ok := websocket.ProxyHeaderFromContext(r.conn.Context()); !ok {
+		t.Error("PROXY header is not in context")
+	}
+}
+
+func TestReadProxyHeaderV2Protocol(t *testing.T) {
+	header := func(famProto byte) []byte {
+		return append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, famProto, 0x00, 0x0c,
+			192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x00, 0x35)
+	}
+
+	tests := []struct {
+		name     string
+		famProto byte
+		source   net.Addr
+		err      error
+	}{
+		{"stream", 0x11, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324}, nil},
+		{"dgram", 0x12, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 56324}, nil},
+		{"unspec", 0x10, nil, nil},
+		{"unknown", 0x13, nil, websocket.ErrInvalidProxyHeader},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientNetConn, serverNetConn := net.Pipe()
+			defer clientNetConn.Close()
+			go func() {
+				_, _ = clientNetConn.Write(append(header(tt.famProto), "data"...))
+			}()
+
+			conn, h, err := websocket.ReadProxyHeader(serverNetConn, websocket.ProxyProtocolRequired)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if tt.source == nil {
+				if h.Source != nil || conn.RemoteAddr() != serverNetConn.RemoteAddr() {
+					t.Errorf("source = %v, remote = %v, want connection address", h.Source, conn.RemoteAddr())
+				}
+			} else if h.Source.Network() != tt.source.Network() || h.Source.String() != tt.source.String() {
+				t.Errorf("source = %s %s, want %s %s", h.Source.Network(), h.Source, tt.source.Network(), tt.source)
+			}
+
+			// data after header is not lost
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "data" {
+				t.Errorf("read %q %v, want %q", buf, err, "data")
+			}
+		})
+	}
+}
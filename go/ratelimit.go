@@ -0,0 +1,187 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/wmdanor/websocket/go/internal"
+)
+
+type RateLimitAction uint8
+
+const (
+	// Stops reading from connection until limits allow it,
+	// so peer is slowed down by TCP flow control
+	RateLimitDelay RateLimitAction = iota
+	// Closes connection with ClosePolicyViolation
+	RateLimitClose
+)
+
+// Inbound traffic limits, zero rate means unlimited.
+// Burst is max amount which can be received at once,
+// if not set it equals to one second worth of rate.
+// Frames bigger than bytes burst close connection with CloseMessageTooBig
+type RateLimit struct {
+	MessagesPerSecond float64
+	MessagesBurst     int
+
+	BytesPerSecond float64
+	BytesBurst     int
+
+	ControlFramesPerSecond float64
+	ControlFramesBurst     int
+
+	Action RateLimitAction
+}
+
+type rateLimiter struct {
+	messages      *tokenBucket
+	bytes         *tokenBucket
+	controlFrames *tokenBucket
+
+	action RateLimitAction
+}
+
+func newRateLimiter(l RateLimit) *rateLimiter {
+	return &rateLimiter{
+		messages:      newTokenBucket(l.MessagesPerSecond, l.MessagesBurst),
+		bytes:         newTokenBucket(l.BytesPerSecond, l.BytesBurst),
+		controlFrames: newTokenBucket(l.ControlFramesPerSecond, l.ControlFramesBurst),
+		action:        l.Action,
+	}
+}
+
+// Sets inbound rate limit for connection, must not be called concurrently with reads.
+// Passing nil removes limits
+func (c *Conn) SetRateLimit(l *RateLimit) {
+	if l == nil {
+		c.limiter = nil
+		return
+	}
+
+	c.limiter = newRateLimiter(*l)
+}
+
+// Called for each received frame header before its payload is read
+func (c *Conn) limitFrame(f *internal.FrameHeader) error {
+	if c.limiter == nil || c.sentConnClose.Load() {
+		// frames received while closing are only drained
+		return nil
+	}
+
+	if b := c.limiter.bytes; b != nil && float64(f.PayloadLength) > b.burst {
+		return c.fatal(CloseMessageTooBig,
+			fmt.Errorf("frame of %d bytes exceeds rate limit burst of %.0f bytes", f.PayloadLength, b.burst),
+			"frame exceeds rate limit burst")
+	}
+
+	now := time.Now()
+
+	var wait time.Duration
+	if f.Opcode.IsControl() {
+		wait = max(wait, c.limiter.controlFrames.take(1, now))
+	} else if f.Opcode != internal.OpcodeContinuationFrame {
+		wait = max(wait, c.limiter.messages.take(1, now))
+	}
+	wait = max(wait, c.limiter.bytes.take(float64(f.PayloadLength), now))
+
+	if wait == 0 {
+		return nil
+	}
+
+	if c.limiter.action == RateLimitClose {
+		return c.fatal(ClosePolicyViolation,
+			fmt.Errorf("inbound rate limit exceeded"), "rate limit exceeded")
+	}
+
+	c.l.Debug("inbound rate limit exceeded, delaying read", "wait", wait)
+	return c.delayRead(wait)
+}
+
+// Waits until rate limit allows reading. Returns early once connection is closed
+// or read deadline is reached, context of read moves deadline as well
+func (c *Conn) delayRead(wait time.Duration) error {
+	until := time.Now().Add(wait)
+
+	for {
+		deadline, changed := c.readDeadline.current()
+		if c.sentConnClose.Load() {
+			// frames received while closing are only drained
+			return nil
+		}
+
+		end := until
+		timedOut := !deadline.IsZero() && deadline.Before(until)
+		if timedOut {
+			end = deadline
+		}
+
+		timer := time.NewTimer(time.Until(end))
+		select {
+		case <-timer.C:
+			if !timedOut {
+				return nil
+			}
+			// frame header is already read, so read can't be retried
+			return c.fatal(CloseInternalServerErr,
+				fmt.Errorf("failed to wait for rate limit: [%w]", os.ErrDeadlineExceeded), "")
+		case <-changed:
+			timer.Stop()
+		case <-c.ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("connection was closed while waiting for rate limit: [%w]", context.Cause(c.ctx))
+		}
+	}
+}
+
+// Token bucket which allows to go into debt of up to burst, so frame
+// bigger than available tokens is delayed until bucket refills
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	b := float64(burst)
+	if burst <= 0 {
+		b = rate
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		last:   time.Now(),
+	}
+}
+
+// Takes n tokens and returns how long to wait until bucket is out of debt
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	b.tokens = min(b.burst, b.tokens+elapsed*b.rate)
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	wait := -b.tokens / b.rate * float64(time.Second)
+	if wait >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(wait)
+}
@@ -0,0 +1,239 @@
+package websocket_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+// Reads connection until it fails, then closes it and reports it to done
+func readUntilError(done chan<- struct{}) func(c *websocket.Conn) {
+	return func(c *websocket.Conn) {
+		for {
+			if _, _, err := c.NextMessage(); err != nil {
+				_ = c.Close()
+				done <- struct{}{}
+				return
+			}
+		}
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	done := make(chan struct{}, 10)
+	srv := wstest.NewServer(&websocket.Upgrader{MaxConnsPerIP: 1}, readUntilError(done))
+	defer srv.Close()
+
+	dial := func() *websocket.Conn {
+		t.Helper()
+		c, err := srv.Dial("/")
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		return c
+	}
+	status := func() int {
+		t.Helper()
+		res, err := http.Get(srv.HTTP.URL)
+		if err != nil {
+			t.Fatalf("failed to send request: %v", err)
+		}
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+
+	first := dial()
+	if s := status(); s != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", s, http.StatusTooManyRequests)
+	}
+
+	// slot is released when connection is closed
+	if err := first.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	<-done
+
+	// request is not websocket handshake, so upgrade fails after slot was reserved
+	if s := status(); s != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", s, http.StatusBadRequest)
+	}
+
+	second := dial()
+	_ = second.Close()
+}
+
+func TestRateLimitClose(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit websocket.RateLimit
+		// written twice, second one is over limit
+		write func(c *websocket.Conn) error
+	}{
+		{
+			"messages",
+			websocket.RateLimit{MessagesPerSecond: 1, MessagesBurst: 1},
+			func(c *websocket.Conn) error { return c.WriteMessage(websocket.TextMessage, []byte("m")) },
+		},
+		{
+			"bytes",
+			websocket.RateLimit{BytesPerSecond: 10, BytesBurst: 10},
+			func(c *websocket.Conn) error { return c.WriteMessage(websocket.BinaryMessage, make([]byte, 8)) },
+		},
+		{
+			"control frames",
+			websocket.RateLimit{ControlFramesPerSecond: 1, ControlFramesBurst: 1},
+			func(c *websocket.Conn) error { return c.WriteControl(websocket.PingMessage, nil) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.limit.Action = websocket.RateLimitClose
+			done := make(chan struct{}, 1)
+			srv := wstest.NewServer(&websocket.Upgrader{RateLimit: &tt.limit}, readUntilError(done))
+			defer srv.Close()
+
+			client, err := srv.Dial("/")
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+
+			codes := make(chan websocket.CloseCode, 1)
+			client.SetCloseHandler(func(code websocket.CloseCode, reason string) error {
+				codes <- code
+				return client.WriteClose(code, reason)
+			})
+
+			for range 2 {
+				if err := tt.write(client); err != nil {
+					t.Fatalf("failed to write: %v", err)
+				}
+			}
+			if _, _, err := client.NextMessage(); err == nil {
+				t.Fatal("read succeeded after rate limit was exceeded")
+			}
+			if code := <-codes; code != websocket.ClosePolicyViolation {
+				t.Errorf("close code = %d, want %d", code, websocket.ClosePolicyViolation)
+			}
+			<-done
+		})
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit websocket.RateLimit
+		// frames written before final message
+		write func(c *websocket.Conn) error
+	}{
+		{
+			"messages",
+			websocket.RateLimit{MessagesPerSecond: 20, MessagesBurst: 1},
+			func(c *websocket.Conn) error { return c.WriteMessage(websocket.TextMessage, []byte("m")) },
+		},
+		{
+			"control frames",
+			websocket.RateLimit{ControlFramesPerSecond: 20, ControlFramesBurst: 1},
+			func(c *websocket.Conn) error { return c.WriteControl(websocket.PingMessage, nil) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			read := make(chan time.Duration, 1)
+			srv := wstest.NewServer(&websocket.Upgrader{RateLimit: &tt.limit}, func(c *websocket.Conn) {
+				start := time.Now()
+				for {
+					_, data, err := c.NextMessage()
+					if err != nil {
+						return
+					}
+					if string(data) == "last" {
+						read <- time.Since(start)
+					}
+				}
+			})
+			defer srv.Close()
+
+			client, err := srv.Dial("/")
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer client.Close()
+
+			for range 4 {
+				if err := tt.write(client); err != nil {
+					t.Fatalf("failed to write: %v", err)
+				}
+			}
+			_ = client.WriteMessage(websocket.TextMessage, []byte("last"))
+
+			// burst allows first frame right away, every next one waits 50ms
+			if d := <-read; d < 150*time.Millisecond {
+				t.Errorf("frames were read in %v, want at least %v", d, 150*time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestRateLimitDelayInterrupted(t *testing.T) {
+	server, raw, err := wstest.NewRawClient(nil)
+	if err != nil {
+		t.Fatalf("failed to create raw client: %v", err)
+	}
+	defer raw.Close()
+
+	server.SetRateLimit(&websocket.RateLimit{BytesPerSecond: 10, BytesBurst: 100})
+
+	payload := make([]byte, 100)
+	writeFrames(t, raw,
+		raw.Frame(websocket.BinaryMessage, true, payload),
+		// waits 10 seconds for bucket to refill
+		raw.Frame(websocket.BinaryMessage, true, payload),
+	)
+
+	if _, _, err := server.NextMessage(); err != nil {
+		t.Fatalf("failed to read first message: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := server.NextMessageContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("read error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("delayed read returned after %s, want it interrupted by context", elapsed)
+	}
+}
+
+func TestRateLimitFrameExceedsBurst(t *testing.T) {
+	server, raw, err := wstest.NewRawClient(nil)
+	if err != nil {
+		t.Fatalf("failed to create raw client: %v", err)
+	}
+	defer raw.Close()
+
+	server.SetRateLimit(&websocket.RateLimit{BytesPerSecond: 10, BytesBurst: 100})
+	writeFrames(t, raw, raw.Frame(websocket.BinaryMessage, true, make([]byte, 101)))
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := server.NextMessage()
+		readErr <- err
+	}()
+
+	code, _, err := raw.ReadClose()
+	if err != nil || code != websocket.CloseMessageTooBig {
+		t.Fatalf("close code = %d %v, want %d", code, err, websocket.CloseMessageTooBig)
+	}
+	if err := <-readErr; err == nil {
+		t.Fatal("frame exceeding burst was read")
+	}
+}
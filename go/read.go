@@ -2,41 +2,134 @@ package websocket
 
 import (
 	"bytes"
-	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"math/big"
+	"math"
+	"os"
+	"slices"
+	"sync"
 	"unicode/utf8"
 
 	"github.com/wmdanor/websocket/go/internal"
 )
 
+var (
+	ErrReadLimitExceeded = errors.New("message exceeds read limit")
+
+	// returned once close frame is received and handled
+	errCloseReceived = fmt.Errorf("connection was closed: [%w]", io.EOF)
+)
+
+const (
+	// max amount of memory allocated for frame payload before it is read
+	maxPayloadPrealloc = 64 * 1024
+	// buffers of larger messages are not returned to pool
+	maxPooledMessageSize = 1024 * 1024
+)
+
 func (c *Conn) NextMessage() (MessageType, []byte, error) {
-	mt, data, err := c.NextReader()
+	return c.ReadMessageInto(nil)
+}
+
+// Same as NextMessage, but message is read into buf, which is grown
+// only if message doesn't fit into it. Returned data shares memory with buf
+func (c *Conn) ReadMessageInto(buf []byte) (MessageType, []byte, error) {
+	mt, r, err := c.NextReader()
 	if err != nil {
 		return MessageType(0), nil, fmt.Errorf("failed to get next reader: [%w]", err)
 	}
 
-	buf := bytes.Buffer{}
-	_, err = buf.ReadFrom(data)
+	data, err := readAllInto(r, buf[:0], c.curReader.sizeHint())
 	if err != nil {
 		return MessageType(0), nil, fmt.Errorf("failed to read data from reader: [%w]", err)
 	}
 
-	return mt, buf.Bytes(), nil
+	return mt, data, nil
+}
+
+// Reads r until EOF appending to buf, buf is grown by sizeHint
+// up front if it doesn't have enough space
+func readAllInto(r io.Reader, buf []byte, sizeHint int) ([]byte, error) {
+	buf = slices.Grow(buf, sizeHint)
+
+	for {
+		if len(buf) == cap(buf) {
+			// zero length read tells if message ended, so buf
+			// which fits message exactly is not grown
+			_, err := r.Read(buf[len(buf):])
+			if err == io.EOF {
+				return buf, nil
+			}
+			if err != nil {
+				return buf, err
+			}
+			buf = slices.Grow(buf, 1)
+		}
+
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			return buf, err
+		}
+	}
+}
+
+// Message data read with ReadMessagePooled
+type MessageBuffer struct {
+	buf []byte
+}
+
+// Valid until Release is called
+func (b *MessageBuffer) Bytes() []byte {
+	return b.buf
+}
+
+// Returns buffer to pool for next messages, must be called once
+// and buffer must not be used after that
+func (b *MessageBuffer) Release() {
+	if cap(b.buf) > maxPooledMessageSize {
+		// rare large messages would keep memory in pool
+		b.buf = nil
+	}
+	b.buf = b.buf[:0]
+	messageBufferPool.Put(b)
+}
+
+var messageBufferPool = sync.Pool{
+	New: func() any {
+		return &MessageBuffer{}
+	},
+}
+
+// Same as NextMessage, but message is read into buffer taken from pool
+// shared by all connections, it is returned there with Release
+func (c *Conn) ReadMessagePooled() (MessageType, *MessageBuffer, error) {
+	b := messageBufferPool.Get().(*MessageBuffer)
+
+	mt, data, err := c.ReadMessageInto(b.buf)
+	if err != nil {
+		messageBufferPool.Put(b)
+		return MessageType(0), nil, err
+	}
+	b.buf = data
+
+	return mt, b, nil
 }
 
 // If connection was closed, will return: errors.Is(err, io.EOF) == true
 func (c *Conn) NextReader() (mt MessageType, data io.Reader, err error) {
-	if c.err != nil {
-		return MessageType(0), nil, c.err
+	if err := c.getErr(); err != nil {
+		return MessageType(0), nil, err
 	}
 
-	if c.sentConnClose && c.recvConnClose {
-		return MessageType(0), nil, fmt.Errorf("connection closed")
+	if c.isClosed() {
+		return MessageType(0), nil, ErrConnClosed
 	}
 
 	if c.curReader != nil {
@@ -53,22 +146,38 @@ func (c *Conn) NextReader() (mt MessageType, data io.Reader, err error) {
 	}
 	if f.Opcode == internal.OpcodeContinuationFrame {
 		return MessageType(0), nil, c.fatal(CloseProtocolError,
-			fmt.Errorf("first received frame must not be continuation frame: [%w]", err), "")
+			fmt.Errorf("first received frame must not be continuation frame"), "")
 	}
 
-	id, _ := rand.Int(rand.Reader, big.NewInt(1000))
-	l := c.l.With("id", id.Int64())
+	l, seq := c.messageLogger()
+
+	mt = MessageType(f.Opcode)
+	reader := &messageReader{
+		c:           c,
+		messageType: mt,
+		span: c.startSpan(SpanRead,
+			Attribute{AttrMessageType, mt.String()}, Attribute{AttrMessageSeq, seq}),
+		l: l,
+	}
+	c.curReader = reader
+
+	rsv, err := reader.startFrame(f)
+	if err != nil {
+		reader.finish(err)
+		return MessageType(0), nil, err
+	}
 
-	reader := messageReader{
-		c:              c,
-		messageType:    MessageType(f.Opcode),
-		isFinal:        f.IsFinalFrame,
-		bytesRemaining: int(f.PayloadLength),
-		maskingKey:     f.MaskingKey,
-		l:              l,
+	reader.outer = c.wrapReader(mt, rsv, reader)
+	if c.readLimit > 0 && len(c.extensions) > 0 {
+		// extensions may restore message much larger than received one
+		reader.outer = &limitReader{r: reader.outer, m: reader, remaining: c.readLimit}
+	}
+	if mt == TextMessage {
+		// text is validated after extensions restored it
+		reader.outer = &textReader{r: reader.outer, m: reader}
 	}
 
-	return MessageType(f.Opcode), &reader, nil
+	return mt, reader.outer, nil
 }
 
 type messageReader struct {
@@ -79,82 +188,370 @@ type messageReader struct {
 	bytesRemaining int
 
 	maskingKey [4]byte
+	// position in current frame payload, masking key is applied from it
+	maskOffset int
 	isFinal    bool
 
+	// payload of current frame transformed by extensions, it is read fully
+	// before being passed to them instead of being streamed from connection
+	frame []byte
+
+	// reader returned to user, message reader wrapped by extensions
+	outer io.Reader
+
+	// stats for observer
+	frames int
+	bytes  int
+
+	span     Span
+	finished bool
+
+	// frame being captured, nil if capture is disabled
+	capFrame *CapturedFrame
+
 	l *slog.Logger
 }
 
 func (m *messageReader) Read(p []byte) (n int, err error) {
-	if m.bytesRemaining == 0 && m.isFinal {
+	if m.bytesRemaining == 0 && len(m.frame) == 0 && m.isFinal {
+		m.finish(nil)
 		return 0, io.EOF
 	}
 
-	maskOfset := 0
-
 	for n < len(p) {
-		m.l.Debug("reading data", "frame.bytesRemaining", m.bytesRemaining, "n", n, "p.len", len(p))
-		if m.bytesRemaining == 0 {
-			if m.isFinal {
-				m.c.curReader = nil
-				break
-			}
+		if m.c.debug {
+			m.l.Debug("reading data", "frame.bytesRemaining", m.bytesRemaining, "n", n, "p.len", len(p))
+		}
+		more, err := m.nextFrame()
+		if err != nil {
+			return n, err
+		}
+		if !more {
+			break
+		}
+
+		if len(m.frame) > 0 {
+			nn := copy(p[n:], m.frame)
+			m.frame = m.frame[nn:]
+			n += nn
+			continue
+		}
 
-			m.l.Debug("reading next frame")
+		nn, err := m.c.r.Read(p[n:min(len(p), n+m.bytesRemaining)])
+		if err != nil {
+			return n, m.readFailed(err)
+		}
+		if m.c.debug {
+			m.l.Debug("received frame data chunk", "bytes", nn)
+		}
 
-			maskOfset = 0
+		m.consume(p[n : n+nn])
+		n += nn
+	}
+
+	if m.c.debug {
+		m.l.Debug("finished reading frame data chunk", "n", n)
+	}
 
-			f, err := m.c.readFrameHeader()
+	return n, nil
+}
+
+// Writes rest of message to w, payload is passed to w straight from
+// read buffer of connection, so io.Copy needs no intermediate buffer
+func (m *messageReader) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+
+	for {
+		more, err := m.nextFrame()
+		if err != nil {
+			return total, err
+		}
+		if !more {
+			m.finish(nil)
+			return total, nil
+		}
+
+		var chunk []byte
+		if len(m.frame) > 0 {
+			chunk, m.frame = m.frame, nil
+		} else {
+			chunk, err = m.peekPayload()
 			if err != nil {
-				err = errors.Join(err, io.ErrUnexpectedEOF)
-				return n, fmt.Errorf("failed to read frame: [%w]", err)
-			}
-			if f.Opcode != internal.OpcodeContinuationFrame {
-				err = errors.Join(io.ErrUnexpectedEOF)
-				return n, m.c.fatal(CloseProtocolError,
-					fmt.Errorf("succeeding frames must be continuation frames received opcode: %X, [%w]", f.Opcode, err), "")
+				return total, err
 			}
+		}
 
-			m.l.Debug("got next frame", "isFinal", f.IsFinalFrame, "maskingKey", f.MaskingKey, "payloadLength", f.PayloadLength)
-			m.isFinal = f.IsFinalFrame
-			m.maskingKey = f.MaskingKey
-			m.bytesRemaining = int(f.PayloadLength)
+		n, err := w.Write(chunk)
+		total += int64(n)
+		if err != nil {
+			return total, err
 		}
+	}
+}
 
-		nn, err := m.c.r.Read(p[n:min(len(p), n+m.bytesRemaining)])
+// Returns buffered part of current frame payload and discards it from read
+// buffer, it stays valid until next read from connection
+func (m *messageReader) peekPayload() ([]byte, error) {
+	if m.c.r.Buffered() == 0 {
+		_, err := m.c.r.Peek(1)
+		if err != nil {
+			return nil, m.readFailed(err)
+		}
+	}
+
+	chunk, _ := m.c.r.Peek(min(m.bytesRemaining, m.c.r.Buffered()))
+	_, _ = m.c.r.Discard(len(chunk))
+	m.consume(chunk)
+
+	return chunk, nil
+}
+
+// Unmasks payload chunk read from connection in place and records it
+func (m *messageReader) consume(chunk []byte) {
+	if m.c.isServer {
+		internal.MaskOffset(chunk, m.maskingKey, m.maskOffset%4)
+	}
+
+	m.capture(chunk)
+
+	m.maskOffset += len(chunk)
+	m.bytesRemaining -= len(chunk)
+	m.bytes += len(chunk)
+	m.endCapture()
+}
+
+func (m *messageReader) readFailed(err error) error {
+	m.l.Debug("failed to read frame data chunk", "err", err)
+	err = errors.Join(err, io.ErrUnexpectedEOF)
+	err = m.c.fatal(CloseInternalServerErr,
+		fmt.Errorf("failed to read bytes: [%w]", err), "")
+	m.finish(err)
+	return err
+}
+
+// Starts next frame once current one is read, returns false at the end of message
+func (m *messageReader) nextFrame() (bool, error) {
+	for m.bytesRemaining == 0 && len(m.frame) == 0 {
+		if m.isFinal {
+			return false, nil
+		}
+
+		m.l.Debug("reading next frame")
+
+		f, err := m.c.readFrameHeader()
 		if err != nil {
-			m.l.Debug("failed to read frame data chunk", "err", err)
 			err = errors.Join(err, io.ErrUnexpectedEOF)
-			return n, m.c.fatal(CloseInternalServerErr,
-				fmt.Errorf("failed to read bytes: [%w]", err), "")
+			m.finish(err)
+			return false, fmt.Errorf("failed to read frame: [%w]", err)
+		}
+		if f.Opcode != internal.OpcodeContinuationFrame {
+			err = errors.Join(io.ErrUnexpectedEOF)
+			err = m.c.fatal(CloseProtocolError,
+				fmt.Errorf("succeeding frames must be continuation frames received opcode: %X, [%w]", f.Opcode, err), "")
+			m.finish(err)
+			return false, err
 		}
-		m.l.Debug("received frame data chunk", "bytes", nn)
 
-		if m.c.isServer {
-			m.l.Debug("unmasking data chunk", "maskingKey", m.maskingKey, "from", n, "to", n+nn)
-			internal.MaskOffset(p[n:n+nn], m.maskingKey, maskOfset%4)
+		if m.c.debug {
+			m.l.Debug("got next frame", "isFinal", f.IsFinalFrame, "maskingKey", f.MaskingKey, "payloadLength", f.PayloadLength)
+		}
+		_, err = m.startFrame(f)
+		if err != nil {
+			m.finish(err)
+			return false, err
 		}
+	}
 
-		n += nn
-		maskOfset += nn
-		m.bytesRemaining -= nn
+	return true, nil
+}
+
+// Size of message known before it is read, 0 if it is unknown.
+// Limited, so peer can't make reader allocate memory up front
+func (m *messageReader) sizeHint() int {
+	if !m.isFinal || len(m.c.extensions) > 0 {
+		return 0
 	}
+	return min(m.bytesRemaining, maxPayloadPrealloc)
+}
 
-	m.l.Debug("finished reading frame data chunk", "n", n)
+// Starts reading frame payload, if extensions transform frames payload is read
+// and transformed right away. Returns RSV bits left after frame transforms
+func (m *messageReader) startFrame(f *internal.FrameHeader) (RSV, error) {
+	if limit := m.c.readLimit; limit > 0 && f.PayloadLength > uint64(limit-int64(m.bytes)) {
+		return 0, m.readLimitExceeded()
+	}
 
-	if m.messageType == TextMessage {
-		// todo: what if read byte is not end and because of that utf8 validation fails for last rune
-		valid := utf8.Valid(p[:n])
-		if !valid {
-			return n, m.c.fatal(CloseInvalidFramePayloadData,
-				fmt.Errorf("received invalid UTF-8 data"), "")
-		}
+	m.isFinal = f.IsFinalFrame
+	m.maskingKey = f.MaskingKey
+	m.maskOffset = 0
+	m.bytesRemaining = int(f.PayloadLength)
+	m.frames++
+	m.startCapture(f)
+
+	rsv := headerRSV(f)
+	if !m.c.frameExts {
+		return rsv, nil
+	}
+
+	payload, err := m.c.readPayload(f.PayloadLength)
+	if err != nil {
+		return 0, m.c.fatal(CloseInternalServerErr,
+			fmt.Errorf("failed to read frame data: [%w]", err), "")
+	}
+	if m.c.isServer {
+		internal.Mask(payload, f.MaskingKey)
+	}
+	m.capture(payload)
+	m.bytesRemaining = 0
+	m.bytes += len(payload)
+	m.endCapture()
+
+	fr := &Frame{IsFinal: f.IsFinalFrame, Type: MessageType(f.Opcode), RSV: rsv, Payload: payload}
+	err = m.c.transformIncoming(fr)
+	if err != nil {
+		return 0, m.c.fatal(CloseProtocolError, err, "")
+	}
+	m.frame = fr.Payload
+
+	return fr.RSV, nil
+}
+
+// Sets max size of received message, larger messages fail with
+// ErrReadLimitExceeded and connection is closed with CloseMessageTooBig.
+// Applies both to received payload and to data restored by extensions,
+// e.g. decompressed by PerMessageDeflate. 0 means unlimited.
+// Must not be called concurrently with reads
+func (c *Conn) SetReadLimit(n int64) {
+	c.readLimit = max(n, 0)
+}
+
+func (m *messageReader) readLimitExceeded() error {
+	err := m.c.fatal(CloseMessageTooBig, ErrReadLimitExceeded, "")
+	m.finish(err)
+	return err
+}
+
+// Limits message restored by extensions
+type limitReader struct {
+	r         io.Reader
+	m         *messageReader
+	remaining int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	// one byte more is read to know if limit is exceeded
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n - 1, l.m.readLimitExceeded()
+	}
+
+	return n, err
+}
+
+// Validates text message, final check is done once message ends
+type textReader struct {
+	r    io.Reader
+	m    *messageReader
+	utf8 utf8Validator
+}
+
+func (t *textReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+
+	if !t.utf8.valid(p[:n], err == io.EOF) {
+		return n, t.invalid()
+	}
+
+	return n, err
+}
+
+// Validates data passed to writer when inner reader supports WriteTo
+func (t *textReader) WriteTo(w io.Writer) (int64, error) {
+	wt, ok := t.r.(io.WriterTo)
+	if !ok {
+		return io.Copy(w, readerOnly{t})
+	}
+
+	n, err := wt.WriteTo(&textWriter{w: w, t: t})
+	if err != nil {
+		return n, err
+	}
+	if !t.utf8.valid(nil, true) {
+		return n, t.invalid()
 	}
 
 	return n, nil
 }
 
+func (t *textReader) invalid() error {
+	err := t.m.c.fatal(CloseInvalidFramePayloadData,
+		fmt.Errorf("received invalid UTF-8 data"), "")
+	t.m.finish(err)
+	return err
+}
+
+type textWriter struct {
+	w io.Writer
+	t *textReader
+}
+
+func (w *textWriter) Write(p []byte) (int, error) {
+	if !w.t.utf8.valid(p, false) {
+		return 0, w.t.invalid()
+	}
+	return w.w.Write(p)
+}
+
+// Hides WriteTo, so io.Copy doesn't call it recursively
+type readerOnly struct {
+	io.Reader
+}
+
+func (m *messageReader) startCapture(f *internal.FrameHeader) {
+	m.capFrame = m.c.newCapturedFrame(f, DirectionInbound)
+	m.endCapture()
+}
+
+func (m *messageReader) capture(b []byte) {
+	if m.capFrame != nil {
+		m.capFrame.Payload = append(m.capFrame.Payload, b...)
+	}
+}
+
+// Passes frame to capturer once its payload is fully read
+func (m *messageReader) endCapture() {
+	if m.capFrame != nil && m.bytesRemaining == 0 {
+		m.c.capturer.CaptureFrame(m.capFrame)
+		m.capFrame = nil
+	}
+}
+
+// Reports message to observer and ends its span, only first call has effect
+func (m *messageReader) finish(err error) {
+	if m.finished {
+		return
+	}
+	m.finished = true
+
+	if err == nil {
+		m.c.obs.MessageRead(m.c.side(), m.messageType, m.bytes, m.frames)
+	}
+
+	m.span.SetAttributes(Attribute{AttrMessageSize, m.bytes})
+	endSpan(m.span, err)
+}
+
+// Discards rest of message, it is read through extensions to keep their state in sync
 func (m *messageReader) close() error {
-	_, err := io.Copy(io.Discard, m)
+	_, err := io.Copy(io.Discard, m.outer)
 	if err != nil {
 		return fmt.Errorf("failed to discard remaining current message: [%w]", err)
 	}
@@ -164,144 +561,223 @@ func (m *messageReader) close() error {
 
 func (c *Conn) readFrameHeader() (*internal.FrameHeader, error) {
 	for {
-		c.l.Debug("reading frame header")
+		f, err := c.readRawFrameHeader()
+		if err != nil {
+			return nil, err
+		}
 
-		f := internal.FrameHeader{}
+		if f.Opcode.IsControl() {
+			_, err := c.readControlFrame(f)
+			if err != nil {
+				return nil, err
+			}
 
-		fixed, err := c.readNBytes(2)
-		if err != nil {
-			return nil, c.fatal(CloseInternalServerErr,
-				fmt.Errorf("failed to read first 2 essential bytes of the frame: [%w]", err), "")
+			continue
 		}
-		b0, b1 := fixed[0], fixed[1]
 
-		f.IsFinalFrame = b0&0b1_000_0000 == 0b1_000_0000
-		f.RSV1 = b0 & 0b0_100_0000 >> 6
-		f.RSV2 = b0 & 0b0_010_0000 >> 5
-		f.RSV3 = b0 & 0b0_001_0000 >> 4
-		f.Opcode = internal.Opcode(b0 & 0b0_000_1111)
+		return f, nil
+	}
+}
 
-		if f.RSV1 != 0 || f.RSV2 != 0 || f.RSV3 != 0 {
-			return nil, c.fatal(CloseProtocolError,
-				fmt.Errorf("RSV bits must be 0 as extensions are not supported"), "")
+// Reads and validates frame header without handling control frames
+func (c *Conn) readRawFrameHeader() (*internal.FrameHeader, error) {
+	c.l.Debug("reading frame header")
+
+	f := internal.FrameHeader{}
+
+	fixed, err := c.readNBytes(2)
+	if err != nil {
+		err = fmt.Errorf("failed to read first 2 essential bytes of the frame: [%w]", err)
+		if errors.Is(err, os.ErrDeadlineExceeded) && c.curReader == nil && !c.rFragmented {
+			// nothing was consumed and no message is started,
+			// next read can start from the same frame
+			return nil, err
 		}
+		return nil, c.fatal(CloseInternalServerErr, err, "")
+	}
+	b0, b1 := fixed[0], fixed[1]
+
+	f.IsFinalFrame = b0&0b1_000_0000 == 0b1_000_0000
+	f.RSV1 = b0 & 0b0_100_0000 >> 6
+	f.RSV2 = b0 & 0b0_010_0000 >> 5
+	f.RSV3 = b0 & 0b0_001_0000 >> 4
+	f.Opcode = internal.Opcode(b0 & 0b0_000_1111)
 
+	if c.debug {
 		c.l.Debug("read header byte 0", "partialHeader", f)
+	}
+
+	if f.Opcode.IsReserved() {
+		return nil, c.fatal(CloseProtocolError,
+			fmt.Errorf("opcode must not be one of reserved values"), "")
+	}
+
+	rsv := headerRSV(&f)
+	if rsv&^c.extRSV != 0 {
+		return nil, c.fatal(CloseProtocolError,
+			fmt.Errorf("RSV bits must be 0 unless negotiated extension uses them, received %03b", rsv), "")
+	}
+	if rsv != 0 && f.Opcode.IsControl() {
+		return nil, c.fatal(CloseProtocolError,
+			fmt.Errorf("RSV bits must not be set on control frames"), "")
+	}
+	if rsv&^c.frameRSV != 0 && f.Opcode == internal.OpcodeContinuationFrame {
+		return nil, c.fatal(CloseProtocolError,
+			fmt.Errorf("RSV bits of message extensions must be set on first frame of message only"), "")
+	}
 
-		if f.Opcode.IsReserved() {
+	f.IsMasked = b1&0b1_0000000 == 0b1_0000000
+	if f.IsMasked && !c.isServer {
+		return nil, c.fatal(CloseProtocolError,
+			fmt.Errorf("received masked frame on the client"), "")
+	}
+	if !f.IsMasked && c.isServer {
+		return nil, c.fatal(CloseProtocolError,
+			fmt.Errorf("received unmasked frame on the server"), "")
+	}
+
+	f.PayloadLength = uint64(b1 & 0b0_1111111)
+	if f.PayloadLength == 126 {
+		payloadLen16, err := c.readNBytes(2)
+		if err != nil {
+			return nil, c.fatal(CloseInternalServerErr,
+				fmt.Errorf("payload length 126 signaled that next 16 bits must be actual length, but failed to read them: [%w]", err), "")
+		}
+		f.PayloadLength = uint64(binary.BigEndian.Uint16(payloadLen16))
+	} else if f.PayloadLength == 127 {
+		payloadLen64, err := c.readNBytes(8)
+		if err != nil {
+			return nil, c.fatal(CloseInternalServerErr,
+				fmt.Errorf("payload length 127 signaled that next 64 bits must be actual length, but failed to read them: [%w]", err), "")
+		}
+		f.PayloadLength = binary.BigEndian.Uint64(payloadLen64)
+		if f.PayloadLength > math.MaxInt64 {
 			return nil, c.fatal(CloseProtocolError,
-				fmt.Errorf("opcode must not be one of reserved values"), "")
+				fmt.Errorf("most significant bit of 64 bit payload length must be 0"), "")
 		}
+	}
 
-		f.IsMasked = b1&0b1_0000000 == 0b1_0000000
-		if f.IsMasked && !c.isServer {
-			return nil, c.fatal(CloseProtocolError,
-				fmt.Errorf("received masked frame on the client"), "")
+	if c.debug {
+		c.l.Debug("read header byte 1 + payload len extra", "partialHeader", f)
+	}
+
+	if f.Opcode.IsControl() && (f.PayloadLength > 125 || !f.IsFinalFrame) {
+		return nil, c.fatal(CloseProtocolError,
+			fmt.Errorf("all control frames must have a payload length of 125 bytes or less and must not be fragmented"), "")
+	}
+
+	if f.IsMasked {
+		maskingKey, err := c.readNBytes(4)
+		if err != nil {
+			return nil, c.fatal(CloseInternalServerErr,
+				fmt.Errorf("mask bit signaled that next 32 bits must have masking key, but failed to read them: [%w]", err), "")
+		}
+		copy(f.MaskingKey[:], maskingKey)
+		if c.debug {
+			c.l.Debug("read frame masking key", "partialHeader", f)
 		}
+	}
 
-		f.PayloadLength = uint64(b1 & 0b0_1111111)
-		if f.PayloadLength == 126 {
-			payloadLen16, err := c.readNBytes(2)
-			if err != nil {
-				return nil, c.fatal(CloseInternalServerErr,
-					fmt.Errorf("payload length 126 signaled that next 16 bits must be actual length, but failed to read them: [%w]", err), "")
-			}
-			f.PayloadLength = uint64(binary.BigEndian.Uint16(payloadLen16))
-		} else if f.PayloadLength == 127 {
-			payloadLen64, err := c.readNBytes(8)
-			if err != nil {
-				return nil, c.fatal(CloseInternalServerErr,
-					fmt.Errorf("payload length 127 signaled that next 64 bits must be actual length, but failed to read them: [%w]", err), "")
-			}
-			f.PayloadLength = binary.BigEndian.Uint64(payloadLen64)
+	err = c.limitFrame(&f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// Reads control frame payload and calls corresponding handler
+func (c *Conn) readControlFrame(f *internal.FrameHeader) ([]byte, error) {
+	if c.debug {
+		c.l.Debug("received frame is control, handling specially", "partialHeader", f)
+	}
+
+	var buf []byte
+	if f.PayloadLength != 0 {
+		buf = make([]byte, f.PayloadLength)
+		if c.debug {
+			c.l.Debug("reading control frame data", "payloadLength", f.PayloadLength)
 		}
+		_, err := io.ReadFull(c.r, buf) // TODO ???
+		if err != nil {
+			return nil, c.fatal(CloseInternalServerErr,
+				fmt.Errorf("failed to read control frame data: [%w]", err), "")
+		}
+		if c.isServer {
+			internal.Mask(buf, f.MaskingKey)
+		}
+	} else {
+		c.l.Debug("control frame does not have data to read")
+	}
 
-		c.l.Debug("read header byte 1 + payload len extra", "partialHeader", f)
+	c.captureFrame(f, DirectionInbound, buf)
+
+	c.obs.ControlFrameRead(c.side(), MessageType(f.Opcode))
 
-		if f.Opcode.IsControl() && (f.PayloadLength > 125 || !f.IsFinalFrame) {
+	if f.Opcode == internal.OpcodeConnectionClose {
+		c.l.Debug("received frame is close, handling specially")
+		c.recvConnClose.Store(true)
+
+		if f.PayloadLength == 1 {
 			return nil, c.fatal(CloseProtocolError,
-				fmt.Errorf("all control frames must have a payload length of 125 bytes or less and must not be fragmented"), "")
+				fmt.Errorf("close frame must either have 0 or 2+ payload length, but received 1"), "")
 		}
-
-		if f.IsMasked {
-			maskingKey, err := c.readNBytes(4)
-			if err != nil {
-				return nil, c.fatal(CloseInternalServerErr,
-					fmt.Errorf("mask bit signaled that next 32 bits must have masking key, but failed to read them: [%w]", err), "")
-			}
-			copy(f.MaskingKey[:], maskingKey)
-			c.l.Debug("read frame masking key", "partialHeader", f)
+		if len(buf) > 2 && !utf8.Valid(buf[2:]) {
+			return nil, c.fatal(CloseInvalidFramePayloadData,
+				fmt.Errorf("close frame reason in data must be valid UTF-8 encoded string"), "")
 		}
 
-		// Extensions are not supported
-		f.ExtensionData = nil
-
-		if f.Opcode.IsControl() {
-			c.l.Debug("received frame is control, handling specially", "partialHeader", f)
-
-			var buf []byte
-			if f.PayloadLength != 0 {
-				buf = make([]byte, f.PayloadLength)
-				c.l.Debug("reading control frame data", "payloadLength", f.PayloadLength)
-				_, err := io.ReadFull(c.r, buf) // TODO ???
-				if err != nil {
-					return nil, c.fatal(CloseInternalServerErr,
-						fmt.Errorf("failed to read control frame data: [%w]", err), "")
-				}
-				if c.isServer {
-					internal.Mask(buf, f.MaskingKey)
-				}
-			} else {
-				c.l.Debug("control frame does not have data to read")
+		closeCode := uint16(CloseNormalClosure)
+		if len(buf) >= 2 {
+			closeCode = binary.BigEndian.Uint16(buf)
+			_, ok := NewCloseCode(closeCode)
+			if !ok {
+				return nil, c.fatal(CloseProtocolError,
+					fmt.Errorf("received invalid close code: %d", closeCode), "")
 			}
+		}
+		c.obs.CloseReceived(c.side(), CloseCode(closeCode))
+		c.observeCloseFrame(false, CloseCode(closeCode))
+		err := c.handleClose(CloseCode(closeCode), string(buf[min(len(buf), 2):]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to handle close frame: [%w]", err)
+		}
+		err = errCloseReceived
+		c.setErr(err)
+		if c.isClosed() {
+			// close handshake is complete, nothing else can be sent or received
+			_ = c.closeNetConn()
+		}
+		return buf, err
+	} else if f.Opcode == internal.OpcodePing {
+		c.l.Debug("received frame is ping, handling specially")
+		err := c.handlePing(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to handle ping frame: [%w]", err)
+		}
+	} else if f.Opcode == internal.OpcodePong {
+		c.l.Debug("received frame is pong, handling specially")
+		err := c.handlePong(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to handle pong frame: [%w]", err)
+		}
+	}
 
-			if f.Opcode == internal.OpcodeConnectionClose {
-				c.l.Debug("received frame is close, handling specially")
-				c.recvConnClose = true
-
-				if f.PayloadLength == 1 {
-					return nil, c.fatal(CloseProtocolError,
-						fmt.Errorf("close frame must either have 0 or 2+ payload length, but received 1"), "")
-				}
-				if len(buf) > 2 && !utf8.Valid(buf[2:]) {
-					return nil, c.fatal(CloseInvalidFramePayloadData,
-						fmt.Errorf("close frame reason in data must be valid UTF-8 encoded string"), "")
-				}
-
-				closeCode := uint16(CloseNormalClosure)
-				if len(buf) >= 2 {
-					closeCode = binary.BigEndian.Uint16(buf)
-					_, ok := NewCloseCode(closeCode)
-					if !ok {
-						return nil, c.fatal(CloseProtocolError,
-							fmt.Errorf("received invalid close code: %d", closeCode), "")
-					}
-				}
-				err = c.handleClose(CloseCode(closeCode), string(buf[min(len(buf), 2):]))
-				if err != nil {
-					return nil, fmt.Errorf("failed to handle close frame: [%w]", err)
-				}
-				c.err = fmt.Errorf("connection was closed: [%w]", io.EOF)
-				return &f, c.err
-			} else if f.Opcode == internal.OpcodePing {
-				c.l.Debug("received frame is ping, handling specially")
-				err = c.handlePing(buf)
-				if err != nil {
-					return nil, fmt.Errorf("failed to handle ping frame: [%w]", err)
-				}
-			} else if f.Opcode == internal.OpcodePong {
-				c.l.Debug("received frame is pong, handling specially")
-				err = c.handlePong(buf)
-				if err != nil {
-					return nil, fmt.Errorf("failed to handle pong frame: [%w]", err)
-				}
-			}
+	return buf, nil
+}
 
-			continue
-		}
+// Reads payload of given length, memory is allocated as data arrives,
+// so huge length in frame header doesn't cause huge allocation up front
+func (c *Conn) readPayload(length uint64) ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.Grow(int(min(length, maxPayloadPrealloc)))
 
-		return &f, nil
+	_, err := io.CopyN(&buf, c.r, int64(length))
+	if err != nil {
+		return nil, err
 	}
+
+	return buf.Bytes(), nil
 }
 
 // TODO; this is shit : The bytes stop being valid at the next read call.
@@ -310,8 +786,11 @@ func (c *Conn) readNBytes(n int) ([]byte, error) {
 	if err == io.EOF {
 		return nil, io.ErrUnexpectedEOF
 	}
+	if err != nil {
+		return nil, err
+	}
 
 	c.r.Discard(len(bytes))
 
-	return bytes, err
+	return bytes, nil
 }
@@ -0,0 +1,143 @@
+package websocket_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+// Sends frames from raw client in background, so unbuffered pipe doesn't block
+func writeFrames(t *testing.T, raw *wstest.RawConn, frames ...*wstest.RawFrame) {
+	t.Helper()
+
+	go func() {
+		for _, f := range frames {
+			if err := raw.WriteFrame(f); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestReadMessageInto(t *testing.T) {
+	server, raw, err := wstest.NewRawClient(nil)
+	if err != nil {
+		t.Fatalf("failed to create raw client: %v", err)
+	}
+	defer raw.Close()
+
+	large := make([]byte, 100_000)
+	rand.New(rand.NewSource(1)).Read(large)
+
+	writeFrames(t, raw,
+		raw.Frame(websocket.TextMessage, true, []byte("small")),
+		raw.Frame(websocket.BinaryMessage, true, large[:1024]),
+		raw.Frame(websocket.BinaryMessage, false, large[:33_333]),
+		raw.Frame(websocket.ContinuationFrame, false, large[33_333:66_667]),
+		raw.Frame(websocket.ContinuationFrame, true, large[66_667:]),
+	)
+
+	buf := make([]byte, 1024)
+
+	mt, data, err := server.ReadMessageInto(buf)
+	if err != nil || mt != websocket.TextMessage || string(data) != "small" {
+		t.Fatalf("got %s %q %v, want text %q", mt, data, err, "small")
+	}
+	if &data[0] != &buf[0] {
+		t.Error("message which fits was not read into provided buffer")
+	}
+
+	// message of exactly buffer size
+	mt, data, err = server.ReadMessageInto(buf)
+	if err != nil || mt != websocket.BinaryMessage || !bytes.Equal(data, large[:1024]) {
+		t.Fatalf("got %s of %d bytes %v, want binary of %d bytes", mt, len(data), err, 1024)
+	}
+	if &data[0] != &buf[0] || cap(data) != cap(buf) {
+		t.Error("message which fits exactly was not read into provided buffer")
+	}
+
+	mt, data, err = server.ReadMessageInto(buf)
+	if err != nil || mt != websocket.BinaryMessage || !bytes.Equal(data, large) {
+		t.Fatalf("got %s of %d bytes %v, want binary of %d bytes", mt, len(data), err, len(large))
+	}
+}
+
+func TestReadMessagePooled(t *testing.T) {
+	client, server := wstest.NewPipe()
+	defer client.Close()
+	go wstest.Echo(server)
+
+	for _, msg := range []string{"first message", "second", ""} {
+		if err := client.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+
+		mt, b, err := client.ReadMessagePooled()
+		if err != nil {
+			t.Fatalf("failed to read message: %v", err)
+		}
+		if mt != websocket.TextMessage || string(b.Bytes()) != msg {
+			t.Errorf("got %s %q, want text %q", mt, b.Bytes(), msg)
+		}
+		b.Release()
+	}
+}
+
+func TestMessageReaderWriteTo(t *testing.T) {
+	server, raw, err := wstest.NewRawClient(nil)
+	if err != nil {
+		t.Fatalf("failed to create raw client: %v", err)
+	}
+	defer raw.Close()
+
+	data := make([]byte, 50_000)
+	rand.New(rand.NewSource(2)).Read(data)
+	text := []byte("héllo, wörld")
+
+	writeFrames(t, raw,
+		raw.Frame(websocket.BinaryMessage, false, data[:10_001]),
+		raw.Frame(websocket.ContinuationFrame, true, data[10_001:]),
+		// rune split between frames
+		raw.Frame(websocket.TextMessage, false, text[:2]),
+		raw.Frame(websocket.ContinuationFrame, true, text[2:]),
+		raw.Frame(websocket.TextMessage, true, []byte{'a', 0xff}),
+	)
+
+	for _, want := range [][]byte{data, text} {
+		_, r, err := server.NextReader()
+		if err != nil {
+			t.Fatalf("failed to get reader: %v", err)
+		}
+		if _, ok := r.(io.WriterTo); !ok {
+			t.Fatal("reader does not implement io.WriterTo")
+		}
+
+		got := &bytes.Buffer{}
+		n, err := io.Copy(got, r)
+		if err != nil || n != int64(len(want)) || !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("copied %d bytes %v, want %d bytes", n, err, len(want))
+		}
+	}
+
+	_, r, err := server.NextReader()
+	if err != nil {
+		t.Fatalf("failed to get reader: %v", err)
+	}
+	copyErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, r)
+		copyErr <- err
+	}()
+
+	code, _, err := raw.ReadClose()
+	if err != nil || code != websocket.CloseInvalidFramePayloadData {
+		t.Fatalf("close code = %d %v, want %d", code, err, websocket.CloseInvalidFramePayloadData)
+	}
+	if err := <-copyErr; err == nil {
+		t.Fatal("copy of invalid UTF-8 text succeeded")
+	}
+}
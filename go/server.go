@@ -1,19 +1,140 @@
 package websocket
 
 import (
+	"bufio"
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Upgrader struct {
+	// Supported subprotocols in order of preference
+	Subprotocols []string
+	// Supported extensions, offers are accepted in order client listed them
+	Extensions []Extension
+	// Decides which messages are compressed when compression extension
+	// is negotiated, every message is compressed if nil
+	CompressionPolicy *CompressionPolicy
+
+	// Writes HTTP error response when upgrade fails before connection is hijacked.
+	// If nil, http.Error is used
+	Error func(w http.ResponseWriter, req *http.Request, status int, reason error)
+
+	// Close code sent to connections by Shutdown, CloseGoingAway if not set
+	ShutdownCloseCode CloseCode
+
+	// Authenticates upgrade request before handshake, returned principal is
+	// available with PrincipalFromContext(conn.Context()). Return error wrapping
+	// ErrUnauthorized to respond with 401 or ErrForbidden to respond with 403,
+	// any other error results in 500.
+	// Tokens sent by browsers in Sec-WebSocket-Protocol can be read here as well,
+	// one of Subprotocols must still be selected for handshake to succeed
+	Authenticate func(req *http.Request) (any, error)
+	// WWW-Authenticate header of 401 response, "Bearer" if empty
+	AuthChallenge string
+
+	// Called after request is validated and before successful response is
+	// written with selected subprotocol. Headers added to responseHeader are
+	// sent in response, reserved ones are not allowed. Returned error rejects
+	// upgrade with 403
+	BeforeUpgrade func(req *http.Request, subprotocol string, responseHeader http.Header) error
+
+	// Inbound rate limit applied to every upgraded connection, nil if unlimited
+	RateLimit *RateLimit
+	// Max payload size of written data frames, see Conn.SetMaxFrameSize
+	MaxFrameSize int
+	// Max size of received message, see Conn.SetReadLimit.
+	// Should be set when compression extension is used
+	ReadLimit int64
+	// Max amount of concurrent connections from single remote IP, 0 if unlimited
+	MaxConnsPerIP int
+
+	// Receives handshake and connection events, nil if not needed
+	Observer Observer
+	// Creates spans for handshake, messages and close handshake,
+	// trace context is extracted from handshake request headers. nil if not needed
+	Tracer Tracer
+
 	InternalLogger *slog.Logger
+
+	mu         sync.Mutex
+	conns      map[*Conn]struct{}
+	ipConns    map[string]int
+	inShutdown atomic.Bool
+}
+
+const (
+	shutdownPollInterval = 50 * time.Millisecond
+)
+
+var (
+	ErrUpgraderShutdown   = errors.New("upgrader is shutting down")
+	ErrTooManyConnections = errors.New("too many connections")
+	ErrReservedHeader     = errors.New("reserved response header")
+)
+
+// Response headers set by handshake or HTTP server
+var reservedResponseHeaders = []string{
+	headerUpgrade, headerConn, headerSecWsAccept, headerSecWsProto,
+	headerSecWsExt, headerSecWsVersion, "Content-Length", "Transfer-Encoding",
+}
+
+// All Sec-WebSocket-* headers belong to protocol, including ones it may define later
+const reservedResponseHeaderPrefix = "Sec-Websocket-"
+
+func isReservedResponseHeader(name string) bool {
+	if strings.HasPrefix(name, ":") {
+		return true
+	}
+	if len(name) >= len(reservedResponseHeaderPrefix) &&
+		strings.EqualFold(name[:len(reservedResponseHeaderPrefix)], reservedResponseHeaderPrefix) {
+		return true
+	}
+	return slices.ContainsFunc(reservedResponseHeaders, func(r string) bool {
+		return strings.EqualFold(r, name)
+	})
+}
+
+// First reserved header name in h
+func reservedHeaderIn(h http.Header) (string, bool) {
+	for name := range h {
+		if isReservedResponseHeader(name) {
+			return name, true
+		}
+	}
+	return "", false
 }
 
 // On a server call this in your http handler
-// to upgrade connection to Websocket connection
+// to upgrade connection to Websocket connection.
+//
+// HTTP/2 extended CONNECT requests (RFC 8441) are accepted as well, such
+// connection runs over request stream, so handler must not return until
+// connection is closed. Go http.Server advertises extended CONNECT support
+// only with GODEBUG=http2xconnect=1
 func (u *Upgrader) Upgrade(w http.ResponseWriter, req *http.Request) (*Conn, error) {
+	return u.upgrade(w, req, nil, u.Subprotocols, nil)
+}
+
+// Same as Upgrade, but sends responseHeader in successful response, e.g. Set-Cookie.
+// Upgrade fails with ErrReservedHeader and 500 is written if it contains
+// Upgrade, Connection, Sec-WebSocket-*, Content-Length or Transfer-Encoding
+func (u *Upgrader) UpgradeWithHeader(w http.ResponseWriter, req *http.Request, responseHeader http.Header) (*Conn, error) {
+	return u.upgrade(w, req, responseHeader, u.Subprotocols, nil)
+}
+
+// Upgrades connection selecting one of given subprotocols instead of configured ones.
+// Authenticate is skipped if request was already authenticated
+func (u *Upgrader) upgrade(w http.ResponseWriter, req *http.Request, responseHeader http.Header, subprotocols []string, auth *authenticated) (conn *Conn, err error) {
 	l := u.InternalLogger
 	if l == nil {
 		l = slog.New(slog.DiscardHandler)
@@ -21,37 +142,353 @@ func (u *Upgrader) Upgrade(w http.ResponseWriter, req *http.Request) (*Conn, err
 
 	l.Debug("Opening new websocket connection")
 
-	err := u.handleOpenHandshake(w, req, l)
+	start := time.Now()
+
+	tracer := u.Tracer
+	if tracer == nil {
+		tracer = NopTracer{}
+	}
+	traceCtx := tracer.Extract(context.WithoutCancel(req.Context()), req.Header)
+	_, span := tracer.Start(traceCtx, SpanHandshake,
+		Attribute{AttrSide, SideServer.String()}, Attribute{AttrURL, req.URL.String()})
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if u.inShutdown.Load() {
+		l.Debug("Failed to open websocket connection: upgrader is shutting down")
+		return nil, u.fail(w, req, http.StatusServiceUnavailable, FailureReasonShutdown, ErrUpgraderShutdown)
+	}
+
+	// invalid caller header is rejected before any hook runs
+	if name, ok := reservedHeaderIn(responseHeader); ok {
+		l.Debug("Failed to open websocket connection: reserved response header", "header", name)
+		return nil, u.fail(w, req, http.StatusInternalServerError, FailureReasonReservedHeader,
+			fmt.Errorf("%w: %q", ErrReservedHeader, name))
+	}
+
+	ip := remoteIP(req)
+	if !u.reserveIP(ip) {
+		l.Debug("Failed to open websocket connection: too many connections", "ip", ip)
+		return nil, u.fail(w, req, http.StatusTooManyRequests, FailureReasonTooManyConns, ErrTooManyConnections)
+	}
+	reserved := true
+	defer func() {
+		if reserved {
+			u.releaseIP(ip)
+		}
+	}()
+
+	if auth == nil && u.Authenticate != nil {
+		auth, err = u.authenticate(w, req, l)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if isExtendedConnect(req) {
+		conn, err = u.acceptStream(w, req, responseHeader, subprotocols, l)
+	} else {
+		conn, err = u.acceptHijacked(w, req, responseHeader, subprotocols, l)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l.Debug("New websocket connection opened")
+
+	conn.isServer = true
+	conn.setContext(req.Context(), req.Header.Clone())
+	if auth != nil && auth.principal != nil {
+		conn.ctx = context.WithValue(conn.ctx, principalKey{}, auth.principal)
+	}
+
+	if u.RateLimit != nil {
+		conn.SetRateLimit(u.RateLimit)
+	}
+	if u.CompressionPolicy != nil {
+		conn.SetCompressionPolicy(u.CompressionPolicy)
+	}
+	conn.SetMaxFrameSize(u.MaxFrameSize)
+	conn.SetReadLimit(u.ReadLimit)
+
+	u.track(conn, ip)
+	reserved = false
+
+	conn.observe(u.Observer)
+	if u.Observer != nil {
+		u.Observer.HandshakeSucceeded(SideServer, time.Since(start))
+	}
+	conn.trace(traceCtx, u.Tracer)
+	span.SetAttributes(Attribute{AttrSubprotocol, conn.Subprotocol()})
+
+	return conn, nil
+}
+
+// Completes HTTP/1.1 upgrade and takes over TCP connection
+func (u *Upgrader) acceptHijacked(w http.ResponseWriter, req *http.Request, responseHeader http.Header, subprotocols []string, l *slog.Logger) (*Conn, error) {
+	subprotocol, exts, err := u.handleOpenHandshake(w, req, subprotocols, l)
 	if err != nil {
 		l.Debug(fmt.Sprintf("Failed to open websocket connection: %s", err.Error()))
+		return nil, u.fail(w, req, http.StatusBadRequest, FailureReasonBadRequest, err)
+	}
+
+	err = u.prepareResponse(w, req, subprotocol, responseHeader, l)
+	if err != nil {
 		return nil, err
 	}
 
+	w.WriteHeader(http.StatusSwitchingProtocols)
+
 	netConn, rw, err := http.NewResponseController(w).Hijack()
 	if err != nil {
 		l.Debug("Failed to open websocket connection: couldn't hijack TCP connection")
-		return nil, fmt.Errorf("failed to hijack net.Conn")
+		// status is already written, error response is not possible
+		if u.Observer != nil {
+			u.Observer.HandshakeFailed(SideServer, FailureReasonHijack)
+		}
+		return nil, fmt.Errorf("failed to hijack net.Conn: [%w]", err)
 	}
 
-	l.Debug("New websocket connection opened")
+	c, err := newConn(netTransport{netConn}, rw.Reader, rw.AvailableBuffer(), subprotocol, l)
+	if err != nil {
+		return nil, err
+	}
+	c.setExtensions(exts)
+
+	return c, nil
+}
 
-	conn, err := newConn(netConn, rw.Reader, rw.AvailableBuffer(), l)
+// Accepts HTTP/2 extended CONNECT stream (RFC 8441), connection runs
+// over the stream which lives until http handler returns
+func (u *Upgrader) acceptStream(w http.ResponseWriter, req *http.Request, responseHeader http.Header, subprotocols []string, l *slog.Logger) (*Conn, error) {
+	subprotocol, exts, err := u.handleExtendedConnect(w, req, subprotocols, l)
+	if err != nil {
+		l.Debug(fmt.Sprintf("Failed to open websocket connection: %s", err.Error()))
+		return nil, u.fail(w, req, http.StatusBadRequest, FailureReasonBadRequest, err)
+	}
+
+	err = u.prepareResponse(w, req, subprotocol, responseHeader, l)
 	if err != nil {
 		return nil, err
 	}
 
-	conn.isServer = true
+	w.WriteHeader(http.StatusOK)
 
-	return conn, nil
+	err = http.NewResponseController(w).Flush()
+	if err != nil {
+		l.Debug("Failed to open websocket connection: couldn't flush response headers")
+		// status is already written, error response is not possible
+		if u.Observer != nil {
+			u.Observer.HandshakeFailed(SideServer, FailureReasonConnectionError)
+		}
+		return nil, fmt.Errorf("failed to flush response headers: [%w]", err)
+	}
+
+	t := newServerStreamTransport(w, req)
+
+	c, err := newConn(t, bufio.NewReader(t), nil, subprotocol, l)
+	if err != nil {
+		return nil, err
+	}
+	c.setExtensions(exts)
+
+	return c, nil
 }
 
-func (u *Upgrader) handleOpenHandshake(w http.ResponseWriter, req *http.Request, l *slog.Logger) error {
+// Adds custom headers to response and runs BeforeUpgrade hook,
+// failure response is written before returning error
+func (u *Upgrader) prepareResponse(w http.ResponseWriter, req *http.Request, subprotocol string, responseHeader http.Header, l *slog.Logger) error {
+	h := responseHeader.Clone()
+	if h == nil {
+		h = http.Header{}
+	}
+
+	reject := func(status int, failureReason string, err error) error {
+		// response is not an upgrade anymore
+		for _, name := range reservedResponseHeaders {
+			w.Header().Del(name)
+		}
+		return u.fail(w, req, status, failureReason, err)
+	}
+
+	if u.BeforeUpgrade != nil {
+		err := u.BeforeUpgrade(req, subprotocol, h)
+		if err != nil {
+			l.Debug("Failed to open websocket connection: upgrade rejected", "err", err)
+			return reject(http.StatusForbidden, FailureReasonRejected,
+				fmt.Errorf("%w: upgrade rejected: [%w]", ErrHandshakeFailure, err))
+		}
+	}
+
+	// caller header is already checked, so this catches hook additions
+	if name, ok := reservedHeaderIn(h); ok {
+		l.Debug("Failed to open websocket connection: reserved response header added by BeforeUpgrade", "header", name)
+		return reject(http.StatusInternalServerError, FailureReasonReservedHeader,
+			fmt.Errorf("%w: %q", ErrReservedHeader, name))
+	}
+	for name, values := range h {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+
+	return nil
+}
+
+func (u *Upgrader) fail(w http.ResponseWriter, req *http.Request, status int, failureReason string, reason error) error {
+	if u.Observer != nil {
+		u.Observer.HandshakeFailed(SideServer, failureReason)
+	}
+
+	if u.Error != nil {
+		u.Error(w, req, status, reason)
+	} else {
+		http.Error(w, reason.Error(), status)
+	}
+
+	return reason
+}
+
+// Shutdown sends close frame to all connections opened by Upgrade and waits
+// for close handshakes to finish until context is done, then closes remaining
+// connections. New connections are rejected once Shutdown is called.
+// Handlers must keep reading connections for close handshake to finish.
+//
+// Hijacked connections are not tracked by http.Server, so call it alongside
+// http.Server.Shutdown or from http.Server.RegisterOnShutdown
+func (u *Upgrader) Shutdown(ctx context.Context) error {
+	u.inShutdown.Store(true)
+
+	code := u.ShutdownCloseCode
+	if code == 0 {
+		code = CloseGoingAway
+	}
+
+	for _, c := range u.trackedConns() {
+		err := c.WriteClose(code, "server is shutting down")
+		if err != nil {
+			c.l.Debug("Failed to send shutdown close frame", "err", err)
+		}
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if u.closeFinished() {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, c := range u.trackedConns() {
+				c.closeNetConn()
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Registers connection, ip slot must be reserved already
+// and is released when connection is closed
+func (u *Upgrader) track(c *Conn, ip string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conns == nil {
+		u.conns = make(map[*Conn]struct{})
+	}
+	u.conns[c] = struct{}{}
+
+	c.onClose = append(c.onClose, func() {
+		u.mu.Lock()
+		delete(u.conns, c)
+		u.mu.Unlock()
+
+		u.releaseIP(ip)
+	})
+}
+
+func (u *Upgrader) reserveIP(ip string) bool {
+	if u.MaxConnsPerIP <= 0 {
+		return true
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.ipConns == nil {
+		u.ipConns = make(map[string]int)
+	}
+	if u.ipConns[ip] >= u.MaxConnsPerIP {
+		return false
+	}
+	u.ipConns[ip]++
+
+	return true
+}
+
+func (u *Upgrader) releaseIP(ip string) {
+	if u.MaxConnsPerIP <= 0 {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.ipConns[ip]--
+	if u.ipConns[ip] <= 0 {
+		delete(u.ipConns, ip)
+	}
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (u *Upgrader) trackedConns() []*Conn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	conns := make([]*Conn, 0, len(u.conns))
+	for c := range u.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Closes connections which finished close handshake,
+// reports if there are no connections left
+func (u *Upgrader) closeFinished() bool {
+	conns := u.trackedConns()
+
+	left := 0
+	for _, c := range conns {
+		if c.isClosed() {
+			c.closeNetConn()
+		} else {
+			left++
+		}
+	}
+
+	return left == 0
+}
+
+// Validates request and sets response headers, returns selected subprotocol and extensions.
+// Response status is not written
+func (u *Upgrader) handleOpenHandshake(w http.ResponseWriter, req *http.Request, subprotocols []string, l *slog.Logger) (string, []negotiatedExtension, error) {
 	w.Header().Add("Access-Control-Allow-Origin", "*")
 
 	l.Debug("Handling opening handshake")
 
 	if req.Method != http.MethodGet {
-		return fmt.Errorf("%w: method must be %q, actual %q",
+		return "", nil, fmt.Errorf("%w: method must be %q, actual %q",
 			ErrHandshakeFailure, http.MethodGet, req.Method)
 	}
 
@@ -59,45 +496,41 @@ func (u *Upgrader) handleOpenHandshake(w http.ResponseWriter, req *http.Request,
 
 	actual, ok := headerEquals(req.Header, headerUpgrade, headerUpgradeExpected)
 	if !ok {
-		return fmt.Errorf(`%w: %q header must be %q , actual %q`,
+		return "", nil, fmt.Errorf(`%w: %q header must be %q , actual %q`,
 			ErrHandshakeFailure, headerUpgrade, headerUpgradeExpected, actual)
 	}
 
 	actual, ok = headerEquals(req.Header, headerConn, headerConnExpected)
 	if !ok {
-		return fmt.Errorf(`%w, %q header must be %q, actual: %q`,
+		return "", nil, fmt.Errorf(`%w, %q header must be %q, actual: %q`,
 			ErrHandshakeFailure, headerConn, headerConnExpected, actual)
 	}
 
 	actual, ok = headerEquals(req.Header, headerSecWsVersion, headerSecWsVersionExpected)
 	if !ok {
-		return fmt.Errorf(`%w, %q header must be %q, received: %q`,
+		return "", nil, fmt.Errorf(`%w, %q header must be %q, received: %q`,
 			ErrHandshakeFailure, headerSecWsVersion, headerSecWsVersion, actual)
 	}
 
-	secWsProto := req.Header.Get(headerSecWsProto)
-	if secWsProto != "" {
-		// TODO
-		l.Debug(fmt.Sprintf(`%q header not supported, received value: %q`, headerSecWsProto, secWsProto))
-	}
+	subprotocol := selectSubprotocol(subprotocols, headerTokens(req.Header, headerSecWsProto))
+	l.Debug("Selected subprotocol", "subprotocol", subprotocol)
 
-	secWsExt := req.Header.Get(headerSecWsExt)
-	if secWsExt != "" {
-		// TODO
-		l.Debug(fmt.Sprintf(`%q header not supported, received value: %q`, headerSecWsExt, secWsExt))
+	exts, err := u.selectExtensions(w, req, l)
+	if err != nil {
+		return "", nil, err
 	}
 
 	secWsKey := req.Header.Get(headerSecWsKey)
 	if len(secWsKey) == 0 {
-		return fmt.Errorf("%w: missing %q header", ErrHandshakeFailure, headerSecWsKey)
+		return "", nil, fmt.Errorf("%w: missing %q header", ErrHandshakeFailure, headerSecWsKey)
 	} else {
 		decoded, err := base64.StdEncoding.DecodeString(secWsKey)
 		if err != nil {
-			return fmt.Errorf("%w: failed to base64 decode %q header: [%w]",
+			return "", nil, fmt.Errorf("%w: failed to base64 decode %q header: [%w]",
 				ErrHandshakeFailure, headerSecWsKey, err)
 		}
 		if len(decoded) != 16 {
-			return fmt.Errorf("%w: decoded value of %q must be 16 bytes, received %d bytes",
+			return "", nil, fmt.Errorf("%w: decoded value of %q must be 16 bytes, received %d bytes",
 				ErrHandshakeFailure, headerSecWsKey, len(decoded))
 		}
 	}
@@ -107,8 +540,73 @@ func (u *Upgrader) handleOpenHandshake(w http.ResponseWriter, req *http.Request,
 	w.Header().Add(headerUpgrade, headerUpgradeExpected)
 	w.Header().Add(headerConn, headerConnExpected)
 	w.Header().Add(headerSecWsAccept, secWebsocketAccept.String())
+	if subprotocol != "" {
+		w.Header().Add(headerSecWsProto, subprotocol)
+	}
+
+	return subprotocol, exts, nil
+}
 
-	w.WriteHeader(101)
+func isExtendedConnect(req *http.Request) bool {
+	return req.ProtoMajor == 2 && req.Method == http.MethodConnect &&
+		strings.EqualFold(req.Header.Get(headerProtocol), headerUpgradeExpected)
+}
 
-	return nil
+// Validates extended CONNECT request and sets response headers, returns selected subprotocol and extensions.
+// Unlike HTTP/1.1 upgrade there are no Upgrade, Connection and Sec-WebSocket-Key headers
+func (u *Upgrader) handleExtendedConnect(w http.ResponseWriter, req *http.Request, subprotocols []string, l *slog.Logger) (string, []negotiatedExtension, error) {
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+
+	l.Debug("Handling extended CONNECT handshake")
+
+	actual, ok := headerEquals(req.Header, headerSecWsVersion, headerSecWsVersionExpected)
+	if !ok {
+		return "", nil, fmt.Errorf(`%w, %q header must be %q, received: %q`,
+			ErrHandshakeFailure, headerSecWsVersion, headerSecWsVersionExpected, actual)
+	}
+
+	subprotocol := selectSubprotocol(subprotocols, headerTokens(req.Header, headerSecWsProto))
+	l.Debug("Selected subprotocol", "subprotocol", subprotocol)
+
+	exts, err := u.selectExtensions(w, req, l)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if subprotocol != "" {
+		w.Header().Add(headerSecWsProto, subprotocol)
+	}
+
+	return subprotocol, exts, nil
+}
+
+// Negotiates extensions offered in request and adds them to response headers.
+// Header is ignored if there are no supported extensions
+func (u *Upgrader) selectExtensions(w http.ResponseWriter, req *http.Request, l *slog.Logger) ([]negotiatedExtension, error) {
+	if len(u.Extensions) == 0 {
+		return nil, nil
+	}
+
+	offers, err := ParseExtensions(req.Header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: [%w]", ErrHandshakeFailure, err)
+	}
+
+	exts, err := negotiateExtensions(u.Extensions, offers)
+	if err != nil {
+		return nil, err
+	}
+	if len(exts) == 0 {
+		return nil, nil
+	}
+
+	responses := make([]ExtensionOffer, len(exts))
+	for i, e := range exts {
+		responses[i] = e.params
+	}
+	header := extensionsHeader(responses)
+	l.Debug("Negotiated extensions", "extensions", header)
+	w.Header().Set(headerSecWsExt, header)
+
+	return exts, nil
 }
@@ -0,0 +1,85 @@
+package websocket_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+func TestShutdown(t *testing.T) {
+	u := &websocket.Upgrader{ShutdownCloseCode: websocket.CloseServiceRestart}
+	done := make(chan struct{}, 2)
+	srv := wstest.NewServer(u, readUntilError(done))
+	defer srv.HTTP.Close()
+
+	codes := make(chan websocket.CloseCode, 2)
+	for range 2 {
+		client, err := srv.Dial("/")
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		client.SetCloseHandler(func(code websocket.CloseCode, reason string) error {
+			codes <- code
+			return client.WriteClose(code, reason)
+		})
+		// answers close
+		go func() { _, _, _ = client.NextMessage() }()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := u.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown error = %v, want nil after close handshakes", err)
+	}
+
+	for range 2 {
+		if code := <-codes; code != websocket.CloseServiceRestart {
+			t.Errorf("close code = %d, want %d", code, websocket.CloseServiceRestart)
+		}
+		<-done
+	}
+
+	res, err := http.Get(srv.HTTP.URL)
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status after shutdown = %d, want %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+	if _, err := srv.Dial("/"); err == nil {
+		t.Error("dial succeeded after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	u := &websocket.Upgrader{}
+	done := make(chan struct{}, 1)
+	srv := wstest.NewServer(u, readUntilError(done))
+	defer srv.HTTP.Close()
+
+	// client never reads, so close frame is not answered
+	client, err := srv.Dial("/")
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := u.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// connection is closed, so server read fails
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not closed when shutdown context expired")
+	}
+}
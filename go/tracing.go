@@ -0,0 +1,90 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+)
+
+// Span attribute keys
+const (
+	AttrSide           = "websocket.side"
+	AttrURL            = "websocket.url"
+	AttrSubprotocol    = "websocket.subprotocol"
+	AttrMessageType    = "websocket.message.type"
+	AttrMessageSize    = "websocket.message.size"
+	AttrMessageSeq     = "websocket.message.seq"
+	AttrCloseCode      = "websocket.close.code"
+	AttrCloseInitiator = "websocket.close.initiator"
+)
+
+// Span names
+const (
+	SpanHandshake = "websocket.handshake"
+	SpanRead      = "websocket.read"
+	SpanWrite     = "websocket.write"
+	SpanClose     = "websocket.close"
+)
+
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Tracer creates spans for opening handshake, messages and close handshake.
+// It is shaped after OpenTelemetry API, so adapter is a thin wrapper around
+// trace.Tracer and propagation.TextMapPropagator
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+	// Writes trace context from ctx to handshake request headers
+	Inject(ctx context.Context, header http.Header)
+	// Returns ctx with trace context read from handshake request headers
+	Extract(ctx context.Context, header http.Header) context.Context
+}
+
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+type NopTracer struct{}
+
+func (NopTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+func (NopTracer) Inject(ctx context.Context, header http.Header) {}
+
+func (NopTracer) Extract(ctx context.Context, header http.Header) context.Context {
+	return ctx
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(attrs ...Attribute) {}
+func (nopSpan) RecordError(err error)            {}
+func (nopSpan) End()                             {}
+
+// Sets tracer and context message spans are created in,
+// ctx must not be cancelled when connection is still alive
+func (c *Conn) trace(ctx context.Context, t Tracer) {
+	if t == nil {
+		return
+	}
+
+	c.tracer = t
+	c.traceCtx = ctx
+}
+
+func (c *Conn) startSpan(name string, attrs ...Attribute) Span {
+	_, span := c.tracer.Start(c.traceCtx, name, append(attrs, Attribute{AttrSide, c.side().String()})...)
+	return span
+}
+
+// Ends span with error if it is not nil
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,217 @@
+package websocket_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+type traceIDKey struct{}
+
+// Records spans in order they were started, trace id is propagated
+// through handshake headers
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	t       *recordingTracer
+	name    string
+	traceID any
+	attrs   map[string]string
+	err     error
+	ended   bool
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, attrs ...websocket.Attribute) (context.Context, websocket.Span) {
+	s := &recordedSpan{t: t, name: name, traceID: ctx.Value(traceIDKey{}), attrs: map[string]string{}}
+	s.SetAttributes(attrs...)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, s)
+	return ctx, s
+}
+
+func (t *recordingTracer) Inject(ctx context.Context, header http.Header) {
+	if id, ok := ctx.Value(traceIDKey{}).(string); ok {
+		header.Set("Trace-Id", id)
+	}
+}
+
+func (t *recordingTracer) Extract(ctx context.Context, header http.Header) context.Context {
+	if id := header.Get("Trace-Id"); id != "" {
+		return context.WithValue(ctx, traceIDKey{}, id)
+	}
+	return ctx
+}
+
+// Returns copies of recorded spans
+func (t *recordingTracer) recorded() []recordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var spans []recordedSpan
+	for _, s := range t.spans {
+		spans = append(spans, *s)
+	}
+	return spans
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...websocket.Attribute) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	for _, a := range attrs {
+		s.attrs[a.Key] = fmt.Sprint(a.Value)
+	}
+}
+
+func (s *recordedSpan) RecordError(err error) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.err = err
+}
+
+func (s *recordedSpan) End() {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.ended = true
+}
+
+func checkSpans(t *testing.T, side string, got []recordedSpan, want []recordedSpan) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		var names []string
+		for _, s := range got {
+			names = append(names, s.name)
+		}
+		t.Fatalf("%s spans = %v, want %d spans", side, names, len(want))
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.name != w.name || !g.ended || g.traceID != w.traceID || (g.err != nil) != (w.err != nil) {
+			t.Errorf("%s span %d = %s ended %t trace %v error %v, want %s ended trace %v error %v",
+				side, i, g.name, g.ended, g.traceID, g.err, w.name, w.traceID, w.err)
+		}
+		for k, v := range w.attrs {
+			if g.attrs[k] != v {
+				t.Errorf("%s span %s attribute %s = %q, want %q", side, g.name, k, g.attrs[k], v)
+			}
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	clientTracer, serverTracer := &recordingTracer{}, &recordingTracer{}
+	client, server, err := wstest.NewPipeWith(
+		&websocket.Dialer{Tracer: clientTracer},
+		&websocket.Upgrader{Tracer: serverTracer},
+	)
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		_ = client.WriteMessage(websocket.TextMessage, []byte("hello"))
+		closed <- client.Close()
+	}()
+	if _, _, err := server.NextMessage(); err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	// answers close
+	if _, _, err := server.NextMessage(); err == nil {
+		t.Fatal("read succeeded after close")
+	}
+	if err := <-closed; err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	checkSpans(t, "client", clientTracer.recorded(), []recordedSpan{
+		{name: websocket.SpanHandshake, attrs: map[string]string{
+			websocket.AttrSide: "client",
+		}},
+		{name: websocket.SpanWrite, attrs: map[string]string{
+			websocket.AttrSide:        "client",
+			websocket.AttrMessageType: websocket.TextMessage.String(),
+			websocket.AttrMessageSize: "5",
+		}},
+		{name: websocket.SpanClose, attrs: map[string]string{
+			websocket.AttrCloseInitiator: "local",
+			websocket.AttrCloseCode:      "1000",
+		}},
+	})
+	checkSpans(t, "server", serverTracer.recorded(), []recordedSpan{
+		{name: websocket.SpanHandshake, attrs: map[string]string{
+			websocket.AttrSide: "server",
+			websocket.AttrURL:  "/",
+		}},
+		{name: websocket.SpanRead, attrs: map[string]string{
+			websocket.AttrSide:        "server",
+			websocket.AttrMessageType: websocket.TextMessage.String(),
+			websocket.AttrMessageSize: "5",
+		}},
+		{name: websocket.SpanClose, attrs: map[string]string{
+			websocket.AttrCloseInitiator: "remote",
+			websocket.AttrCloseCode:      "1000",
+		}},
+	})
+}
+
+func TestTracingPropagation(t *testing.T) {
+	clientTracer, serverTracer := &recordingTracer{}, &recordingTracer{}
+	srv := wstest.NewServer(&websocket.Upgrader{Tracer: serverTracer}, func(c *websocket.Conn) {
+		_, _, _ = c.NextMessage()
+	})
+	defer srv.Close()
+
+	d := &websocket.Dialer{Tracer: clientTracer}
+	ctx := context.WithValue(context.Background(), traceIDKey{}, "trace-1")
+	client, err := d.DialContext(ctx, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	_ = client.Close()
+
+	spans := serverTracer.recorded()
+	if len(spans) == 0 || spans[0].name != websocket.SpanHandshake || spans[0].traceID != "trace-1" {
+		t.Fatalf("server spans = %+v, want handshake span of trace %q", spans, "trace-1")
+	}
+	// message spans continue trace of handshake request
+	for _, s := range append(spans, clientTracer.recorded()...) {
+		if s.traceID != "trace-1" {
+			t.Errorf("span %s trace = %v, want %q", s.name, s.traceID, "trace-1")
+		}
+	}
+}
+
+func TestTracingHandshakeError(t *testing.T) {
+	handshake := []recordedSpan{{name: websocket.SpanHandshake, err: errors.New("")}}
+
+	clientTracer := &recordingTracer{}
+	d := &websocket.Dialer{Tracer: clientTracer}
+	if _, err := d.Dial("http://localhost/", nil); err == nil {
+		t.Fatal("dial with invalid scheme succeeded")
+	}
+	checkSpans(t, "client", clientTracer.recorded(), handshake)
+
+	serverTracer := &recordingTracer{}
+	srv := wstest.NewServer(&websocket.Upgrader{Tracer: serverTracer}, func(c *websocket.Conn) {})
+	defer srv.Close()
+
+	// plain HTTP request is not websocket handshake
+	res, err := http.Get(srv.HTTP.URL)
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	_ = res.Body.Close()
+	checkSpans(t, "server", serverTracer.recorded(), handshake)
+}
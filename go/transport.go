@@ -0,0 +1,283 @@
+package websocket
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wmdanor/websocket/go/internal/http2"
+)
+
+// Byte stream Conn runs over, either net.Conn of upgraded HTTP/1.1
+// connection or HTTP/2 stream opened with extended CONNECT (RFC 8441)
+type transport interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	// Sends data buffered by Write, called after every frame
+	Flush() error
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+type netTransport struct {
+	net.Conn
+}
+
+func (netTransport) Flush() error {
+	return nil
+}
+
+const (
+	streamReadChunkSize = 32 * 1024
+)
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// HTTP/2 stream, request body and response writer on server,
+// request body pipe and response body on client.
+// Body is read by separate goroutine, so read deadline can interrupt
+// blocked Read without breaking the stream
+type streamTransport struct {
+	body io.ReadCloser
+	w    io.Writer
+
+	flush            func() error
+	setWriteDeadline func(t time.Time) error
+	// releases stream resources, body is closed separately
+	release func() error
+
+	local, remote net.Addr
+
+	reads   chan readResult
+	pending []byte
+	readErr error
+
+	readDeadline deadline
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newStreamTransport(body io.ReadCloser, w io.Writer, local, remote net.Addr) *streamTransport {
+	t := &streamTransport{
+		body:         body,
+		w:            w,
+		local:        local,
+		remote:       remote,
+		reads:        make(chan readResult),
+		readDeadline: newDeadline(),
+		closed:       make(chan struct{}),
+	}
+
+	go t.readLoop()
+
+	return t
+}
+
+// Serves extended CONNECT stream from http handler. Stream is ended by
+// http.Server once handler returns, so writes after that are rejected
+func newServerStreamTransport(w http.ResponseWriter, req *http.Request) *streamTransport {
+	local, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	t := newStreamTransport(req.Body, w, local, stringAddr{"tcp", req.RemoteAddr})
+
+	rc := http.NewResponseController(w)
+	ctx := req.Context()
+	t.w = writerFunc(func(p []byte) (int, error) {
+		if ctx.Err() != nil {
+			return 0, net.ErrClosed
+		}
+		return w.Write(p)
+	})
+	t.flush = func() error {
+		if ctx.Err() != nil {
+			return net.ErrClosed
+		}
+		return rc.Flush()
+	}
+	t.setWriteDeadline = rc.SetWriteDeadline
+
+	return t
+}
+
+// Runs extended CONNECT stream opened by client, release closes HTTP/2 connection
+func newClientStreamTransport(stream *http2.Stream, local, remote net.Addr, release func() error) *streamTransport {
+	bw := bufio.NewWriterSize(stream, streamReadChunkSize)
+
+	t := newStreamTransport(stream, bw, local, remote)
+	t.flush = bw.Flush
+	t.setWriteDeadline = stream.SetWriteDeadline
+	t.release = release
+
+	return t
+}
+
+func (t *streamTransport) readLoop() {
+	for {
+		buf := make([]byte, streamReadChunkSize)
+		n, err := t.body.Read(buf)
+
+		select {
+		case t.reads <- readResult{buf[:n], err}:
+		case <-t.closed:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (t *streamTransport) Read(p []byte) (int, error) {
+	for len(t.pending) == 0 {
+		if t.readErr != nil {
+			return 0, t.readErr
+		}
+
+		select {
+		case r := <-t.reads:
+			t.pending, t.readErr = r.data, r.err
+		case <-t.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-t.closed:
+			return 0, net.ErrClosed
+		}
+	}
+
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+
+	return n, nil
+}
+
+func (t *streamTransport) Write(p []byte) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	return t.w.Write(p)
+}
+
+func (t *streamTransport) Flush() error {
+	return t.flush()
+}
+
+func (t *streamTransport) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		err = t.body.Close()
+		if t.release != nil {
+			err = errors.Join(err, t.release())
+		}
+	})
+	return err
+}
+
+func (t *streamTransport) SetReadDeadline(d time.Time) error {
+	t.readDeadline.set(d)
+	return nil
+}
+
+func (t *streamTransport) SetWriteDeadline(d time.Time) error {
+	return t.setWriteDeadline(d)
+}
+
+func (t *streamTransport) LocalAddr() net.Addr {
+	return t.local
+}
+
+func (t *streamTransport) RemoteAddr() net.Addr {
+	return t.remote
+}
+
+// Deadline which can be waited on, same as one used by net.Pipe
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// timer already fired, wait for cancel to be closed
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// Returns channel which is closed once deadline is exceeded
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+type stringAddr struct {
+	network, addr string
+}
+
+func (a stringAddr) Network() string {
+	return a.network
+}
+
+func (a stringAddr) String() string {
+	return a.addr
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,311 @@
+package websocket_test
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+// Sends opening handshake request over new TCP connection and returns response
+func rawHandshake(t *testing.T, url string, header http.Header) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	for name, value := range map[string]string{
+		"Upgrade":               "websocket",
+		"Connection":            "Upgrade",
+		"Sec-WebSocket-Version": "13",
+		"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+	} {
+		if req.Header.Get(name) == "" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	netConn, err := net.Dial("tcp", req.URL.Host)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { _ = netConn.Close() })
+
+	if err := req.Write(netConn); err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(netConn), req)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return res
+}
+
+func TestUpgradeWithHeader(t *testing.T) {
+	tests := []struct {
+		name          string
+		header        http.Header
+		beforeUpgrade func(req *http.Request, subprotocol string, h http.Header) error
+		status        int
+		err           error
+		want          http.Header
+	}{
+		{
+			name:   "custom headers",
+			header: http.Header{"Set-Cookie": {"a=1", "b=2"}, "X-Server": {"test"}},
+			beforeUpgrade: func(req *http.Request, subprotocol string, h http.Header) error {
+				h.Set("X-Subprotocol", subprotocol)
+				h.Set("X-Token", req.Header.Get("X-Token"))
+				return nil
+			},
+			status: http.StatusSwitchingProtocols,
+			want: http.Header{
+				"Set-Cookie":             {"a=1", "b=2"},
+				"X-Server":               {"test"},
+				"X-Subprotocol":          {"chat"},
+				"X-Token":                {"abc"},
+				"Sec-Websocket-Protocol": {"chat"},
+			},
+		},
+		{
+			name:   "reserved header",
+			header: http.Header{"Sec-Websocket-Protocol": {"other"}},
+			status: http.StatusInternalServerError,
+			err:    websocket.ErrReservedHeader,
+			want:   http.Header{"Upgrade": nil, "Sec-Websocket-Accept": nil},
+		},
+		{
+			name:   "reserved header prefix",
+			header: http.Header{"Sec-Websocket-Custom": {"x"}},
+			status: http.StatusInternalServerError,
+			err:    websocket.ErrReservedHeader,
+		},
+		{
+			name:   "reserved header checked before hook",
+			header: http.Header{"Content-Length": {"0"}},
+			beforeUpgrade: func(req *http.Request, subprotocol string, h http.Header) error {
+				return errors.New("hook must not run")
+			},
+			status: http.StatusInternalServerError,
+			err:    websocket.ErrReservedHeader,
+		},
+		{
+			name: "reserved header added by hook",
+			beforeUpgrade: func(req *http.Request, subprotocol string, h http.Header) error {
+				h.Set("Connection", "close")
+				return nil
+			},
+			status: http.StatusInternalServerError,
+			err:    websocket.ErrReservedHeader,
+		},
+		{
+			name:   "rejected by hook",
+			header: http.Header{"Set-Cookie": {"a=1"}},
+			beforeUpgrade: func(req *http.Request, subprotocol string, h http.Header) error {
+				return errors.New("origin is not allowed")
+			},
+			status: http.StatusForbidden,
+			err:    websocket.ErrHandshakeFailure,
+			want:   http.Header{"Set-Cookie": nil, "Upgrade": nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &websocket.Upgrader{Subprotocols: []string{"chat"}, BeforeUpgrade: tt.beforeUpgrade}
+			errc := make(chan error, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				c, err := u.UpgradeWithHeader(w, req, tt.header)
+				errc <- err
+				if err == nil {
+					_ = c.Close()
+				}
+			}))
+			defer srv.Close()
+
+			res := rawHandshake(t, srv.URL, http.Header{
+				"Sec-Websocket-Protocol": {"chat"},
+				"X-Token":                {"abc"},
+			})
+			res.Body.Close()
+
+			if res.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.status)
+			}
+			if err := <-errc; !errors.Is(err, tt.err) {
+				t.Errorf("upgrade error = %v, want %v", err, tt.err)
+			}
+			for name, want := range tt.want {
+				if got := res.Header.Values(name); strings.Join(got, ",") != strings.Join(want, ",") {
+					t.Errorf("header %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpgradeConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type result struct {
+		conn *websocket.Conn
+		req  *http.Request
+		err  error
+	}
+	results := make(chan result, 1)
+
+	u := &websocket.Upgrader{Subprotocols: []string{"chat"}}
+	opts := &websocket.UpgradeConnOptions{
+		MaxHeaderBytes:   1024,
+		HandshakeTimeout: 200 * time.Millisecond,
+		ResponseHeader:   http.Header{"Set-Cookie": {"a=1"}},
+	}
+	go func() {
+		for {
+			netConn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c, req, err := u.UpgradeConn(netConn, opts)
+				results <- result{c, req, err}
+			}()
+		}
+	}()
+
+	url := "ws://" + ln.Addr().String() + "/path"
+
+	t.Run("upgraded", func(t *testing.T) {
+		d := &websocket.Dialer{Subprotocols: []string{"chat"}}
+		client, err := d.Dial(url, map[string]string{"X-Token": "abc"})
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer client.Close()
+
+		res := <-results
+		if res.err != nil {
+			t.Fatalf("failed to upgrade: %v", res.err)
+		}
+		go wstest.Echo(res.conn)
+
+		if res.req.URL.Path != "/path" || res.req.Header.Get("X-Token") != "abc" {
+			t.Errorf("request = %s %v, want /path with X-Token", res.req.URL.Path, res.req.Header)
+		}
+		if res.req.RemoteAddr != client.LocalAddr().String() {
+			t.Errorf("request remote address = %s, want %s", res.req.RemoteAddr, client.LocalAddr())
+		}
+		if client.Subprotocol() != "chat" {
+			t.Errorf("subprotocol = %q, want %q", client.Subprotocol(), "chat")
+		}
+
+		if err := client.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		_, data, err := client.NextMessage()
+		if err != nil || string(data) != "hello" {
+			t.Fatalf("echo = %q %v, want %q", data, err, "hello")
+		}
+	})
+
+	t.Run("cookie", func(t *testing.T) {
+		// raw peer is closed first, so close handshake is not awaited
+		var server *websocket.Conn
+		t.Cleanup(func() {
+			if server != nil {
+				_ = server.Close()
+			}
+		})
+
+		res := rawHandshake(t, url, http.Header{})
+		if res.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("status = %d, want 101", res.StatusCode)
+		}
+		if got := res.Header.Get("Set-Cookie"); got != "a=1" {
+			t.Errorf("Set-Cookie = %q, want %q", got, "a=1")
+		}
+		server = (<-results).conn
+	})
+
+	t.Run("header too large", func(t *testing.T) {
+		res := rawHandshake(t, url, http.Header{"X-Large": {strings.Repeat("a", 2048)}})
+		if res.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+			t.Errorf("status = %d, want 431", res.StatusCode)
+		}
+		if err := (<-results).err; !errors.Is(err, websocket.ErrRequestHeaderTooLarge) {
+			t.Errorf("upgrade error = %v, want ErrRequestHeaderTooLarge", err)
+		}
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		res := rawHandshake(t, url, http.Header{"Sec-Websocket-Version": {"8"}})
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("status = %d, want 400", res.StatusCode)
+		}
+		if err := (<-results).err; !errors.Is(err, websocket.ErrHandshakeFailure) {
+			t.Errorf("upgrade error = %v, want ErrHandshakeFailure", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		netConn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer netConn.Close()
+
+		select {
+		case res := <-results:
+			if res.err == nil {
+				t.Fatal("upgrade succeeded without request")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("upgrade did not time out")
+		}
+	})
+}
+
+type failureObserver struct {
+	websocket.NopObserver
+	reasons []string
+}
+
+func (o *failureObserver) HandshakeFailed(_ websocket.Side, reason string) {
+	o.reasons = append(o.reasons, reason)
+}
+
+func TestUpgradeHijackFailed(t *testing.T) {
+	obs := &failureObserver{}
+	u := &websocket.Upgrader{Observer: obs}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	// recorder doesn't support hijacking
+	w := httptest.NewRecorder()
+
+	if _, err := u.Upgrade(w, req); err == nil {
+		t.Fatal("upgrade succeeded without hijacking connection")
+	}
+	if w.Code != http.StatusSwitchingProtocols || w.Body.Len() != 0 {
+		t.Errorf("response = %d %q, want only %d", w.Code, w.Body, http.StatusSwitchingProtocols)
+	}
+	if len(obs.reasons) != 1 || obs.reasons[0] != websocket.FailureReasonHijack {
+		t.Errorf("handshake failures = %q, want %q", obs.reasons, websocket.FailureReasonHijack)
+	}
+}
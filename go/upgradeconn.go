@@ -0,0 +1,239 @@
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMaxRequestHeaderBytes = 16 << 10
+	defaultUpgradeConnTimeout    = 10 * time.Second
+)
+
+var (
+	ErrRequestHeaderTooLarge = errors.New("request header too large")
+)
+
+// Options of Upgrader.UpgradeConn, zero value uses defaults
+type UpgradeConnOptions struct {
+	// Max size of request line and headers, 16KB if 0. Larger requests are
+	// rejected with 431. PROXY header is not counted, its size is bounded by format
+	MaxHeaderBytes int
+	// Time given to peer to send request and read response, 10s if 0
+	HandshakeTimeout time.Duration
+	// Sent in successful response, same as in Upgrader.UpgradeWithHeader
+	ResponseHeader http.Header
+	// Reads PROXY protocol header sent by load balancer before request, its
+	// source address is reported as remote address of connection and request.
+	// Header precedes TLS, so for *tls.Conn it must be read with ReadProxyHeader
+	// before TLS handshake instead
+	ProxyProtocol ProxyProtocol
+}
+
+// Upgrades connection accepted from custom listener without net/http. Reads
+// and validates handshake request from netConn and writes response, returns
+// connection with request it was opened with. Upgrader hooks and limits apply
+// same as for Upgrade, request RemoteAddr is netConn.RemoteAddr() unless
+// PROXY header says otherwise. netConn is closed if upgrade fails
+func (u *Upgrader) UpgradeConn(netConn net.Conn, opts *UpgradeConnOptions) (*Conn, *http.Request, error) {
+	if opts == nil {
+		opts = &UpgradeConnOptions{}
+	}
+
+	l := u.InternalLogger
+	if l == nil {
+		l = slog.New(slog.DiscardHandler)
+	}
+
+	timeout := opts.HandshakeTimeout
+	if timeout == 0 {
+		timeout = defaultUpgradeConnTimeout
+	}
+	maxHeaderBytes := opts.MaxHeaderBytes
+	if maxHeaderBytes == 0 {
+		maxHeaderBytes = defaultMaxRequestHeaderBytes
+	}
+
+	_ = netConn.SetDeadline(time.Now().Add(timeout))
+
+	lr := &limitedReader{r: netConn, n: maxHeaderBytes}
+	brw := bufio.NewReadWriter(bufio.NewReader(lr), bufio.NewWriter(netConn))
+	w := &connResponseWriter{conn: netConn, brw: brw, header: make(http.Header)}
+
+	fail := func(err error) (*Conn, *http.Request, error) {
+		status := http.StatusBadRequest
+		failureReason := FailureReasonBadRequest
+		switch {
+		case errors.Is(err, ErrRequestHeaderTooLarge):
+			status = http.StatusRequestHeaderFieldsTooLarge
+		case errors.Is(err, ErrInvalidProxyHeader), errors.Is(err, ErrMissingProxyHeader):
+			// peer is not a client which can understand response
+			status = 0
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), isNetError(err):
+			// peer is gone or too slow, there is no one to respond to
+			status, failureReason = 0, FailureReasonConnectionError
+		}
+		if status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			_ = brw.Flush()
+		}
+		if u.Observer != nil {
+			u.Observer.HandshakeFailed(SideServer, failureReason)
+		}
+		_ = netConn.Close()
+
+		return nil, nil, fmt.Errorf("%w: [%w]", ErrHandshakeFailure, err)
+	}
+
+	var proxyHeader *ProxyHeader
+	// PROXY header and request bytes buffered after it
+	proxyBytes := 0
+	if opts.ProxyProtocol != ProxyProtocolOff {
+		// v2 header with TLVs may alone be larger than request limit
+		lr.n = proxyV2MaxLength + maxHeaderBytes
+
+		var err error
+		proxyHeader, err = readProxyHeader(brw.Reader, opts.ProxyProtocol)
+		if err != nil {
+			l.Debug("Failed to open websocket connection: couldn't read PROXY header", "err", err)
+			return fail(fmt.Errorf("failed to read PROXY header: [%w]", err))
+		}
+		if proxyHeader != nil && proxyHeader.Source != nil {
+			l.Debug("Read PROXY header", "source", proxyHeader.Source, "destination", proxyHeader.Destination)
+			w.conn = newProxiedConn(netConn, netConn, proxyHeader)
+		}
+
+		proxyBytes = lr.read - brw.Reader.Buffered()
+		lr.n = max(maxHeaderBytes-brw.Reader.Buffered(), 0)
+	} else {
+		proxyHeader = proxyHeaderOf(netConn)
+	}
+
+	req, err := http.ReadRequest(brw.Reader)
+	if err != nil {
+		l.Debug("Failed to open websocket connection: couldn't read request", "err", err)
+		if lr.n == 0 && !errors.Is(err, ErrRequestHeaderTooLarge) {
+			// line cut at limit is reported as malformed header
+			err = fmt.Errorf("%w: [%w]", ErrRequestHeaderTooLarge, err)
+		}
+		return fail(fmt.Errorf("failed to read request: [%w]", err))
+	}
+	// request read ahead with PROXY header is not limited by limitedReader
+	if lr.read-proxyBytes-brw.Reader.Buffered() > maxHeaderBytes {
+		l.Debug("Failed to open websocket connection: request after PROXY header is too large")
+		return fail(fmt.Errorf("failed to read request: [%w]", ErrRequestHeaderTooLarge))
+	}
+	// rest of buffered data belongs to frames
+	lr.n = -1
+
+	if proxyHeader != nil {
+		req = req.WithContext(context.WithValue(req.Context(), proxyHeaderKey{}, proxyHeader))
+	}
+	req.RemoteAddr = w.conn.RemoteAddr().String()
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+
+	c, err := u.upgrade(w, req, opts.ResponseHeader, u.Subprotocols, nil)
+	if err != nil {
+		_ = brw.Flush()
+		_ = netConn.Close()
+		return nil, nil, err
+	}
+
+	_ = netConn.SetDeadline(time.Time{})
+
+	return c, req, nil
+}
+
+func isNetError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// Reader which fails with ErrRequestHeaderTooLarge once n bytes are read, unlimited if n < 0
+type limitedReader struct {
+	r io.Reader
+	// bytes left, unlimited if negative
+	n int
+	// total bytes read while limited
+	read int
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return l.r.Read(p)
+	}
+	if l.n == 0 {
+		return 0, ErrRequestHeaderTooLarge
+	}
+
+	p = p[:min(len(p), l.n)]
+	n, err := l.r.Read(p)
+	l.n -= n
+	l.read += n
+	return n, err
+}
+
+// Minimal http.ResponseWriter and http.Hijacker over net.Conn,
+// just enough for Upgrader
+type connResponseWriter struct {
+	conn        net.Conn
+	brw         *bufio.ReadWriter
+	header      http.Header
+	wroteHeader bool
+	hijacked    bool
+}
+
+var errHijacked = errors.New("connection is hijacked")
+
+func (w *connResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *connResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader || w.hijacked {
+		return
+	}
+	w.wroteHeader = true
+
+	_, _ = w.brw.WriteString("HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n")
+	if status != http.StatusSwitchingProtocols {
+		// there is no content length, body ends with connection
+		w.header.Set("Connection", "close")
+	}
+	_ = w.header.Write(w.brw)
+	_, _ = w.brw.WriteString("\r\n")
+}
+
+func (w *connResponseWriter) Write(b []byte) (int, error) {
+	if w.hijacked {
+		return 0, errHijacked
+	}
+	w.WriteHeader(http.StatusOK)
+	return w.brw.Write(b)
+}
+
+func (w *connResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.hijacked {
+		return nil, nil, errHijacked
+	}
+	w.hijacked = true
+
+	err := w.brw.Flush()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to flush response: [%w]", err)
+	}
+
+	return w.conn, w.brw, nil
+}
@@ -0,0 +1,49 @@
+package websocket
+
+import (
+	"unicode/utf8"
+)
+
+// Validates UTF-8 text received in chunks, rune may be split
+// between chunks, so its beginning is kept until it is complete
+type utf8Validator struct {
+	pending [utf8.UTFMax]byte
+	n       int
+}
+
+// Reports if b is valid continuation of text,
+// final means that no more data will follow
+func (v *utf8Validator) valid(b []byte, final bool) bool {
+	for v.n > 0 && len(b) > 0 {
+		v.pending[v.n] = b[0]
+		v.n++
+		b = b[1:]
+
+		if utf8.FullRune(v.pending[:v.n]) {
+			r, size := utf8.DecodeRune(v.pending[:v.n])
+			if r == utf8.RuneError && size == 1 {
+				return false
+			}
+			v.n = 0
+		}
+	}
+
+	// keep incomplete rune at the end, it can be completed by next chunk
+	start := len(b)
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				start = i
+			}
+			break
+		}
+	}
+
+	if !utf8.Valid(b[:start]) {
+		return false
+	}
+
+	v.n += copy(v.pending[v.n:], b[start:])
+
+	return !final || v.n == 0
+}
@@ -3,12 +3,10 @@ package websocket
 import (
 	"crypto/rand"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math"
-	"math/big"
 
 	"github.com/wmdanor/websocket/go/internal"
 )
@@ -22,6 +20,9 @@ func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
 	if err != nil {
 		return err
 	}
+	if mw, ok := w.(*messageWriter); ok {
+		mw.whole = true
+	}
 
 	_, err = w.Write(data)
 	if err != nil {
@@ -32,7 +33,9 @@ func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
 }
 
 func (c *Conn) WriteClose(code CloseCode, message string) error {
-	c.l.Debug("writing close message", "code", code, "data", message)
+	if c.debug {
+		c.l.Debug("writing close message", "code", code, "data", message)
+	}
 	return c.WriteControl(CloseMessage, CloseMessageData(code, message))
 }
 
@@ -41,16 +44,15 @@ func (c *Conn) WriteControl(messageType MessageType, data []byte) error {
 		return fmt.Errorf("message type must be close, ping or pong")
 	}
 
-	if messageType == CloseMessage && c.sentConnClose {
+	if messageType == CloseMessage && c.sentConnClose.Load() {
 		c.l.Debug("Already wrote close message, skipping")
 		return nil
 	}
-	if messageType == CloseMessage {
-		c.sentConnClose = true
-	}
 
-	c.l.Debug("writing control frame", "messageType", messageType)
-	err := c.writeFrame(true, internal.Opcode(messageType), data)
+	if c.debug {
+		c.l.Debug("writing control frame", "messageType", messageType)
+	}
+	err := c.writeFrame(true, 0, internal.Opcode(messageType), data, true)
 	if err != nil {
 		return fmt.Errorf("failed to write control frame: [%w]", err)
 	}
@@ -59,16 +61,20 @@ func (c *Conn) WriteControl(messageType MessageType, data []byte) error {
 }
 
 func (c *Conn) NextWriter(messageType MessageType) (io.WriteCloser, error) {
-	if c.err != nil {
-		return nil, c.err
+	if err := c.getErr(); err != nil {
+		return nil, err
 	}
 
-	if c.sentConnClose && c.recvConnClose {
-		return nil, fmt.Errorf("connection closed")
+	if c.isClosed() {
+		return nil, ErrConnClosed
+	}
+
+	if c.wFragmented {
+		return nil, fmt.Errorf("message written with WriteFrame is not finished, expected continuation frame")
 	}
 
 	if c.curWriter != nil {
-		err := c.curWriter.Close()
+		err := c.curWriter.outer.Close()
 		if err != nil {
 			return nil, fmt.Errorf("failed to close current writer: [%w]", err)
 		}
@@ -76,18 +82,31 @@ func (c *Conn) NextWriter(messageType MessageType) (io.WriteCloser, error) {
 
 	c.wBuf.Reset()
 
-	id, _ := rand.Int(rand.Reader, big.NewInt(1000))
-	l := c.l.With("id", id.Int64())
+	l, seq := c.messageLogger()
 
-	l.Debug("creating new writer", "messageType", messageType)
+	if c.debug {
+		l.Debug("creating new writer", "messageType", messageType)
+	}
 
-	c.curWriter = &messageWriter{
+	w := &messageWriter{
 		c:           c,
 		messageType: messageType,
 		isFirst:     true,
-		l:           l,
+		span: c.startSpan(SpanWrite,
+			Attribute{AttrMessageType, messageType.String()}, Attribute{AttrMessageSeq, seq}),
+		l: l,
 	}
-	return c.curWriter, nil
+	w.outer = w
+	if messageType == TextMessage || messageType == BinaryMessage {
+		if c.compressExts {
+			w.outer = c.newCompressionWriter(w)
+		} else {
+			w.outer = c.wrapWriter(messageType, &w.rsv, w, false)
+		}
+	}
+	c.curWriter = w
+
+	return w.outer, nil
 }
 
 type messageWriter struct {
@@ -99,6 +118,20 @@ type messageWriter struct {
 
 	isFirst bool
 	isFinal bool
+	// data of next Write is rest of message, so frame which ends it is final
+	whole bool
+
+	// set by extensions before first frame is written
+	rsv RSV
+
+	// writer returned to user, message writer wrapped by extensions
+	outer io.WriteCloser
+
+	// stats for observer
+	frames int
+	bytes  int
+
+	span Span
 
 	l *slog.Logger
 }
@@ -107,9 +140,11 @@ func (w *messageWriter) Write(p []byte) (n int, err error) {
 	buf := w.c.wBuf
 	written := 0
 
-	l := w.l.With("buf.cap", buf.Cap(), "data.len", len(p))
-
-	l.Debug("message writer: write")
+	l := w.l
+	if w.c.debug {
+		l = l.With("buf.cap", buf.Cap(), "data.len", len(p))
+		l.Debug("message writer: write")
+	}
 
 	w.bytesReceived += len(p)
 	if internal.Opcode(w.messageType).IsControl() && w.bytesReceived > 125 {
@@ -117,122 +152,324 @@ func (w *messageWriter) Write(p []byte) (n int, err error) {
 	}
 
 	for len(p) != 0 {
-		if buf.Available() == 0 {
-			l.Debug("message writer: write: buffer full, writing frame", "buf.len", buf.Len())
+		// data which doesn't fit into empty buffer is sent without copying,
+		// frame extensions may modify payload, so it is buffered for them
+		if buf.Len() == 0 && len(p) >= buf.Cap() && !w.c.frameExts {
+			size := w.c.frameSize(len(p))
+			if w.c.debug {
+				l.Debug("message writer: write: writing frame from data", "frame.len", size)
+			}
+			// Close doesn't need to send empty final frame after it
+			w.isFinal = w.whole && size == len(p)
+			err := w.writeFrameData(p[:size], true)
+			if err != nil {
+				return written, fmt.Errorf("failed to write frame: [%w]", err)
+			}
+			p = p[size:]
+			written += size
+			continue
+		}
+
+		limit := w.c.frameSize(buf.Cap())
+		if buf.Len() >= limit {
+			if w.c.debug {
+				l.Debug("message writer: write: buffer full, writing frame", "buf.len", buf.Len())
+			}
 			err := w.writeFrame()
 			if err != nil {
 				return written, fmt.Errorf("failed to write frame: [%w]", err)
 			}
 		}
 
-		l.Debug("message writer: write: writing to buffer", "buf.len", buf.Len(), "data.remaining", len(p))
-		toCopy := min(len(p), buf.Available())
+		if w.c.debug {
+			l.Debug("message writer: write: writing to buffer", "buf.len", buf.Len(), "data.remaining", len(p))
+		}
+		toCopy := min(len(p), limit-buf.Len())
 		n, _ := buf.Write(p[:toCopy])
 		p = p[toCopy:]
 		written += n
 	}
 
-	l.Debug("message writer: write: finished writing", "buf.len", buf.Len())
+	if w.c.debug {
+		l.Debug("message writer: write: finished writing", "buf.len", buf.Len())
+	}
 	return written, nil
 }
 
+// Reads r until EOF into frame buffer, result of every read is sent as separate
+// frame of up to 64KB or max frame size. Lets io.Copy skip its intermediate buffer
+func (w *messageWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.c.frameExts || internal.Opcode(w.messageType).IsControl() {
+		return io.Copy(writerOnly{w}, r)
+	}
+
+	err := w.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	if w.c.frameBuf == nil {
+		w.c.frameBuf = make([]byte, readFromBufSize)
+	}
+	buf := w.c.frameBuf[:w.c.frameSize(readFromBufSize)]
+
+	var total int64
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			w.bytesReceived += n
+			total += int64(n)
+			err := w.writeFrameData(buf[:n], false)
+			if err != nil {
+				return total, fmt.Errorf("failed to write frame: [%w]", err)
+			}
+		}
+		if rerr == io.EOF {
+			return total, nil
+		}
+		if rerr != nil {
+			return total, rerr
+		}
+	}
+}
+
+// Hides ReadFrom, so io.Copy doesn't call it recursively
+type writerOnly struct {
+	io.Writer
+}
+
+// Writes buffered data as non-final frame without ending the message
+func (w *messageWriter) Flush() error {
+	if internal.Opcode(w.messageType).IsControl() {
+		return fmt.Errorf("control messages must not be fragmented")
+	}
+
+	if w.c.wBuf.Len() == 0 {
+		w.l.Debug("message writer: flush: buffer is empty, skipping")
+		return nil
+	}
+
+	if w.c.debug {
+		w.l.Debug("message writer: flush", "buf.len", w.c.wBuf.Len())
+	}
+	err := w.writeFrame()
+	if err != nil {
+		return fmt.Errorf("failed to write frame: [%w]", err)
+	}
+
+	return nil
+}
+
 func (w *messageWriter) Close() error {
-	w.l.Debug("message writer: close", "buf.len", w.c.wBuf.Len())
-	w.isFinal = true
+	if w.c.debug {
+		w.l.Debug("message writer: close", "buf.len", w.c.wBuf.Len())
+	}
 	w.c.curWriter = nil
 
-	return w.writeFrame()
+	// final frame is already written if message was written whole
+	var err error
+	if !w.isFinal {
+		w.isFinal = true
+		err = w.writeFrame()
+	}
+	w.span.SetAttributes(Attribute{AttrMessageSize, w.bytes})
+	endSpan(w.span, err)
+	if err != nil {
+		return err
+	}
+
+	w.c.obs.MessageWritten(w.c.side(), w.messageType, w.bytes, w.frames)
+
+	return nil
 }
 
+// Writes buffered data as next frame of message
 func (w *messageWriter) writeFrame() error {
-	w.l.Debug("writing frame")
+	defer w.c.wBuf.Reset()
+	return w.writeFrameData(w.c.wBuf.Bytes(), false)
+}
 
-	buf := w.c.wBuf
+// Writes data as next frame of message, keepData is set when data
+// belongs to caller and must not be masked in place
+func (w *messageWriter) writeFrameData(data []byte, keepData bool) error {
+	if w.c.debug {
+		w.l.Debug("writing frame", "data.len", len(data))
+	}
 
 	isFirst := w.isFirst
 	if w.isFirst {
 		w.isFirst = false
 	}
 
-	defer buf.Reset()
-
 	opcode := internal.OpcodeContinuationFrame
+	var rsv RSV
 	if isFirst {
 		opcode = internal.Opcode(w.messageType)
+		rsv = w.rsv
 	}
-	err := w.c.writeFrame(w.isFinal, opcode, buf.Bytes())
+	w.frames++
+	w.bytes += len(data)
 
-	return err
+	if w.c.frameExts && opcode.IsData() {
+		f := &Frame{IsFinal: w.isFinal, Type: MessageType(opcode), RSV: rsv, Payload: data}
+		err := w.c.transformOutgoing(f)
+		if err != nil {
+			return err
+		}
+		data, rsv = f.Payload, f.RSV
+	}
+
+	return w.c.writeFrame(w.isFinal, rsv, opcode, data, keepData)
+}
+
+// Limits size of written frame to max frame size
+func (c *Conn) frameSize(n int) int {
+	if c.maxFrameSize > 0 {
+		return min(n, c.maxFrameSize)
+	}
+	return n
 }
 
-func (c *Conn) writeFrame(isFinal bool, opcode internal.Opcode, data []byte) error {
+// Sets max payload size of written data frames, larger messages are split
+// into several frames. Frames are limited only by write buffer for buffered
+// writes if 0. Must not be called concurrently with writes
+func (c *Conn) SetMaxFrameSize(n int) {
+	c.maxFrameSize = max(n, 0)
+}
+
+// Data is masked in place on client unless keepData is set
+func (c *Conn) writeFrame(isFinal bool, rsv RSV, opcode internal.Opcode, data []byte, keepData bool) error {
 	if opcode.IsControl() && len(data) > 125 {
 		return fmt.Errorf("control frame data must not exceed 125 bytes, received: %d", len(data))
 	}
 
-	dest := c.conn
+	c.wMu.Lock()
+	if c.sentConnClose.Load() {
+		c.wMu.Unlock()
+		if opcode == internal.OpcodeConnectionClose {
+			c.l.Debug("Already wrote close message, skipping")
+			return nil
+		}
+		return fmt.Errorf("close frame was already sent: [%w]", ErrConnClosed)
+	}
+	if opcode == internal.OpcodeConnectionClose {
+		c.sentConnClose.Store(true)
+	}
+	closeCode := CloseNoStatusReceived
+	if opcode == internal.OpcodeConnectionClose && len(data) >= 2 {
+		closeCode = CloseCode(binary.BigEndian.Uint16(data))
+	}
+	err := c.writeFrameLocked(isFinal, rsv, opcode, data, keepData)
+	if err == nil {
+		err = c.conn.Flush()
+	}
+	c.wMu.Unlock()
 
-	var b0, b1 byte
+	if err != nil {
+		// connection is broken, there is no point in close handshake
+		c.l.Debug("failed to write frame, closing connection", "err", err)
+		c.setErr(err)
+		c.closeNetConn()
+		return err
+	}
 
-	if isFinal {
-		b0 = b0 | 0b1_000_0000
+	if opcode.IsControl() {
+		c.obs.ControlFrameWritten(c.side(), MessageType(opcode))
+	}
+	if opcode == internal.OpcodeConnectionClose {
+		c.obs.CloseSent(c.side(), closeCode)
+		c.observeCloseFrame(true, closeCode)
 	}
-	// b0 = b0 | byte(0)<<6 // RSV1
-	// b0 = b0 | byte(0)<<5 // RSV2
-	// b0 = b0 | byte(0)<<4 // RSV3
 
-	// Else continuation opcode is 0, so no need to write
-	b0 = b0 | byte(opcode)
+	return nil
+}
 
-	c.l.Debug("frame byte 0", "binary", fmt.Sprintf("%08b", b0))
+func (c *Conn) writeFrameLocked(isFinal bool, rsv RSV, opcode internal.Opcode, data []byte, keepData bool) error {
+	dest := c.conn
 
-	err := binary.Write(dest, binary.BigEndian, b0)
-	if err != nil {
-		return c.fatal(CloseInternalServerErr,
-			fmt.Errorf("failed to write first byte of frame: [%w]", err), "")
+	// 2 bytes, up to 8 bytes of extended payload length and masking key
+	var header [14]byte
+	n := 2
+
+	// continuation opcode is 0
+	header[0] = byte(rsv)<<4 | byte(opcode)
+	if isFinal {
+		header[0] |= 0b1_000_0000
+	}
+
+	switch {
+	case len(data) <= 125:
+		header[1] = byte(len(data))
+	case len(data) <= math.MaxUint16:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[n:], uint16(len(data)))
+		n += 2
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[n:], uint64(len(data)))
+		n += 8
 	}
 
 	var maskingKey [4]byte
 	if !c.isServer {
-		b1 = b1 | 0b1_000_0000
+		header[1] |= 0b1_000_0000
 		rand.Read(maskingKey[:])
+		n += copy(header[n:], maskingKey[:])
 	}
 
-	if len(data) <= 125 {
-		b1 = b1 | byte(len(data))
-		err = binary.Write(dest, binary.BigEndian, b1)
-	} else if len(data) <= math.MaxUint16 {
-		b1 = b1 | byte(126)
-		err = binary.Write(dest, binary.BigEndian, b1)
-		err = errors.Join(err, binary.Write(dest, binary.BigEndian, uint16(len(data))))
-	} else {
-		b1 = b1 | byte(127)
-		err = binary.Write(dest, binary.BigEndian, b1)
-		err = errors.Join(err, binary.Write(dest, binary.BigEndian, uint64(len(data))))
+	c.captureFrame(&internal.FrameHeader{
+		IsFinalFrame:  isFinal,
+		RSV1:          uint8(rsv>>2) & 1,
+		RSV2:          uint8(rsv>>1) & 1,
+		RSV3:          uint8(rsv) & 1,
+		Opcode:        opcode,
+		IsMasked:      !c.isServer,
+		PayloadLength: uint64(len(data)),
+		MaskingKey:    maskingKey,
+	}, DirectionOutbound, data)
+
+	if c.debug {
+		c.l.Debug("writing frame", "isFinal", isFinal, "rsv", rsv, "opcode", opcode, "data.len", len(data))
 	}
-	c.l.Debug("frame byte 1", "binary", fmt.Sprintf("%08b", b1))
+
+	_, err := dest.Write(header[:n])
 	if err != nil {
-		return c.fatal(CloseInternalServerErr,
-			fmt.Errorf("failed to write MASK and payload length: [%w]", err), "")
+		return fmt.Errorf("failed to write frame header: [%w]", err)
 	}
 
-	if !c.isServer {
-		c.l.Debug("masking frame data", "maskingKey", maskingKey)
-		_, err = dest.Write(maskingKey[:])
-		if err != nil {
-			return c.fatal(CloseInternalServerErr,
-				fmt.Errorf("failed to write masking key: [%w]", err), "")
-		}
+	switch {
+	case len(data) == 0:
+	case c.isServer:
+		_, err = dest.Write(data)
+	case keepData:
+		err = c.writeMasked(data, maskingKey)
+	default:
 		internal.Mask(data, maskingKey)
+		_, err = dest.Write(data)
 	}
-
-	c.l.Debug("writing frame data", "data.len", len(data))
-	_, err = dest.Write(data)
 	if err != nil {
-		return c.fatal(CloseInternalServerErr,
-			fmt.Errorf("failed to write application data: [%w]", err), "")
+		return fmt.Errorf("failed to write application data: [%w]", err)
 	}
 	c.l.Debug("wrote frame successfully")
 
 	return nil
 }
+
+// Masks data in chunks of separate buffer, so data itself is left intact
+func (c *Conn) writeMasked(data []byte, maskingKey [4]byte) error {
+	if c.maskBuf == nil {
+		c.maskBuf = make([]byte, maskBufSize)
+	}
+
+	for off := 0; off < len(data); {
+		n := copy(c.maskBuf, data[off:])
+		internal.MaskOffset(c.maskBuf[:n], maskingKey, off)
+		_, err := c.conn.Write(c.maskBuf[:n])
+		if err != nil {
+			return err
+		}
+		off += n
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package websocket_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"slices"
+	"testing"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+func TestLargeWrite(t *testing.T) {
+	data := make([]byte, 1_000_000)
+	rand.New(rand.NewSource(1)).Read(data)
+	orig := bytes.Clone(data)
+
+	tests := []struct {
+		name         string
+		maxFrameSize int
+		// data frames of message
+		want []int
+	}{
+		{"single frame", 0, []int{len(data)}},
+		{"max frame size", 300_000, []int{300_000, 300_000, 300_000, 100_000}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server, err := wstest.NewPipeWith(
+				&websocket.Dialer{MaxFrameSize: tt.maxFrameSize},
+				&websocket.Upgrader{MaxFrameSize: tt.maxFrameSize},
+			)
+			if err != nil {
+				t.Fatalf("failed to create pipe: %v", err)
+			}
+			defer client.Close()
+			go wstest.Echo(server)
+
+			clientRec, serverRec := &frameRecorder{}, &frameRecorder{}
+			client.SetCapture(clientRec)
+			server.SetCapture(serverRec)
+
+			roundTrip(t, client, websocket.BinaryMessage, data)
+			if !bytes.Equal(data, orig) {
+				t.Fatal("client modified written data")
+			}
+
+			for _, rec := range []*frameRecorder{clientRec, serverRec} {
+				rec.mu.Lock()
+				var sizes []int
+				for _, f := range rec.frames {
+					sizes = append(sizes, len(f.Payload))
+				}
+				rec.mu.Unlock()
+
+				if !slices.Equal(sizes, tt.want) {
+					t.Errorf("frame sizes = %v, want %v", sizes, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteMaxFrameSizeBuffered(t *testing.T) {
+	client, server := wstest.NewPipe()
+	defer client.Close()
+	go wstest.Echo(server)
+
+	client.SetMaxFrameSize(100)
+	rec := &frameRecorder{}
+	client.SetCapture(rec)
+
+	w, err := client.NextWriter(websocket.TextMessage)
+	if err != nil {
+		t.Fatalf("failed to get writer: %v", err)
+	}
+	for range 5 {
+		_, _ = w.Write(bytes.Repeat([]byte("a"), 50))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+	if _, _, err := client.NextMessage(); err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var sizes []int
+	for _, f := range rec.frames {
+		sizes = append(sizes, len(f.Payload))
+	}
+	if want := []int{100, 100, 50}; !slices.Equal(sizes, want) {
+		t.Errorf("frame sizes = %v, want %v", sizes, want)
+	}
+}
+
+func TestWriterReadFrom(t *testing.T) {
+	data := make([]byte, 200_000)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	client, server := wstest.NewPipe()
+	defer client.Close()
+	go wstest.Echo(server)
+
+	rec := &frameRecorder{}
+	client.SetCapture(rec)
+
+	w, err := client.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		t.Fatalf("failed to get writer: %v", err)
+	}
+	if _, ok := w.(io.ReaderFrom); !ok {
+		t.Fatal("writer does not implement io.ReaderFrom")
+	}
+	_, _ = w.Write([]byte("head"))
+	// LimitedReader has no WriteTo, so io.Copy uses writer ReadFrom
+	n, err := io.Copy(w, &io.LimitedReader{R: bytes.NewReader(data), N: int64(len(data))})
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("copied %d bytes %v, want %d", n, err, len(data))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+
+	_, got, err := client.NextMessage()
+	if err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if want := append([]byte("head"), data...); !bytes.Equal(got, want) {
+		t.Fatalf("echo = %d bytes, want %d bytes", len(got), len(want))
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	// buffered head, then at most 64KB per read
+	if len(rec.frames) < 5 || len(rec.frames[0].Payload) != 4 {
+		t.Fatalf("got %d frames, first of %d bytes, want buffered head and data frames",
+			len(rec.frames), len(rec.frames[0].Payload))
+	}
+	for _, f := range rec.frames[1:] {
+		if len(f.Payload) > 64*1024 {
+			t.Errorf("frame of %d bytes, want at most 64KB", len(f.Payload))
+		}
+	}
+}
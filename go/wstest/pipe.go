@@ -0,0 +1,77 @@
+// Package wstest provides utilities for testing code built on websocket.Conn:
+// in-memory connection pairs, test server and raw peers for injecting
+// malformed frames.
+package wstest
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	websocket "github.com/wmdanor/websocket/go"
+)
+
+// Placeholder url used for in-memory connections
+const pipeURL = "ws://pipe/"
+
+// Returns connected pair of connections over net.Pipe,
+// opening handshake is done with default Dialer and Upgrader.
+// Pipe is unbuffered, so writes block until the peer reads them.
+// Panics if handshake fails, which doesn't happen with defaults
+func NewPipe() (client, server *websocket.Conn) {
+	client, server, err := NewPipeWith(&websocket.Dialer{}, &websocket.Upgrader{})
+	if err != nil {
+		panic(fmt.Sprintf("wstest: failed to create pipe: %v", err))
+	}
+	return client, server
+}
+
+// Returns connected pair of connections over net.Pipe,
+// opening handshake is done with provided dialer and upgrader.
+// Dialer.NetDialContext is ignored
+func NewPipeWith(d *websocket.Dialer, u *websocket.Upgrader) (client, server *websocket.Conn, err error) {
+	clientNetConn, serverNetConn := net.Pipe()
+
+	result := make(chan upgradeResult, 1)
+	go func() {
+		c, err := upgradeNetConn(serverNetConn, u)
+		result <- upgradeResult{c, err}
+	}()
+
+	client, err = dialNetConn(clientNetConn, d)
+	if err != nil {
+		_ = clientNetConn.Close()
+		_ = serverNetConn.Close()
+		<-result
+		return nil, nil, err
+	}
+
+	res := <-result
+	if res.err != nil {
+		_ = clientNetConn.Close()
+		return nil, nil, res.err
+	}
+
+	return client, res.conn, nil
+}
+
+type upgradeResult struct {
+	conn *websocket.Conn
+	err  error
+}
+
+// Runs client handshake over already established net.Conn
+func dialNetConn(netConn net.Conn, d *websocket.Dialer) (*websocket.Conn, error) {
+	dialer := *d
+	dialer.NetDialContext = func(context.Context, string, string) (net.Conn, error) {
+		return netConn, nil
+	}
+
+	return dialer.Dial(pipeURL, nil)
+}
+
+// Reads handshake request from net.Conn and runs Upgrader on it
+func upgradeNetConn(netConn net.Conn, u *websocket.Upgrader) (*websocket.Conn, error) {
+	c, _, err := u.UpgradeConn(netConn, nil)
+	return c, err
+}
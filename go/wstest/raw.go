@@ -0,0 +1,371 @@
+package wstest
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+)
+
+const wsGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// RawFrame is frame as it is written on the wire, no validation is done
+// when it is encoded, so it can be used to write malformed frames
+type RawFrame struct {
+	IsFinal bool
+	RSV1    bool
+	RSV2    bool
+	RSV3    bool
+	// Any 4 bit opcode, including reserved ones
+	Opcode websocket.MessageType
+
+	IsMasked   bool
+	MaskingKey [4]byte
+
+	// Unmasked payload
+	Payload []byte
+}
+
+// Encodes frame, payload is masked if frame is masked
+func (f *RawFrame) Encode() []byte {
+	header := make([]byte, 0, 14)
+
+	var b0 byte
+	if f.IsFinal {
+		b0 |= 0x80
+	}
+	if f.RSV1 {
+		b0 |= 0x40
+	}
+	if f.RSV2 {
+		b0 |= 0x20
+	}
+	if f.RSV3 {
+		b0 |= 0x10
+	}
+	b0 |= byte(f.Opcode) & 0x0F
+	header = append(header, b0)
+
+	var b1 byte
+	if f.IsMasked {
+		b1 = 0x80
+	}
+	length := len(f.Payload)
+	switch {
+	case length <= 125:
+		header = append(header, b1|byte(length))
+	case length <= math.MaxUint16:
+		header = append(header, b1|126)
+		header = binary.BigEndian.AppendUint16(header, uint16(length))
+	default:
+		header = append(header, b1|127)
+		header = binary.BigEndian.AppendUint64(header, uint64(length))
+	}
+
+	if f.IsMasked {
+		header = append(header, f.MaskingKey[:]...)
+	}
+
+	data := append(header, f.Payload...)
+	if f.IsMasked {
+		mask(data[len(header):], f.MaskingKey)
+	}
+
+	return data
+}
+
+// RawConn is websocket peer which reads and writes frames as they are,
+// without any protocol handling. Use it to test how Conn handles
+// protocol errors
+type RawConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// frames created by Frame are masked
+	isClient bool
+}
+
+// Returns server Conn connected to raw client over net.Pipe,
+// opening handshake is done with provided upgrader, default one if nil
+func NewRawClient(u *websocket.Upgrader) (server *websocket.Conn, client *RawConn, err error) {
+	if u == nil {
+		u = &websocket.Upgrader{}
+	}
+
+	clientNetConn, serverNetConn := net.Pipe()
+
+	result := make(chan upgradeResult, 1)
+	go func() {
+		c, err := upgradeNetConn(serverNetConn, u)
+		result <- upgradeResult{c, err}
+	}()
+
+	client = &RawConn{
+		conn:     clientNetConn,
+		r:        bufio.NewReader(clientNetConn),
+		isClient: true,
+	}
+
+	err = client.handshakeClient()
+	if err != nil {
+		_ = clientNetConn.Close()
+		_ = serverNetConn.Close()
+		<-result
+		return nil, nil, err
+	}
+
+	res := <-result
+	if res.err != nil {
+		_ = clientNetConn.Close()
+		return nil, nil, res.err
+	}
+
+	return res.conn, client, nil
+}
+
+// Returns client Conn connected to raw server over net.Pipe,
+// opening handshake is done with provided dialer, default one if nil.
+// Dialer.NetDialContext is ignored
+func NewRawServer(d *websocket.Dialer) (client *websocket.Conn, server *RawConn, err error) {
+	if d == nil {
+		d = &websocket.Dialer{}
+	}
+
+	clientNetConn, serverNetConn := net.Pipe()
+
+	server = &RawConn{
+		conn: serverNetConn,
+		r:    bufio.NewReader(serverNetConn),
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- server.handshakeServer()
+	}()
+
+	client, err = dialNetConn(clientNetConn, d)
+	if err != nil {
+		_ = clientNetConn.Close()
+		_ = serverNetConn.Close()
+		<-result
+		return nil, nil, err
+	}
+
+	err = <-result
+	if err != nil {
+		_ = clientNetConn.Close()
+		return nil, nil, err
+	}
+
+	return client, server, nil
+}
+
+func (c *RawConn) handshakeClient() error {
+	nonce := [16]byte{}
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := "GET / HTTP/1.1\r\n" +
+		"Host: pipe\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"\r\n"
+
+	_, err := io.WriteString(c.conn, req)
+	if err != nil {
+		return fmt.Errorf("failed to write handshake request: [%w]", err)
+	}
+
+	res, err := http.ReadResponse(c.r, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read handshake response: [%w]", err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("unexpected handshake response status %d", res.StatusCode)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != secWebsocketAccept(key) {
+		return fmt.Errorf("unexpected Sec-WebSocket-Accept header %q", res.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	return nil
+}
+
+func (c *RawConn) handshakeServer() error {
+	req, err := http.ReadRequest(c.r)
+	if err != nil {
+		return fmt.Errorf("failed to read handshake request: [%w]", err)
+	}
+
+	res := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + secWebsocketAccept(req.Header.Get("Sec-WebSocket-Key")) + "\r\n" +
+		"\r\n"
+
+	_, err = io.WriteString(c.conn, res)
+	if err != nil {
+		return fmt.Errorf("failed to write handshake response: [%w]", err)
+	}
+
+	return nil
+}
+
+// Returns well formed frame for this side of connection,
+// masked with random key if raw conn is client
+func (c *RawConn) Frame(opcode websocket.MessageType, isFinal bool, payload []byte) *RawFrame {
+	f := &RawFrame{
+		IsFinal:  isFinal,
+		Opcode:   opcode,
+		IsMasked: c.isClient,
+		Payload:  payload,
+	}
+	if f.IsMasked {
+		rand.Read(f.MaskingKey[:])
+	}
+	return f
+}
+
+// Writes encoded frame
+func (c *RawConn) WriteFrame(f *RawFrame) error {
+	_, err := c.conn.Write(f.Encode())
+	return err
+}
+
+// Writes well formed frame, see Frame
+func (c *RawConn) WriteMessage(mt websocket.MessageType, data []byte) error {
+	return c.WriteFrame(c.Frame(mt, true, data))
+}
+
+// Writes bytes as they are, e.g. to write frame with invalid length
+func (c *RawConn) Write(b []byte) (int, error) {
+	return c.conn.Write(b)
+}
+
+// Reads next frame, payload is unmasked
+func (c *RawConn) ReadFrame() (*RawFrame, error) {
+	h := [2]byte{}
+	_, err := io.ReadFull(c.r, h[:])
+	if err != nil {
+		return nil, err
+	}
+
+	f := &RawFrame{
+		IsFinal:  h[0]&0x80 != 0,
+		RSV1:     h[0]&0x40 != 0,
+		RSV2:     h[0]&0x20 != 0,
+		RSV3:     h[0]&0x10 != 0,
+		Opcode:   websocket.MessageType(h[0] & 0x0F),
+		IsMasked: h[1]&0x80 != 0,
+	}
+
+	length := uint64(h[1] & 0x7F)
+	switch length {
+	case 126:
+		b := [2]byte{}
+		_, err = io.ReadFull(c.r, b[:])
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		b := [8]byte{}
+		_, err = io.ReadFull(c.r, b[:])
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if length > math.MaxInt32 {
+		return nil, fmt.Errorf("frame payload length %d is too big", length)
+	}
+
+	if f.IsMasked {
+		_, err = io.ReadFull(c.r, f.MaskingKey[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f.Payload = make([]byte, length)
+	_, err = io.ReadFull(c.r, f.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.IsMasked {
+		mask(f.Payload, f.MaskingKey)
+	}
+
+	return f, nil
+}
+
+// Reads frames until close frame, returns its code and reason.
+// Code is websocket.CloseNoStatusReceived if close frame has no payload
+func (c *RawConn) ReadClose() (websocket.CloseCode, string, error) {
+	for {
+		f, err := c.ReadFrame()
+		if err != nil {
+			return 0, "", err
+		}
+		if f.Opcode != websocket.CloseMessage {
+			continue
+		}
+
+		if len(f.Payload) < 2 {
+			return websocket.CloseNoStatusReceived, "", nil
+		}
+		code := websocket.CloseCode(binary.BigEndian.Uint16(f.Payload))
+		return code, string(f.Payload[2:]), nil
+	}
+}
+
+// Reads until connection is closed by peer, returns error
+// if anything other than io.EOF is received
+func (c *RawConn) ExpectEOF() error {
+	b, err := c.r.ReadByte()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("expected EOF, received byte 0x%02x", b)
+}
+
+func (c *RawConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *RawConn) Close() error {
+	return c.conn.Close()
+}
+
+// Underlying connection
+func (c *RawConn) NetConn() net.Conn {
+	return c.conn
+}
+
+// Returns close frame payload, code is not validated
+func ClosePayload(code websocket.CloseCode, reason string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(b, reason...)
+}
+
+func secWebsocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + wsGuid))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func mask(b []byte, key [4]byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
@@ -0,0 +1,97 @@
+package wstest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	websocket "github.com/wmdanor/websocket/go"
+)
+
+// Time given to connections to finish close handshake on Server.Close
+const serverShutdownTimeout = time.Second
+
+// Server is httptest.Server which upgrades every request
+// and passes connection to handler
+type Server struct {
+	// Underlying HTTP server
+	HTTP *httptest.Server
+	// Upgrader used for every request
+	Upgrader *websocket.Upgrader
+	// Base url of the server with ws scheme, e.g. ws://127.0.0.1:43567
+	URL string
+}
+
+// Starts server, handler is called in request goroutine for every
+// upgraded connection. If u is nil, default Upgrader is used
+func NewServer(u *websocket.Upgrader, handler func(c *websocket.Conn)) *Server {
+	if u == nil {
+		u = &websocket.Upgrader{}
+	}
+
+	s := &Server{Upgrader: u}
+
+	s.HTTP = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c, err := u.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		handler(c)
+	}))
+
+	s.URL = "ws" + strings.TrimPrefix(s.HTTP.URL, "http")
+
+	return s
+}
+
+// Dials server at path with default Dialer
+func (s *Server) Dial(path string) (*websocket.Conn, error) {
+	d := websocket.Dialer{}
+	return d.Dial(s.URL+path, nil)
+}
+
+// Shuts down upgraded connections and closes HTTP server
+func (s *Server) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+
+	_ = s.Upgrader.Shutdown(ctx)
+	s.HTTP.Close()
+}
+
+// Handler which sends every received message back until reading fails,
+// then closes connection. Messages are read in odd sized chunks, so they
+// end up split between Read calls in the middle of masking key and UTF-8 runes
+func Echo(c *websocket.Conn) {
+	defer c.Close()
+
+	buf := make([]byte, 1021)
+
+	for {
+		mt, r, err := c.NextReader()
+		if err != nil {
+			return
+		}
+
+		var data []byte
+		for {
+			n, err := r.Read(buf)
+			data = append(data, buf[:n]...)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return
+			}
+		}
+
+		err = c.WriteMessage(mt, data)
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package wstest_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	websocket "github.com/wmdanor/websocket/go"
+	"github.com/wmdanor/websocket/go/wstest"
+)
+
+func TestPipe(t *testing.T) {
+	client, server := wstest.NewPipe()
+
+	// pipe is unbuffered, so every write needs reading peer
+	go func() { _ = client.WriteMessage(websocket.TextMessage, []byte("hello")) }()
+	mt, data, err := server.NextMessage()
+	if err != nil || mt != websocket.TextMessage || string(data) != "hello" {
+		t.Fatalf("got %d %q %v, want text %q", mt, data, err, "hello")
+	}
+
+	go func() { _ = server.WriteMessage(websocket.BinaryMessage, []byte("world")) }()
+	mt, data, err = client.NextMessage()
+	if err != nil || mt != websocket.BinaryMessage || string(data) != "world" {
+		t.Fatalf("got %d %q %v, want binary %q", mt, data, err, "world")
+	}
+
+	// answers close
+	go func() { _, _, _ = server.NextMessage() }()
+	if err := client.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+}
+
+func TestPipeWithError(t *testing.T) {
+	// upgrader rejects connections after shutdown
+	u := &websocket.Upgrader{}
+	if err := u.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down upgrader: %v", err)
+	}
+
+	if _, _, err := wstest.NewPipeWith(&websocket.Dialer{}, u); err == nil {
+		t.Fatal("pipe created with rejecting upgrader")
+	}
+}
+
+func TestRawClient(t *testing.T) {
+	server, raw, err := wstest.NewRawClient(nil)
+	if err != nil {
+		t.Fatalf("failed to create raw client: %v", err)
+	}
+	defer raw.Close()
+
+	// every payload length encoding
+	for _, size := range []int{1, 125, 126, 65535, 65536} {
+		data := bytes.Repeat([]byte{'a'}, size)
+
+		go func() { _ = raw.WriteMessage(websocket.BinaryMessage, data) }()
+		mt, got, err := server.NextMessage()
+		if err != nil || mt != websocket.BinaryMessage || !bytes.Equal(got, data) {
+			t.Fatalf("got %d of %d bytes %v, want binary of %d bytes", mt, len(got), err, size)
+		}
+
+		written := make(chan error, 1)
+		go func() { written <- server.WriteMessage(websocket.BinaryMessage, data) }()
+		// message may be fragmented
+		var payload []byte
+		for {
+			f, err := raw.ReadFrame()
+			if err != nil {
+				t.Fatalf("failed to read frame: %v", err)
+			}
+			if f.IsMasked {
+				t.Fatal("server frame is masked")
+			}
+			payload = append(payload, f.Payload...)
+			if f.IsFinal {
+				break
+			}
+		}
+		if err := <-written; err != nil || !bytes.Equal(payload, data) {
+			t.Fatalf("read %d bytes %v, want %d", len(payload), err, size)
+		}
+	}
+
+	// answers close
+	go func() {
+		_, _, _ = server.NextMessage()
+		_ = server.Close()
+	}()
+	go func() {
+		_ = raw.WriteFrame(raw.Frame(websocket.CloseMessage, true, wstest.ClosePayload(websocket.CloseGoingAway, "")))
+	}()
+	code, reason, err := raw.ReadClose()
+	if err != nil || code != websocket.CloseGoingAway || reason != "" {
+		t.Fatalf("close = %d %q %v, want %d", code, reason, err, websocket.CloseGoingAway)
+	}
+	if err := raw.ExpectEOF(); err != nil {
+		t.Fatalf("server did not close connection: %v", err)
+	}
+}
+
+func TestRawServer(t *testing.T) {
+	client, raw, err := wstest.NewRawServer(nil)
+	if err != nil {
+		t.Fatalf("failed to create raw server: %v", err)
+	}
+	defer raw.Close()
+
+	go func() { _ = client.WriteMessage(websocket.TextMessage, []byte("hello")) }()
+	f, err := raw.ReadFrame()
+	if err != nil {
+		t.Fatalf("failed to read frame: %v", err)
+	}
+	// payload is unmasked by ReadFrame
+	if !f.IsMasked || f.Opcode != websocket.TextMessage || string(f.Payload) != "hello" {
+		t.Fatalf("got %s frame %q, masked %t, want masked text %q", f.Opcode, f.Payload, f.IsMasked, "hello")
+	}
+
+	go func() { _ = raw.WriteMessage(websocket.TextMessage, []byte("world")) }()
+	mt, data, err := client.NextMessage()
+	if err != nil || mt != websocket.TextMessage || string(data) != "world" {
+		t.Fatalf("got %s %q %v, want text %q", mt, data, err, "world")
+	}
+
+	// malformed frame, server frames must not be masked
+	masked := raw.Frame(websocket.TextMessage, true, []byte("masked"))
+	masked.IsMasked = true
+	go func() { _ = raw.WriteFrame(masked) }()
+	go func() { _, _, _ = client.NextMessage() }()
+
+	code, _, err := raw.ReadClose()
+	if err != nil || code != websocket.CloseProtocolError {
+		t.Fatalf("close code = %d %v, want %d", code, err, websocket.CloseProtocolError)
+	}
+}
+
+func TestServer(t *testing.T) {
+	srv := wstest.NewServer(nil, wstest.Echo)
+	defer srv.Close()
+
+	client, err := srv.Dial("/path")
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.WriteMessage(websocket.BinaryMessage, []byte("data")); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	mt, data, err := client.NextMessage()
+	if err != nil || mt != websocket.BinaryMessage || string(data) != "data" {
+		t.Fatalf("got %s %q %v, want binary %q", mt, data, err, "data")
+	}
+
+	// open connections are closed by server, client reads to answer close
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := client.NextMessage()
+		readErr <- err
+	}()
+	srv.Close()
+	if err := <-readErr; err == nil {
+		t.Fatal("read succeeded after server was closed")
+	}
+}